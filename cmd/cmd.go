@@ -7,7 +7,8 @@ import (
 )
 
 //Executor defines the func that contains some prepration handles of start server.
-type Executor func(config.ServiceConfig)
+//reloads receives the re-parsed and validated configs in watch mode, otherwise it is nil.
+type Executor func(cfg config.ServiceConfig, reloads <-chan config.ServiceConfig)
 
 //Execute for other method to call.
 func Execute(configParser config.Parser, executor Executor) {
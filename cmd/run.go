@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"github.com/spf13/cobra"
+	"melody/config"
 	"os"
 )
 
@@ -19,6 +20,15 @@ func runFunc(cmd *cobra.Command, args []string) {
 	}
 	//Judge is debug
 	serviceConfig.Debug = serviceConfig.Debug || debug
+	//Watch the config file and SIGHUP if needed
+	var reloads <-chan config.ServiceConfig
+	if watch {
+		reloads, err = watchConfig(cmd, cfgFilePath)
+		if err != nil {
+			cmd.Printf("ERROR watching the melody config file: %s\n", err.Error())
+			os.Exit(-1)
+		}
+	}
 	//Run with service config
-	run(serviceConfig)
+	run(serviceConfig, reloads)
 }
@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"melody/config"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/cobra"
+)
+
+// 编辑器保存文件时通常会连续触发多个事件
+const reloadDebounce = 200 * time.Millisecond
+
+// watchConfig 监听配置文件的变化以及SIGHUP信号
+// 每次触发都会通过parser重新解析并校验配置文件, 只有校验通过的配置才会被推送
+func watchConfig(cmd *cobra.Command, path string) (<-chan config.ServiceConfig, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	// 监听文件所在的目录, 以便捕获以重命名方式保存的文件
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	reloads := make(chan config.ServiceConfig, 1)
+	target := filepath.Clean(path)
+
+	go func() {
+		defer watcher.Close()
+		var debounce <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != target {
+					continue
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				debounce = time.After(reloadDebounce)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				cmd.Printf("ERROR watching the melody config file: %s\n", err.Error())
+			case <-debounce:
+				debounce = nil
+				reloadConfig(cmd, path, reloads)
+			case <-hup:
+				reloadConfig(cmd, path, reloads)
+			}
+		}
+	}()
+
+	return reloads, nil
+}
+
+func reloadConfig(cmd *cobra.Command, path string, reloads chan config.ServiceConfig) {
+	cmd.Printf("Reloading configuration file: %s\n", path)
+	serviceConfig, err := parser.Parse(path)
+	if err != nil {
+		cmd.Printf("ERROR parsing the melody config file, keeping the current endpoints: %s\n", err.Error())
+		return
+	}
+	serviceConfig.Debug = serviceConfig.Debug || debug
+
+	// 只保留最新的一份配置
+	select {
+	case <-reloads:
+	default:
+	}
+	reloads <- serviceConfig
+}
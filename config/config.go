@@ -20,13 +20,21 @@ const (
 )
 
 var (
-	RoutingPattern          = ColonRouterPatternBuilder
-	debugPattern            = "^[^/]|/__debug(/.*)?$"
-	sequentialParamsPattern = regexp.MustCompile(`^resp[\d]+_.*$`)
-	simpleURLKeysPattern    = regexp.MustCompile(`\{([a-zA-Z\-_0-9\.]+)\}`)
-	errInvalidNoOpEncoding  = errors.New("can not use NoOp encoding with more than one backends connected to the same endpoint")
+	RoutingPattern           = ColonRouterPatternBuilder
+	debugPattern             = "^[^/]|/__debug(/.*)?$"
+	sequentialParamsPattern  = regexp.MustCompile(`^resp[\d]+_.*$`)
+	simpleURLKeysPattern     = regexp.MustCompile(`\{([a-zA-Z\-_0-9\.]+)\}`)
+	errInvalidNoOpEncoding   = errors.New("can not use NoOp encoding with more than one backends connected to the same endpoint")
+	errInvalidStreamEncoding = errors.New("can not use stream encoding with more than one backends connected to the same endpoint")
+	methodPattern            = regexp.MustCompile(`^[A-Z]+$`)
 )
 
+// AnyMethod 表示endpoint接受所有的method
+const AnyMethod = "ANY"
+
+// AnyMethods ANY 对应的method
+var AnyMethods = []string{"GET", "POST", "PUT", "PATCH", "HEAD", "OPTIONS", "DELETE", "CONNECT", "TRACE"}
+
 //ServiceConfig contains all config in melody server.
 type ServiceConfig struct {
 	ExtraConfig    ExtraConfig       `mapstructure:"extra_config"`
@@ -61,6 +69,12 @@ type ServiceConfig struct {
 	// Plugin定义了插件加载器的配置
 	Plugin *Plugin `mapstructure:"plugin"`
 
+	// 拥有相同前缀与默认配置的endpoint分组, Init时展开到Endpoints中
+	Groups []*EndpointGroup `mapstructure:"groups"`
+
+	// 监听地址列表, 配置了listeners时取代port与tls
+	Listeners []*Listener `mapstructure:"listeners"`
+
 	//melody is in debug model
 	Debug     bool
 	uriParser URIParser
@@ -70,7 +84,10 @@ type EndpointConfig struct {
 	// 对外暴露的url
 	Endpoint string `mapstructure:"endpoint"`
 	// HTTP method of the endpoint (GET, POST, PUT, etc)
+	// 多个method使用逗号分隔, ANY 表示接受所有的method
 	Method string `mapstructure:"method"`
+	// 由Method解析出的method列表
+	Methods []string `mapstructure:"-"`
 	// 此端点连接的后端的集合
 	Backends []*Backend `mapstructure:"backends"`
 	// 此端点的并发调用数
@@ -87,6 +104,46 @@ type EndpointConfig struct {
 	HeadersToPass []string `mapstructure:"headers_to_pass"`
 	// 响应输出时的编码
 	OutputEncoding string `mapstructure:"output_encoding"`
+	// 绑定的虚拟主机(请求的Host头), 为空时对所有的host生效, 支持 *.example.com
+	Hosts []string `mapstructure:"hosts"`
+	// 绑定的listener名称, 为空时在所有的listener上生效
+	Listeners []string `mapstructure:"listeners"`
+}
+
+// Listener 一个监听地址, 每个listener运行一个独立的http.Server
+type Listener struct {
+	// endpoint通过名称绑定到listener
+	Name string `mapstructure:"name"`
+	// 监听地址, 例如 :80、127.0.0.1:9000、unix:///var/run/melody.sock
+	Address string `mapstructure:"address"`
+	// 配置了TLS时使用https
+	TLS *TLS `mapstructure:"tls"`
+	// 把所有请求重定向到第一个使用TLS的listener
+	RedirectToHTTPS bool `mapstructure:"redirect_to_https"`
+}
+
+// IsTLS listener是否使用https
+func (l *Listener) IsTLS() bool {
+	return l.TLS != nil && !l.TLS.IsDisabled
+}
+
+// EndpointGroup 一组共享前缀与默认配置的endpoint
+type EndpointGroup struct {
+	// 组内endpoint绑定的虚拟主机, endpoint自己配置了hosts时以endpoint为准
+	Hosts []string `mapstructure:"hosts"`
+	// 组内endpoint绑定的listener, endpoint自己配置了listeners时以endpoint为准
+	Listeners []string `mapstructure:"listeners"`
+	// 组内endpoint的路径前缀
+	Prefix string `mapstructure:"prefix"`
+	// 组内endpoint默认的超时时间
+	Timeout time.Duration `mapstructure:"timeout"`
+	// 组内endpoint默认的缓存时间
+	CacheTTL time.Duration `mapstructure:"cache_ttl"`
+	// 组内backend默认的host列表
+	Host []string `mapstructure:"host"`
+	// 组内endpoint默认的extra config, endpoint中相同的命名空间优先
+	ExtraConfig ExtraConfig       `mapstructure:"extra_config"`
+	Endpoints   []*EndpointConfig `mapstructure:"endpoints"`
 }
 
 type Backend struct {
@@ -119,8 +176,8 @@ type Backend struct {
 	URLKeys []string
 	// number of concurrent calls this endpoint must send to the API
 	ConcurrentCalls int
-	// timeout of this backend
-	Timeout time.Duration
+	// timeout of this backend, 默认与endpoint相同, 不能超过endpoint的timeout
+	Timeout time.Duration `mapstructure:"timeout"`
 	// decoder to use in order to parse the received response from the API
 	Decoder encoding.Decoder `json:"-"`
 	// Backend Extra configuration for customized behaviours
@@ -159,6 +216,60 @@ type NoBackendsError struct {
 	Method string
 }
 
+// InvalidCatchAllError endpoint中的通配段不是最后一段
+type InvalidCatchAllError struct {
+	Path   string
+	Method string
+}
+
+func (i *InvalidCatchAllError) Error() string {
+	return fmt.Sprintf("ERROR: path:%s, method:%s, the catch-all segment must be the last one", i.Path, i.Method)
+}
+
+// InvalidListenerError listener没有配置地址或者名称重复
+type InvalidListenerError struct {
+	Name    string
+	Address string
+}
+
+func (i *InvalidListenerError) Error() string {
+	return fmt.Sprintf("ERROR: invalid listener name:%s, address:%s", i.Name, i.Address)
+}
+
+// UndefinedListenerError endpoint绑定了不存在的listener
+type UndefinedListenerError struct {
+	Path     string
+	Method   string
+	Listener string
+}
+
+func (u *UndefinedListenerError) Error() string {
+	return fmt.Sprintf("ERROR: path:%s, method:%s, undefined listener:%s", u.Path, u.Method, u.Listener)
+}
+
+// InvalidBackendTimeoutError backend的timeout超过了endpoint的timeout
+type InvalidBackendTimeoutError struct {
+	Path     string
+	Method   string
+	Backend  string
+	Timeout  time.Duration
+	Endpoint time.Duration
+}
+
+func (i *InvalidBackendTimeoutError) Error() string {
+	return fmt.Sprintf("ERROR: path:%s, method:%s, the timeout %s of the backend %s exceeds the endpoint timeout %s", i.Path, i.Method, i.Timeout, i.Backend, i.Endpoint)
+}
+
+// UnsupportedMethodError endpoint配置了非法的method
+type UnsupportedMethodError struct {
+	Path   string
+	Method string
+}
+
+func (u *UnsupportedMethodError) Error() string {
+	return fmt.Sprintf("ERROR: path:%s, unsupported method:%s", u.Path, u.Method)
+}
+
 func (n *NoBackendsError) Error() string {
 	return fmt.Sprintf("ERROR: path:%s, method:%s has 0 backends", n.Path, n.Method)
 }
@@ -167,6 +278,26 @@ func (e *EndpointMatchError) Error() string {
 	return fmt.Sprintf("ERROR: parsing endpoint error : url:%s, method:%s, error:%s", e.Path, e.Method, e.Err)
 }
 
+// ParseMethods 解析逗号分隔的method列表, 统一转换为大写并去重, ANY 展开为 AnyMethods
+func ParseMethods(method string) []string {
+	methods := []string{}
+	seen := map[string]bool{}
+	for _, m := range strings.Split(method, ",") {
+		m = strings.ToUpper(strings.TrimSpace(m))
+		expanded := []string{m}
+		if m == AnyMethod {
+			expanded = AnyMethods
+		}
+		for _, m := range expanded {
+			if m != "" && !seen[m] {
+				seen[m] = true
+				methods = append(methods, m)
+			}
+		}
+	}
+	return methods
+}
+
 // 该方法作用等于clean一下整个struct
 func (e *ExtraConfig) sanitize() {
 	for module, extra := range *e {
@@ -195,6 +326,14 @@ func (s *ServiceConfig) Init() error {
 	// 初始化全局参数
 	s.initGlobalParams()
 
+	// 展开endpoint分组
+	s.initGroups()
+
+	// 检查listeners
+	if err := s.initListeners(); err != nil {
+		return err
+	}
+
 	// 初始化Endpoints
 	return s.initEndpoints()
 }
@@ -216,6 +355,68 @@ func (s *ServiceConfig) initGlobalParams() {
 	s.ExtraConfig.sanitize()
 }
 
+// initGroups 把分组中的endpoint加上前缀与默认配置之后追加到Endpoints中
+func (s *ServiceConfig) initGroups() {
+	for _, g := range s.Groups {
+		prefix := strings.TrimSuffix(s.uriParser.CleanPath(g.Prefix), "/")
+		g.ExtraConfig.sanitize()
+		for _, e := range g.Endpoints {
+			e.Endpoint = prefix + s.uriParser.CleanPath(e.Endpoint)
+			if len(e.Hosts) == 0 {
+				e.Hosts = g.Hosts
+			}
+			if len(e.Listeners) == 0 {
+				e.Listeners = g.Listeners
+			}
+			if e.Timeout == 0 {
+				e.Timeout = g.Timeout
+			}
+			if e.CacheTTL == 0 {
+				e.CacheTTL = g.CacheTTL
+			}
+			if len(g.ExtraConfig) > 0 {
+				if e.ExtraConfig == nil {
+					e.ExtraConfig = ExtraConfig{}
+				}
+				for k, v := range g.ExtraConfig {
+					if _, ok := e.ExtraConfig[k]; !ok {
+						e.ExtraConfig[k] = v
+					}
+				}
+			}
+			for _, b := range e.Backends {
+				if len(b.Host) == 0 {
+					b.Host = g.Host
+				}
+			}
+			s.Endpoints = append(s.Endpoints, e)
+		}
+	}
+	// 避免重复执行Init时再次展开
+	s.Groups = nil
+}
+
+// initListeners listener的名称不能重复, 地址不能为空
+func (s *ServiceConfig) initListeners() error {
+	names := map[string]bool{}
+	for _, l := range s.Listeners {
+		if l.Address == "" || (l.Name != "" && names[l.Name]) {
+			return &InvalidListenerError{Name: l.Name, Address: l.Address}
+		}
+		names[l.Name] = true
+	}
+	return nil
+}
+
+// NormalizeHost 去掉host中的端口并转换为小写
+func NormalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if i := strings.LastIndex(host, ":"); i != -1 && !strings.HasSuffix(host, "]") {
+		host = host[:i]
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
 func (s *ServiceConfig) initEndpoints() error {
 	for i, e := range s.Endpoints {
 		e.Endpoint = s.uriParser.CleanPath(e.Endpoint)
@@ -227,6 +428,11 @@ func (s *ServiceConfig) initEndpoints() error {
 		// 从Endpoint url中提取参数列表
 		// 类似 -> /debug/{id}/{name}
 		inputUrlParams := s.getPlaceHoldersFromEndpointUrl(e.Endpoint, s.paramExtractionPattern())
+		// 末尾的通配段, 类似 -> /users/*rest
+		catchAll := catchAllParam(e.Endpoint)
+		if catchAll != "" {
+			inputUrlParams = append(inputUrlParams, catchAll)
+		}
 		inputParamsSet := map[string]interface{}{}
 		for _, v := range inputUrlParams {
 			inputParamsSet[v] = nil
@@ -237,16 +443,43 @@ func (s *ServiceConfig) initEndpoints() error {
 		// 初始化一些全局默认值
 		s.initDefaultEndpoints(i)
 
+		for _, m := range e.Methods {
+			if !methodPattern.MatchString(m) {
+				return &UnsupportedMethodError{Path: e.Endpoint, Method: m}
+			}
+		}
+
 		//判断encode为NOOP时，backends是否大于1
 		if e.OutputEncoding == encoding.NOOP && len(e.Backends) > 1 {
 			return errInvalidNoOpEncoding
 		}
+		if e.OutputEncoding == encoding.STREAM && len(e.Backends) > 1 {
+			return errInvalidStreamEncoding
+		}
 
 		e.ExtraConfig.sanitize()
 
+		for h, host := range e.Hosts {
+			e.Hosts[h] = NormalizeHost(host)
+		}
+
+		for _, name := range e.Listeners {
+			if !s.hasListener(name) {
+				return &UndefinedListenerError{Path: e.Endpoint, Method: e.Method, Listener: name}
+			}
+		}
+
 		for j, b := range e.Backends {
+			if b.Timeout > e.Timeout {
+				return &InvalidBackendTimeoutError{Path: e.Endpoint, Method: e.Method, Backend: b.URLPattern, Timeout: b.Timeout, Endpoint: e.Timeout}
+			}
 			s.initDefaultBackends(i, j)
 
+			// 通配段的值以 / 开头, 避免 /users/{rest} 生成 //
+			if catchAll != "" {
+				b.URLPattern = strings.Replace(b.URLPattern, "/{"+catchAll+"}", "{"+catchAll+"}", -1)
+			}
+
 			// 初始化、解析Backends的url以及对应的参数 （*）
 			s.initBackendsURLMappings(i, j, inputParamsSet)
 
@@ -257,6 +490,15 @@ func (s *ServiceConfig) initEndpoints() error {
 	return nil
 }
 
+func (s *ServiceConfig) hasListener(name string) bool {
+	for _, l := range s.Listeners {
+		if l.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 // 提取参数的模式
 // 1. 严格模式
 // 2. 非严格模式
@@ -285,6 +527,9 @@ func (s *ServiceConfig) initDefaultEndpoints(i int) {
 	if cur.Method == "" {
 		cur.Method = "GET"
 	}
+	if len(cur.Methods) == 0 {
+		cur.Methods = ParseMethods(cur.Method)
+	}
 
 	if s.CacheTTL != 0 && cur.CacheTTL == 0 {
 		cur.CacheTTL = s.CacheTTL
@@ -318,11 +563,14 @@ func (s *ServiceConfig) initDefaultBackends(e, b int) {
 		backend.Host = s.uriParser.CleanHosts(backend.Host)
 	}
 
-	if backend.Method == "" {
+	// 接受多个method的endpoint, 没有配置method的backend使用请求的method
+	if backend.Method == "" && len(endpoint.Methods) == 1 {
 		backend.Method = endpoint.Method
 	}
 
-	backend.Timeout = endpoint.Timeout
+	if backend.Timeout == 0 {
+		backend.Timeout = endpoint.Timeout
+	}
 	backend.ConcurrentCalls = endpoint.ConcurrentCalls
 
 	//根据配置的encoding， 加载对应的Decoder
@@ -396,6 +644,14 @@ func (e *EndpointConfig) validate() error {
 		}
 	}
 
+	// 通配段只能出现一次, 并且必须是endpoint的最后一段
+	if strings.Contains(endpointCatchAllPattern.ReplaceAllString(e.Endpoint, ""), "*") {
+		return &InvalidCatchAllError{
+			Path:   e.Endpoint,
+			Method: e.Method,
+		}
+	}
+
 	if len(e.Backends) == 0 {
 		return &NoBackendsError{
 			Path:   e.Endpoint,
@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -223,3 +224,280 @@ func TestConfig_init_NoBackends(t *testing.T) {
 		}
 	}
 }
+
+func TestParseMethods(t *testing.T) {
+	for method, expected := range map[string][]string{
+		"":               {},
+		"get":            {"GET"},
+		"GET, post,GET,": {"GET", "POST"},
+		"purge":          {"PURGE"},
+		"any":            AnyMethods,
+		"POST,ANY":       {"POST", "GET", "PUT", "PATCH", "HEAD", "OPTIONS", "DELETE", "CONNECT", "TRACE"},
+	} {
+		if res := ParseMethods(method); !reflect.DeepEqual(res, expected) {
+			t.Errorf("%s: unexpected methods %v", method, res)
+		}
+	}
+}
+
+func TestConfig_init_methods(t *testing.T) {
+	listEndpoint := EndpointConfig{
+		Endpoint: "/list",
+		Method:   "get,post",
+		Backends: []*Backend{{}},
+	}
+	singleEndpoint := EndpointConfig{
+		Endpoint: "/single",
+		Method:   "put",
+		Backends: []*Backend{{}},
+	}
+	subject := ServiceConfig{
+		Version:   1,
+		Host:      []string{"http://127.0.0.1:8080"},
+		Endpoints: []*EndpointConfig{&listEndpoint, &singleEndpoint},
+	}
+	if err := subject.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(listEndpoint.Methods, []string{"GET", "POST"}) {
+		t.Errorf("unexpected methods %v", listEndpoint.Methods)
+	}
+	// 多个method时backend沿用请求的method
+	if listEndpoint.Backends[0].Method != "" {
+		t.Errorf("unexpected backend method %s", listEndpoint.Backends[0].Method)
+	}
+	if singleEndpoint.Backends[0].Method != "put" {
+		t.Errorf("unexpected backend method %s", singleEndpoint.Backends[0].Method)
+	}
+
+	subject = ServiceConfig{
+		Version: 1,
+		Host:    []string{"http://127.0.0.1:8080"},
+		Endpoints: []*EndpointConfig{{
+			Endpoint: "/invalid",
+			Method:   "GET,PO ST",
+			Backends: []*Backend{{}},
+		}},
+	}
+	err := subject.Init()
+	if e, ok := err.(*UnsupportedMethodError); !ok || e.Method != "PO ST" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestConfig_init_catchAll(t *testing.T) {
+	restEndpoint := EndpointConfig{
+		Endpoint: "/api/v1/users/*rest",
+		Backends: []*Backend{{URLPattern: "/users/{rest}"}},
+	}
+	pathEndpoint := EndpointConfig{
+		Endpoint: "/api/v1/{tenant}/files/{*path}",
+		Backends: []*Backend{{URLPattern: "/{tenant}/storage{path}?v=1"}},
+	}
+	subject := ServiceConfig{
+		Version:   1,
+		Host:      []string{"http://127.0.0.1:8080"},
+		Endpoints: []*EndpointConfig{&restEndpoint, &pathEndpoint},
+	}
+	if err := subject.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	if restEndpoint.Endpoint != "/api/v1/users/*rest" {
+		t.Errorf("unexpected endpoint %s", restEndpoint.Endpoint)
+	}
+	if b := restEndpoint.Backends[0]; b.URLPattern != "/users{{.Rest}}" || !reflect.DeepEqual(b.URLKeys, []string{"Rest"}) {
+		t.Errorf("unexpected backend %s %v", b.URLPattern, b.URLKeys)
+	}
+	if pathEndpoint.Endpoint != "/api/v1/:tenant/files/*path" {
+		t.Errorf("unexpected endpoint %s", pathEndpoint.Endpoint)
+	}
+	if b := pathEndpoint.Backends[0]; b.URLPattern != "/{{.Tenant}}/storage{{.Path}}?v=1" {
+		t.Errorf("unexpected backend %s", b.URLPattern)
+	}
+
+	for _, endpoint := range []string{"/users/*rest/orders", "/users/*/orders", "/*a/*b"} {
+		subject := ServiceConfig{
+			Version:   1,
+			Host:      []string{"http://127.0.0.1:8080"},
+			Endpoints: []*EndpointConfig{{Endpoint: endpoint, Backends: []*Backend{{}}}},
+		}
+		if err := subject.Init(); err == nil {
+			t.Errorf("%s: expecting an error", endpoint)
+		} else if _, ok := err.(*InvalidCatchAllError); !ok {
+			t.Errorf("%s: unexpected error %v", endpoint, err)
+		}
+	}
+}
+
+func TestURI_GetEndpointPath(t *testing.T) {
+	for _, tc := range []struct {
+		builder  URI
+		path     string
+		params   []string
+		expected string
+	}{
+		{ColonRouterPatternBuilder, "/users/{id}", []string{"id"}, "/users/:id"},
+		{ColonRouterPatternBuilder, "/users/{id}/*rest", []string{"id", "rest"}, "/users/:id/*rest"},
+		{ColonRouterPatternBuilder, "/users/{*rest}", []string{"rest"}, "/users/*rest"},
+		{BracketsRouterPatternBuilder, "/users/{id}/*rest", []string{"id", "rest"}, "/users/{id}/{*rest}"},
+		{BracketsRouterPatternBuilder, "/users/{*rest}", []string{"rest"}, "/users/{*rest}"},
+	} {
+		if res := tc.builder.GetEndpointPath(tc.path, tc.params); res != tc.expected {
+			t.Errorf("%s: unexpected path %s", tc.path, res)
+		}
+	}
+}
+
+func TestConfig_init_groups(t *testing.T) {
+	usersEndpoint := EndpointConfig{
+		Endpoint: "/users/{id}",
+		Backends: []*Backend{{URLPattern: "/users/{id}"}},
+	}
+	ordersEndpoint := EndpointConfig{
+		Endpoint:    "orders",
+		Timeout:     time.Second,
+		Hosts:       []string{"Admin.A.com:8080"},
+		ExtraConfig: ExtraConfig{"melody_proxy": map[string]interface{}{"sequential": false}},
+		Backends:    []*Backend{{URLPattern: "/orders", Host: []string{"http://orders"}}},
+	}
+	subject := ServiceConfig{
+		Version: 1,
+		Timeout: 5 * time.Second,
+		Host:    []string{"http://127.0.0.1:8080"},
+		Groups: []*EndpointGroup{
+			{
+				Hosts:   []string{"api.a.com"},
+				Prefix:  "/api/v1/",
+				Timeout: 3 * time.Second,
+				Host:    []string{"http://users"},
+				ExtraConfig: ExtraConfig{
+					"melody_proxy":  map[string]interface{}{"sequential": true},
+					"melody_router": map[string]interface{}{"return_status_code": true},
+				},
+				Endpoints: []*EndpointConfig{&usersEndpoint, &ordersEndpoint},
+			},
+		},
+	}
+	if err := subject.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if len(subject.Endpoints) != 2 || subject.Groups != nil {
+		t.Fatalf("unexpected endpoints %v", subject.Endpoints)
+	}
+
+	if usersEndpoint.Endpoint != "/api/v1/users/:id" || usersEndpoint.Timeout != 3*time.Second {
+		t.Errorf("unexpected endpoint %s %s", usersEndpoint.Endpoint, usersEndpoint.Timeout)
+	}
+	if !reflect.DeepEqual(usersEndpoint.Hosts, []string{"api.a.com"}) {
+		t.Errorf("unexpected hosts %v", usersEndpoint.Hosts)
+	}
+	if !reflect.DeepEqual(usersEndpoint.Backends[0].Host, []string{"http://users"}) {
+		t.Errorf("unexpected backend hosts %v", usersEndpoint.Backends[0].Host)
+	}
+	if len(usersEndpoint.ExtraConfig) != 2 {
+		t.Errorf("unexpected extra config %v", usersEndpoint.ExtraConfig)
+	}
+
+	if ordersEndpoint.Endpoint != "/api/v1/orders" || ordersEndpoint.Timeout != time.Second {
+		t.Errorf("unexpected endpoint %s %s", ordersEndpoint.Endpoint, ordersEndpoint.Timeout)
+	}
+	if !reflect.DeepEqual(ordersEndpoint.Hosts, []string{"admin.a.com"}) {
+		t.Errorf("unexpected hosts %v", ordersEndpoint.Hosts)
+	}
+	if !reflect.DeepEqual(ordersEndpoint.Backends[0].Host, []string{"http://orders"}) {
+		t.Errorf("unexpected backend hosts %v", ordersEndpoint.Backends[0].Host)
+	}
+	if v := ordersEndpoint.ExtraConfig["melody_proxy"].(map[string]interface{})["sequential"]; v != false {
+		t.Errorf("unexpected extra config %v", ordersEndpoint.ExtraConfig)
+	}
+}
+
+func TestConfig_init_listeners(t *testing.T) {
+	for _, tc := range []struct {
+		listeners []*Listener
+		endpoint  []string
+		err       error
+	}{
+		{
+			listeners: []*Listener{{Name: "public", Address: ":80"}, {Name: "admin", Address: ":9090"}},
+			endpoint:  []string{"admin"},
+		},
+		{
+			listeners: []*Listener{{Name: "public", Address: ":80"}},
+			endpoint:  []string{"admin"},
+			err:       &UndefinedListenerError{Path: "/supu", Method: "GET", Listener: "admin"},
+		},
+		{
+			listeners: []*Listener{{Name: "public", Address: ":80"}, {Name: "public", Address: ":81"}},
+			err:       &InvalidListenerError{Name: "public", Address: ":81"},
+		},
+		{
+			listeners: []*Listener{{Name: "public"}},
+			err:       &InvalidListenerError{Name: "public"},
+		},
+	} {
+		subject := ServiceConfig{
+			Version:   1,
+			Host:      []string{"http://127.0.0.1:8080"},
+			Listeners: tc.listeners,
+			Endpoints: []*EndpointConfig{{Endpoint: "/supu", Listeners: tc.endpoint, Backends: []*Backend{{}}}},
+		}
+		if err := subject.Init(); !reflect.DeepEqual(err, tc.err) {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+}
+
+func TestConfig_init_backendTimeout(t *testing.T) {
+	subject := ServiceConfig{
+		Version: 1,
+		Timeout: time.Second,
+		Host:    []string{"http://127.0.0.1:8080"},
+		Endpoints: []*EndpointConfig{
+			{
+				Endpoint: "/timeout",
+				Method:   "GET",
+				Backends: []*Backend{
+					{URLPattern: "/a", Timeout: 200 * time.Millisecond},
+					{URLPattern: "/b"},
+				},
+			},
+		},
+	}
+	if err := subject.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []time.Duration{200 * time.Millisecond, time.Second} {
+		if timeout := subject.Endpoints[0].Backends[i].Timeout; timeout != expected {
+			t.Errorf("unexpected timeout of the backend %d: %v", i, timeout)
+		}
+	}
+
+	subject.Endpoints = []*EndpointConfig{
+		{
+			Endpoint: "/timeout",
+			Method:   "GET",
+			Backends: []*Backend{{URLPattern: "/a", Timeout: 2 * time.Second}},
+		},
+	}
+	err := subject.Init()
+	if e, ok := err.(*InvalidBackendTimeoutError); !ok || e.Backend != "/a" || e.Timeout != 2*time.Second {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestGeneration(t *testing.T) {
+	backend := &Backend{}
+	g := NewGeneration(ServiceConfig{Endpoints: []*EndpointConfig{{Backends: []*Backend{backend}}}})
+	closed := 0
+	RegisterCloser(backend, func() { closed++ })
+	// 不属于任何generation的backend
+	RegisterCloser(&Backend{}, func() { t.Error("unexpected call") })
+
+	g.Close()
+	g.Close()
+	if closed != 1 {
+		t.Errorf("unexpected number of calls: %d", closed)
+	}
+}
@@ -0,0 +1,76 @@
+package config
+
+import "sync"
+
+var (
+	generationsMu sync.Mutex
+	// 每个backend所属的generation
+	generations = map[*Backend]*Generation{}
+)
+
+// Generation 由同一份配置构建出的proxy持有的资源(连接、探测等)
+// 热加载替换路由表, 并且旧的请求都处理完之后调用 Close 释放
+type Generation struct {
+	backends []*Backend
+	mu       sync.Mutex
+	closers  []func()
+	closed   bool
+}
+
+// NewGeneration 记录cfg中所有的backend, 之后为这些backend登记的资源都属于该generation
+func NewGeneration(cfg ServiceConfig) *Generation {
+	g := &Generation{}
+	generationsMu.Lock()
+	defer generationsMu.Unlock()
+	for _, e := range cfg.Endpoints {
+		for _, b := range e.Backends {
+			generations[b] = g
+			g.backends = append(g.backends, b)
+		}
+	}
+	return g
+}
+
+// RegisterCloser 登记backend持有的资源, 在backend所属的generation关闭时调用closer
+// backend不属于任何generation时不会调用closer, 资源与进程的生命周期相同
+func RegisterCloser(backend *Backend, closer func()) {
+	generationsMu.Lock()
+	g, ok := generations[backend]
+	generationsMu.Unlock()
+	if !ok {
+		return
+	}
+	g.mu.Lock()
+	if !g.closed {
+		g.closers = append(g.closers, closer)
+		g.mu.Unlock()
+		return
+	}
+	g.mu.Unlock()
+	closer()
+}
+
+// Close 释放登记的所有资源, 多次调用只会释放一次
+func (g *Generation) Close() {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return
+	}
+	g.closed = true
+	closers := g.closers
+	g.closers = nil
+	g.mu.Unlock()
+
+	generationsMu.Lock()
+	for _, b := range g.backends {
+		if generations[b] == g {
+			delete(generations, b)
+		}
+	}
+	generationsMu.Unlock()
+
+	for _, c := range closers {
+		c()
+	}
+}
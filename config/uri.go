@@ -12,8 +12,10 @@ const (
 
 var (
 	endpointURLKeysPattern = regexp.MustCompile(`/\{([a-zA-Z\-_0-9]+)\}`)
-	hostPattern            = regexp.MustCompile(`(https?://)?([a-zA-Z0-9\._\-]+)(:[0-9]{2,6})?/?`)
-	errInvalidHost         = errors.New("invalid host")
+	// 匹配endpoint末尾的通配段, 例如 /users/*rest 或者 /users/{*rest}
+	endpointCatchAllPattern = regexp.MustCompile(`/(?:\*([a-zA-Z\-_0-9]+)|\{\*([a-zA-Z\-_0-9]+)\})$`)
+	hostPattern             = regexp.MustCompile(`(https?://)?([a-zA-Z0-9\._\-]+)(:[0-9]{2,6})?/?`)
+	errInvalidHost          = errors.New("invalid host")
 )
 
 //URIParser defines all method that uri needed
@@ -59,8 +61,18 @@ func (U URI) CleanPath(path string) string {
 	return "/" + strings.TrimPrefix(path, "/")
 }
 
+// GetEndpointPath 把endpoint转换为router使用的格式
+// 末尾的通配段统一转换为 /*rest (colon) 或者 /{*rest} (brackets)
 func (U URI) GetEndpointPath(path string, params []string) string {
 	endPoint := path
+	if name := catchAllParam(endPoint); name != "" {
+		endPoint = endpointCatchAllPattern.ReplaceAllString(endPoint, "")
+		if U == ColonRouterPatternBuilder {
+			endPoint += "/*" + name
+		} else {
+			endPoint += "/{*" + name + "}"
+		}
+	}
 	if U == ColonRouterPatternBuilder {
 		for p := range params {
 			parts := strings.Split(endPoint, "?")
@@ -71,3 +83,12 @@ func (U URI) GetEndpointPath(path string, params []string) string {
 
 	return endPoint
 }
+
+// catchAllParam 返回endpoint末尾通配段的参数名, 没有通配段时返回空字符串
+func catchAllParam(path string) string {
+	matches := endpointCatchAllPattern.FindStringSubmatch(path)
+	if len(matches) == 0 {
+		return ""
+	}
+	return matches[1] + matches[2]
+}
@@ -5,6 +5,8 @@ import (
 	"melody/config"
 	"melody/logging"
 	circuitbreaker "melody/middleware/melody-circuitbreaker/proxy"
+	graphql "melody/middleware/melody-graphql"
+	grpc "melody/middleware/melody-grpc"
 	martian "melody/middleware/melody-martian"
 	metrics "melody/middleware/melody-metrics/gin"
 	juju "melody/middleware/melody-ratelimit/juju/proxy"
@@ -20,6 +22,10 @@ func NewBackendFactoryWithContext(ctx context.Context, logger logging.Logger, me
 		return proxy.NewHTTPProxyWithHTTPRequestExecutor(backend, httpRequestExecutor, backend.Decoder)
 	}
 	backendFactory = martian.NewBackendFactory(logger, httpRequestExecutor)
+	// 配置了melody_grpc的backend使用gRPC调用
+	backendFactory = grpc.NewBackendFactory(logger, httpRequestExecutor, backendFactory)
+	// 配置了melody_graphql的backend转换为GraphQL请求
+	backendFactory = graphql.NewBackendFactory(logger, httpRequestExecutor, backendFactory)
 	backendFactory = juju.BackendFactory(backendFactory)
 	// 使用断路器
 	backendFactory = circuitbreaker.BackendFactory(backendFactory, logger)
@@ -17,13 +17,14 @@ import (
 	router "melody/router/gin"
 	server "melody/transport/http/server/plugin"
 	"os"
+	"reflect"
 
 	"github.com/gin-gonic/gin"
 )
 
 //NewExecutor return an new executor
 func NewExecutor(ctx context.Context) cmd.Executor {
-	return func(cfg config.ServiceConfig) {
+	return func(cfg config.ServiceConfig, reloads <-chan config.ServiceConfig) {
 		// 确定以及初始化 log有哪些输出
 		var writers []io.Writer
 		// 检察是否使用Gelf
@@ -92,7 +93,10 @@ func NewExecutor(ctx context.Context) cmd.Executor {
 
 		// Set up melody Router
 		routerFactory := router.NewFactory(router.Config{
-			Engine:         NewEngine(cfg, logger, gelfWriter),
+			Engine: NewEngine(cfg, logger, gelfWriter),
+			EngineFactory: func(cfg config.ServiceConfig) *gin.Engine {
+				return NewEngine(cfg, logger, gelfWriter)
+			},
 			ProxyFactory:   NewProxyFactory(logger, NewBackendFactoryWithContext(ctx, logger, metricsController), metricsController),
 			HandlerFactory: NewHandlerFactory(logger, tokenRejecterFactory, metricsController),
 			MiddleWares:    []gin.HandlerFunc{},
@@ -102,8 +106,36 @@ func NewExecutor(ctx context.Context) cmd.Executor {
 
 		logger.Info("melody server listening on port:", cfg.Port, "🎁")
 
-		routerFactory.NewWithContext(ctx).Run(cfg)
+		melodyRouter := routerFactory.NewWithContext(ctx)
+		// Reload 会等待 Run 安装第一份路由表之后才替换
+		if reloader, ok := melodyRouter.(melodyrouter.Reloader); ok && reloads != nil {
+			go handleReloads(ctx, cfg, reloader, reloads, logger)
+		}
+		melodyRouter.Run(cfg)
+
+	}
+}
 
+// handleReloads 将热加载得到的配置交给router重建路由表
+// 端口、TLS、listener等server级别的配置需要重启才能生效
+func handleReloads(ctx context.Context, current config.ServiceConfig, r melodyrouter.Reloader, reloads <-chan config.ServiceConfig, logger logging.Logger) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case cfg := <-reloads:
+			if cfg.Port != current.Port || !reflect.DeepEqual(cfg.TLS, current.TLS) {
+				logger.Warning("reload: port and tls changes require a restart, still listening on port:", current.Port)
+			}
+			if !reflect.DeepEqual(cfg.Listeners, current.Listeners) {
+				logger.Warning("reload: listener changes require a restart, keeping the current listeners")
+			}
+			if err := r.Reload(cfg); err != nil {
+				logger.Error("reload: keeping the current endpoints:", err.Error())
+				continue
+			}
+			logger.Info("reload: endpoints updated, total:", len(cfg.Endpoints))
+		}
 	}
 }
 
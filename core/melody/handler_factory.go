@@ -7,6 +7,7 @@ import (
 	ginjose "melody/middleware/melody-jose/gin"
 	metrics "melody/middleware/melody-metrics/gin"
 	juju "melody/middleware/melody-ratelimit/juju/router/gin"
+	websocket "melody/middleware/melody-websocket/gin"
 	router "melody/router/gin"
 )
 
@@ -15,6 +16,7 @@ import (
 // 这里的Handler旨在处理Endpoint层的逻辑
 func NewHandlerFactory(logger logging.Logger, rejecter jose.RejecterFactory, metrics *metrics.Metrics) router.HandlerFactory {
 	handlerFactory := router.EndpointHandler
+	handlerFactory = websocket.New(handlerFactory, logger)
 	handlerFactory = juju.NewRateLimiterMw(handlerFactory)
 	handlerFactory = ginjose.HandlerFactory(handlerFactory, logger, rejecter)
 	handlerFactory = botmonitor.New(handlerFactory, logger)
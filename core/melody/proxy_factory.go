@@ -2,14 +2,18 @@ package melody
 
 import (
 	"melody/logging"
+	circuitbreaker "melody/middleware/melody-circuitbreaker/proxy"
 	jsonschema "melody/middleware/melody-jsonschema"
 	metrics "melody/middleware/melody-metrics/gin"
 	"melody/proxy"
+	"melody/sd"
 )
 
 func NewProxyFactory(logger logging.Logger, backend proxy.BackendFactory, metrics *metrics.Metrics) proxy.Factory {
 	// 完成了默认的ProxyFactory
-	proxyFactory := proxy.NewDefaultFactory(backend, logger)
+	// 开启per_host的断路器在负载均衡时跳过故障的host
+	subscriberFactory := circuitbreaker.SubscriberFactory(sd.GetSubscriber, logger)
+	proxyFactory := proxy.NewDefaultFactoryWithSubscriberFactory(backend, logger, subscriberFactory)
 	proxyFactory = proxy.NewShadowFactory(proxyFactory)
 	proxyFactory = jsonschema.ProxyFactory(proxyFactory)
 	proxyFactory = metrics.NewProxyFactory("endpoint", proxyFactory)
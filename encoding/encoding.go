@@ -4,6 +4,9 @@ import "io"
 
 const NOOP = "no-op"
 
+// STREAM 不解码响应体, 以流的方式直接转发给客户端
+const STREAM = "stream"
+
 // NoOpDecoder implements the Decoder interface
 func NoOpDecoder(_ io.Reader, _ *map[string]interface{}) error { return nil }
 
@@ -11,6 +11,7 @@ var (
 		JSON:   NewJSONDecoder,
 		STRING: NewStringDecoder,
 		NOOP:   NoOpDecoderFactory,
+		STREAM: NoOpDecoderFactory,
 	}
 )
 
@@ -5,6 +5,7 @@ import (
 	"github.com/sony/gobreaker"
 	"melody/config"
 	"melody/logging"
+	"sync"
 	"time"
 )
 
@@ -19,6 +20,16 @@ type Config struct {
 	MaxErrors int
 	//断路器状态发生改变时，是否log
 	LogStatusChange bool
+	//为每个host单独维护断路器，负载均衡时跳过断路器打开的host
+	PerHost bool
+	//时间窗口内错误率达到该值时打开断路器(0, 1]
+	ErrorRatio float64
+	//耗时超过该值的请求视为慢调用
+	SlowCallDuration time.Duration
+	//时间窗口内慢调用比例达到该值时打开断路器(0, 1]
+	SlowCallRatio float64
+	//计算错误率、慢调用比例所需的最少请求数
+	MinRequests int
 }
 
 // 空实现
@@ -62,6 +73,23 @@ func ConfigGetter(e config.ExtraConfig) interface{} {
 	value, ok := temp["logStatusChange"].(bool)
 	cfg.LogStatusChange = ok && value
 
+	perHost, ok := temp["per_host"].(bool)
+	cfg.PerHost = ok && perHost
+	if v, ok := temp["error_ratio"].(float64); ok {
+		cfg.ErrorRatio = v
+	}
+	if v, ok := temp["slow_call_ratio"].(float64); ok {
+		cfg.SlowCallRatio = v
+	}
+	if v, ok := temp["slow_call_duration"].(string); ok {
+		if d, err := time.ParseDuration(v); err == nil {
+			cfg.SlowCallDuration = d
+		}
+	}
+	if v, ok := temp["min_requests"].(float64); ok {
+		cfg.MinRequests = int(v)
+	}
+
 	return cfg
 }
 
@@ -84,3 +112,97 @@ func NewCircuitBreaker(config Config, logger logging.Logger) *gobreaker.CircuitB
 
 	return gobreaker.NewCircuitBreaker(settings)
 }
+
+// Breaker 基于sony的TwoStepCircuitBreaker，在连续故障数之外，额外按照时间窗口统计错误率与慢调用比例
+type Breaker struct {
+	cb     *gobreaker.TwoStepCircuitBreaker
+	config Config
+	mu     sync.Mutex
+	window callWindow
+}
+
+type callWindow struct {
+	start    time.Time
+	requests uint32
+	failures uint32
+	slow     uint32
+}
+
+// NewBreaker 返回一个命名的断路器
+func NewBreaker(name string, config Config, logger logging.Logger) *Breaker {
+	b := &Breaker{config: config, window: callWindow{start: time.Now()}}
+	settings := gobreaker.Settings{
+		Name:        name,
+		Interval:    time.Duration(config.Interval) * time.Second,
+		Timeout:     time.Duration(config.Timeout) * time.Second,
+		ReadyToTrip: b.readyToTrip,
+		OnStateChange: func(name string, from gobreaker.State, to gobreaker.State) {
+			b.resetWindow()
+			if config.LogStatusChange {
+				logger.Warning(fmt.Sprintf("circuit breaker named '%s' went from '%s' to '%s'", name, from.String(), to.String()))
+			}
+		},
+	}
+	b.cb = gobreaker.NewTwoStepCircuitBreaker(settings)
+	return b
+}
+
+// State 返回断路器当前的状态
+func (b *Breaker) State() gobreaker.State {
+	return b.cb.State()
+}
+
+// Allow 检查请求能否通过，通过时返回请求结束后需要调用的回调
+// 配置了慢调用比例时，慢调用同样会计入连续故障数
+func (b *Breaker) Allow() (func(success bool, latency time.Duration), error) {
+	done, err := b.cb.Allow()
+	if err != nil {
+		return nil, err
+	}
+	return func(success bool, latency time.Duration) {
+		slow := b.config.SlowCallDuration > 0 && latency >= b.config.SlowCallDuration
+		b.record(success, slow)
+		done(success && !(slow && b.config.SlowCallRatio > 0))
+	}, nil
+}
+
+func (b *Breaker) readyToTrip(counts gobreaker.Counts) bool {
+	if b.config.ErrorRatio <= 0 && b.config.SlowCallRatio <= 0 {
+		return counts.ConsecutiveFailures > uint32(b.config.MaxErrors)
+	}
+	if b.config.MaxErrors > 0 && counts.ConsecutiveFailures > uint32(b.config.MaxErrors) {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	w := b.window
+	if w.requests == 0 || w.requests < uint32(b.config.MinRequests) {
+		return false
+	}
+	if b.config.ErrorRatio > 0 && float64(w.failures)/float64(w.requests) >= b.config.ErrorRatio {
+		return true
+	}
+	return b.config.SlowCallRatio > 0 && float64(w.slow)/float64(w.requests) >= b.config.SlowCallRatio
+}
+
+func (b *Breaker) record(success, slow bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.config.Interval > 0 && time.Since(b.window.start) >= time.Duration(b.config.Interval)*time.Second {
+		b.window = callWindow{start: time.Now()}
+	}
+	b.window.requests++
+	if !success {
+		b.window.failures++
+	}
+	if slow {
+		b.window.slow++
+	}
+}
+
+func (b *Breaker) resetWindow() {
+	b.mu.Lock()
+	b.window = callWindow{start: time.Now()}
+	b.mu.Unlock()
+}
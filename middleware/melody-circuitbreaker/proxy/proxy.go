@@ -6,6 +6,7 @@ import (
 	"melody/logging"
 	gobreaker "melody/middleware/melody-circuitbreaker"
 	"melody/proxy"
+	"time"
 )
 
 func BackendFactory(next proxy.BackendFactory, logger logging.Logger) proxy.BackendFactory {
@@ -16,25 +17,30 @@ func BackendFactory(next proxy.BackendFactory, logger logging.Logger) proxy.Back
 
 func NewMiddleware(remote *config.Backend, logger logging.Logger) proxy.Middleware {
 	config := gobreaker.ConfigGetter(remote.ExtraConfig).(gobreaker.Config)
-	if config == gobreaker.DefaultCfg {
+	// per_host 模式下由 SubscriberFactory 在负载均衡时处理
+	if config == gobreaker.DefaultCfg || config.PerHost {
 		return proxy.EmptyMiddleware
 	}
 
-	breaker := gobreaker.NewCircuitBreaker(config, logger)
+	breaker := gobreaker.NewBreaker("Melody CircuitBreaker", config, logger)
 
 	return func(next ...proxy.Proxy) proxy.Proxy {
 		if len(next) > 1 {
 			panic(proxy.ErrTooManyProxies)
 		}
 
-		return func(ctx context.Context, request *proxy.Request) (response *proxy.Response, err error) {
-			res, err := breaker.Execute(func() (i interface{}, err error) {
-				return next[0](ctx, request)
-			})
+		return func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+			done, err := breaker.Allow()
 			if err != nil {
 				return nil, err
 			}
-			return res.(*proxy.Response), err
+			begin := time.Now()
+			res, err := next[0](ctx, request)
+			done(err == nil, time.Since(begin))
+			if err != nil {
+				return nil, err
+			}
+			return res, err
 		}
 	}
 }
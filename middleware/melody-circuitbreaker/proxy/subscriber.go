@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"melody/config"
+	"melody/logging"
+	gobreaker "melody/middleware/melody-circuitbreaker"
+	"melody/sd"
+	"sync"
+	"time"
+
+	sonybreaker "github.com/sony/gobreaker"
+)
+
+// SubscriberFactory 开启per_host时，为每个host单独维护一个断路器
+// 负载均衡时跳过断路器打开的host，选中host之后获取断路器的ticket，请求结果由 proxy.NewHTTPProxyDetailed 上报
+func SubscriberFactory(next sd.SubscriberFactory, logger logging.Logger) sd.SubscriberFactory {
+	return func(backend *config.Backend) sd.Subscriber {
+		subscriber := next(backend)
+		config := gobreaker.ConfigGetter(backend.ExtraConfig).(gobreaker.Config)
+		if config == gobreaker.DefaultCfg || !config.PerHost {
+			return subscriber
+		}
+		return NewHostBreakerSubscriber(backend.URLPattern, subscriber, config, logger)
+	}
+}
+
+// NewHostBreakerSubscriber 返回一个只提供断路器未打开的host的subscriber
+// 所有host的断路器都打开时，返回 gobreaker.ErrOpenState
+func NewHostBreakerSubscriber(name string, subscriber sd.Subscriber, config gobreaker.Config, logger logging.Logger) sd.Subscriber {
+	s := &hostBreakerSubscriber{
+		next:     subscriber,
+		name:     name,
+		config:   config,
+		logger:   logger,
+		breakers: map[string]*gobreaker.Breaker{},
+	}
+	if ws, ok := subscriber.(sd.WeightedSubscriber); ok {
+		return weightedHostBreakerSubscriber{s, ws}
+	}
+	return s
+}
+
+type hostBreakerSubscriber struct {
+	next     sd.Subscriber
+	name     string
+	config   gobreaker.Config
+	logger   logging.Logger
+	mu       sync.RWMutex
+	breakers map[string]*gobreaker.Breaker
+}
+
+// Hosts implements the sd.Subscriber interface
+func (h *hostBreakerSubscriber) Hosts() ([]string, error) {
+	hosts, err := h.next.Hosts()
+	if err != nil || len(hosts) == 0 {
+		return hosts, err
+	}
+	available := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		if h.breaker(host).State() != sonybreaker.StateOpen {
+			available = append(available, host)
+		}
+	}
+	if len(available) == 0 {
+		return available, sonybreaker.ErrOpenState
+	}
+	return available, nil
+}
+
+// Report implements the sd.HealthReporter interface
+// 断路器的结果通过 Admit 返回的ticket上报, 这里只传递给内层的subscriber
+func (h *hostBreakerSubscriber) Report(target string, healthy bool, latency time.Duration) {
+	if r, ok := h.next.(sd.HealthReporter); ok {
+		r.Report(target, healthy, latency)
+	}
+}
+
+// Admit implements the sd.HostAdmitter interface
+// 在选中host之后获取断路器的ticket, 半开状态下超出允许的请求数或者断路器已经打开时返回错误
+func (h *hostBreakerSubscriber) Admit(target string) (func(healthy bool, latency time.Duration), error) {
+	h.mu.RLock()
+	var breaker *gobreaker.Breaker
+	for host, b := range h.breakers {
+		if sd.MatchHost(target, host) {
+			breaker = b
+			break
+		}
+	}
+	h.mu.RUnlock()
+	if breaker == nil {
+		return sd.Admit(h.next, target)
+	}
+	return breaker.Allow()
+}
+
+func (h *hostBreakerSubscriber) breaker(host string) *gobreaker.Breaker {
+	h.mu.RLock()
+	b, ok := h.breakers[host]
+	h.mu.RUnlock()
+	if ok {
+		return b
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if b, ok := h.breakers[host]; ok {
+		return b
+	}
+	b = gobreaker.NewBreaker(h.name+" "+host, h.config, h.logger)
+	h.breakers[host] = b
+	return b
+}
+
+type weightedHostBreakerSubscriber struct {
+	*hostBreakerSubscriber
+	weighted sd.WeightedSubscriber
+}
+
+// Weight implements the sd.WeightedSubscriber interface
+func (w weightedHostBreakerSubscriber) Weight(host string) int {
+	return w.weighted.Weight(host)
+}
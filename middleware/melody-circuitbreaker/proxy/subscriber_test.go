@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"melody/config"
+	gcb "melody/middleware/melody-circuitbreaker"
+	"melody/sd"
+	"testing"
+	"time"
+
+	gologging "github.com/op/go-logging"
+	"github.com/sony/gobreaker"
+)
+
+func TestSubscriberFactory_disabled(t *testing.T) {
+	sf := SubscriberFactory(sd.FixedSubscriberFactory, gologging.MustGetLogger("proxy_test"))
+	for _, extra := range []config.ExtraConfig{
+		{},
+		{gcb.Namespace: map[string]interface{}{"maxErrors": 1.0}},
+	} {
+		if _, ok := sf(&config.Backend{Host: []string{"a"}, ExtraConfig: extra}).(sd.FixedSubscriber); !ok {
+			t.Error("the subscriber should not be decorated")
+		}
+	}
+}
+
+func TestSubscriberFactory_perHost(t *testing.T) {
+	sf := SubscriberFactory(sd.FixedSubscriberFactory, gologging.MustGetLogger("proxy_test"))
+	s := sf(&config.Backend{
+		Host: []string{"http://a", "http://b"},
+		ExtraConfig: config.ExtraConfig{
+			gcb.Namespace: map[string]interface{}{
+				"interval":  100.0,
+				"timeout":   100.0,
+				"maxErrors": 1.0,
+				"per_host":  true,
+			},
+		},
+	})
+	admitter, ok := s.(sd.HostAdmitter)
+	if !ok {
+		t.Error("the subscriber should admit the requests")
+		return
+	}
+	report := func(target string, healthy bool) {
+		done, err := admitter.Admit(target)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", target, err)
+			return
+		}
+		done(healthy, 0)
+	}
+
+	hosts, err := s.Hosts()
+	if err != nil || len(hosts) != 2 {
+		t.Errorf("unexpected hosts: %v, %v", hosts, err)
+		return
+	}
+
+	report("http://a/foo", false)
+	report("http://b/foo", true)
+	report("http://a/foo", false)
+
+	hosts, err = s.Hosts()
+	if err != nil || len(hosts) != 1 || hosts[0] != "http://b" {
+		t.Errorf("the failing host should be skipped: %v, %v", hosts, err)
+	}
+	// 选中host之后才打开的断路器拒绝请求
+	if _, err := admitter.Admit("http://a/foo"); err != gobreaker.ErrOpenState {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	report("http://b/foo", false)
+	report("http://b/foo", false)
+	if _, err = s.Hosts(); err != gobreaker.ErrOpenState {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestBreaker_errorRatio(t *testing.T) {
+	b := gcb.NewBreaker("test", gcb.Config{
+		Interval:    100,
+		Timeout:     100,
+		ErrorRatio:  0.5,
+		MinRequests: 4,
+	}, gologging.MustGetLogger("proxy_test"))
+
+	for _, success := range []bool{false, true, false, true, false} {
+		done, err := b.Allow()
+		if err != nil {
+			t.Error("unexpected error:", err.Error())
+			return
+		}
+		done(success, 0)
+	}
+	if b.State() != gobreaker.StateOpen {
+		t.Errorf("unexpected state: %s", b.State())
+	}
+}
+
+func TestBreaker_slowCallRatio(t *testing.T) {
+	b := gcb.NewBreaker("test", gcb.Config{
+		Interval:         100,
+		Timeout:          100,
+		SlowCallDuration: 10 * time.Millisecond,
+		SlowCallRatio:    0.5,
+		MinRequests:      2,
+	}, gologging.MustGetLogger("proxy_test"))
+
+	done, _ := b.Allow()
+	done(true, time.Millisecond)
+	done, _ = b.Allow()
+	done(true, time.Millisecond)
+	done, _ = b.Allow()
+	done(true, 20*time.Millisecond)
+	if b.State() != gobreaker.StateClosed {
+		t.Errorf("unexpected state: %s", b.State())
+	}
+	done, _ = b.Allow()
+	done(true, 20*time.Millisecond)
+	if b.State() != gobreaker.StateOpen {
+		t.Errorf("unexpected state: %s", b.State())
+	}
+}
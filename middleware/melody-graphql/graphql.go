@@ -0,0 +1,280 @@
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"melody/config"
+	"melody/logging"
+	"melody/proxy"
+	"melody/transport/http/client"
+)
+
+// Namespace 命名空间
+const Namespace = "melody_graphql"
+
+var (
+	// ErrNoConfig 当没有为模块定义配置时，将返回ErrNoConfig
+	ErrNoConfig = errors.New("no config defined for the module")
+	// ErrEmptyQuery 没有配置query或query_path
+	ErrEmptyQuery = errors.New("the graphql query is empty")
+)
+
+// 匹配query中的变量定义, 例如 ($id: Int!, $tags: [String])
+var variableDefinition = regexp.MustCompile(`\$(\w+)\s*:\s*\[?\s*(\w+)`)
+
+// Config GraphQL backend的配置
+type Config struct {
+	// query或者mutation
+	Query string `json:"query"`
+	// 从文件中读取query, 配置了query时忽略
+	QueryPath     string `json:"query_path"`
+	OperationName string `json:"operation_name"`
+	// 变量的默认值, "{name}" 表示使用请求中name的值
+	Variables map[string]interface{} `json:"variables"`
+}
+
+// ParseConfig 从ExtraConfig中提取GraphQL backend的配置
+func ParseConfig(cfg config.ExtraConfig) (Config, error) {
+	res := Config{}
+	e, ok := cfg[Namespace]
+	if !ok {
+		return res, ErrNoConfig
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return res, err
+	}
+	if err := json.Unmarshal(b, &res); err != nil {
+		return res, err
+	}
+	if res.Query == "" && res.QueryPath != "" {
+		q, err := ioutil.ReadFile(res.QueryPath)
+		if err != nil {
+			return res, err
+		}
+		res.Query = string(q)
+	}
+	if strings.TrimSpace(res.Query) == "" {
+		return res, ErrEmptyQuery
+	}
+	return res, nil
+}
+
+// NewBackendFactory 为配置了melody_graphql的backend创建proxy, 其他backend交给next处理
+func NewBackendFactory(logger logging.Logger, re client.HTTPRequestExecutor, next proxy.BackendFactory) proxy.BackendFactory {
+	return func(remote *config.Backend) proxy.Proxy {
+		cfg, err := ParseConfig(remote.ExtraConfig)
+		if err == ErrNoConfig {
+			return next(remote)
+		}
+		if err != nil {
+			logger.Error("graphql:", err.Error())
+			return next(remote)
+		}
+		return NewProxy(remote, cfg, re)
+	}
+}
+
+// NewProxy 把请求转换为GraphQL请求, 通过HTTPRequestExecutor POST到backend
+// 响应中的data作为Response.Data, 之后的过滤、分组、合并与json的backend一致
+// 只有部分字段失败时返回不完整的响应, 没有data时返回 Error
+func NewProxy(remote *config.Backend, cfg Config, re client.HTTPRequestExecutor) proxy.Proxy {
+	declared := map[string]string{}
+	for _, m := range variableDefinition.FindAllStringSubmatch(cfg.Query, -1) {
+		declared[m[1]] = m[2]
+	}
+	next := proxy.NewHTTPProxyDetailed(remote, re, client.NoOpHTTPStatusHandler, newResponseParser(proxy.NewEntityFormatter(remote)))
+
+	return func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+		data, err := proxy.RequestData(request)
+		if err != nil {
+			return nil, err
+		}
+		body, err := json.Marshal(graphqlRequest{
+			Query:         cfg.Query,
+			OperationName: cfg.OperationName,
+			Variables:     variables(cfg.Variables, declared, data),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		r := request.Clone()
+		r.Method = http.MethodPost
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.Headers = proxy.CloneRequestHeaders(request.Headers)
+		r.Headers["Content-Type"] = []string{"application/json"}
+		r.Headers["Content-Length"] = []string{strconv.Itoa(len(body))}
+		return next(ctx, &r)
+	}
+}
+
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+type graphqlResponse struct {
+	Data   map[string]interface{} `json:"data"`
+	Errors []ErrorMessage         `json:"errors"`
+}
+
+func lookup(data map[string]interface{}, key string) (interface{}, bool) {
+	if v, ok := data[key]; ok {
+		return v, true
+	}
+	for k, v := range data {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// variables 依次使用配置的默认值、请求中与query里定义的变量同名的值、"{name}"绑定的值
+// 字符串会按照变量定义的类型转换为Int、Float、Boolean
+func variables(defaults map[string]interface{}, declared map[string]string, data map[string]interface{}) map[string]interface{} {
+	res := map[string]interface{}{}
+	for name, v := range defaults {
+		if _, ok := placeholder(v); !ok {
+			res[name] = v
+		}
+	}
+	for name := range declared {
+		if v, ok := lookup(data, name); ok {
+			res[name] = v
+		}
+	}
+	for name, v := range defaults {
+		if key, ok := placeholder(v); ok {
+			if v, ok := lookup(data, key); ok {
+				res[name] = v
+			}
+		}
+	}
+	for name, v := range res {
+		if s, ok := v.(string); ok {
+			res[name] = coerce(s, declared[name])
+		}
+	}
+	return res
+}
+
+func placeholder(v interface{}) (string, bool) {
+	s, ok := v.(string)
+	if !ok || len(s) < 3 || s[0] != '{' || s[len(s)-1] != '}' {
+		return "", false
+	}
+	return s[1 : len(s)-1], true
+}
+
+func coerce(s, t string) interface{} {
+	switch t {
+	case "Int":
+		if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return v
+		}
+	case "Float":
+		if v, err := strconv.ParseFloat(s, 64); err == nil {
+			return v
+		}
+	case "Boolean":
+		if v, err := strconv.ParseBool(s); err == nil {
+			return v
+		}
+	}
+	return s
+}
+
+func newResponseParser(formatter proxy.EntityFormatter) proxy.HTTPResponseParser {
+	return func(_ context.Context, resp *http.Response) (*proxy.Response, error) {
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		var r graphqlResponse
+		if err := json.Unmarshal(body, &r); err != nil {
+			if resp.StatusCode >= http.StatusBadRequest {
+				return nil, client.InvalidStatusCodeError{Code: resp.StatusCode, Body: body}
+			}
+			return nil, err
+		}
+		if r.Data == nil {
+			if len(r.Errors) > 0 {
+				return nil, newError(resp.StatusCode, r.Errors)
+			}
+			if resp.StatusCode >= http.StatusBadRequest {
+				return nil, client.InvalidStatusCodeError{Code: resp.StatusCode, Body: body}
+			}
+			r.Data = map[string]interface{}{}
+		}
+
+		response := formatter.Format(proxy.Response{
+			Data:       r.Data,
+			IsComplete: len(r.Errors) == 0,
+			// 与默认的解析器一致, 只记录状态码, 响应体重新编码之后backend的响应头不再适用
+			Metadata: proxy.Metadata{StatusCode: resp.StatusCode},
+		})
+		return &response, nil
+	}
+}
+
+// ErrorMessage GraphQL响应中errors的元素
+type ErrorMessage struct {
+	Message    string                 `json:"message"`
+	Path       []interface{}          `json:"path,omitempty"`
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+// Error 没有返回data时GraphQL的错误
+type Error struct {
+	Code   int
+	Errors []ErrorMessage
+}
+
+// 常见的 extensions.code 对应的http状态码
+var extensionCodes = map[string]int{
+	"BAD_USER_INPUT":            http.StatusBadRequest,
+	"GRAPHQL_PARSE_FAILED":      http.StatusBadRequest,
+	"GRAPHQL_VALIDATION_FAILED": http.StatusBadRequest,
+	"UNAUTHENTICATED":           http.StatusUnauthorized,
+	"FORBIDDEN":                 http.StatusForbidden,
+	"NOT_FOUND":                 http.StatusNotFound,
+}
+
+// newError 优先使用backend的错误状态码, 其次是第一个错误的 extensions.code
+func newError(status int, errs []ErrorMessage) Error {
+	if status >= http.StatusBadRequest {
+		return Error{Code: status, Errors: errs}
+	}
+	code, _ := errs[0].Extensions["code"].(string)
+	if c, ok := extensionCodes[code]; ok {
+		return Error{Code: c, Errors: errs}
+	}
+	return Error{Code: http.StatusInternalServerError, Errors: errs}
+}
+
+// Error implements the error interface
+func (e Error) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, m := range e.Errors {
+		msgs[i] = m.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Name returns the name of the error
+func (e Error) Name() string { return "graphql" }
+
+// StatusCode returns the status code of the error
+func (e Error) StatusCode() int { return e.Code }
@@ -0,0 +1,219 @@
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"melody/config"
+	"melody/logging"
+	"melody/proxy"
+	melodygin "melody/router/gin"
+	"melody/transport/http/client"
+)
+
+const testQuery = `query GetUser($id: Int!, $active: Boolean, $fields: [String]) {
+	user(id: $id, active: $active) { id name }
+}`
+
+func newTestProxy(t *testing.T, extra map[string]interface{}, handler http.HandlerFunc) (proxy.Proxy, func()) {
+	server := httptest.NewServer(handler)
+	bf := NewBackendFactory(logging.NoOp, client.DefaultHTTPRequestExecutor(client.NewHTTPClient), func(_ *config.Backend) proxy.Proxy {
+		t.Error("the next backend factory should not be called")
+		return proxy.NoopProxy
+	})
+	p := bf(&config.Backend{
+		Target:      "user",
+		ExtraConfig: config.ExtraConfig{Namespace: extra},
+	})
+	u, _ := url.Parse(server.URL + "/graphql")
+	return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+		r.URL = u
+		return p(ctx, r)
+	}, server.Close
+}
+
+func TestNewBackendFactory(t *testing.T) {
+	p, closeServer := newTestProxy(t, map[string]interface{}{
+		"query":          testQuery,
+		"operation_name": "GetUser",
+		"variables": map[string]interface{}{
+			"active": "{status}",
+			"limit":  10,
+		},
+	}, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" || r.Header.Get("X-Test") != "ok" {
+			t.Errorf("unexpected request %s %v", r.Method, r.Header)
+		}
+		var req graphqlRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		expected := map[string]interface{}{
+			"id":     42.0,
+			"active": true,
+			"limit":  10.0,
+			"fields": []interface{}{"id", "name"},
+		}
+		if req.Query != testQuery || req.OperationName != "GetUser" || !reflect.DeepEqual(req.Variables, expected) {
+			t.Errorf("unexpected graphql request %+v", req)
+		}
+		w.Write([]byte(`{"data":{"user":{"id":42,"name":"melody"}}}`))
+	})
+	defer closeServer()
+
+	resp, err := p(context.Background(), &proxy.Request{
+		Method:  http.MethodGet,
+		Params:  map[string]string{"Id": "42"},
+		Query:   url.Values{"status": {"true"}, "fields": {"id", "name"}},
+		Headers: map[string][]string{"X-Test": {"ok"}},
+		Body:    ioutil.NopCloser(bytes.NewBufferString(`{"id":1}`)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.IsComplete || !reflect.DeepEqual(resp.Data, map[string]interface{}{"id": 42.0, "name": "melody"}) {
+		t.Errorf("unexpected response %+v", resp)
+	}
+}
+
+func TestNewBackendFactory_endpointHandler(t *testing.T) {
+	p, closeServer := newTestProxy(t, map[string]interface{}{"query": testQuery}, func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "backend"})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data":{"user":{"id":42,"name":"melody"}},"extensions":{"cost":1}}`))
+	})
+	defer closeServer()
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.GET("/user", melodygin.EndpointHandler(&config.EndpointConfig{Timeout: time.Second}, p))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/user", nil)
+	engine.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d", w.Code)
+	}
+	if h := w.Header().Get("Set-Cookie"); h != "" {
+		t.Errorf("the backend headers should not be forwarded: %s", h)
+	}
+	if h := w.Header().Get("Content-Length"); h != "" && h != strconv.Itoa(w.Body.Len()) {
+		t.Errorf("unexpected content length %s for %q", h, w.Body.String())
+	}
+	var data map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &data); err != nil {
+		t.Fatalf("unexpected body %q: %v", w.Body.String(), err)
+	}
+	if !reflect.DeepEqual(data, map[string]interface{}{"id": 42.0, "name": "melody"}) {
+		t.Errorf("unexpected response %v", data)
+	}
+}
+
+func TestNewBackendFactory_errors(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		status   int
+		body     string
+		complete bool
+		code     int
+	}{
+		{
+			name:     "partial",
+			status:   http.StatusOK,
+			body:     `{"data":{"user":{"id":42,"name":null}},"errors":[{"message":"name unavailable","path":["user","name"]}]}`,
+			complete: false,
+		},
+		{
+			name:   "extension code",
+			status: http.StatusOK,
+			body:   `{"data":null,"errors":[{"message":"user not found","extensions":{"code":"NOT_FOUND"}}]}`,
+			code:   http.StatusNotFound,
+		},
+		{
+			name:   "unknown code",
+			status: http.StatusOK,
+			body:   `{"errors":[{"message":"boom"}]}`,
+			code:   http.StatusInternalServerError,
+		},
+		{
+			name:   "status code",
+			status: http.StatusBadRequest,
+			body:   `{"errors":[{"message":"syntax error","extensions":{"code":"NOT_FOUND"}}]}`,
+			code:   http.StatusBadRequest,
+		},
+		{
+			name:   "invalid body",
+			status: http.StatusBadGateway,
+			body:   `bad gateway`,
+			code:   http.StatusBadGateway,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, closeServer := newTestProxy(t, map[string]interface{}{"query": testQuery}, func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			})
+			defer closeServer()
+
+			resp, err := p(context.Background(), &proxy.Request{})
+			if tc.code == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if resp.IsComplete != tc.complete || resp.Data["id"] != 42.0 {
+					t.Errorf("unexpected response %+v", resp)
+				}
+				return
+			}
+			switch e := err.(type) {
+			case Error:
+				if e.StatusCode() != tc.code {
+					t.Errorf("unexpected status code %d", e.StatusCode())
+				}
+			case client.InvalidStatusCodeError:
+				if e.Code != tc.code {
+					t.Errorf("unexpected status code %d", e.Code)
+				}
+			default:
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	if _, err := ParseConfig(config.ExtraConfig{}); err != ErrNoConfig {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err := ParseConfig(config.ExtraConfig{Namespace: map[string]interface{}{}}); err != ErrEmptyQuery {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	f, err := ioutil.TempFile("", "query.graphql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(testQuery)
+	f.Close()
+	cfg, err := ParseConfig(config.ExtraConfig{Namespace: map[string]interface{}{"query_path": f.Name()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Query != testQuery {
+		t.Errorf("unexpected query %q", cfg.Query)
+	}
+}
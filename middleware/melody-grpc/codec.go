@@ -0,0 +1,583 @@
+package grpc
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errMalformedMessage = errors.New("grpc: malformed protobuf message")
+
+// registry 保存descriptor set中的message、enum和method的描述
+// message和enum使用以"."开头的全名, 与FieldDescriptorProto.TypeName一致
+// method使用 "package.Service/Method"
+type registry struct {
+	messages map[string]*descriptor.DescriptorProto
+	enums    map[string]*descriptor.EnumDescriptorProto
+	methods  map[string]*descriptor.MethodDescriptorProto
+}
+
+func newRegistry() *registry {
+	return &registry{
+		messages: map[string]*descriptor.DescriptorProto{},
+		enums:    map[string]*descriptor.EnumDescriptorProto{},
+		methods:  map[string]*descriptor.MethodDescriptorProto{},
+	}
+}
+
+// loadRegistry 读取 protoc --descriptor_set_out 生成的文件
+func loadRegistry(files []string) (*registry, error) {
+	r := newRegistry()
+	for _, name := range files {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		set := &descriptor.FileDescriptorSet{}
+		if err := proto.Unmarshal(b, set); err != nil {
+			return nil, err
+		}
+		for _, f := range set.File {
+			r.addFile(f)
+		}
+	}
+	return r, nil
+}
+
+func (r *registry) addFile(f *descriptor.FileDescriptorProto) {
+	prefix := ""
+	if f.GetPackage() != "" {
+		prefix = "." + f.GetPackage()
+	}
+	for _, m := range f.MessageType {
+		r.addMessage(prefix, m)
+	}
+	for _, e := range f.EnumType {
+		r.enums[prefix+"."+e.GetName()] = e
+	}
+	for _, s := range f.Service {
+		for _, m := range s.Method {
+			r.methods[strings.TrimPrefix(prefix+"."+s.GetName(), ".")+"/"+m.GetName()] = m
+		}
+	}
+}
+
+func (r *registry) addMessage(prefix string, m *descriptor.DescriptorProto) {
+	name := prefix + "." + m.GetName()
+	r.messages[name] = m
+	for _, nested := range m.NestedType {
+		r.addMessage(name, nested)
+	}
+	for _, e := range m.EnumType {
+		r.enums[name+"."+e.GetName()] = e
+	}
+}
+
+func (r *registry) mapEntry(f *descriptor.FieldDescriptorProto) *descriptor.DescriptorProto {
+	if f.GetType() != descriptor.FieldDescriptorProto_TYPE_MESSAGE {
+		return nil
+	}
+	m, ok := r.messages[f.GetTypeName()]
+	if !ok || !m.GetOptions().GetMapEntry() {
+		return nil
+	}
+	return m
+}
+
+// encode 按照message的描述把data编码为protobuf, data中没有对应字段的值会被忽略
+// 字段名称不区分大小写, 可以使用proto中的名称或者json_name
+func (r *registry) encode(typeName string, data map[string]interface{}) ([]byte, error) {
+	m, ok := r.messages[typeName]
+	if !ok {
+		return nil, fmt.Errorf("grpc: unknown message type %s", typeName)
+	}
+	var b []byte
+	for _, f := range m.Field {
+		v, ok := lookupField(data, f)
+		if !ok || v == nil {
+			continue
+		}
+		var err error
+		if b, err = r.encodeField(b, f, v); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func lookupField(data map[string]interface{}, f *descriptor.FieldDescriptorProto) (interface{}, bool) {
+	for _, name := range []string{f.GetName(), f.GetJsonName()} {
+		if v, ok := data[name]; ok && name != "" {
+			return v, true
+		}
+	}
+	for k, v := range data {
+		if strings.EqualFold(k, f.GetName()) || strings.EqualFold(k, f.GetJsonName()) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+func (r *registry) encodeField(b []byte, f *descriptor.FieldDescriptorProto, v interface{}) ([]byte, error) {
+	if f.GetLabel() != descriptor.FieldDescriptorProto_LABEL_REPEATED {
+		return r.encodeValue(b, f, v)
+	}
+	if entry := r.mapEntry(f); entry != nil {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("grpc: the field %s must be an object", f.GetName())
+		}
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			eb, err := r.encode(f.GetTypeName(), map[string]interface{}{
+				entry.Field[0].GetName(): k,
+				entry.Field[1].GetName(): m[k],
+			})
+			if err != nil {
+				return nil, err
+			}
+			b = appendTag(b, f.GetNumber(), wireBytes)
+			b = appendBytes(b, eb)
+		}
+		return b, nil
+	}
+	vs, ok := v.([]interface{})
+	if !ok {
+		vs = []interface{}{v}
+	}
+	var err error
+	for _, item := range vs {
+		if b, err = r.encodeValue(b, f, item); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func (r *registry) encodeValue(b []byte, f *descriptor.FieldDescriptorProto, v interface{}) ([]byte, error) {
+	n := f.GetNumber()
+	switch f.GetType() {
+	case descriptor.FieldDescriptorProto_TYPE_DOUBLE, descriptor.FieldDescriptorProto_TYPE_FLOAT:
+		x, err := toFloat(v)
+		if err != nil {
+			return nil, fieldError(f, err)
+		}
+		if f.GetType() == descriptor.FieldDescriptorProto_TYPE_FLOAT {
+			return appendFixed32(appendTag(b, n, wireFixed32), math.Float32bits(float32(x))), nil
+		}
+		return appendFixed64(appendTag(b, n, wireFixed64), math.Float64bits(x)), nil
+
+	case descriptor.FieldDescriptorProto_TYPE_INT64, descriptor.FieldDescriptorProto_TYPE_INT32:
+		x, err := toInt(v)
+		if err != nil {
+			return nil, fieldError(f, err)
+		}
+		return appendVarint(appendTag(b, n, wireVarint), uint64(x)), nil
+
+	case descriptor.FieldDescriptorProto_TYPE_SINT64, descriptor.FieldDescriptorProto_TYPE_SINT32:
+		x, err := toInt(v)
+		if err != nil {
+			return nil, fieldError(f, err)
+		}
+		return appendVarint(appendTag(b, n, wireVarint), uint64(x<<1)^uint64(x>>63)), nil
+
+	case descriptor.FieldDescriptorProto_TYPE_UINT64, descriptor.FieldDescriptorProto_TYPE_UINT32:
+		x, err := toUint(v)
+		if err != nil {
+			return nil, fieldError(f, err)
+		}
+		return appendVarint(appendTag(b, n, wireVarint), x), nil
+
+	case descriptor.FieldDescriptorProto_TYPE_FIXED64, descriptor.FieldDescriptorProto_TYPE_SFIXED64:
+		x, err := toInt(v)
+		if f.GetType() == descriptor.FieldDescriptorProto_TYPE_FIXED64 {
+			var u uint64
+			u, err = toUint(v)
+			x = int64(u)
+		}
+		if err != nil {
+			return nil, fieldError(f, err)
+		}
+		return appendFixed64(appendTag(b, n, wireFixed64), uint64(x)), nil
+
+	case descriptor.FieldDescriptorProto_TYPE_FIXED32, descriptor.FieldDescriptorProto_TYPE_SFIXED32:
+		x, err := toInt(v)
+		if f.GetType() == descriptor.FieldDescriptorProto_TYPE_FIXED32 {
+			var u uint64
+			u, err = toUint(v)
+			x = int64(u)
+		}
+		if err != nil {
+			return nil, fieldError(f, err)
+		}
+		return appendFixed32(appendTag(b, n, wireFixed32), uint32(x)), nil
+
+	case descriptor.FieldDescriptorProto_TYPE_BOOL:
+		x, err := toBool(v)
+		if err != nil {
+			return nil, fieldError(f, err)
+		}
+		var u uint64
+		if x {
+			u = 1
+		}
+		return appendVarint(appendTag(b, n, wireVarint), u), nil
+
+	case descriptor.FieldDescriptorProto_TYPE_ENUM:
+		x, err := r.toEnum(f.GetTypeName(), v)
+		if err != nil {
+			return nil, fieldError(f, err)
+		}
+		return appendVarint(appendTag(b, n, wireVarint), uint64(x)), nil
+
+	case descriptor.FieldDescriptorProto_TYPE_STRING:
+		s, ok := v.(string)
+		if !ok {
+			s = fmt.Sprintf("%v", v)
+		}
+		return appendBytes(appendTag(b, n, wireBytes), []byte(s)), nil
+
+	case descriptor.FieldDescriptorProto_TYPE_BYTES:
+		var data []byte
+		switch t := v.(type) {
+		case []byte:
+			data = t
+		case string:
+			var err error
+			if data, err = base64.StdEncoding.DecodeString(t); err != nil {
+				data = []byte(t)
+			}
+		default:
+			return nil, fieldError(f, fmt.Errorf("unexpected type %T", v))
+		}
+		return appendBytes(appendTag(b, n, wireBytes), data), nil
+
+	case descriptor.FieldDescriptorProto_TYPE_MESSAGE:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("grpc: the field %s must be an object", f.GetName())
+		}
+		data, err := r.encode(f.GetTypeName(), m)
+		if err != nil {
+			return nil, err
+		}
+		return appendBytes(appendTag(b, n, wireBytes), data), nil
+	}
+	return nil, fmt.Errorf("grpc: unsupported type %s for the field %s", f.GetType(), f.GetName())
+}
+
+// decode 把protobuf解码为map, 使用json_name(没有时使用proto中的名称)作为key
+// 64位整数解码为int64/uint64, bytes编码为base64, 未知的字段会被忽略
+func (r *registry) decode(typeName string, b []byte) (map[string]interface{}, error) {
+	m, ok := r.messages[typeName]
+	if !ok {
+		return nil, fmt.Errorf("grpc: unknown message type %s", typeName)
+	}
+	fields := make(map[int32]*descriptor.FieldDescriptorProto, len(m.Field))
+	for _, f := range m.Field {
+		fields[f.GetNumber()] = f
+	}
+
+	res := map[string]interface{}{}
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errMalformedMessage
+		}
+		b = b[n:]
+
+		var raw uint64
+		var data []byte
+		wire := key & 7
+		switch wire {
+		case wireVarint:
+			if raw, n = binary.Uvarint(b); n <= 0 {
+				return nil, errMalformedMessage
+			}
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return nil, errMalformedMessage
+			}
+			raw, b = binary.LittleEndian.Uint64(b), b[8:]
+		case wireFixed32:
+			if len(b) < 4 {
+				return nil, errMalformedMessage
+			}
+			raw, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return nil, errMalformedMessage
+			}
+			data, b = b[n:n+int(l)], b[n+int(l):]
+		default:
+			return nil, fmt.Errorf("grpc: unsupported wire type %d", wire)
+		}
+
+		f, ok := fields[int32(key>>3)]
+		if !ok {
+			continue
+		}
+		name := f.GetJsonName()
+		if name == "" {
+			name = f.GetName()
+		}
+
+		if entry := r.mapEntry(f); entry != nil {
+			e, err := r.decode(f.GetTypeName(), data)
+			if err != nil {
+				return nil, err
+			}
+			values, _ := res[name].(map[string]interface{})
+			if values == nil {
+				values = map[string]interface{}{}
+				res[name] = values
+			}
+			values[fmt.Sprintf("%v", e[fieldName(entry.Field[0])])] = e[fieldName(entry.Field[1])]
+			continue
+		}
+
+		var vs []interface{}
+		if wire == wireBytes && isPackable(f.GetType()) {
+			var err error
+			if vs, err = r.decodePacked(f, data); err != nil {
+				return nil, err
+			}
+		} else {
+			v, err := r.decodeValue(f, raw, data)
+			if err != nil {
+				return nil, err
+			}
+			vs = []interface{}{v}
+		}
+
+		if f.GetLabel() != descriptor.FieldDescriptorProto_LABEL_REPEATED {
+			res[name] = vs[len(vs)-1]
+			continue
+		}
+		list, _ := res[name].([]interface{})
+		res[name] = append(list, vs...)
+	}
+	return res, nil
+}
+
+func (r *registry) decodePacked(f *descriptor.FieldDescriptorProto, data []byte) ([]interface{}, error) {
+	res := []interface{}{}
+	for len(data) > 0 {
+		var raw uint64
+		switch f.GetType() {
+		case descriptor.FieldDescriptorProto_TYPE_DOUBLE, descriptor.FieldDescriptorProto_TYPE_FIXED64, descriptor.FieldDescriptorProto_TYPE_SFIXED64:
+			if len(data) < 8 {
+				return nil, errMalformedMessage
+			}
+			raw, data = binary.LittleEndian.Uint64(data), data[8:]
+		case descriptor.FieldDescriptorProto_TYPE_FLOAT, descriptor.FieldDescriptorProto_TYPE_FIXED32, descriptor.FieldDescriptorProto_TYPE_SFIXED32:
+			if len(data) < 4 {
+				return nil, errMalformedMessage
+			}
+			raw, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		default:
+			var n int
+			if raw, n = binary.Uvarint(data); n <= 0 {
+				return nil, errMalformedMessage
+			}
+			data = data[n:]
+		}
+		v, err := r.decodeValue(f, raw, nil)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+	}
+	return res, nil
+}
+
+func (r *registry) decodeValue(f *descriptor.FieldDescriptorProto, raw uint64, data []byte) (interface{}, error) {
+	switch f.GetType() {
+	case descriptor.FieldDescriptorProto_TYPE_DOUBLE:
+		return math.Float64frombits(raw), nil
+	case descriptor.FieldDescriptorProto_TYPE_FLOAT:
+		return float64(math.Float32frombits(uint32(raw))), nil
+	case descriptor.FieldDescriptorProto_TYPE_INT64, descriptor.FieldDescriptorProto_TYPE_SFIXED64:
+		return int64(raw), nil
+	case descriptor.FieldDescriptorProto_TYPE_INT32:
+		return int64(int32(raw)), nil
+	case descriptor.FieldDescriptorProto_TYPE_SFIXED32:
+		return int64(int32(uint32(raw))), nil
+	case descriptor.FieldDescriptorProto_TYPE_SINT64, descriptor.FieldDescriptorProto_TYPE_SINT32:
+		return int64(raw>>1) ^ -int64(raw&1), nil
+	case descriptor.FieldDescriptorProto_TYPE_UINT64, descriptor.FieldDescriptorProto_TYPE_FIXED64:
+		return raw, nil
+	case descriptor.FieldDescriptorProto_TYPE_UINT32, descriptor.FieldDescriptorProto_TYPE_FIXED32:
+		return uint64(uint32(raw)), nil
+	case descriptor.FieldDescriptorProto_TYPE_BOOL:
+		return raw != 0, nil
+	case descriptor.FieldDescriptorProto_TYPE_ENUM:
+		if e, ok := r.enums[f.GetTypeName()]; ok {
+			for _, v := range e.Value {
+				if v.GetNumber() == int32(raw) {
+					return v.GetName(), nil
+				}
+			}
+		}
+		return int64(int32(raw)), nil
+	case descriptor.FieldDescriptorProto_TYPE_STRING:
+		return string(data), nil
+	case descriptor.FieldDescriptorProto_TYPE_BYTES:
+		return base64.StdEncoding.EncodeToString(data), nil
+	case descriptor.FieldDescriptorProto_TYPE_MESSAGE:
+		return r.decode(f.GetTypeName(), data)
+	}
+	return nil, fmt.Errorf("grpc: unsupported type %s for the field %s", f.GetType(), f.GetName())
+}
+
+func (r *registry) toEnum(typeName string, v interface{}) (int32, error) {
+	if s, ok := v.(string); ok {
+		if e, ok := r.enums[typeName]; ok {
+			for _, value := range e.Value {
+				if value.GetName() == s {
+					return value.GetNumber(), nil
+				}
+			}
+		}
+	}
+	x, err := toInt(v)
+	return int32(x), err
+}
+
+func fieldName(f *descriptor.FieldDescriptorProto) string {
+	if f.GetJsonName() != "" {
+		return f.GetJsonName()
+	}
+	return f.GetName()
+}
+
+func fieldError(f *descriptor.FieldDescriptorProto, err error) error {
+	return fmt.Errorf("grpc: invalid value for the field %s: %s", f.GetName(), err.Error())
+}
+
+func isPackable(t descriptor.FieldDescriptorProto_Type) bool {
+	switch t {
+	case descriptor.FieldDescriptorProto_TYPE_STRING,
+		descriptor.FieldDescriptorProto_TYPE_BYTES,
+		descriptor.FieldDescriptorProto_TYPE_MESSAGE,
+		descriptor.FieldDescriptorProto_TYPE_GROUP:
+		return false
+	}
+	return true
+}
+
+func appendTag(b []byte, n int32, wire uint64) []byte {
+	return appendVarint(b, uint64(n)<<3|wire)
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendFixed64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendFixed32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendBytes(b []byte, data []byte) []byte {
+	return append(appendVarint(b, uint64(len(data))), data...)
+}
+
+func toInt(v interface{}) (int64, error) {
+	switch t := v.(type) {
+	case float64:
+		return int64(t), nil
+	case int:
+		return int64(t), nil
+	case int64:
+		return t, nil
+	case uint64:
+		return int64(t), nil
+	case json.Number:
+		return t.Int64()
+	case string:
+		return strconv.ParseInt(t, 10, 64)
+	}
+	return 0, fmt.Errorf("unexpected type %T", v)
+}
+
+func toUint(v interface{}) (uint64, error) {
+	switch t := v.(type) {
+	case float64:
+		return uint64(t), nil
+	case int:
+		return uint64(t), nil
+	case int64:
+		return uint64(t), nil
+	case uint64:
+		return t, nil
+	case json.Number:
+		return strconv.ParseUint(t.String(), 10, 64)
+	case string:
+		return strconv.ParseUint(t, 10, 64)
+	}
+	return 0, fmt.Errorf("unexpected type %T", v)
+}
+
+func toFloat(v interface{}) (float64, error) {
+	switch t := v.(type) {
+	case float64:
+		return t, nil
+	case int:
+		return float64(t), nil
+	case int64:
+		return float64(t), nil
+	case uint64:
+		return float64(t), nil
+	case json.Number:
+		return t.Float64()
+	case string:
+		return strconv.ParseFloat(t, 64)
+	}
+	return 0, fmt.Errorf("unexpected type %T", v)
+}
+
+func toBool(v interface{}) (bool, error) {
+	switch t := v.(type) {
+	case bool:
+		return t, nil
+	case string:
+		return strconv.ParseBool(t)
+	}
+	return false, fmt.Errorf("unexpected type %T", v)
+}
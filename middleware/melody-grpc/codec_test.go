@@ -0,0 +1,226 @@
+package grpc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+func field(name string, number int32, t descriptor.FieldDescriptorProto_Type, typeName string, repeated bool) *descriptor.FieldDescriptorProto {
+	label := descriptor.FieldDescriptorProto_LABEL_OPTIONAL
+	if repeated {
+		label = descriptor.FieldDescriptorProto_LABEL_REPEATED
+	}
+	f := &descriptor.FieldDescriptorProto{
+		Name:     proto.String(name),
+		JsonName: proto.String(name),
+		Number:   proto.Int32(number),
+		Type:     t.Enum(),
+		Label:    label.Enum(),
+	}
+	if typeName != "" {
+		f.TypeName = proto.String(typeName)
+	}
+	return f
+}
+
+// testFile 相当于下面的proto文件
+//
+//	package test;
+//	enum Status { UNKNOWN = 0; ACTIVE = 1; }
+//	message GetUserRequest { int64 id = 1; repeated string fields = 2; }
+//	message Address { string city = 1; }
+//	message User {
+//	  int64 id = 1; string name = 2; Status status = 3; repeated int32 scores = 4;
+//	  map<string, string> labels = 5; Address address = 6; double balance = 7; bool admin = 8; sint32 delta = 9;
+//	}
+//	service UserService { rpc GetUser(GetUserRequest) returns (User); }
+func testFile() *descriptor.FileDescriptorProto {
+	return &descriptor.FileDescriptorProto{
+		Name:    proto.String("test.proto"),
+		Package: proto.String("test"),
+		EnumType: []*descriptor.EnumDescriptorProto{
+			{
+				Name: proto.String("Status"),
+				Value: []*descriptor.EnumValueDescriptorProto{
+					{Name: proto.String("UNKNOWN"), Number: proto.Int32(0)},
+					{Name: proto.String("ACTIVE"), Number: proto.Int32(1)},
+				},
+			},
+		},
+		MessageType: []*descriptor.DescriptorProto{
+			{
+				Name: proto.String("GetUserRequest"),
+				Field: []*descriptor.FieldDescriptorProto{
+					field("id", 1, descriptor.FieldDescriptorProto_TYPE_INT64, "", false),
+					field("fields", 2, descriptor.FieldDescriptorProto_TYPE_STRING, "", true),
+				},
+			},
+			{
+				Name: proto.String("Address"),
+				Field: []*descriptor.FieldDescriptorProto{
+					field("city", 1, descriptor.FieldDescriptorProto_TYPE_STRING, "", false),
+				},
+			},
+			{
+				Name: proto.String("User"),
+				Field: []*descriptor.FieldDescriptorProto{
+					field("id", 1, descriptor.FieldDescriptorProto_TYPE_INT64, "", false),
+					field("name", 2, descriptor.FieldDescriptorProto_TYPE_STRING, "", false),
+					field("status", 3, descriptor.FieldDescriptorProto_TYPE_ENUM, ".test.Status", false),
+					field("scores", 4, descriptor.FieldDescriptorProto_TYPE_INT32, "", true),
+					field("labels", 5, descriptor.FieldDescriptorProto_TYPE_MESSAGE, ".test.User.LabelsEntry", true),
+					field("address", 6, descriptor.FieldDescriptorProto_TYPE_MESSAGE, ".test.Address", false),
+					field("balance", 7, descriptor.FieldDescriptorProto_TYPE_DOUBLE, "", false),
+					field("admin", 8, descriptor.FieldDescriptorProto_TYPE_BOOL, "", false),
+					field("delta", 9, descriptor.FieldDescriptorProto_TYPE_SINT32, "", false),
+				},
+				NestedType: []*descriptor.DescriptorProto{
+					{
+						Name: proto.String("LabelsEntry"),
+						Field: []*descriptor.FieldDescriptorProto{
+							field("key", 1, descriptor.FieldDescriptorProto_TYPE_STRING, "", false),
+							field("value", 2, descriptor.FieldDescriptorProto_TYPE_STRING, "", false),
+						},
+						Options: &descriptor.MessageOptions{MapEntry: proto.Bool(true)},
+					},
+				},
+			},
+		},
+		Service: []*descriptor.ServiceDescriptorProto{
+			{
+				Name: proto.String("UserService"),
+				Method: []*descriptor.MethodDescriptorProto{
+					{
+						Name:       proto.String("GetUser"),
+						InputType:  proto.String(".test.GetUserRequest"),
+						OutputType: proto.String(".test.User"),
+					},
+				},
+			},
+		},
+	}
+}
+
+func writeDescriptorSet(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "melody-grpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := proto.Marshal(&descriptor.FileDescriptorSet{File: []*descriptor.FileDescriptorProto{testFile()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "test.pb")
+	if err := ioutil.WriteFile(name, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name, func() { os.RemoveAll(dir) }
+}
+
+func TestLoadRegistry(t *testing.T) {
+	name, cleanup := writeDescriptorSet(t)
+	defer cleanup()
+
+	r, err := loadRegistry([]string{name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []string{".test.GetUserRequest", ".test.Address", ".test.User", ".test.User.LabelsEntry"} {
+		if _, ok := r.messages[m]; !ok {
+			t.Errorf("message %s not found", m)
+		}
+	}
+	if _, ok := r.enums[".test.Status"]; !ok {
+		t.Error("enum not found")
+	}
+	if _, ok := r.methods["test.UserService/GetUser"]; !ok {
+		t.Error("method not found")
+	}
+
+	if _, err := loadRegistry([]string{name + ".unknown"}); err == nil {
+		t.Error("expecting an error")
+	}
+}
+
+func TestRegistry_roundTrip(t *testing.T) {
+	r := newRegistry()
+	r.addFile(testFile())
+
+	b, err := r.encode(".test.User", map[string]interface{}{
+		"Id":      "42",
+		"name":    "melody",
+		"status":  "ACTIVE",
+		"scores":  []interface{}{1.0, -2.0, 300.0},
+		"labels":  map[string]interface{}{"a": "1", "b": "2"},
+		"address": map[string]interface{}{"city": "Shanghai"},
+		"balance": 3.5,
+		"admin":   true,
+		"delta":   -7.0,
+		"ignored": "value",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := r.decode(".test.User", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"id":      int64(42),
+		"name":    "melody",
+		"status":  "ACTIVE",
+		"scores":  []interface{}{int64(1), int64(-2), int64(300)},
+		"labels":  map[string]interface{}{"a": "1", "b": "2"},
+		"address": map[string]interface{}{"city": "Shanghai"},
+		"balance": 3.5,
+		"admin":   true,
+		"delta":   int64(-7),
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("unexpected result %v", res)
+	}
+}
+
+func TestRegistry_decodePacked(t *testing.T) {
+	r := newRegistry()
+	r.addFile(testFile())
+
+	// scores = [3, 270] 使用packed编码
+	b := []byte{0x22, 0x03, 0x03, 0x8e, 0x02}
+	res, err := r.decode(".test.User", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res["scores"], []interface{}{int64(3), int64(270)}) {
+		t.Errorf("unexpected result %v", res)
+	}
+
+	if _, err := r.decode(".test.User", []byte{0x22, 0x05, 0x03}); err != errMalformedMessage {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestRegistry_encodeErrors(t *testing.T) {
+	r := newRegistry()
+	r.addFile(testFile())
+
+	for _, data := range []map[string]interface{}{
+		{"id": "abc"},
+		{"address": "Shanghai"},
+		{"labels": []interface{}{"a"}},
+	} {
+		if _, err := r.encode(".test.User", data); err == nil {
+			t.Errorf("expecting an error for %v", data)
+		}
+	}
+	if _, err := r.encode(".test.Unknown", map[string]interface{}{}); err == nil {
+		t.Error("expecting an error")
+	}
+}
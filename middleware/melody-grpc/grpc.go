@@ -0,0 +1,314 @@
+package grpc
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"melody/config"
+	"melody/logging"
+	"melody/proxy"
+	"melody/transport/http/client"
+)
+
+// Namespace 命名空间
+const Namespace = "melody_grpc"
+
+var (
+	// ErrNoConfig 当没有为模块定义配置时，将返回ErrNoConfig
+	ErrNoConfig = errors.New("no config defined for the module")
+	// ErrUnknownMethod 在descriptor set中找不到配置的method
+	ErrUnknownMethod = errors.New("unknown grpc method")
+	// ErrConnPoolClosed backend所属的路由表已经被替换, 连接已经关闭
+	ErrConnPoolClosed = errors.New("grpc connection pool closed")
+)
+
+// Config gRPC backend的配置
+type Config struct {
+	// 调用的方法, 格式为 package.Service/Method
+	Method string `json:"method"`
+	// protoc --include_imports --descriptor_set_out 生成的文件
+	DescriptorSets []string `json:"descriptor_sets"`
+	// 使用gRPC-Web协议通过http调用
+	Web bool `json:"web"`
+}
+
+// 不会作为metadata发送给backend的请求头
+var skippedHeaders = map[string]bool{
+	"Connection":        true,
+	"Content-Length":    true,
+	"Content-Type":      true,
+	"Keep-Alive":        true,
+	"Te":                true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// ParseConfig 从ExtraConfig中提取gRPC backend的配置
+func ParseConfig(cfg config.ExtraConfig) (Config, error) {
+	res := Config{}
+	e, ok := cfg[Namespace]
+	if !ok {
+		return res, ErrNoConfig
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return res, err
+	}
+	err = json.Unmarshal(b, &res)
+	res.Method = strings.TrimPrefix(res.Method, "/")
+	return res, err
+}
+
+// NewBackendFactory 为配置了melody_grpc的backend创建调用gRPC方法的proxy, 其他backend交给next处理
+// gRPC-Web的请求使用注入的HTTPRequestExecutor发送
+func NewBackendFactory(logger logging.Logger, re client.HTTPRequestExecutor, next proxy.BackendFactory) proxy.BackendFactory {
+	return func(remote *config.Backend) proxy.Proxy {
+		cfg, err := ParseConfig(remote.ExtraConfig)
+		if err == ErrNoConfig {
+			return next(remote)
+		}
+		if err != nil {
+			logger.Error("grpc:", err.Error())
+			return next(remote)
+		}
+		r, err := loadRegistry(cfg.DescriptorSets)
+		if err != nil {
+			logger.Error("grpc: unable to load the descriptor sets:", err.Error())
+			return next(remote)
+		}
+		var inv invoker
+		if cfg.Web {
+			inv = webInvoker(re)
+		} else {
+			pool := newConnPool()
+			// 路由表被热加载替换之后关闭连接
+			config.RegisterCloser(remote, pool.Close)
+			inv = pool.invoke
+		}
+		p, err := newProxy(remote, cfg, r, inv)
+		if err != nil {
+			logger.Error("grpc:", cfg.Method, err.Error())
+			return next(remote)
+		}
+		return p
+	}
+}
+
+// invoker 调用target上的method, 返回响应的message
+type invoker func(ctx context.Context, target *url.URL, method string, md metadata.MD, in []byte) ([]byte, error)
+
+// newProxy 把请求的body、query string和参数映射为method的请求message, 再把响应的message转换为Response.Data
+// 响应会经过backend的过滤、分组、映射等处理, 与json的backend一致
+func newProxy(remote *config.Backend, cfg Config, r *registry, inv invoker) (proxy.Proxy, error) {
+	method, ok := r.methods[cfg.Method]
+	if !ok {
+		return nil, ErrUnknownMethod
+	}
+	fullMethod := "/" + cfg.Method
+	formatter := proxy.NewEntityFormatter(remote)
+
+	return func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+		data, err := proxy.RequestData(request)
+		if err != nil {
+			return nil, err
+		}
+		in, err := r.encode(method.GetInputType(), data)
+		if err != nil {
+			return nil, err
+		}
+		begin := time.Now()
+		out, err := inv(ctx, request.URL, fullMethod, requestMetadata(request.Headers), in)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		// 与http的backend一致, 结果交给被动健康检查和per-host熔断器
+		proxy.ReportHealth(ctx, request.URL.String(), isHealthy(err), time.Since(begin))
+		if err != nil {
+			return nil, err
+		}
+		res, err := r.decode(method.GetOutputType(), out)
+		if err != nil {
+			return nil, err
+		}
+		resp := formatter.Format(proxy.Response{
+			Data:       res,
+			IsComplete: true,
+			// 响应的metadata是gRPC的传输信息, 不会作为响应头传递
+			Metadata: proxy.Metadata{StatusCode: http.StatusOK},
+		})
+		return &resp, nil
+	}, nil
+}
+
+func requestMetadata(headers map[string][]string) metadata.MD {
+	md := metadata.MD{}
+	for k, vs := range headers {
+		if skippedHeaders[textproto.CanonicalMIMEHeaderKey(k)] {
+			continue
+		}
+		md[strings.ToLower(k)] = append(md[strings.ToLower(k)], vs...)
+	}
+	return md
+}
+
+type connPool struct {
+	mu     sync.Mutex
+	conns  map[string]*grpc.ClientConn
+	closed bool
+}
+
+func newConnPool() *connPool {
+	return &connPool{conns: map[string]*grpc.ClientConn{}}
+}
+
+// get 每个host复用同一个连接, https的host使用tls
+func (p *connPool) get(target *url.URL) (*grpc.ClientConn, error) {
+	key := target.Scheme + "://" + target.Host
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, ErrConnPoolClosed
+	}
+	if conn, ok := p.conns[key]; ok {
+		return conn, nil
+	}
+	opt := grpc.WithInsecure()
+	if target.Scheme == "https" {
+		opt = grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{}))
+	}
+	conn, err := grpc.Dial(target.Host, opt)
+	if err != nil {
+		return nil, err
+	}
+	p.conns[key] = conn
+	return conn, nil
+}
+
+// Close 关闭所有的连接, 之后的调用返回 ErrConnPoolClosed
+func (p *connPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for key, conn := range p.conns {
+		conn.Close()
+		delete(p.conns, key)
+	}
+}
+
+func (p *connPool) invoke(ctx context.Context, target *url.URL, method string, md metadata.MD, in []byte) ([]byte, error) {
+	conn, err := p.get(target)
+	if err != nil {
+		return nil, err
+	}
+	var out []byte
+	err = conn.Invoke(metadata.NewOutgoingContext(ctx, md), method, in, &out, grpc.ForceCodec(rawCodec{}))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if s, ok := status.FromError(err); ok {
+			return nil, Error{Code: s.Code(), Message: s.Message()}
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+// isHealthy 与http的backend一致, 只有5xx对应的状态和传输错误才认为backend不健康
+func isHealthy(err error) bool {
+	if err == nil {
+		return true
+	}
+	switch e := err.(type) {
+	case Error:
+		return e.StatusCode() < http.StatusInternalServerError
+	case client.InvalidStatusCodeError:
+		return e.Code < http.StatusInternalServerError
+	}
+	return false
+}
+
+// rawCodec 直接传递已经编码好的message
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	switch t := v.(type) {
+	case []byte:
+		return t, nil
+	case *[]byte:
+		return *t, nil
+	}
+	return nil, fmt.Errorf("grpc: unexpected message type %T", v)
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	t, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("grpc: unexpected message type %T", v)
+	}
+	*t = append((*t)[:0], data...)
+	return nil
+}
+
+// Name 使用proto作为content-subtype, 这样backend会按照protobuf处理
+func (rawCodec) Name() string { return "proto" }
+
+func (c rawCodec) String() string { return c.Name() }
+
+// Error gRPC方法返回的非OK状态
+type Error struct {
+	Code    codes.Code
+	Message string
+}
+
+// Error implements the error interface
+func (e Error) Error() string {
+	return fmt.Sprintf("rpc error: code = %s desc = %s", e.Code, e.Message)
+}
+
+// Name returns the name of the error
+func (e Error) Name() string { return "grpc" }
+
+// StatusCode 返回与gRPC状态对应的http状态码
+func (e Error) StatusCode() int {
+	switch e.Code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return http.StatusRequestTimeout
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,258 @@
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"melody/config"
+	"melody/logging"
+	"melody/proxy"
+	"melody/sd"
+	"melody/transport/http/client"
+)
+
+// getUser 是测试使用的 test.UserService/GetUser 的实现
+func getUser(r *registry, ctx context.Context, in []byte) ([]byte, error) {
+	req, err := r.decode(".test.GetUserRequest", in)
+	if err != nil {
+		return nil, err
+	}
+	if req["id"] != int64(42) {
+		return nil, status.Error(codes.NotFound, "user not found")
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	return r.encode(".test.User", map[string]interface{}{
+		"id":     req["id"],
+		"name":   md.Get("x-name")[0],
+		"status": "ACTIVE",
+		"labels": map[string]interface{}{"fields": len(req["fields"].([]interface{}))},
+	})
+}
+
+func newTestServer(t *testing.T, r *registry) (string, func()) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer(grpc.CustomCodec(rawCodec{}))
+	s.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "test.UserService",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{
+			{
+				MethodName: "GetUser",
+				Handler: func(_ interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+					var in []byte
+					if err := dec(&in); err != nil {
+						return nil, err
+					}
+					grpc.SetHeader(ctx, metadata.Pairs("x-served-by", "test"))
+					return getUser(r, ctx, in)
+				},
+			},
+		},
+	}, struct{}{})
+	go s.Serve(lis)
+	return "http://" + lis.Addr().String(), s.Stop
+}
+
+func newTestBackend(t *testing.T, web bool) (*config.Backend, func()) {
+	name, cleanup := writeDescriptorSet(t)
+	return &config.Backend{
+		Group: "user",
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				"method":          "/test.UserService/GetUser",
+				"descriptor_sets": []string{name},
+				"web":             web,
+			},
+		},
+	}, cleanup
+}
+
+func testProxy(t *testing.T, p proxy.Proxy, host string) {
+	u, _ := url.Parse(host + "/ignored?a=1")
+	resp, err := p(context.Background(), &proxy.Request{
+		URL:     u,
+		Params:  map[string]string{"Id": "42"},
+		Query:   url.Values{"fields": {"name", "status"}},
+		Headers: map[string][]string{"X-Name": {"melody"}, "Content-Length": {"10"}},
+		Body:    ioutil.NopCloser(bytes.NewBufferString(`{"id":1}`)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"user": map[string]interface{}{
+			"id":     int64(42),
+			"name":   "melody",
+			"status": "ACTIVE",
+			"labels": map[string]interface{}{"fields": "2"},
+		},
+	}
+	if !resp.IsComplete || !reflect.DeepEqual(resp.Data, expected) {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	if resp.Metadata.StatusCode != http.StatusOK || len(resp.Metadata.Headers) != 0 {
+		t.Errorf("unexpected metadata %+v", resp.Metadata)
+	}
+
+	_, err = p(context.Background(), &proxy.Request{URL: u, Params: map[string]string{"Id": "1"}})
+	e, ok := err.(Error)
+	if !ok || e.Code != codes.NotFound || e.Message != "user not found" || e.StatusCode() != http.StatusNotFound {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestNewBackendFactory(t *testing.T) {
+	name, cleanup := writeDescriptorSet(t)
+	defer cleanup()
+	r, _ := loadRegistry([]string{name})
+	host, stop := newTestServer(t, r)
+	defer stop()
+
+	backend, cleanup := newTestBackend(t, false)
+	defer cleanup()
+
+	bf := NewBackendFactory(logging.NoOp, nil, func(_ *config.Backend) proxy.Proxy {
+		t.Error("the next backend factory should not be called")
+		return proxy.NoopProxy
+	})
+	testProxy(t, bf(backend), host)
+}
+
+func TestNewBackendFactory_closedWithGeneration(t *testing.T) {
+	name, cleanup := writeDescriptorSet(t)
+	defer cleanup()
+	r, _ := loadRegistry([]string{name})
+	host, stop := newTestServer(t, r)
+	defer stop()
+
+	backend, cleanup := newTestBackend(t, false)
+	defer cleanup()
+
+	generation := config.NewGeneration(config.ServiceConfig{Endpoints: []*config.EndpointConfig{{Backends: []*config.Backend{backend}}}})
+	p := NewBackendFactory(logging.NoOp, nil, nil)(backend)
+	testProxy(t, p, host)
+
+	// 路由表被替换之后连接被关闭
+	generation.Close()
+	u, _ := url.Parse(host)
+	if _, err := p(context.Background(), &proxy.Request{URL: u, Params: map[string]string{"Id": "42"}}); err != ErrConnPoolClosed {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+// healthRecorder 记录上报的请求结果
+type healthRecorder struct {
+	sd.FixedSubscriber
+	results []bool
+}
+
+func (h *healthRecorder) Report(_ string, healthy bool, _ time.Duration) {
+	h.results = append(h.results, healthy)
+}
+
+func TestNewBackendFactory_healthReport(t *testing.T) {
+	name, cleanup := writeDescriptorSet(t)
+	defer cleanup()
+	r, _ := loadRegistry([]string{name})
+	host, stop := newTestServer(t, r)
+
+	backend, cleanup := newTestBackend(t, false)
+	defer cleanup()
+
+	recorder := &healthRecorder{}
+	p := proxy.NewHealthReportMiddleware(recorder)(NewBackendFactory(logging.NoOp, nil, nil)(backend))
+	u, _ := url.Parse(host)
+	for _, id := range []string{"42", "1"} {
+		p(context.Background(), &proxy.Request{
+			URL:     u,
+			Params:  map[string]string{"Id": id},
+			Query:   url.Values{"fields": {"name"}},
+			Headers: map[string][]string{"X-Name": {"melody"}},
+		})
+	}
+	// backend不可用
+	stop()
+	p(context.Background(), &proxy.Request{URL: u, Params: map[string]string{"Id": "42"}})
+
+	if !reflect.DeepEqual(recorder.results, []bool{true, true, false}) {
+		t.Errorf("unexpected health reports %v", recorder.results)
+	}
+}
+
+func TestNewBackendFactory_web(t *testing.T) {
+	name, cleanup := writeDescriptorSet(t)
+	defer cleanup()
+	r, _ := loadRegistry([]string{name})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/test.UserService/GetUser" || req.Header.Get("Content-Type") != webContentType {
+			t.Errorf("unexpected request %s %v", req.URL, req.Header)
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		if len(body) < 5 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+			t.Errorf("unexpected body %v", body)
+			return
+		}
+		ctx := metadata.NewIncomingContext(req.Context(), metadata.MD{"x-name": {req.Header.Get("X-Name")}})
+		out, err := getUser(r, ctx, body[5:])
+		if err != nil {
+			s, _ := status.FromError(err)
+			w.Header().Set("Content-Type", webContentType)
+			w.Header().Set("Grpc-Status", "5")
+			w.Header().Set("Grpc-Message", url.PathEscape(s.Message()))
+			return
+		}
+		w.Header().Set("Content-Type", webContentType)
+		w.Header().Set("X-Served-By", "test")
+		w.Write(webFrame(0, out))
+		w.Write(webFrame(webTrailerFlag, []byte("grpc-status: 0\r\ngrpc-message: \r\n")))
+	}))
+	defer server.Close()
+
+	backend, cleanup := newTestBackend(t, true)
+	defer cleanup()
+
+	re := client.DefaultHTTPRequestExecutor(client.NewHTTPClient)
+	bf := NewBackendFactory(logging.NoOp, re, func(_ *config.Backend) proxy.Proxy {
+		t.Error("the next backend factory should not be called")
+		return proxy.NoopProxy
+	})
+	testProxy(t, bf(backend), server.URL)
+}
+
+func TestNewBackendFactory_fallback(t *testing.T) {
+	name, cleanup := writeDescriptorSet(t)
+	defer cleanup()
+
+	for _, extra := range []config.ExtraConfig{
+		{},
+		{Namespace: map[string]interface{}{"method": "test.UserService/Unknown", "descriptor_sets": []string{name}}},
+		{Namespace: map[string]interface{}{"method": "test.UserService/GetUser", "descriptor_sets": []string{name + ".unknown"}}},
+	} {
+		called := false
+		NewBackendFactory(logging.NoOp, nil, func(_ *config.Backend) proxy.Proxy {
+			called = true
+			return proxy.NoopProxy
+		})(&config.Backend{ExtraConfig: extra})
+		if !called {
+			t.Errorf("the next backend factory should be called for %v", extra)
+		}
+	}
+}
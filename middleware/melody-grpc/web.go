@@ -0,0 +1,122 @@
+package grpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+
+	"melody/transport/http/client"
+)
+
+const (
+	webContentType  = "application/grpc-web+proto"
+	webTrailerFlag  = 0x80
+	webCompressFlag = 0x01
+)
+
+var errMalformedWebResponse = errors.New("grpc: malformed grpc-web response")
+
+// webInvoker 使用gRPC-Web协议调用method
+// 请求和响应的body都是 1字节标志位 + 4字节长度 + 数据 的帧, 标志位最高位为1的帧是trailer
+func webInvoker(re client.HTTPRequestExecutor) invoker {
+	return func(ctx context.Context, target *url.URL, method string, md metadata.MD, in []byte) ([]byte, error) {
+		u := *target
+		u.Path = method
+		u.RawPath = ""
+		u.RawQuery = ""
+
+		req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(webFrame(0, in)))
+		if err != nil {
+			return nil, err
+		}
+		for k, vs := range md {
+			for _, v := range vs {
+				req.Header.Add(k, v)
+			}
+		}
+		req.Header.Set("Content-Type", webContentType)
+		req.Header.Set("Accept", webContentType)
+		req.Header.Set("X-Grpc-Web", "1")
+
+		resp, err := re(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		// 只有trailer的响应, 状态在响应头中
+		if err := webStatus(resp.Header); err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, client.InvalidStatusCodeError{Code: resp.StatusCode}
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		var out []byte
+		for len(body) > 0 {
+			if len(body) < 5 {
+				return nil, errMalformedWebResponse
+			}
+			flag, size := body[0], binary.BigEndian.Uint32(body[1:5])
+			if uint32(len(body)-5) < size {
+				return nil, errMalformedWebResponse
+			}
+			data := body[5 : 5+size]
+			body = body[5+size:]
+
+			if flag&webTrailerFlag != 0 {
+				trailer, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(append(data, '\r', '\n')))).ReadMIMEHeader()
+				if err != nil {
+					return nil, errMalformedWebResponse
+				}
+				if err := webStatus(http.Header(trailer)); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if flag&webCompressFlag != 0 {
+				return nil, errors.New("grpc: compressed grpc-web messages are not supported")
+			}
+			out = data
+		}
+		return out, nil
+	}
+}
+
+func webFrame(flag byte, data []byte) []byte {
+	b := make([]byte, 5, 5+len(data))
+	b[0] = flag
+	binary.BigEndian.PutUint32(b[1:], uint32(len(data)))
+	return append(b, data...)
+}
+
+func webStatus(h http.Header) error {
+	s := strings.TrimSpace(h.Get("Grpc-Status"))
+	if s == "" || s == "0" {
+		return nil
+	}
+	code, err := strconv.Atoi(s)
+	if err != nil {
+		return errMalformedWebResponse
+	}
+	msg, err := url.PathUnescape(h.Get("Grpc-Message"))
+	if err != nil {
+		msg = h.Get("Grpc-Message")
+	}
+	return Error{Code: codes.Code(code), Message: msg}
+}
@@ -124,6 +124,9 @@ func TokenSignatureValidator(hf melodygin.HandlerFactory, logger logging.Logger,
 				return
 			}
 
+			// 供backend的路由条件使用
+			c.Set(proxy.JWTClaimsKey, claims)
+
 			handler(c)
 		}
 	}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"melody/config"
 	"melody/logging"
+	"melody/proxy"
+	"melody/sd"
 	"time"
 
 	"github.com/rcrowley/go-metrics"
@@ -71,6 +73,12 @@ func New(ctx context.Context, e config.ExtraConfig, logger logging.Logger) *Metr
 	}
 
 	m.processMetrics(ctx, m.Config.CollectionTime, logger) // melody.service.
+	// backend host的健康状态                                   // melody.sd.
+	sd.SetHealthCheckRegistry(metrics.NewPrefixedChildRegistry(registry, "sd."))
+	// backend对冲请求的次数与胜出次数                              // melody.proxy.hedge.
+	proxy.SetHedgingRegistry(metrics.NewPrefixedChildRegistry(registry, "proxy."))
+	// endpoint与backend的并发限制状态                             // melody.proxy.concurrency.
+	proxy.SetConcurrencyRegistry(metrics.NewPrefixedChildRegistry(registry, "proxy."))
 
 	return &m
 }
@@ -1,10 +1,14 @@
 package viper
 
 import (
-	"github.com/spf13/viper"
-	"melody/config"
+	"fmt"
 	"reflect"
+	"strings"
 	"unsafe"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+	"melody/config"
 )
 
 //ViperParser extends viper
@@ -29,7 +33,7 @@ func (p ViperParser) Parse(configFile string) (config.ServiceConfig, error) {
 		return cfg, checkErr(err, configFile)
 	}
 
-	if err := p.viper.Unmarshal(&cfg); err != nil {
+	if err := p.viper.Unmarshal(&cfg, viper.DecodeHook(decodeHook)); err != nil {
 		return cfg, checkErr(err, configFile)
 	}
 
@@ -40,6 +44,43 @@ func (p ViperParser) Parse(configFile string) (config.ServiceConfig, error) {
 	return cfg, nil
 }
 
+// decodeHook 在viper默认的hook之外, 允许endpoint的method配置为列表
+var decodeHook = mapstructure.ComposeDecodeHookFunc(
+	mapstructure.StringToTimeDurationHookFunc(),
+	mapstructure.StringToSliceHookFunc(","),
+	endpointMethodHook,
+)
+
+var endpointConfigType = reflect.TypeOf(config.EndpointConfig{})
+
+// endpointMethodHook 把 "method": ["GET", "HEAD"] 转换为 "GET,HEAD"
+func endpointMethodHook(_ reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	if to.Kind() == reflect.Ptr {
+		to = to.Elem()
+	}
+	if to != endpointConfigType {
+		return data, nil
+	}
+	m, ok := data.(map[string]interface{})
+	if !ok {
+		return data, nil
+	}
+	methods, ok := m["method"].([]interface{})
+	if !ok {
+		return data, nil
+	}
+	res := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		res[k] = v
+	}
+	parts := make([]string, len(methods))
+	for i, v := range methods {
+		parts[i] = fmt.Sprintf("%v", v)
+	}
+	res["method"] = strings.Join(parts, ",")
+	return res, nil
+}
+
 func checkErr(err error, configFile string) error {
 	switch e := err.(type) {
 	case viper.ConfigParseError:
@@ -0,0 +1,239 @@
+package gin
+
+import (
+	"errors"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"melody/config"
+	"melody/logging"
+	"melody/middleware/melody-ratelimit/juju"
+	melodywebsocket "melody/middleware/melody-websocket"
+	"melody/proxy"
+	melodygin "melody/router/gin"
+	"melody/sd"
+)
+
+var (
+	errUpgradeRequired = errors.New("websocket upgrade required")
+	errRateLimited     = errors.New("rate limit exceeded")
+)
+
+// 由gorilla/websocket在握手时自行设置的请求头
+var handshakeHeaders = []string{
+	"Upgrade",
+	"Connection",
+	"Sec-Websocket-Key",
+	"Sec-Websocket-Version",
+	"Sec-Websocket-Extensions",
+	"Sec-Websocket-Protocol",
+}
+
+const closeTimeout = time.Second
+
+// New 为配置了melody_websocket的endpoint返回websocket处理程序
+// 它需要放在handler工厂链的最内层，这样握手请求依然会经过jose、限流等外层的处理程序
+func New(hf melodygin.HandlerFactory, l logging.Logger) melodygin.HandlerFactory {
+	return func(cfg *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+		wsCfg, err := melodywebsocket.ParseConfig(cfg.ExtraConfig)
+		if err == melodywebsocket.ErrNoConfig {
+			return hf(cfg, p)
+		}
+		if err != nil {
+			l.Warning("websocket: ", err.Error())
+			return hf(cfg, p)
+		}
+		if len(cfg.Backends) != 1 {
+			l.Warning("websocket: the endpoint", cfg.Endpoint, "must have exactly one backend")
+			return hf(cfg, p)
+		}
+		backend := cfg.Backends[0]
+		// 复用proxy为backend构建的subscriber, 与http请求共享健康检查与per-host熔断的状态
+		subscriber, ok := sd.BackendSubscriber(backend)
+		if !ok {
+			subscriber = sd.NewHealthCheckSubscriber(backend, sd.GetSubscriber(backend))
+		}
+		return handler(cfg, wsCfg, subscriber, sd.GetBalancer(backend, subscriber), l)
+	}
+}
+
+func handler(cfg *config.EndpointConfig, wsCfg melodywebsocket.Config, subscriber sd.Subscriber, lb sd.Balancer, l logging.Logger) gin.HandlerFunc {
+	reporter, isReporter := subscriber.(sd.HealthReporter)
+	requestGenerator := melodygin.NewRequest(cfg.HeadersToPass)
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  wsCfg.ReadBufferSize,
+		WriteBufferSize: wsCfg.WriteBufferSize,
+		CheckOrigin:     checkOrigin(wsCfg.AllowedOrigins),
+	}
+	tracking, isTracking := lb.(sd.TrackingBalancer)
+
+	return func(c *gin.Context) {
+		if !websocket.IsWebSocketUpgrade(c.Request) {
+			c.AbortWithError(http.StatusBadRequest, errUpgradeRequired)
+			return
+		}
+
+		host, err := lb.Host()
+		if err != nil {
+			c.AbortWithError(http.StatusServiceUnavailable, err)
+			return
+		}
+		if isTracking {
+			defer tracking.Release(host)
+		}
+		done, err := sd.Admit(subscriber, host)
+		if err != nil {
+			c.AbortWithError(http.StatusServiceUnavailable, err)
+			return
+		}
+
+		r := requestGenerator(c, cfg.QueryString)
+		r.GeneratePath(cfg.Backends[0].URLPattern)
+		target, err := backendURL(host, r)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		dialer := websocket.Dialer{
+			Proxy:            http.ProxyFromEnvironment,
+			HandshakeTimeout: cfg.Timeout,
+			ReadBufferSize:   wsCfg.ReadBufferSize,
+			WriteBufferSize:  wsCfg.WriteBufferSize,
+			Subprotocols:     websocket.Subprotocols(c.Request),
+		}
+		begin := time.Now()
+		backendConn, resp, err := dialer.DialContext(c.Request.Context(), target, requestHeaders(r.Headers))
+		// 握手的结果交给被动健康检查与熔断器, 客户端取消时不认为backend异常
+		healthy := err == nil || c.Request.Context().Err() != nil || (resp != nil && resp.StatusCode < http.StatusInternalServerError)
+		if isReporter {
+			reporter.Report(host, healthy, time.Since(begin))
+		}
+		done(healthy, time.Since(begin))
+		if err != nil {
+			status := http.StatusBadGateway
+			if resp != nil && resp.StatusCode >= http.StatusBadRequest {
+				status = resp.StatusCode
+			}
+			l.Warning("websocket: unable to dial", target, err.Error())
+			c.AbortWithError(status, err)
+			return
+		}
+
+		var responseHeader http.Header
+		if subprotocol := backendConn.Subprotocol(); subprotocol != "" {
+			responseHeader = http.Header{"Sec-Websocket-Protocol": {subprotocol}}
+		}
+		// 握手失败时 Upgrade 已经向客户端返回了错误
+		clientConn, err := upgrader.Upgrade(c.Writer, c.Request, responseHeader)
+		if err != nil {
+			backendConn.Close()
+			return
+		}
+
+		pipe(clientConn, backendConn, wsCfg)
+	}
+}
+
+// pipe 双向转发消息，任意一个方向结束时把关闭原因转发给两端
+func pipe(client, backend *websocket.Conn, cfg melodywebsocket.Config) {
+	if cfg.MaxMessageSize > 0 {
+		client.SetReadLimit(cfg.MaxMessageSize)
+	}
+	allow := func() bool { return true }
+	if cfg.MessageRate > 0 {
+		allow = juju.NewLimiter(cfg.MessageRate, cfg.MessageBurst).Allow
+	}
+
+	errc := make(chan error, 2)
+	go func() { errc <- copyMessages(backend, client, allow) }()
+	go func() { errc <- copyMessages(client, backend, func() bool { return true }) }()
+
+	msg := closeMessage(<-errc)
+	deadline := time.Now().Add(closeTimeout)
+	client.WriteControl(websocket.CloseMessage, msg, deadline)
+	backend.WriteControl(websocket.CloseMessage, msg, deadline)
+	client.Close()
+	backend.Close()
+	<-errc
+}
+
+func copyMessages(dst, src *websocket.Conn, allow func() bool) error {
+	for {
+		messageType, msg, err := src.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if !allow() {
+			return errRateLimited
+		}
+		if err := dst.WriteMessage(messageType, msg); err != nil {
+			return err
+		}
+	}
+}
+
+func closeMessage(err error) []byte {
+	if e, ok := err.(*websocket.CloseError); ok {
+		if e.Code == websocket.CloseNoStatusReceived || e.Code == websocket.CloseAbnormalClosure {
+			return websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+		}
+		return websocket.FormatCloseMessage(e.Code, e.Text)
+	}
+	switch err {
+	case errRateLimited:
+		return websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error())
+	case websocket.ErrReadLimit:
+		return websocket.FormatCloseMessage(websocket.CloseMessageTooBig, "")
+	}
+	return websocket.FormatCloseMessage(websocket.CloseGoingAway, "")
+}
+
+func backendURL(host string, r *proxy.Request) (string, error) {
+	u, err := url.Parse(host + r.Path)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "https", "wss":
+		u.Scheme = "wss"
+	default:
+		u.Scheme = "ws"
+	}
+	if len(r.Query) > 0 {
+		u.RawQuery = r.Query.Encode()
+	}
+	return u.String(), nil
+}
+
+func requestHeaders(headers map[string][]string) http.Header {
+	res := make(http.Header, len(headers))
+	for k, vs := range headers {
+		res[textproto.CanonicalMIMEHeaderKey(k)] = vs
+	}
+	for _, k := range handshakeHeaders {
+		delete(res, k)
+	}
+	return res
+}
+
+func checkOrigin(origins []string) func(*http.Request) bool {
+	if len(origins) == 0 {
+		// 使用gorilla/websocket默认的同源检查
+		return nil
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		for _, o := range origins {
+			if o == "*" || strings.EqualFold(o, origin) {
+				return true
+			}
+		}
+		return false
+	}
+}
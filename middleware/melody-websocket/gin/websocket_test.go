@@ -0,0 +1,244 @@
+package gin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"melody/config"
+	"melody/logging"
+	melodywebsocket "melody/middleware/melody-websocket"
+	"melody/proxy"
+	"melody/sd"
+)
+
+func newEchoBackend(t *testing.T) *httptest.Server {
+	upgrader := websocket.Upgrader{Subprotocols: []string{"chat"}}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/echo/42" || r.URL.Query().Get("a") != "1" || r.Header.Get("X-Test") != "ok" {
+			t.Errorf("unexpected handshake request: %s %v", r.URL, r.Header)
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			messageType, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(messageType, msg); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+func newGateway(backendURL string, cfg map[string]interface{}) *httptest.Server {
+	return serveEndpoint(newEndpoint(backendURL, cfg))
+}
+
+func newEndpoint(backendURL string, cfg map[string]interface{}) *config.EndpointConfig {
+	return &config.EndpointConfig{
+		Endpoint:      "/ws/:id",
+		HeadersToPass: []string{"X-Test"},
+		QueryString:   []string{"a"},
+		Backends: []*config.Backend{
+			{
+				Host:       []string{backendURL},
+				URLPattern: "/echo/{{.Id}}",
+			},
+		},
+		ExtraConfig: config.ExtraConfig{melodywebsocket.Namespace: cfg},
+	}
+}
+
+func serveEndpoint(endpoint *config.EndpointConfig) *httptest.Server {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	next := func(_ *config.EndpointConfig, _ proxy.Proxy) gin.HandlerFunc {
+		return func(c *gin.Context) { c.String(http.StatusTeapot, "not a websocket endpoint") }
+	}
+	engine.GET(endpoint.Endpoint, New(next, logging.NoOp)(endpoint, proxy.NoopProxy))
+	return httptest.NewServer(engine)
+}
+
+func dial(t *testing.T, server *httptest.Server) *websocket.Conn {
+	dialer := websocket.Dialer{Subprotocols: []string{"chat"}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/42?a=1&b=2", http.Header{"X-Test": {"ok"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.Subprotocol() != "chat" {
+		t.Errorf("unexpected subprotocol %q", conn.Subprotocol())
+	}
+	return conn
+}
+
+func TestNew(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+	gateway := newGateway(backend.URL, map[string]interface{}{})
+	defer gateway.Close()
+
+	conn := dial(t, gateway)
+	defer conn.Close()
+
+	for _, msg := range []string{"hello", "world"} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		_, resp, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(resp) != msg {
+			t.Errorf("unexpected message %q", string(resp))
+		}
+	}
+
+	resp, err := http.Get(gateway.URL + "/ws/42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+}
+
+func TestNew_noConfig(t *testing.T) {
+	next := func(_ *config.EndpointConfig, _ proxy.Proxy) gin.HandlerFunc {
+		return func(c *gin.Context) { c.String(http.StatusTeapot, "") }
+	}
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.GET("/", New(next, logging.NoOp)(&config.EndpointConfig{}, proxy.NoopProxy))
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusTeapot {
+		t.Errorf("unexpected status code %d", w.Code)
+	}
+}
+
+func TestNew_limits(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	for _, tc := range []struct {
+		name     string
+		cfg      map[string]interface{}
+		messages []string
+		code     int
+	}{
+		{
+			name:     "max_message_size",
+			cfg:      map[string]interface{}{"max_message_size": 4},
+			messages: []string{"1234", "12345"},
+			code:     websocket.CloseMessageTooBig,
+		},
+		{
+			name:     "message_rate",
+			cfg:      map[string]interface{}{"message_rate": 0.001, "message_burst": 2},
+			messages: []string{"1", "2", "3"},
+			code:     websocket.ClosePolicyViolation,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gateway := newGateway(backend.URL, tc.cfg)
+			defer gateway.Close()
+
+			conn := dial(t, gateway)
+			defer conn.Close()
+
+			for i, msg := range tc.messages {
+				if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+					t.Fatal(err)
+				}
+				_, _, err := conn.ReadMessage()
+				if i < len(tc.messages)-1 {
+					if err != nil {
+						t.Fatal(err)
+					}
+					continue
+				}
+				if !websocket.IsCloseError(err, tc.code) {
+					t.Errorf("unexpected error %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestNew_backendUnavailable(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer backend.Close()
+	gateway := newGateway(backend.URL, map[string]interface{}{})
+	defer gateway.Close()
+
+	_, resp, err := websocket.DefaultDialer.DialContext(context.Background(), "ws"+strings.TrimPrefix(gateway.URL, "http")+"/ws/42", nil)
+	if err == nil {
+		t.Fatal("expecting an error")
+	}
+	if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unexpected response %v", resp)
+	}
+}
+
+// recordingSubscriber 记录握手的许可与结果
+type recordingSubscriber struct {
+	sd.FixedSubscriber
+	admitErr error
+	mu       sync.Mutex
+	admitted []string
+	reports  []bool
+}
+
+func (r *recordingSubscriber) Admit(target string) (func(bool, time.Duration), error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.admitted = append(r.admitted, target)
+	return func(bool, time.Duration) {}, r.admitErr
+}
+
+func (r *recordingSubscriber) Report(_ string, healthy bool, _ time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reports = append(r.reports, healthy)
+}
+
+func TestNew_backendSubscriber(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+
+	endpoint := newEndpoint(backend.URL, map[string]interface{}{})
+	subscriber := &recordingSubscriber{FixedSubscriber: sd.FixedSubscriber{backend.URL}}
+	// proxy为backend构建的subscriber
+	sd.RegisterBackendSubscriber(endpoint.Backends[0], subscriber)
+	gateway := serveEndpoint(endpoint)
+	defer gateway.Close()
+
+	dial(t, gateway).Close()
+	subscriber.mu.Lock()
+	if len(subscriber.admitted) != 1 || subscriber.admitted[0] != backend.URL || len(subscriber.reports) != 1 || !subscriber.reports[0] {
+		t.Errorf("unexpected admissions %v and reports %v", subscriber.admitted, subscriber.reports)
+	}
+	subscriber.admitErr = errors.New("breaker is open")
+	subscriber.mu.Unlock()
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(gateway.URL, "http")+"/ws/42?a=1", http.Header{"X-Test": {"ok"}})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("unexpected response %v: %v", resp, err)
+	}
+}
@@ -0,0 +1,52 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+
+	"melody/config"
+)
+
+// Namespace 命名空间
+const Namespace = "melody_websocket"
+
+// ErrNoConfig 当没有为模块定义配置时，将返回ErrNoConfig
+var ErrNoConfig = errors.New("no config defined for the module")
+
+// Config websocket endpoint的配置
+type Config struct {
+	// 客户端单条消息的最大字节数，0表示不限制
+	MaxMessageSize int64 `json:"max_message_size"`
+	// 每个连接每秒允许客户端发送的消息数，0表示不限制
+	MessageRate float64 `json:"message_rate"`
+	// 令牌桶容量，默认与message_rate相同
+	MessageBurst int64 `json:"message_burst"`
+	// 读写缓冲区大小，0时使用默认值
+	ReadBufferSize  int `json:"read_buffer_size"`
+	WriteBufferSize int `json:"write_buffer_size"`
+	// 允许握手的Origin，"*"表示全部允许，为空时只允许同源的请求
+	AllowedOrigins []string `json:"allowed_origins"`
+}
+
+// ParseConfig 从ExtraConfig中提取websocket的配置
+func ParseConfig(cfg config.ExtraConfig) (Config, error) {
+	res := Config{}
+	e, ok := cfg[Namespace]
+	if !ok {
+		return res, ErrNoConfig
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return res, err
+	}
+	if err := json.Unmarshal(b, &res); err != nil {
+		return res, err
+	}
+	if res.MessageRate > 0 && res.MessageBurst <= 0 {
+		res.MessageBurst = int64(res.MessageRate)
+		if res.MessageBurst < 1 {
+			res.MessageBurst = 1
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,30 @@
+package websocket
+
+import (
+	"testing"
+
+	"melody/config"
+)
+
+func TestParseConfig(t *testing.T) {
+	if _, err := ParseConfig(config.ExtraConfig{}); err != ErrNoConfig {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	cfg, err := ParseConfig(config.ExtraConfig{
+		Namespace: map[string]interface{}{
+			"max_message_size": 1024,
+			"message_rate":     2.5,
+			"allowed_origins":  []string{"*"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MaxMessageSize != 1024 || cfg.MessageRate != 2.5 || cfg.MessageBurst != 2 {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+	if len(cfg.AllowedOrigins) != 1 || cfg.AllowedOrigins[0] != "*" {
+		t.Errorf("unexpected origins %v", cfg.AllowedOrigins)
+	}
+}
@@ -2,25 +2,52 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"melody/sd"
+	"net/textproto"
 	"net/url"
 	"strings"
+	"sync"
+	"time"
 )
 
 func NewLoadBalancedMiddlewareWithSubscriber(subscriber sd.Subscriber) Middleware {
 	return newLoadBalancedMiddleware(sd.NewBalancer(subscriber))
 }
 
+// NewLoadBalancedMiddlewareWithBalancer 使用指定的balancer选择host
+func NewLoadBalancedMiddlewareWithBalancer(lb sd.Balancer) Middleware {
+	return newLoadBalancedMiddleware(lb)
+}
+
 func newLoadBalancedMiddleware(lb sd.Balancer) Middleware {
+	tracking, isTracking := lb.(sd.TrackingBalancer)
 	return func(next ...Proxy) Proxy {
 		if len(next) > 1 {
 			panic(ErrTooManyProxies)
 		}
 		return func(ctx context.Context, request *Request) (*Response, error) {
-			host, err := lb.Host()
+			host, err := selectHost(lb, request)
 			if err != nil {
 				return nil, err
 			}
+			if used, ok := ctx.Value(hedgedHostsKey{}).(*hedgedHosts); ok {
+				// 对冲请求尽量选择其他尝试没有使用过的host
+				for i := 0; i < maxHedgedHostSelections && used.contains(host); i++ {
+					next, err := selectHost(lb, request)
+					if err != nil {
+						break
+					}
+					if isTracking {
+						tracking.Release(host)
+					}
+					host = next
+				}
+				used.add(host)
+			}
+			if isTracking {
+				defer tracking.Release(host)
+			}
 			r := request.Clone()
 
 			var b strings.Builder
@@ -38,3 +65,89 @@ func newLoadBalancedMiddleware(lb sd.Balancer) Middleware {
 		}
 	}
 }
+
+// NewHealthReportMiddleware 当subscriber支持被动健康检查时, 将它放入context
+// 由 NewHTTPProxyDetailed 上报每一次请求的结果
+// subscriber实现了 sd.HostAdmitter 时, 在发送请求之前为选中的host获取许可, 请求的结果按照该许可上报
+func NewHealthReportMiddleware(subscriber sd.Subscriber) Middleware {
+	reporter, isReporter := subscriber.(sd.HealthReporter)
+	admitter, isAdmitter := subscriber.(sd.HostAdmitter)
+	if !isReporter && !isAdmitter {
+		return EmptyMiddleware
+	}
+	return func(next ...Proxy) Proxy {
+		if len(next) > 1 {
+			panic(ErrTooManyProxies)
+		}
+		return func(ctx context.Context, request *Request) (*Response, error) {
+			if isReporter {
+				ctx = context.WithValue(ctx, healthReporterKey{}, reporter)
+			}
+			if !isAdmitter {
+				return next[0](ctx, request)
+			}
+			done, err := admitter.Admit(request.URL.String())
+			if err != nil {
+				return nil, err
+			}
+			t := &hostTicket{done: done}
+			begin := time.Now()
+			resp, err := next[0](context.WithValue(ctx, hostTicketKey{}, t), request)
+			// backend没有上报结果时(例如请求被取消), 根据返回的错误上报, 避免ticket一直被占用
+			t.report(err == nil || errors.Is(err, context.Canceled), time.Since(begin))
+			return resp, err
+		}
+	}
+}
+
+type healthReporterKey struct{}
+
+type hostTicketKey struct{}
+
+// hostTicket 发送请求之前获取的许可, 只上报一次结果
+type hostTicket struct {
+	once sync.Once
+	done func(healthy bool, latency time.Duration)
+}
+
+func (t *hostTicket) report(healthy bool, latency time.Duration) {
+	t.once.Do(func() { t.done(healthy, latency) })
+}
+
+// ReportHealth 上报一次请求的结果, 没有经过 NewHealthReportMiddleware 时不做任何处理
+// 不通过 NewHTTPProxyDetailed 发送请求的backend(例如gRPC)使用它接入被动健康检查和熔断器
+func ReportHealth(ctx context.Context, target string, healthy bool, latency time.Duration) {
+	if reporter, ok := ctx.Value(healthReporterKey{}).(sd.HealthReporter); ok {
+		reporter.Report(target, healthy, latency)
+	}
+	if t, ok := ctx.Value(hostTicketKey{}).(*hostTicket); ok {
+		t.report(healthy, latency)
+	}
+}
+
+func selectHost(lb sd.Balancer, request *Request) (string, error) {
+	kb, ok := lb.(sd.KeyedBalancer)
+	if !ok {
+		return lb.Host()
+	}
+	return kb.HostByKey(hashKeyValue(kb.HashKey(), request))
+}
+
+// hashKeyValue 从请求中取出一致性hash使用的值
+// header 需要同时配置在 headers_to_pass 中才会传递到这一层
+func hashKeyValue(key sd.HashKey, request *Request) string {
+	if key.Header != "" {
+		if v, ok := requestHeader(request, key.Header, textproto.CanonicalMIMEHeaderKey(key.Header)); ok {
+			return v
+		}
+	}
+	if key.Param != "" {
+		if v, ok := request.Params[strings.Title(key.Param)]; ok {
+			return v
+		}
+	}
+	if key.Query != "" {
+		return request.Query.Get(key.Query)
+	}
+	return ""
+}
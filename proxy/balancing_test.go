@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"melody/config"
+	"melody/encoding"
+	"melody/sd"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type trackingBalancer struct {
+	host     string
+	released []string
+}
+
+func (t *trackingBalancer) Host() (string, error) { return t.host, nil }
+
+func (t *trackingBalancer) Release(host string) { t.released = append(t.released, host) }
+
+func TestNewLoadBalancedMiddlewareWithBalancer_release(t *testing.T) {
+	lb := &trackingBalancer{host: "http://127.0.0.1:8080"}
+	var calls int
+	p := NewLoadBalancedMiddlewareWithBalancer(lb)(func(_ context.Context, r *Request) (*Response, error) {
+		calls++
+		if r.URL.Host != "127.0.0.1:8080" || r.URL.Path != "/a" || r.URL.Query().Get("b") != "1" {
+			t.Errorf("unexpected url: %s", r.URL.String())
+		}
+		if len(lb.released) != 0 {
+			t.Error("the host was released before the request finished")
+		}
+		return &Response{}, nil
+	})
+
+	p(context.Background(), &Request{Path: "/a", Query: url.Values{"b": {"1"}}})
+	if calls != 1 {
+		t.Errorf("unexpected number of calls: %d", calls)
+	}
+	if len(lb.released) != 1 || lb.released[0] != lb.host {
+		t.Errorf("unexpected released hosts: %v", lb.released)
+	}
+}
+
+func TestNewLoadBalancedMiddlewareWithBalancer_consistentHash(t *testing.T) {
+	hosts := sd.FixedSubscriber{"http://a", "http://b", "http://c"}
+	for _, subject := range []struct {
+		key     sd.HashKey
+		request *Request
+	}{
+		{sd.HashKey{Header: "x-user-id"}, &Request{Headers: map[string][]string{"X-User-Id": {"42"}}}},
+		{sd.HashKey{Param: "id"}, &Request{Params: map[string]string{"Id": "42"}}},
+		{sd.HashKey{Query: "uid"}, &Request{Query: url.Values{"uid": {"42"}}}},
+	} {
+		lb := sd.NewConsistentHashLB(hosts, subject.key, 0)
+		expected, _ := lb.HostByKey("42")
+
+		var host string
+		p := NewLoadBalancedMiddlewareWithBalancer(lb)(func(_ context.Context, r *Request) (*Response, error) {
+			host = r.URL.Scheme + "://" + r.URL.Host
+			return &Response{}, nil
+		})
+		for i := 0; i < 10; i++ {
+			p(context.Background(), subject.request)
+			if host != expected {
+				t.Errorf("%v: unexpected host. have: %s, want: %s", subject.key, host, expected)
+			}
+		}
+	}
+}
+
+type recordingReporter struct {
+	sd.Subscriber
+	reports map[string][]bool
+}
+
+func (r *recordingReporter) Report(target string, healthy bool, _ time.Duration) {
+	r.reports[target] = append(r.reports[target], healthy)
+}
+
+func TestNewHealthReportMiddleware(t *testing.T) {
+	status := http.StatusOK
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte("{}"))
+	}))
+	defer backendServer.Close()
+
+	reporter := &recordingReporter{sd.FixedSubscriber{backendServer.URL}, map[string][]bool{}}
+	backend := &config.Backend{Decoder: encoding.JSONDecoder()}
+	p := NewHealthReportMiddleware(reporter)(HTTPProxyFactory(http.DefaultClient)(backend))
+	p = NewLoadBalancedMiddlewareWithBalancer(sd.NewRoundRobinLB(reporter))(p)
+
+	for _, s := range []int{http.StatusOK, http.StatusNotFound, http.StatusBadGateway} {
+		status = s
+		p(context.Background(), &Request{Method: "GET", Path: "/a"})
+	}
+	backendServer.Close()
+	p(context.Background(), &Request{Method: "GET", Path: "/a"})
+
+	reports := reporter.reports[backendServer.URL+"/a"]
+	expected := []bool{true, true, false, false}
+	if len(reports) != len(expected) {
+		t.Errorf("unexpected reports: %v", reporter.reports)
+		return
+	}
+	for i := range expected {
+		if reports[i] != expected[i] {
+			t.Errorf("unexpected reports. have: %v, want: %v", reports, expected)
+		}
+	}
+
+	if mw := NewHealthReportMiddleware(sd.FixedSubscriber{}); mw(NoopProxy) == nil {
+		t.Error("unexpected nil proxy")
+	}
+}
+
+// admittingSubscriber 只允许一个正在进行的请求
+type admittingSubscriber struct {
+	sd.Subscriber
+	inFlight int
+	results  []bool
+}
+
+func (a *admittingSubscriber) Admit(_ string) (func(bool, time.Duration), error) {
+	if a.inFlight > 0 {
+		return nil, errAdmission
+	}
+	a.inFlight++
+	return func(healthy bool, _ time.Duration) {
+		a.inFlight--
+		a.results = append(a.results, healthy)
+	}, nil
+}
+
+var errAdmission = errors.New("not admitted")
+
+func TestNewHealthReportMiddleware_admitter(t *testing.T) {
+	subscriber := &admittingSubscriber{Subscriber: sd.FixedSubscriber{"http://a"}}
+	var inner Proxy
+	p := NewHealthReportMiddleware(subscriber)(func(ctx context.Context, r *Request) (*Response, error) {
+		return inner(ctx, r)
+	})
+	p = NewLoadBalancedMiddlewareWithBalancer(sd.NewRoundRobinLB(subscriber))(p)
+
+	// 请求发送之前获取许可, 结果按照许可上报一次
+	inner = func(ctx context.Context, r *Request) (*Response, error) {
+		if _, err := p(ctx, &Request{Method: "GET", Path: "/b"}); err != errAdmission {
+			t.Errorf("unexpected error: %v", err)
+		}
+		ReportHealth(ctx, r.URL.String(), false, 0)
+		ReportHealth(ctx, r.URL.String(), true, 0)
+		return nil, errors.New("boom")
+	}
+	p(context.Background(), &Request{Method: "GET", Path: "/a"})
+
+	// backend没有上报时根据返回的错误上报
+	inner = func(ctx context.Context, _ *Request) (*Response, error) {
+		return nil, context.Canceled
+	}
+	p(context.Background(), &Request{Method: "GET", Path: "/a"})
+
+	if subscriber.inFlight != 0 || len(subscriber.results) != 2 || subscriber.results[0] || !subscriber.results[1] {
+		t.Errorf("unexpected results: %v", subscriber.results)
+	}
+}
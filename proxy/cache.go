@@ -0,0 +1,482 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"melody/config"
+	"melody/encoding"
+	"melody/transport/http/client"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+const (
+	cacheKey             = "cache"
+	defaultCacheStore    = "memory"
+	defaultCacheTTL      = time.Minute
+	defaultCacheEntries  = 1024
+	defaultCacheMaxBytes = 64 << 20
+)
+
+var responseCaches = initResponseCaches()
+
+// 携带用户凭证的请求头
+var credentialHeaders = []string{"Authorization", "Cookie"}
+
+// CacheEntry 是缓存中保存的一个响应
+type CacheEntry struct {
+	Response *Response
+	// Body 保存了noop编码时Response.Io中的内容
+	Body       []byte
+	ETag       string
+	Expires    time.Time
+	StaleUntil time.Time
+	Size       int
+}
+
+// ResponseCache 定义了响应缓存的存储, 实现必须是并发安全的
+type ResponseCache interface {
+	Get(key string) (*CacheEntry, bool)
+	Set(key string, entry *CacheEntry)
+}
+
+// ResponseCacheFactory 根据最大条目数和最大字节数创建ResponseCache
+type ResponseCacheFactory func(maxEntries, maxBytes int) ResponseCache
+
+type cacheConfig struct {
+	TTL                  time.Duration
+	StaleWhileRevalidate time.Duration
+	MaxEntries           int
+	MaxBytes             int
+	Headers              []string
+	QueryStrings         []string
+	Store                string
+}
+
+// NewEndpointCacheMiddleware 在endpoint层缓存完整的响应
+// 缓存key由请求方法、endpoint、路径参数、白名单内的query string和请求头组成
+func NewEndpointCacheMiddleware(endpoint *config.EndpointConfig) Middleware {
+	cfg, ok := getCacheConfig(endpoint.ExtraConfig)
+	// 流式的响应不会被缓存
+	if !ok || endpoint.OutputEncoding == encoding.STREAM {
+		return EmptyMiddleware
+	}
+	return newCacheMiddleware(cfg, endpoint.Timeout, func(r *Request) string {
+		return cfg.key(r, endpoint.Endpoint, r.Params)
+	})
+}
+
+// NewBackendCacheMiddleware 在backend层缓存单个backend的响应
+// 会遵循backend返回的Cache-Control, 并使用ETag重新验证过期的缓存
+func NewBackendCacheMiddleware(backend *config.Backend) Middleware {
+	cfg, ok := getCacheConfig(backend.ExtraConfig)
+	if !ok || backend.Encoding == encoding.STREAM {
+		return EmptyMiddleware
+	}
+	return newCacheMiddleware(cfg, backend.Timeout, func(r *Request) string {
+		return cfg.key(r, r.Path, nil)
+	})
+}
+
+func newCacheMiddleware(cfg cacheConfig, timeout time.Duration, key func(*Request) string) Middleware {
+	store := responseCaches.GetResponseCacheFactory(cfg.Store)(cfg.MaxEntries, cfg.MaxBytes)
+	refreshing := &sync.Map{}
+
+	return func(next ...Proxy) Proxy {
+		if len(next) > 1 {
+			panic(ErrTooManyProxies)
+		}
+
+		fetch := func(ctx context.Context, k string, request *Request, stale *CacheEntry) (*Response, error) {
+			r := CloneRequest(request)
+			if stale != nil && stale.ETag != "" {
+				r.Headers["If-None-Match"] = []string{stale.ETag}
+			}
+			hints := &cacheHints{}
+			resp, err := next[0](context.WithValue(ctx, cacheHintsKey{}, hints), r)
+			closeRequest(r)
+
+			if stale != nil && isNotModified(resp, err) {
+				entry := *stale
+				if cfg.refresh(&entry, hints) {
+					store.Set(k, &entry)
+				}
+				return entry.response(), nil
+			}
+			if err != nil || resp == nil || !resp.IsComplete {
+				return resp, err
+			}
+			entry, ok := cfg.newEntry(resp, hints)
+			if !ok {
+				return resp, err
+			}
+			store.Set(k, entry)
+			return entry.response(), nil
+		}
+
+		return func(ctx context.Context, request *Request) (*Response, error) {
+			if request.Method != http.MethodGet && request.Method != http.MethodHead || !cfg.shareable(request) {
+				return next[0](ctx, request)
+			}
+
+			k := key(request)
+			entry, ok := store.Get(k)
+			if !ok {
+				return fetch(ctx, k, request, nil)
+			}
+
+			now := time.Now()
+			if now.Before(entry.Expires) {
+				return entry.response(), nil
+			}
+			if now.After(entry.StaleUntil) {
+				return fetch(ctx, k, request, entry)
+			}
+
+			// stale-while-revalidate: 直接返回旧的响应, 在后台更新缓存
+			if _, loaded := refreshing.LoadOrStore(k, true); !loaded {
+				r := CloneRequest(request)
+				go func() {
+					localCtx, cancel := context.WithTimeout(newcontextWrapper(ctx), timeout)
+					fetch(localCtx, k, r, entry)
+					cancel()
+					refreshing.Delete(k)
+				}()
+			}
+			return entry.response(), nil
+		}
+	}
+}
+
+// key 生成缓存key
+func (c cacheConfig) key(r *Request, path string, params map[string]string) string {
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteByte(' ')
+	b.WriteString(path)
+
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b.WriteString("|p:" + k + "=" + params[k])
+	}
+
+	query := r.Query
+	if c.QueryStrings != nil {
+		query = make(map[string][]string, len(c.QueryStrings))
+		for _, q := range c.QueryStrings {
+			if v, ok := r.Query[q]; ok {
+				query[q] = v
+			}
+		}
+	}
+	if len(query) > 0 {
+		b.WriteString("|q:" + query.Encode())
+	}
+
+	for _, h := range c.Headers {
+		v, ok := r.Headers[h]
+		if !ok {
+			v = r.Headers[textproto.CanonicalMIMEHeaderKey(h)]
+		}
+		b.WriteString("|h:" + h + "=" + strings.Join(v, ","))
+	}
+	return b.String()
+}
+
+// shareable 请求携带了Authorization或者Cookie, 并且它们没有参与缓存key的计算时, 响应可能与用户相关, 不能共享
+func (c cacheConfig) shareable(r *Request) bool {
+	for _, h := range credentialHeaders {
+		if _, ok := r.Headers[h]; !ok {
+			continue
+		}
+		covered := false
+		for _, k := range c.Headers {
+			covered = covered || textproto.CanonicalMIMEHeaderKey(k) == h
+		}
+		if !covered {
+			return false
+		}
+	}
+	return true
+}
+
+// prefixedReader 先返回已经读取的内容, 再读取剩余的响应体, 关闭时关闭原来的响应体
+type prefixedReader struct {
+	io.Reader
+	rest io.Reader
+}
+
+// Close implements the io.Closer interface
+func (p *prefixedReader) Close() error {
+	if rc, ok := p.rest.(io.Closer); ok {
+		return rc.Close()
+	}
+	return nil
+}
+
+func (c cacheConfig) newEntry(resp *Response, hints *cacheHints) (*CacheEntry, bool) {
+	entry := &CacheEntry{Response: cloneResponse(resp)}
+	entry.Response.Io = nil
+	if !c.refresh(entry, hints) {
+		return nil, false
+	}
+
+	if resp.Io != nil {
+		r := resp.Io
+		if c.MaxBytes > 0 {
+			// 最多多读一个字节, 超过上限的响应体不会被完整读入内存
+			r = io.LimitReader(resp.Io, int64(c.MaxBytes)+1)
+		}
+		body, err := ioutil.ReadAll(r)
+		if err != nil || (c.MaxBytes > 0 && len(body) > c.MaxBytes) {
+			// 不缓存, 已经读取的部分与剩余的响应体依然返回给客户端
+			resp.Io = &prefixedReader{Reader: io.MultiReader(bytes.NewReader(body), resp.Io), rest: resp.Io}
+			return nil, false
+		}
+		entry.Body = body
+		entry.Size = len(body)
+		resp.Io = bytes.NewReader(body)
+	} else {
+		b, err := json.Marshal(resp.Data)
+		if err != nil {
+			return nil, false
+		}
+		entry.Size = len(b)
+	}
+
+	return entry, c.MaxBytes <= 0 || entry.Size <= c.MaxBytes
+}
+
+// refresh 根据配置和backend返回的Cache-Control更新过期时间
+// 返回false表示该响应不允许缓存
+func (c cacheConfig) refresh(entry *CacheEntry, hints *cacheHints) bool {
+	ttl, stale := c.TTL, c.StaleWhileRevalidate
+	cacheControl, etag := hints.get()
+	if etag != "" {
+		entry.ETag = etag
+	}
+	// 多个backend的Cache-Control会被合并, 取最严格的值
+	maxAge, swr := -1, -1
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store", directive == "no-cache", directive == "private":
+			return false
+		case strings.HasPrefix(directive, "max-age="):
+			if s, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil && (maxAge < 0 || s < maxAge) {
+				maxAge = s
+			}
+		case strings.HasPrefix(directive, "stale-while-revalidate="):
+			if s, err := strconv.Atoi(strings.TrimPrefix(directive, "stale-while-revalidate=")); err == nil && (swr < 0 || s < swr) {
+				swr = s
+			}
+		}
+	}
+	if maxAge >= 0 {
+		ttl = time.Duration(maxAge) * time.Second
+	}
+	if swr >= 0 {
+		stale = time.Duration(swr) * time.Second
+	}
+	now := time.Now()
+	entry.Expires = now.Add(ttl)
+	entry.StaleUntil = entry.Expires.Add(stale)
+	return true
+}
+
+// response 返回缓存响应的副本
+func (e *CacheEntry) response() *Response {
+	resp := cloneResponse(e.Response)
+	if e.Body != nil {
+		resp.Io = bytes.NewReader(e.Body)
+	}
+	return resp
+}
+
+func isNotModified(resp *Response, err error) bool {
+	if e, ok := err.(client.InvalidStatusCodeError); ok {
+		return e.Code == http.StatusNotModified
+	}
+	return err == nil && resp != nil && resp.Metadata.StatusCode == http.StatusNotModified
+}
+
+type cacheHintsKey struct{}
+
+// cacheHints 收集backend响应中与缓存相关的响应头
+// 通过context传递, 避免将backend的响应头暴露给客户端
+type cacheHints struct {
+	mu           sync.Mutex
+	cacheControl []string
+	etag         string
+	responses    int
+}
+
+// get 返回合并后的Cache-Control, 只有一个backend响应时才返回ETag
+func (h *cacheHints) get() (string, string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.responses != 1 {
+		return strings.Join(h.cacheControl, ","), ""
+	}
+	return strings.Join(h.cacheControl, ","), h.etag
+}
+
+func recordCacheHints(ctx context.Context, resp *http.Response) {
+	h, ok := ctx.Value(cacheHintsKey{}).(*cacheHints)
+	if !ok {
+		return
+	}
+	h.mu.Lock()
+	h.responses++
+	if cc := resp.Header.Get("Cache-Control"); cc != "" {
+		h.cacheControl = append(h.cacheControl, cc)
+	}
+	h.etag = resp.Header.Get("ETag")
+	h.mu.Unlock()
+}
+
+// cloneResponse 深拷贝Response, Io不会被拷贝
+func cloneResponse(r *Response) *Response {
+	if r == nil {
+		return nil
+	}
+	clone := &Response{
+		IsComplete: r.IsComplete,
+		Io:         r.Io,
+		Metadata: Metadata{
+			StatusCode: r.Metadata.StatusCode,
+			Headers:    CloneRequestHeaders(r.Metadata.Headers),
+		},
+	}
+	if r.Data != nil {
+		clone.Data = cloneValue(r.Data).(map[string]interface{})
+	}
+	return clone
+}
+
+func cloneValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			m[k] = cloneValue(v)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(t))
+		for i, v := range t {
+			s[i] = cloneValue(v)
+		}
+		return s
+	case []map[string]interface{}:
+		s := make([]map[string]interface{}, len(t))
+		for i, v := range t {
+			s[i] = cloneValue(v).(map[string]interface{})
+		}
+		return s
+	default:
+		return v
+	}
+}
+
+func getCacheConfig(extra config.ExtraConfig) (cacheConfig, bool) {
+	v, ok := extra[Namespace]
+	if !ok {
+		return cacheConfig{}, ok
+	}
+	e, ok := v.(map[string]interface{})
+	if !ok {
+		return cacheConfig{}, ok
+	}
+	tmp, ok := e[cacheKey].(map[string]interface{})
+	if !ok {
+		return cacheConfig{}, ok
+	}
+
+	cfg := cacheConfig{
+		TTL:                  getDuration(tmp, "ttl", defaultCacheTTL),
+		StaleWhileRevalidate: getDuration(tmp, "stale_while_revalidate", 0),
+		MaxEntries:           getInt(tmp, "max_entries", defaultCacheEntries),
+		MaxBytes:             getInt(tmp, "max_bytes", defaultCacheMaxBytes),
+		Headers:              getStrings(tmp, "headers"),
+		Store:                defaultCacheStore,
+	}
+	if _, ok := tmp["querystring_params"]; ok {
+		cfg.QueryStrings = getStrings(tmp, "querystring_params")
+	}
+	if s, ok := tmp["store"].(string); ok {
+		cfg.Store = s
+	}
+	return cfg, true
+}
+
+func getStrings(m map[string]interface{}, key string) []string {
+	raw, ok := m[key].([]interface{})
+	if !ok {
+		return []string{}
+	}
+	res := make([]string, 0, len(raw))
+	for _, v := range raw {
+		if s, ok := v.(string); ok {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// NewMemoryResponseCache 返回一个基于LRU淘汰策略的进程内缓存
+// 超过最大条目数或最大字节数时, 淘汰最久未使用的条目
+func NewMemoryResponseCache(maxEntries, maxBytes int) ResponseCache {
+	if maxEntries <= 0 {
+		maxEntries = defaultCacheEntries
+	}
+	c := &memoryCache{maxBytes: maxBytes}
+	c.lru, _ = simplelru.NewLRU(maxEntries, func(_ interface{}, v interface{}) {
+		c.bytes -= v.(*CacheEntry).Size
+	})
+	return c
+}
+
+type memoryCache struct {
+	mu       sync.Mutex
+	lru      *simplelru.LRU
+	bytes    int
+	maxBytes int
+}
+
+// Get implements the ResponseCache interface
+func (m *memoryCache) Get(key string) (*CacheEntry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.lru.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return v.(*CacheEntry), true
+}
+
+// Set implements the ResponseCache interface
+func (m *memoryCache) Set(key string, entry *CacheEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lru.Remove(key)
+	m.lru.Add(key, entry)
+	m.bytes += entry.Size
+	for m.maxBytes > 0 && m.bytes > m.maxBytes && m.lru.Len() > 0 {
+		m.lru.RemoveOldest()
+	}
+}
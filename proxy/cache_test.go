@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"melody/config"
+	"melody/transport/http/client"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newCacheExtra(cache map[string]interface{}) config.ExtraConfig {
+	return config.ExtraConfig{
+		Namespace: map[string]interface{}{
+			cacheKey: cache,
+		},
+	}
+}
+
+func hintedProxy(calls *int32, header http.Header, resp func() (*Response, error)) Proxy {
+	return func(ctx context.Context, r *Request) (*Response, error) {
+		atomic.AddInt32(calls, 1)
+		recordCacheHints(ctx, &http.Response{Header: header})
+		return resp()
+	}
+}
+
+func TestNewEndpointCacheMiddleware_ok(t *testing.T) {
+	endpoint := &config.EndpointConfig{
+		Endpoint: "/users/:id",
+		Timeout:  time.Second,
+		ExtraConfig: newCacheExtra(map[string]interface{}{
+			"ttl":                "1m",
+			"querystring_params": []interface{}{"page"},
+			"headers":            []interface{}{"Accept-Language"},
+		}),
+	}
+	var calls int32
+	p := NewEndpointCacheMiddleware(endpoint)(hintedProxy(&calls, http.Header{}, func() (*Response, error) {
+		return &Response{IsComplete: true, Data: map[string]interface{}{"user": map[string]interface{}{"name": "supu"}}}, nil
+	}))
+
+	newRequest := func(id, page, other, lang string) *Request {
+		return &Request{
+			Method:  "GET",
+			Params:  map[string]string{"Id": id},
+			Query:   url.Values{"page": {page}, "other": {other}},
+			Headers: map[string][]string{"Accept-Language": {lang}},
+		}
+	}
+
+	resp, _ := p(context.Background(), newRequest("1", "1", "a", "en"))
+	resp.Data["user"].(map[string]interface{})["name"] = "tupu"
+
+	resp, err := p(context.Background(), newRequest("1", "1", "b", "en"))
+	if err != nil {
+		t.Error("unexpected error:", err.Error())
+		return
+	}
+	if calls != 1 {
+		t.Errorf("the second request should be served from the cache. calls: %d", calls)
+	}
+	if name := resp.Data["user"].(map[string]interface{})["name"]; name != "supu" {
+		t.Errorf("the cached response was modified: %v", name)
+	}
+
+	for _, r := range []*Request{
+		newRequest("2", "1", "a", "en"),
+		newRequest("1", "2", "a", "en"),
+		newRequest("1", "1", "a", "es"),
+	} {
+		p(context.Background(), r)
+	}
+	if calls != 4 {
+		t.Errorf("different params, queries or headers must not share an entry. calls: %d", calls)
+	}
+
+	post := newRequest("1", "1", "a", "en")
+	post.Method = "POST"
+	p(context.Background(), post)
+	p(context.Background(), post)
+	if calls != 6 {
+		t.Errorf("POST requests must not be cached. calls: %d", calls)
+	}
+}
+
+func TestNewBackendCacheMiddleware_noStore(t *testing.T) {
+	backend := &config.Backend{ExtraConfig: newCacheExtra(map[string]interface{}{"ttl": "1m"})}
+	var calls int32
+	p := NewBackendCacheMiddleware(backend)(hintedProxy(&calls, http.Header{"Cache-Control": {"private, no-store"}}, func() (*Response, error) {
+		return &Response{IsComplete: true, Data: map[string]interface{}{}}, nil
+	}))
+
+	for i := 0; i < 3; i++ {
+		p(context.Background(), &Request{Method: "GET", Path: "/a"})
+	}
+	if calls != 3 {
+		t.Errorf("no-store responses must not be cached. calls: %d", calls)
+	}
+}
+
+func TestNewEndpointCacheMiddleware_credentials(t *testing.T) {
+	for _, tc := range []struct {
+		headers  []interface{}
+		request  map[string][]string
+		expected int32
+	}{
+		{request: map[string][]string{"Authorization": {"Bearer a"}}, expected: 3},
+		{request: map[string][]string{"Cookie": {"session=a"}}, expected: 3},
+		// 凭证参与了缓存key的计算, 同一个用户的请求可以缓存
+		{headers: []interface{}{"authorization"}, request: map[string][]string{"Authorization": {"Bearer a"}}, expected: 1},
+		{request: map[string][]string{"Accept": {"application/json"}}, expected: 1},
+	} {
+		endpoint := &config.EndpointConfig{
+			Endpoint:    "/me",
+			Timeout:     time.Second,
+			ExtraConfig: newCacheExtra(map[string]interface{}{"ttl": "1m", "headers": tc.headers}),
+		}
+		var calls int32
+		p := NewEndpointCacheMiddleware(endpoint)(hintedProxy(&calls, http.Header{}, func() (*Response, error) {
+			return &Response{IsComplete: true, Data: map[string]interface{}{"name": "supu"}}, nil
+		}))
+		for i := 0; i < 3; i++ {
+			p(context.Background(), &Request{Method: "GET", Headers: tc.request})
+		}
+		if calls != tc.expected {
+			t.Errorf("%v: unexpected calls %d", tc.request, calls)
+		}
+	}
+}
+
+func TestNewBackendCacheMiddleware_maxBytes(t *testing.T) {
+	backend := &config.Backend{ExtraConfig: newCacheExtra(map[string]interface{}{"ttl": "1m", "max_bytes": 4})}
+	var calls int32
+	var read int64
+	p := NewBackendCacheMiddleware(backend)(hintedProxy(&calls, http.Header{}, func() (*Response, error) {
+		body := &countingReader{r: strings.NewReader("0123456789"), n: &read}
+		return &Response{IsComplete: true, Data: map[string]interface{}{}, Io: ioutil.NopCloser(body)}, nil
+	}))
+
+	for i := 0; i < 2; i++ {
+		resp, err := p(context.Background(), &Request{Method: "GET", Path: "/a"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if atomic.LoadInt64(&read) > 5 {
+			t.Errorf("the body should not be read beyond the limit before being rejected: %d", read)
+		}
+		// 超过上限的响应体依然完整地返回
+		body, _ := ioutil.ReadAll(resp.Io)
+		if string(body) != "0123456789" {
+			t.Errorf("unexpected body %q", body)
+		}
+		if _, ok := resp.Io.(io.Closer); !ok {
+			t.Error("the body should still be closable")
+		}
+		atomic.StoreInt64(&read, 0)
+	}
+	if calls != 2 {
+		t.Errorf("responses larger than max_bytes must not be cached. calls: %d", calls)
+	}
+}
+
+// countingReader 记录读取的字节数
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+func TestNewBackendCacheMiddleware_etagRevalidation(t *testing.T) {
+	backend := &config.Backend{ExtraConfig: newCacheExtra(map[string]interface{}{"ttl": "1m"})}
+	var calls int32
+	var ifNoneMatch string
+	p := NewBackendCacheMiddleware(backend)(func(ctx context.Context, r *Request) (*Response, error) {
+		atomic.AddInt32(&calls, 1)
+		recordCacheHints(ctx, &http.Response{Header: http.Header{"Cache-Control": {"max-age=0"}, "Etag": {`"v1"`}}})
+		if v, ok := r.Headers["If-None-Match"]; ok {
+			ifNoneMatch = v[0]
+			return nil, client.InvalidStatusCodeError{Code: http.StatusNotModified}
+		}
+		return &Response{IsComplete: true, Data: map[string]interface{}{"supu": 42}}, nil
+	})
+
+	p(context.Background(), &Request{Method: "GET", Path: "/a"})
+	resp, err := p(context.Background(), &Request{Method: "GET", Path: "/a"})
+	if err != nil {
+		t.Error("unexpected error:", err.Error())
+		return
+	}
+	if calls != 2 {
+		t.Errorf("the expired entry should be revalidated. calls: %d", calls)
+	}
+	if ifNoneMatch != `"v1"` {
+		t.Errorf("unexpected If-None-Match header: %s", ifNoneMatch)
+	}
+	if resp == nil || resp.Data["supu"] != 42 {
+		t.Errorf("unexpected response: %v", resp)
+	}
+}
+
+func TestNewBackendCacheMiddleware_staleWhileRevalidate(t *testing.T) {
+	backend := &config.Backend{
+		Timeout: time.Second,
+		ExtraConfig: newCacheExtra(map[string]interface{}{
+			"ttl":                    "1ns",
+			"stale_while_revalidate": "1m",
+		}),
+	}
+	var calls int32
+	refreshed := make(chan struct{}, 1)
+	p := NewBackendCacheMiddleware(backend)(func(_ context.Context, _ *Request) (*Response, error) {
+		n := atomic.AddInt32(&calls, 1)
+		if n > 1 {
+			refreshed <- struct{}{}
+		}
+		return &Response{IsComplete: true, Data: map[string]interface{}{"version": n}}, nil
+	})
+
+	p(context.Background(), &Request{Method: "GET", Path: "/a"})
+	time.Sleep(time.Millisecond)
+
+	resp, _ := p(context.Background(), &Request{Method: "GET", Path: "/a"})
+	if resp.Data["version"] != int32(1) {
+		t.Errorf("the stale response should be served. have: %v", resp.Data)
+	}
+
+	select {
+	case <-refreshed:
+	case <-time.After(time.Second):
+		t.Error("the entry was not revalidated in the background")
+	}
+}
+
+func TestMemoryResponseCache_eviction(t *testing.T) {
+	c := NewMemoryResponseCache(2, 100)
+	c.Set("a", &CacheEntry{Size: 10})
+	c.Set("b", &CacheEntry{Size: 10})
+	c.Get("a")
+	c.Set("c", &CacheEntry{Size: 10})
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("the least recently used entry should be evicted")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Error("the recently used entry should be kept")
+	}
+
+	c.Set("d", &CacheEntry{Size: 95})
+	if _, ok := c.Get("a"); ok {
+		t.Error("entries should be evicted when the size limit is exceeded")
+	}
+	if _, ok := c.Get("d"); !ok {
+		t.Error("the last entry should be kept")
+	}
+}
+
+func TestRegister_responseCacheFactory(t *testing.T) {
+	r := NewRegister()
+	var created bool
+	r.SetResponseCacheFactory("custom", func(maxEntries, maxBytes int) ResponseCache {
+		created = true
+		return NewMemoryResponseCache(maxEntries, maxBytes)
+	})
+
+	NewEndpointCacheMiddleware(&config.EndpointConfig{ExtraConfig: newCacheExtra(map[string]interface{}{"store": "custom"})})
+	if !created {
+		t.Error("the registered cache factory was not used")
+	}
+}
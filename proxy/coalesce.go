@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"context"
+	"melody/config"
+	"melody/encoding"
+	"net/http"
+	"sync"
+)
+
+const coalesceKey = "coalesce"
+
+// NewCoalescingMiddleware 合并同时到达的、缓存key相同的GET/HEAD请求, 只调用一次backend
+// 缓存key与endpoint缓存相同, 每个等待的请求得到响应的深拷贝
+// 等待的请求被取消时只影响自己, 所有等待的请求都取消之后才取消backend的调用
+func NewCoalescingMiddleware(endpoint *config.EndpointConfig) Middleware {
+	cfg, ok := getCoalesceConfig(endpoint.ExtraConfig)
+	// 流式的响应无法共享, noop的响应体需要完整地读入内存才能共享, 大小没有上限
+	if !ok || endpoint.OutputEncoding == encoding.STREAM || endpoint.OutputEncoding == encoding.NOOP {
+		return EmptyMiddleware
+	}
+	return func(next ...Proxy) Proxy {
+		if len(next) > 1 {
+			panic(ErrTooManyProxies)
+		}
+
+		var mu sync.Mutex
+		calls := map[string]*coalescedCall{}
+		remove := func(k string, c *coalescedCall) {
+			mu.Lock()
+			if calls[k] == c {
+				delete(calls, k)
+			}
+			mu.Unlock()
+		}
+
+		return func(ctx context.Context, request *Request) (*Response, error) {
+			// 携带用户凭证的请求不与其他用户的请求合并
+			if request.Method != http.MethodGet && request.Method != http.MethodHead || !cfg.shareable(request) {
+				return next[0](ctx, request)
+			}
+
+			k := cfg.key(request, endpoint.Endpoint, request.Params)
+			mu.Lock()
+			c, ok := calls[k]
+			if !ok {
+				// backend的调用不受发起者取消的影响, 但仍然受endpoint的timeout限制
+				var localCtx context.Context
+				var cancel context.CancelFunc
+				if endpoint.Timeout > 0 {
+					localCtx, cancel = context.WithTimeout(newcontextWrapper(ctx), endpoint.Timeout)
+				} else {
+					localCtx, cancel = context.WithCancel(newcontextWrapper(ctx))
+				}
+				c = &coalescedCall{done: make(chan struct{}), cancel: cancel}
+				calls[k] = c
+				r := CloneRequest(request)
+				// 发起者返回之后调用仍然可能继续读取请求体
+				release := retain(r)
+				go func() {
+					defer release()
+					c.run(localCtx, next[0], r, func() { remove(k, c) })
+					closeRequest(r)
+				}()
+			}
+			c.waiters++
+			mu.Unlock()
+
+			select {
+			case <-c.done:
+				return c.result()
+			case <-ctx.Done():
+				mu.Lock()
+				c.waiters--
+				abandoned := c.waiters == 0
+				if abandoned && calls[k] == c {
+					delete(calls, k)
+				}
+				mu.Unlock()
+				if abandoned {
+					c.cancel()
+				}
+				return nil, ctx.Err()
+			}
+		}
+	}
+}
+
+// coalescedCall 一次被多个请求共享的backend调用
+type coalescedCall struct {
+	done     chan struct{}
+	cancel   context.CancelFunc
+	waiters  int
+	response *Response
+	err      error
+}
+
+func (c *coalescedCall) run(ctx context.Context, next Proxy, request *Request, remove func()) {
+	defer c.cancel()
+	c.response, c.err = next(ctx, request)
+	if c.response != nil && c.response.Io != nil {
+		// 非noop的endpoint只输出Data, 不能被多个请求共享的Io直接关闭
+		closeResponse(c.response)
+		c.response.Io = nil
+	}
+	// 调用结束之后到达的请求发起新的调用
+	remove()
+	close(c.done)
+}
+
+// result 返回共享响应的副本
+func (c *coalescedCall) result() (*Response, error) {
+	return cloneResponse(c.response), c.err
+}
+
+func getCoalesceConfig(extra config.ExtraConfig) (cacheConfig, bool) {
+	v, ok := extra[Namespace]
+	if !ok {
+		return cacheConfig{}, ok
+	}
+	e, ok := v.(map[string]interface{})
+	if !ok {
+		return cacheConfig{}, ok
+	}
+	tmp, ok := e[coalesceKey].(map[string]interface{})
+	if !ok {
+		return cacheConfig{}, ok
+	}
+
+	cfg := cacheConfig{Headers: getStrings(tmp, "headers")}
+	if _, ok := tmp["querystring_params"]; ok {
+		cfg.QueryStrings = getStrings(tmp, "querystring_params")
+	}
+	return cfg, true
+}
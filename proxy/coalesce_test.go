@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"context"
+	"melody/config"
+	"melody/encoding"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newCoalescingEndpoint(coalesce map[string]interface{}) *config.EndpointConfig {
+	return &config.EndpointConfig{
+		Endpoint:    "/users/{id}",
+		Timeout:     time.Second,
+		ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{coalesceKey: coalesce}},
+	}
+}
+
+func TestNewCoalescingMiddleware(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	p := NewCoalescingMiddleware(newCoalescingEndpoint(map[string]interface{}{"querystring_params": []interface{}{"page"}}))(
+		func(_ context.Context, r *Request) (*Response, error) {
+			atomic.AddInt32(&calls, 1)
+			<-release
+			return &Response{
+				Data:       map[string]interface{}{"id": r.Params["Id"], "tags": []interface{}{"a"}},
+				IsComplete: true,
+			}, nil
+		})
+
+	var wg sync.WaitGroup
+	responses := make([]*Response, 10)
+	for i := range responses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := p(context.Background(), &Request{
+				Method: "GET",
+				Params: map[string]string{"Id": "42"},
+				// 不在白名单中的query不影响合并
+				Query: url.Values{"page": {"1"}, "ignored": {string(rune('a' + i))}},
+			})
+			if err != nil {
+				t.Error(err)
+			}
+			responses[i] = resp
+		}(i)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if c := atomic.LoadInt32(&calls); c != 1 {
+		t.Errorf("unexpected number of backend calls: %d", c)
+	}
+	responses[0].Data["tags"].([]interface{})[0] = "changed"
+	for _, resp := range responses[1:] {
+		if resp.Data["id"] != "42" || resp.Data["tags"].([]interface{})[0] != "a" {
+			t.Errorf("every waiter should receive its own copy: %v", resp.Data)
+		}
+	}
+
+	// 调用结束之后到达的请求发起新的调用
+	if _, err := p(context.Background(), &Request{Method: "GET", Params: map[string]string{"Id": "42"}}); err != nil {
+		t.Fatal(err)
+	}
+	if c := atomic.LoadInt32(&calls); c != 2 {
+		t.Errorf("unexpected number of backend calls: %d", c)
+	}
+}
+
+func TestNewCoalescingMiddleware_cancel(t *testing.T) {
+	cancelled := make(chan struct{})
+	release := make(chan struct{})
+	p := NewCoalescingMiddleware(newCoalescingEndpoint(map[string]interface{}{}))(
+		func(ctx context.Context, _ *Request) (*Response, error) {
+			select {
+			case <-ctx.Done():
+				close(cancelled)
+				return nil, ctx.Err()
+			case <-release:
+				return &Response{Data: map[string]interface{}{"ok": true}, IsComplete: true}, nil
+			}
+		})
+
+	// 第一个请求被取消不影响其他等待的请求
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := p(ctx, &Request{Method: "GET"})
+		first <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	second := make(chan *Response, 1)
+	go func() {
+		resp, _ := p(context.Background(), &Request{Method: "GET"})
+		second <- resp
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if err := <-first; err != context.Canceled {
+		t.Errorf("unexpected error %v", err)
+	}
+	close(release)
+	resp := <-second
+	if resp == nil {
+		t.Fatal("the second waiter should receive the response")
+	}
+	if resp.Data["ok"] != true {
+		t.Errorf("unexpected response %+v", resp)
+	}
+
+	// 所有等待的请求都取消之后, 取消backend的调用
+	p = NewCoalescingMiddleware(newCoalescingEndpoint(map[string]interface{}{}))(
+		func(ctx context.Context, _ *Request) (*Response, error) {
+			<-ctx.Done()
+			close(cancelled)
+			return nil, ctx.Err()
+		})
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := p(ctx, &Request{Method: "GET"}); err != context.DeadlineExceeded {
+		t.Errorf("unexpected error %v", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("the backend call was not cancelled")
+	}
+}
+
+func TestNewCoalescingMiddleware_disabled(t *testing.T) {
+	var calls int32
+	p := NewCoalescingMiddleware(newCoalescingEndpoint(map[string]interface{}{}))(func(_ context.Context, _ *Request) (*Response, error) {
+		atomic.AddInt32(&calls, 1)
+		return &Response{}, nil
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p(context.Background(), &Request{Method: "POST"})
+		}()
+	}
+	wg.Wait()
+	if calls != 3 {
+		t.Errorf("write requests should not be coalesced: %d", calls)
+	}
+
+	// noop的响应体不会被读入内存共享
+	endpoint := newCoalescingEndpoint(map[string]interface{}{})
+	endpoint.OutputEncoding = encoding.NOOP
+	calls = 0
+	release := make(chan struct{})
+	p = NewCoalescingMiddleware(endpoint)(func(_ context.Context, _ *Request) (*Response, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return &Response{}, nil
+	})
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p(context.Background(), &Request{Method: "GET"})
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls != 3 {
+		t.Errorf("noop requests should not be coalesced: %d", calls)
+	}
+}
+
+func TestNewCoalescingMiddleware_credentials(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	p := NewCoalescingMiddleware(newCoalescingEndpoint(map[string]interface{}{}))(func(_ context.Context, _ *Request) (*Response, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return &Response{Data: map[string]interface{}{}, IsComplete: true}, nil
+	})
+	var wg sync.WaitGroup
+	for _, token := range []string{"Bearer a", "Bearer b"} {
+		wg.Add(1)
+		go func(token string) {
+			defer wg.Done()
+			p(context.Background(), &Request{Method: "GET", Headers: map[string][]string{"Authorization": {token}}})
+		}(token)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls != 2 {
+		t.Errorf("requests with credentials should not be coalesced: %d", calls)
+	}
+}
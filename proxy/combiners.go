@@ -0,0 +1,225 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	combinerConfigKey            = "combiner_config"
+	deepMergeCombinerName        = "deep_merge"
+	concatCombinerName           = "concat"
+	joinCombinerName             = "join"
+	firstSuccessfulCombinerName  = "first_successful"
+	defaultJoinCollectionKeyName = "collection"
+)
+
+// ResponseCombinerFactory 根据 combiner_config 构造需要参数的ResponseCombiner
+type ResponseCombinerFactory func(cfg map[string]interface{}) ResponseCombiner
+
+func registerBuiltinCombiners(r *combinerRegister) {
+	r.SetResponseCombiner(deepMergeCombinerName, combineDeep)
+	r.SetResponseCombiner(concatCombinerName, combineConcat)
+	r.SetResponseCombiner(firstSuccessfulCombinerName, combineFirstSuccessful)
+	r.SetResponseCombinerFactory(joinCombinerName, newJoinCombiner)
+}
+
+// mergeResponses 统一处理response的完整性, merge负责把src的数据合并进dst
+func mergeResponses(count int, responses []*Response, merge func(dst, src map[string]interface{})) *Response {
+	isComplete := len(responses) == count
+	var resp *Response
+	for _, v := range responses {
+		if v == nil || v.Data == nil {
+			isComplete = false
+			continue
+		}
+		isComplete = isComplete && v.IsComplete
+		if resp == nil {
+			resp = v
+			continue
+		}
+		merge(resp.Data, v.Data)
+	}
+	if nil == resp {
+		return &Response{
+			Data:       map[string]interface{}{},
+			IsComplete: isComplete,
+		}
+	}
+	resp.IsComplete = isComplete
+	return resp
+}
+
+func shallowMerge(dst, src map[string]interface{}) {
+	for k, v := range src {
+		dst[k] = v
+	}
+}
+
+// combineDeep 递归合并嵌套的对象, 其它类型的值后者覆盖前者
+func combineDeep(count int, responses []*Response) *Response {
+	return mergeResponses(count, responses, deepMerge)
+}
+
+func deepMerge(dst, src map[string]interface{}) {
+	for k, v := range src {
+		srcMap, ok := v.(map[string]interface{})
+		if !ok {
+			dst[k] = v
+			continue
+		}
+		dstMap, ok := dst[k].(map[string]interface{})
+		if !ok {
+			dst[k] = v
+			continue
+		}
+		deepMerge(dstMap, srcMap)
+	}
+}
+
+// combineConcat 相同key下的数组拼接在一起, 其它类型的值后者覆盖前者
+func combineConcat(count int, responses []*Response) *Response {
+	return mergeResponses(count, responses, func(dst, src map[string]interface{}) {
+		for k, v := range src {
+			srcSlice, ok := v.([]interface{})
+			if !ok {
+				dst[k] = v
+				continue
+			}
+			dstSlice, ok := dst[k].([]interface{})
+			if !ok {
+				dst[k] = v
+				continue
+			}
+			merged := make([]interface{}, 0, len(dstSlice)+len(srcSlice))
+			dst[k] = append(append(merged, dstSlice...), srcSlice...)
+		}
+	})
+}
+
+// combineFirstSuccessful 只保留第一个完整的response
+func combineFirstSuccessful(_ int, responses []*Response) *Response {
+	var fallback *Response
+	for _, v := range responses {
+		if v == nil || v.Data == nil {
+			continue
+		}
+		if v.IsComplete {
+			return v
+		}
+		if fallback == nil {
+			fallback = v
+		}
+	}
+	if fallback == nil {
+		return &Response{Data: map[string]interface{}{}}
+	}
+	return fallback
+}
+
+// firstSuccessfulMerge 并行请求所有backend, 返回第一个完整的response并取消其它请求
+func firstSuccessfulMerge(timeout time.Duration, conditions []condition, proxies ...Proxy) Proxy {
+	return func(ctx context.Context, request *Request) (*Response, error) {
+		next, err := selectProxies(ctx, request, conditions, proxies)
+		if err != nil {
+			return nil, err
+		}
+
+		localCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		responses := make(chan *Response, len(next))
+		failed := make(chan error, len(next))
+		for _, v := range next {
+			go requestPart(localCtx, v, request, responses, failed)
+		}
+
+		var fallback *Response
+		errs := []error{}
+		for i := 0; i < len(next); i++ {
+			select {
+			case resp := <-responses:
+				if resp.IsComplete {
+					return resp, nil
+				}
+				if fallback == nil {
+					fallback = resp
+				}
+			case err := <-failed:
+				errs = append(errs, err)
+			}
+		}
+		if fallback != nil {
+			return fallback, newMergeError(errs)
+		}
+		return &Response{Data: map[string]interface{}{}}, newMergeError(errs)
+	}
+}
+
+// newJoinCombiner 将right数组中的元素按照 right_key == left_key 挂到left数组的元素上
+// 两个数组需要位于不同的key下(可以通过backend的group或mapping区分), 例如 users 与 orders 按照 user_id 关联:
+// {"left": "users", "right": "orders", "left_key": "id", "right_key": "user_id", "as": "orders"}
+func newJoinCombiner(cfg map[string]interface{}) ResponseCombiner {
+	left := getStringOr(cfg, "left", defaultJoinCollectionKeyName)
+	right := getStringOr(cfg, "right", defaultJoinCollectionKeyName)
+	on := getStringOr(cfg, "on", "id")
+	leftKey := getStringOr(cfg, "left_key", on)
+	rightKey := getStringOr(cfg, "right_key", on)
+	as := getStringOr(cfg, "as", right)
+
+	return func(count int, responses []*Response) *Response {
+		resp := mergeResponses(count, responses, shallowMerge)
+		joinCollections(resp.Data, left, right, leftKey, rightKey, as)
+		return resp
+	}
+}
+
+// joinCollections 两个数组都已经返回时才进行关联, 关联之后删除right数组
+func joinCollections(data map[string]interface{}, left, right, leftKey, rightKey, as string) {
+	if left == right {
+		return
+	}
+	leftItems, ok := data[left].([]interface{})
+	if !ok {
+		return
+	}
+	rightItems, ok := data[right].([]interface{})
+	if !ok {
+		return
+	}
+
+	index := map[string][]interface{}{}
+	for _, item := range rightItems {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if v, ok := m[rightKey]; ok {
+			key := fmt.Sprintf("%v", v)
+			index[key] = append(index[key], item)
+		}
+	}
+
+	for _, item := range leftItems {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		matches := []interface{}{}
+		if v, ok := m[leftKey]; ok {
+			if found, ok := index[fmt.Sprintf("%v", v)]; ok {
+				matches = found
+			}
+		}
+		m[as] = matches
+	}
+	delete(data, right)
+}
+
+func getStringOr(m map[string]interface{}, key, fallback string) string {
+	if s, ok := m[key].(string); ok && s != "" {
+		return s
+	}
+	return fallback
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"melody/config"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newCombinerEndpoint(name string, cfg map[string]interface{}, backends int) *config.EndpointConfig {
+	extra := map[string]interface{}{mergeKey: name}
+	if cfg != nil {
+		extra[combinerConfigKey] = cfg
+	}
+	endpoint := &config.EndpointConfig{
+		Timeout:     time.Second,
+		ExtraConfig: config.ExtraConfig{Namespace: extra},
+	}
+	for i := 0; i < backends; i++ {
+		endpoint.Backends = append(endpoint.Backends, &config.Backend{})
+	}
+	return endpoint
+}
+
+func dataProxy(data map[string]interface{}) Proxy {
+	return func(_ context.Context, _ *Request) (*Response, error) {
+		return &Response{Data: data, IsComplete: true}, nil
+	}
+}
+
+func TestCombiner_deepMerge(t *testing.T) {
+	p := NewMergeDataMiddleware(newCombinerEndpoint(deepMergeCombinerName, nil, 2))(
+		dataProxy(map[string]interface{}{"user": map[string]interface{}{"name": "supu", "address": map[string]interface{}{"city": "a"}}}),
+		delayedProxy(t, 10*time.Millisecond, &Response{
+			Data:       map[string]interface{}{"user": map[string]interface{}{"age": 42.0, "address": map[string]interface{}{"zip": "b"}}},
+			IsComplete: true,
+		}),
+	)
+	out, err := p(context.Background(), &Request{})
+	if err != nil {
+		t.Error("unexpected error:", err.Error())
+		return
+	}
+	expected := map[string]interface{}{"user": map[string]interface{}{
+		"name":    "supu",
+		"age":     42.0,
+		"address": map[string]interface{}{"city": "a", "zip": "b"},
+	}}
+	if !reflect.DeepEqual(out.Data, expected) {
+		t.Errorf("unexpected result: %v", out.Data)
+	}
+	if !out.IsComplete {
+		t.Error("the response should be complete")
+	}
+}
+
+func TestCombiner_concat(t *testing.T) {
+	p := NewMergeDataMiddleware(newCombinerEndpoint(concatCombinerName, nil, 2))(
+		dataProxy(map[string]interface{}{"collection": []interface{}{1.0, 2.0}, "a": true}),
+		delayedProxy(t, 10*time.Millisecond, &Response{
+			Data:       map[string]interface{}{"collection": []interface{}{3.0}, "b": true},
+			IsComplete: true,
+		}),
+	)
+	out, _ := p(context.Background(), &Request{})
+	expected := map[string]interface{}{"collection": []interface{}{1.0, 2.0, 3.0}, "a": true, "b": true}
+	if !reflect.DeepEqual(out.Data, expected) {
+		t.Errorf("unexpected result: %v", out.Data)
+	}
+}
+
+func TestCombiner_join(t *testing.T) {
+	cfg := map[string]interface{}{
+		"left":      "users",
+		"right":     "orders",
+		"left_key":  "id",
+		"right_key": "user_id",
+	}
+	for _, delays := range [][]time.Duration{{0, 10 * time.Millisecond}, {10 * time.Millisecond, 0}} {
+		p := NewMergeDataMiddleware(newCombinerEndpoint(joinCombinerName, cfg, 2))(
+			delayedProxy(t, delays[0], &Response{
+				Data: map[string]interface{}{"users": []interface{}{
+					map[string]interface{}{"id": 1.0, "name": "supu"},
+					map[string]interface{}{"id": 2.0, "name": "tupu"},
+				}},
+				IsComplete: true,
+			}),
+			delayedProxy(t, delays[1], &Response{
+				Data: map[string]interface{}{"orders": []interface{}{
+					map[string]interface{}{"user_id": 1.0, "total": 10.0},
+					map[string]interface{}{"user_id": 1.0, "total": 20.0},
+				}},
+				IsComplete: true,
+			}),
+		)
+		out, err := p(context.Background(), &Request{})
+		if err != nil {
+			t.Error("unexpected error:", err.Error())
+			return
+		}
+		if _, ok := out.Data["orders"]; ok {
+			t.Error("the joined collection should be removed")
+		}
+		users := out.Data["users"].([]interface{})
+		if orders := users[0].(map[string]interface{})["orders"].([]interface{}); len(orders) != 2 {
+			t.Errorf("unexpected orders for the first user: %v", orders)
+		}
+		if orders := users[1].(map[string]interface{})["orders"].([]interface{}); len(orders) != 0 {
+			t.Errorf("unexpected orders for the second user: %v", orders)
+		}
+	}
+}
+
+func TestCombiner_firstSuccessful(t *testing.T) {
+	cancelled := make(chan struct{})
+	p := NewMergeDataMiddleware(newCombinerEndpoint(firstSuccessfulCombinerName, nil, 3))(
+		func(_ context.Context, _ *Request) (*Response, error) {
+			return nil, errors.New("failed")
+		},
+		func(ctx context.Context, _ *Request) (*Response, error) {
+			<-ctx.Done()
+			close(cancelled)
+			return nil, ctx.Err()
+		},
+		delayedProxy(t, 10*time.Millisecond, &Response{Data: map[string]interface{}{"supu": 42.0}, IsComplete: true}),
+	)
+	out, err := p(context.Background(), &Request{})
+	if err != nil {
+		t.Error("unexpected error:", err.Error())
+		return
+	}
+	if !out.IsComplete || out.Data["supu"] != 42.0 {
+		t.Errorf("unexpected response: %v", out)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("the slow backend was not cancelled")
+	}
+
+	p = NewMergeDataMiddleware(newCombinerEndpoint(firstSuccessfulCombinerName, nil, 2))(
+		func(_ context.Context, _ *Request) (*Response, error) { return nil, errors.New("failed") },
+		func(_ context.Context, _ *Request) (*Response, error) { return nil, errors.New("failed") },
+	)
+	if _, err := p(context.Background(), &Request{}); err == nil {
+		t.Error("expecting an error")
+	}
+}
+
+func TestCombiner_firstSuccessfulSequential(t *testing.T) {
+	rc, ok := NewRegister().GetResponseCombiner(firstSuccessfulCombinerName)
+	if !ok {
+		t.Error("the combiner should be registered")
+		return
+	}
+	first := &Response{Data: map[string]interface{}{"a": 1}, IsComplete: true}
+	if out := rc(2, []*Response{first, {Data: map[string]interface{}{"b": 1}, IsComplete: true}}); out != first {
+		t.Errorf("unexpected response: %v", out)
+	}
+}
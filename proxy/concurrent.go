@@ -4,7 +4,6 @@ import (
 	"context"
 	"errors"
 	"melody/config"
-	"time"
 )
 
 var errNullResult = errors.New("invalid response")
@@ -15,7 +14,8 @@ func NewConcurrentCallMiddleware(backend *config.Backend) Middleware {
 		panic(ErrTooManyProxies)
 	}
 
-	serviceTimeout := time.Duration(75*backend.Timeout.Nanoseconds()/100) * time.Nanosecond
+	// 并发调用使用backend的timeout, 请求的context已经有更早的deadline时以context为准
+	serviceTimeout := backend.Timeout
 
 	return func(proxy ...Proxy) Proxy {
 		if len(proxy) > 1 {
@@ -0,0 +1,253 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"melody/config"
+	"net/textproto"
+	"regexp"
+	"strings"
+
+	"github.com/valyala/fastrand"
+)
+
+const conditionKey = "condition"
+
+// JWTClaimsKey melody-jose 验证token之后, 以该key将claims写入请求的context
+const JWTClaimsKey = "melody_jwt_claims"
+
+// ErrNoMatchingBackends 没有任何backend满足路由条件
+var ErrNoMatchingBackends = errors.New("no backend matches the request")
+
+// routingInput 同一个请求的所有条件共享同一个随机分桶, 保证百分比切分互斥
+type routingInput struct {
+	ctx     context.Context
+	request *Request
+	bucket  uint32
+}
+
+type condition func(*routingInput) bool
+
+func newRoutingInput(ctx context.Context, request *Request) *routingInput {
+	return &routingInput{ctx: ctx, request: request, bucket: fastrand.Uint32n(100)}
+}
+
+// NewConditionalMiddleware 单个backend的endpoint, 不满足条件时直接返回 ErrNoMatchingBackends
+func NewConditionalMiddleware(backend *config.Backend) Middleware {
+	cond, ok, _ := getCondition(backend.ExtraConfig)
+	if !ok {
+		return EmptyMiddleware
+	}
+	return func(next ...Proxy) Proxy {
+		if len(next) > 1 {
+			panic(ErrTooManyProxies)
+		}
+		return func(ctx context.Context, request *Request) (*Response, error) {
+			if !cond(newRoutingInput(ctx, request)) {
+				return nil, ErrNoMatchingBackends
+			}
+			return next[0](ctx, request)
+		}
+	}
+}
+
+// getConditions 返回每个backend的路由条件, 没有配置条件的backend总是被调用
+func getConditions(backends []*config.Backend) ([]condition, bool) {
+	conditions := make([]condition, len(backends))
+	found := false
+	for i, b := range backends {
+		cond, ok, _ := getCondition(b.ExtraConfig)
+		if ok {
+			conditions[i] = cond
+			found = true
+		}
+	}
+	return conditions, found
+}
+
+// matchingBackends 返回满足条件的backend下标
+func matchingBackends(conditions []condition, input *routingInput) []int {
+	matched := make([]int, 0, len(conditions))
+	for i, cond := range conditions {
+		if cond == nil || cond(input) {
+			matched = append(matched, i)
+		}
+	}
+	return matched
+}
+
+// validateConditions 在构造proxy之前检查路由条件的配置
+func validateConditions(backends []*config.Backend) error {
+	for _, b := range backends {
+		if _, _, err := getCondition(b.ExtraConfig); err != nil {
+			return fmt.Errorf("backend %s: %s", b.URLPattern, err.Error())
+		}
+	}
+	return nil
+}
+
+// getCondition 解析 melody_proxy.condition, 可以是单个规则或者规则数组, 数组中的规则需要全部满足
+func getCondition(extra config.ExtraConfig) (condition, bool, error) {
+	v, ok := extra[Namespace]
+	if !ok {
+		return nil, false, nil
+	}
+	e, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, false, nil
+	}
+
+	var rules []interface{}
+	switch tmp := e[conditionKey].(type) {
+	case map[string]interface{}:
+		rules = []interface{}{tmp}
+	case []interface{}:
+		rules = tmp
+	default:
+		return nil, false, nil
+	}
+
+	conditions := make([]condition, 0, len(rules))
+	for _, r := range rules {
+		rule, ok := r.(map[string]interface{})
+		if !ok {
+			return nil, false, fmt.Errorf("invalid condition: %v", r)
+		}
+		cond, err := parseCondition(rule)
+		if err != nil {
+			return nil, false, err
+		}
+		conditions = append(conditions, cond)
+	}
+
+	return func(input *routingInput) bool {
+		for _, cond := range conditions {
+			if !cond(input) {
+				return false
+			}
+		}
+		return true
+	}, true, nil
+}
+
+func parseCondition(rule map[string]interface{}) (condition, error) {
+	var value func(*routingInput) (string, bool)
+	for _, source := range []struct {
+		key     string
+		extract func(string) func(*routingInput) (string, bool)
+	}{
+		{"header", headerValue},
+		{"query", queryValue},
+		{"param", paramValue},
+		{"jwt_claim", claimValue},
+	} {
+		if name, ok := rule[source.key].(string); ok {
+			value = source.extract(name)
+			break
+		}
+	}
+
+	var match func(*routingInput) bool
+	if p, ok := rule["percentage"].(float64); ok {
+		if p < 0 || p > 100 {
+			return nil, fmt.Errorf("invalid percentage: %v", p)
+		}
+		match = percentageMatcher(uint32(p), value)
+	} else if value == nil {
+		return nil, fmt.Errorf("the condition needs one of header, query, param, jwt_claim or percentage: %v", rule)
+	} else {
+		check := func(string) bool { return true }
+		if equals, ok := rule["equals"].(string); ok {
+			check = func(v string) bool { return v == equals }
+		} else if pattern, ok := rule["matches"].(string); ok {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, err
+			}
+			check = re.MatchString
+		}
+		match = func(input *routingInput) bool {
+			v, ok := value(input)
+			return ok && check(v)
+		}
+	}
+
+	if negate, ok := rule["not"].(bool); ok && negate {
+		return func(input *routingInput) bool { return !match(input) }, nil
+	}
+	return match, nil
+}
+
+// percentageMatcher 配置了header等来源时按照其hash分桶, 同一个用户总是落到同一侧
+// 否则使用请求级别的随机分桶
+func percentageMatcher(percentage uint32, value func(*routingInput) (string, bool)) func(*routingInput) bool {
+	return func(input *routingInput) bool {
+		bucket := input.bucket
+		if value != nil {
+			if v, ok := value(input); ok && v != "" {
+				bucket = crc32.ChecksumIEEE([]byte(v)) % 100
+			}
+		}
+		return bucket < percentage
+	}
+}
+
+func headerValue(name string) func(*routingInput) (string, bool) {
+	canonical := textproto.CanonicalMIMEHeaderKey(name)
+	return func(input *routingInput) (string, bool) {
+		return requestHeader(input.request, name, canonical)
+	}
+}
+
+// requestHeader headers_to_pass中的key不一定是规范格式, 两种都需要查找
+func requestHeader(request *Request, name, canonical string) (string, bool) {
+	if v, ok := request.Headers[canonical]; ok && len(v) > 0 {
+		return v[0], true
+	}
+	if v, ok := request.Headers[name]; ok && len(v) > 0 {
+		return v[0], true
+	}
+	return "", false
+}
+
+func queryValue(name string) func(*routingInput) (string, bool) {
+	return func(input *routingInput) (string, bool) {
+		v, ok := input.request.Query[name]
+		if !ok || len(v) == 0 {
+			return "", false
+		}
+		return v[0], true
+	}
+}
+
+func paramValue(name string) func(*routingInput) (string, bool) {
+	name = strings.Title(name)
+	return func(input *routingInput) (string, bool) {
+		v, ok := input.request.Params[name]
+		return v, ok
+	}
+}
+
+// claimValue 支持 a.b.c 形式的嵌套claim
+func claimValue(name string) func(*routingInput) (string, bool) {
+	keys := strings.Split(name, ".")
+	return func(input *routingInput) (string, bool) {
+		claims, ok := input.ctx.Value(JWTClaimsKey).(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		var v interface{} = claims
+		for _, k := range keys {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return "", false
+			}
+			if v, ok = m[k]; !ok {
+				return "", false
+			}
+		}
+		return fmt.Sprintf("%v", v), true
+	}
+}
@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"context"
+	"melody/config"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newConditionalBackend(cond interface{}) *config.Backend {
+	return &config.Backend{
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{conditionKey: cond},
+		},
+	}
+}
+
+func TestNewMergeDataMiddleware_conditions(t *testing.T) {
+	endpoint := &config.EndpointConfig{
+		Timeout: time.Second,
+		Backends: []*config.Backend{
+			{},
+			newConditionalBackend(map[string]interface{}{"header": "X-Canary", "equals": "1"}),
+			newConditionalBackend(map[string]interface{}{"header": "X-Canary", "equals": "1", "not": true}),
+		},
+	}
+	newProxy := func(key string) Proxy {
+		return func(_ context.Context, _ *Request) (*Response, error) {
+			return &Response{Data: map[string]interface{}{key: true}, IsComplete: true}, nil
+		}
+	}
+	p := NewMergeDataMiddleware(endpoint)(newProxy("common"), newProxy("canary"), newProxy("stable"))
+
+	for _, subject := range []struct {
+		headers  map[string][]string
+		expected string
+		ignored  string
+	}{
+		{map[string][]string{"X-Canary": {"1"}}, "canary", "stable"},
+		{map[string][]string{}, "stable", "canary"},
+	} {
+		out, err := p(context.Background(), &Request{Headers: subject.headers})
+		if err != nil {
+			t.Error("unexpected error:", err.Error())
+			return
+		}
+		if !out.IsComplete {
+			t.Error("skipped backends should not make the response incomplete")
+		}
+		if _, ok := out.Data[subject.expected]; !ok {
+			t.Errorf("missing data from %s: %v", subject.expected, out.Data)
+		}
+		if _, ok := out.Data[subject.ignored]; ok {
+			t.Errorf("unexpected data from %s: %v", subject.ignored, out.Data)
+		}
+		if _, ok := out.Data["common"]; !ok {
+			t.Errorf("backends without conditions should always be called: %v", out.Data)
+		}
+	}
+}
+
+func TestNewMergeDataMiddleware_sequentialConditions(t *testing.T) {
+	first := newConditionalBackend(map[string]interface{}{"query": "v", "equals": "2"})
+	first.URLPattern = "/first"
+	second := &config.Backend{URLPattern: "/second/{{.Resp0_id}}"}
+	endpoint := &config.EndpointConfig{
+		Timeout:     time.Second,
+		Backends:    []*config.Backend{first, second},
+		ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{isSequentialKey: true}},
+	}
+	var params map[string]string
+	p := NewMergeDataMiddleware(endpoint)(
+		dummyProxy(&Response{Data: map[string]interface{}{"id": "42"}, IsComplete: true}),
+		func(_ context.Context, r *Request) (*Response, error) {
+			params = r.Params
+			return &Response{Data: map[string]interface{}{"second": true}, IsComplete: true}, nil
+		},
+	)
+
+	out, err := p(context.Background(), &Request{Params: map[string]string{}, Query: url.Values{"v": {"1"}}})
+	if err != nil {
+		t.Error("unexpected error:", err.Error())
+		return
+	}
+	if !out.IsComplete || len(out.Data) != 1 {
+		t.Errorf("unexpected response: %v", out)
+	}
+	if _, ok := params["Resp0_id"]; ok {
+		t.Error("the param of a skipped backend should not be replaced")
+	}
+}
+
+func TestNewMergeDataMiddleware_noMatchingBackends(t *testing.T) {
+	b := newConditionalBackend(map[string]interface{}{"param": "id", "matches": "^[0-9]+$"})
+	endpoint := &config.EndpointConfig{Timeout: time.Second, Backends: []*config.Backend{b, b}}
+	p := NewMergeDataMiddleware(endpoint)(NoopProxy, NoopProxy)
+	if _, err := p(context.Background(), &Request{Params: map[string]string{"Id": "abc"}}); err != ErrNoMatchingBackends {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	p = NewConditionalMiddleware(b)(dummyProxy(&Response{}))
+	if _, err := p(context.Background(), &Request{Params: map[string]string{"Id": "abc"}}); err != ErrNoMatchingBackends {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := p(context.Background(), &Request{Params: map[string]string{"Id": "42"}}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCondition_jwtClaim(t *testing.T) {
+	cond, ok, err := getCondition(newConditionalBackend([]interface{}{
+		map[string]interface{}{"jwt_claim": "plan.tier", "equals": "gold"},
+		map[string]interface{}{"jwt_claim": "beta"},
+	}).ExtraConfig)
+	if !ok || err != nil {
+		t.Errorf("unexpected result: %v, %v", ok, err)
+		return
+	}
+
+	claims := map[string]interface{}{"plan": map[string]interface{}{"tier": "gold"}, "beta": true}
+	ctx := context.WithValue(context.Background(), JWTClaimsKey, claims)
+	if !cond(newRoutingInput(ctx, &Request{})) {
+		t.Error("the claims should match")
+	}
+	claims["plan"] = map[string]interface{}{"tier": "silver"}
+	if cond(newRoutingInput(ctx, &Request{})) {
+		t.Error("the claims should not match")
+	}
+	if cond(newRoutingInput(context.Background(), &Request{})) {
+		t.Error("requests without claims should not match")
+	}
+}
+
+func TestCondition_percentage(t *testing.T) {
+	canary, _, _ := getCondition(newConditionalBackend(map[string]interface{}{"percentage": 20.0}).ExtraConfig)
+	stable, _, _ := getCondition(newConditionalBackend(map[string]interface{}{"percentage": 20.0, "not": true}).ExtraConfig)
+
+	hits := 0
+	for i := 0; i < 1000; i++ {
+		input := newRoutingInput(context.Background(), &Request{})
+		if canary(input) == stable(input) {
+			t.Error("the percentage split should be exclusive")
+			return
+		}
+		if canary(input) {
+			hits++
+		}
+	}
+	if hits < 100 || hits > 300 {
+		t.Errorf("unexpected number of hits: %d", hits)
+	}
+
+	sticky, _, _ := getCondition(newConditionalBackend(map[string]interface{}{"percentage": 50.0, "header": "X-User-Id"}).ExtraConfig)
+	for i := 0; i < 10; i++ {
+		r := &Request{Headers: map[string][]string{"X-User-Id": {strconv.Itoa(i)}}}
+		if sticky(newRoutingInput(context.Background(), r)) != sticky(newRoutingInput(context.Background(), r)) {
+			t.Error("the same user should always be routed to the same side")
+		}
+	}
+}
+
+func TestValidateConditions(t *testing.T) {
+	for _, cond := range []interface{}{
+		map[string]interface{}{"header": "X-A", "matches": "("},
+		map[string]interface{}{"percentage": 120.0},
+		map[string]interface{}{"equals": "a"},
+		[]interface{}{42},
+	} {
+		if err := validateConditions([]*config.Backend{newConditionalBackend(cond)}); err == nil {
+			t.Errorf("expecting an error for %v", cond)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"context"
+	"melody/config"
+	"melody/transport/http/client"
+)
+
+// Error endpoint失败时返回给客户端的错误
+type Error struct {
+	Code      int
+	Message   string
+	Backends  []BackendFailure
+	RequestID string
+}
+
+// BackendFailure 单个backend失败的原因
+type BackendFailure struct {
+	Backend string
+	Code    int
+	Message string
+}
+
+// BackendError 带有失败的backend信息的错误
+type BackendError struct {
+	Backend string
+	Err     error
+}
+
+// Error implements the error interface
+func (e BackendError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the original error
+func (e BackendError) Unwrap() error {
+	return e.Err
+}
+
+// NewBackendErrorMiddleware 把backend返回的错误包装成 BackendError
+// backend配置了group时使用group作为名称, 否则使用url_pattern
+func NewBackendErrorMiddleware(backend *config.Backend) Middleware {
+	name := backend.Group
+	if name == "" {
+		name = backend.URLPattern
+	}
+	return func(next ...Proxy) Proxy {
+		if len(next) > 1 {
+			panic(ErrTooManyProxies)
+		}
+		return func(ctx context.Context, request *Request) (*Response, error) {
+			resp, err := next[0](ctx, request)
+			if err != nil {
+				if _, ok := err.(BackendError); !ok {
+					err = BackendError{Backend: name, Err: err}
+				}
+			}
+			return resp, err
+		}
+	}
+}
+
+// NewError 根据proxy返回的错误构造Error, 合并多个backend的错误会被展开
+func NewError(code int, message string, err error) *Error {
+	return &Error{
+		Code:     code,
+		Message:  message,
+		Backends: backendFailures(err),
+	}
+}
+
+func backendFailures(err error) []BackendFailure {
+	switch e := err.(type) {
+	case nil:
+		return []BackendFailure{}
+	case interface{ Errors() []error }:
+		failures := []BackendFailure{}
+		for _, err := range e.Errors() {
+			failures = append(failures, backendFailures(err)...)
+		}
+		return failures
+	case BackendError:
+		failure := BackendFailure{Backend: e.Backend, Message: e.Err.Error()}
+		switch t := e.Err.(type) {
+		case client.InvalidStatusCodeError:
+			failure.Code = t.Code
+		case responseError:
+			failure.Code = t.StatusCode()
+		}
+		return []BackendFailure{failure}
+	}
+	return []BackendFailure{{Message: err.Error()}}
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"melody/config"
+	"melody/transport/http/client"
+	"net/http"
+	"testing"
+)
+
+func TestNewBackendErrorMiddleware(t *testing.T) {
+	expected := client.InvalidStatusCodeError{Code: http.StatusNotFound}
+	p := NewBackendErrorMiddleware(&config.Backend{URLPattern: "/users"})(func(_ context.Context, _ *Request) (*Response, error) {
+		return nil, expected
+	})
+	_, err := p(context.Background(), &Request{})
+	e, ok := err.(BackendError)
+	if !ok {
+		t.Fatalf("unexpected error type: %T", err)
+	}
+	if e.Backend != "/users" || !errors.Is(err, client.ErrInvalidStatusCode) {
+		t.Errorf("unexpected error: %+v", e)
+	}
+}
+
+func TestNewError(t *testing.T) {
+	err := newMergeError([]error{
+		BackendError{Backend: "users", Err: client.InvalidStatusCodeError{Code: http.StatusNotFound}},
+		BackendError{Backend: "orders", Err: errors.New("timeout")},
+		errors.New("unknown"),
+	})
+	e := NewError(http.StatusBadGateway, "bad gateway", err)
+	if e.Code != http.StatusBadGateway || e.Message != "bad gateway" {
+		t.Errorf("unexpected error: %+v", e)
+	}
+	expected := []BackendFailure{
+		{Backend: "users", Code: http.StatusNotFound, Message: client.ErrInvalidStatusCode.Error()},
+		{Backend: "orders", Message: "timeout"},
+		{Message: "unknown"},
+	}
+	if len(e.Backends) != len(expected) {
+		t.Fatalf("unexpected failures: %+v", e.Backends)
+	}
+	for i, f := range expected {
+		if e.Backends[i] != f {
+			t.Errorf("unexpected failure #%d: %+v", i, e.Backends[i])
+		}
+	}
+}
@@ -35,6 +35,9 @@ func NewDefaultFactoryWithSubscriberFactory(factory BackendFactory, logger loggi
 }
 
 func (d defaultFactory) New(cfg *config.EndpointConfig) (p Proxy, err error) {
+	if err = validateConditions(cfg.Backends); err != nil {
+		return
+	}
 	switch len(cfg.Backends) {
 	case 0:
 		err = ErrNoBackends
@@ -49,32 +52,62 @@ func (d defaultFactory) New(cfg *config.EndpointConfig) (p Proxy, err error) {
 	}
 	// 执行顺序：⑥
 	p = NewStaticDataMiddleware(cfg)(p)
+	// 合并相同的并发读请求           执行顺序：⑥ 与 ⑦ 之间
+	p = NewCoalescingMiddleware(cfg)(p)
+	// endpoint层的响应缓存           执行顺序：⑦
+	p = NewEndpointCacheMiddleware(cfg)(p)
+	// 缓存请求体, 每个backend读取独立的副本   执行顺序：⑧
+	p = NewRequestBufferMiddleware(cfg)(p)
+	// endpoint的并发限制, 超过时直接拒绝   执行顺序：⑨
+	p = NewEndpointConcurrencyMiddleware(cfg)(p)
 	return
 }
 
-func (d defaultFactory) NewStack(backend *config.Backend) (p Proxy) {
+func (d defaultFactory) NewStack(endpoint *config.EndpointConfig, backend *config.Backend) (p Proxy) {
 	// 根据config.Backend定制backendProxy 执行顺序：④
 	p = d.backendFactory(backend)
+	// 健康检查, 剔除异常的host
+	subscriber := sd.NewHealthCheckSubscriber(backend, d.subscriberFactory(backend))
+	// websocket等不经过proxy的处理程序复用同一个subscriber
+	sd.RegisterBackendSubscriber(backend, subscriber)
+	// 上报每一次请求的结果, 用于被动健康检查     执行顺序：③ 与 ④ 之间
+	p = NewHealthReportMiddleware(subscriber)(p)
 	// 均衡中间件注册(在此处调用对应的服务发现)     执行顺序：③
-	p = NewLoadBalancedMiddlewareWithSubscriber(d.subscriberFactory(backend))(p)
-	if backend.ConcurrentCalls > 1 {
+	p = NewLoadBalancedMiddlewareWithBalancer(sd.GetBalancer(backend, subscriber))(p)
+	// 失败重试，每次重试都会重新经过负载均衡选择host   执行顺序：② 与 ③ 之间
+	p = NewRetryMiddleware(backend)(p)
+	if _, ok := getHedgeConfig(backend.ExtraConfig); ok {
+		// 对冲请求, 代替并发调用             执行顺序：②
+		p = NewHedgingMiddleware(endpoint, backend)(p)
+	} else if backend.ConcurrentCalls > 1 {
 		// 并发调用 > 1                    执行顺序：②
 		p = NewConcurrentCallMiddleware(backend)(p)
 	}
+	// backend的timeout, 限制重试与并发调用的总时间   执行顺序：① 与 ② 之间
+	p = NewBackendTimeoutMiddleware(backend)(p)
+	// backend层的响应缓存, 此时路径已经生成   执行顺序：① 与 ② 之间
+	p = NewBackendCacheMiddleware(backend)(p)
+	// 改写发送给backend的请求体           执行顺序：① 与 ② 之间
+	p = NewRequestBodyMiddleware(backend)(p)
 	// 基础的Request构造器                 执行顺序：①
 	p = NewRequestBuilderMiddleware(backend)(p)
+	// backend的并发限制(隔离舱)
+	p = NewBackendConcurrencyMiddleware(endpoint, backend)(p)
+	// 记录失败的backend, 用于endpoint返回的错误信息
+	p = NewBackendErrorMiddleware(backend)(p)
 	return
 }
 
 func (d defaultFactory) NewSingle(endpointConfig *config.EndpointConfig) (Proxy, error) {
-	return d.NewStack(endpointConfig.Backends[0]), nil
+	// 执行顺序：⑤
+	return NewConditionalMiddleware(endpointConfig.Backends[0])(d.NewStack(endpointConfig, endpointConfig.Backends[0])), nil
 }
 
 func (d defaultFactory) NewMulti(endpointConfig *config.EndpointConfig) (p Proxy, err error) {
 
 	backendProxies := make([]Proxy, len(endpointConfig.Backends))
 	for i, v := range endpointConfig.Backends {
-		backendProxies[i] = d.NewStack(v)
+		backendProxies[i] = d.NewStack(endpointConfig, v)
 	}
 	// 执行顺序：⑤
 	p = NewMergeDataMiddleware(endpointConfig)(backendProxies...)
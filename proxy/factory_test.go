@@ -5,6 +5,7 @@ import (
 	"context"
 	"melody/config"
 	"melody/logging"
+	"melody/sd"
 	"net/url"
 	"strings"
 	"testing"
@@ -94,3 +95,26 @@ func TestNewDefaultFactory_ok(t *testing.T) {
 		t.Errorf("The proxy middleware propagated an unexpected error: %v\n", response)
 	}
 }
+
+func TestNewDefaultFactory_backendSubscriber(t *testing.T) {
+	backend := &config.Backend{URLPattern: "/", Host: []string{"http://127.0.0.1:8080"}}
+	endpoint := &config.EndpointConfig{Backends: []*config.Backend{backend}}
+	generation := config.NewGeneration(config.ServiceConfig{Endpoints: []*config.EndpointConfig{endpoint}})
+
+	calls := 0
+	factory := NewDefaultFactoryWithSubscriberFactory(func(_ *config.Backend) Proxy { return NoopProxy }, logging.NoOp, func(cfg *config.Backend) sd.Subscriber {
+		calls++
+		return sd.FixedSubscriber(cfg.Host)
+	})
+	if _, err := factory.New(endpoint); err != nil {
+		t.Fatal(err)
+	}
+	// websocket等处理程序复用proxy构建的subscriber, 不会再创建一个
+	if s, ok := sd.BackendSubscriber(backend); !ok || calls != 1 {
+		t.Errorf("unexpected subscriber %v (%d calls)", s, calls)
+	}
+	generation.Close()
+	if _, ok := sd.BackendSubscriber(backend); ok {
+		t.Error("the subscriber should be removed with its generation")
+	}
+}
@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"melody/config"
+	"strconv"
+	"sync"
+)
+
+const fanOutKey = "fan_out"
+
+// fanOutConfig 链式请求中, 引用的参数位于数组中时, 对数组的每个元素调用一次backend
+type fanOutConfig struct {
+	// 同时进行的请求数量, 0 表示不限制
+	MaxConcurrency int
+	// 结果写入元素中的key, 为空时合并进元素
+	Target string
+}
+
+// fanOutCollection 需要展开的数组, rest 为数组元素中参数的路径
+type fanOutCollection struct {
+	key   string
+	items []interface{}
+	rest  []string
+}
+
+// getFanOutConfigs 返回每个backend的fan_out配置, 没有配置的backend为nil
+func getFanOutConfigs(backends []*config.Backend) []*fanOutConfig {
+	configs := make([]*fanOutConfig, len(backends))
+	for i, b := range backends {
+		if cfg, ok := getFanOutConfig(b.ExtraConfig); ok {
+			configs[i] = &cfg
+		}
+	}
+	return configs
+}
+
+func getFanOutConfig(extra config.ExtraConfig) (fanOutConfig, bool) {
+	v, ok := extra[Namespace]
+	if !ok {
+		return fanOutConfig{}, false
+	}
+	e, ok := v.(map[string]interface{})
+	if !ok {
+		return fanOutConfig{}, false
+	}
+	tmp, ok := e[fanOutKey].(map[string]interface{})
+	if !ok {
+		return fanOutConfig{}, false
+	}
+	cfg := fanOutConfig{}
+	if c, ok := tmp["max_concurrency"].(float64); ok && c > 0 {
+		cfg.MaxConcurrency = int(c)
+	}
+	cfg.Target, _ = tmp["target"].(string)
+	return cfg, true
+}
+
+// lookupSequentialParam 按照 a.b.c 在response中查找参数
+// 路径上遇到数组时, 返回数组以及元素中剩余的路径
+func lookupSequentialParam(data map[string]interface{}, keys []string) (interface{}, *fanOutCollection, bool) {
+	var v interface{} = data
+	for i, k := range keys {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, nil, false
+		}
+		if v, ok = m[k]; !ok {
+			return nil, nil, false
+		}
+		if items, ok := v.([]interface{}); ok {
+			return v, &fanOutCollection{items: items, rest: keys[i+1:]}, true
+		}
+	}
+	return v, nil, true
+}
+
+// fanOut 对数组的每个元素调用一次backend, 并把结果写回对应的元素
+// 部分元素失败时返回不完整的response以及错误, 全部失败时只返回错误
+func fanOut(ctx context.Context, next Proxy, request *Request, collection *fanOutCollection, cfg *fanOutConfig) (*Response, error) {
+	total := len(collection.items)
+	if total == 0 {
+		return &Response{Data: map[string]interface{}{}, IsComplete: true}, nil
+	}
+
+	// CloneRequest 会读取body, 需要在并发之前完成
+	requests := make([]*Request, total)
+	for i, item := range collection.items {
+		v, ok := item, true
+		if len(collection.rest) > 0 {
+			m, isMap := item.(map[string]interface{})
+			if isMap {
+				v, _, ok = lookupSequentialParam(m, collection.rest)
+			} else {
+				ok = false
+			}
+		}
+		if !ok {
+			continue
+		}
+		r := CloneRequest(request)
+		r.Params[collection.key] = sequentialParamValue(v)
+		requests[i] = r
+	}
+
+	concurrency := cfg.MaxConcurrency
+	if concurrency <= 0 || concurrency > total {
+		concurrency = total
+	}
+	sem := make(chan struct{}, concurrency)
+	responses := make([]*Response, total)
+	errs := make([]error, total)
+
+	var wg sync.WaitGroup
+	for i, r := range requests {
+		if r == nil {
+			errs[i] = fmt.Errorf("fan out: element %d has no value for %s", i, collection.key)
+			continue
+		}
+		wg.Add(1)
+		go func(i int, r *Request) {
+			defer wg.Done()
+			defer closeRequest(r)
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				return
+			}
+			defer func() { <-sem }()
+			resp, err := next(ctx, r)
+			if err == nil && resp == nil {
+				err = errNullResult
+			}
+			responses[i], errs[i] = resp, err
+		}(i, r)
+	}
+	wg.Wait()
+
+	isComplete := true
+	failures := []error{}
+	for i, resp := range responses {
+		if errs[i] != nil {
+			failures = append(failures, errs[i])
+			isComplete = false
+			continue
+		}
+		isComplete = isComplete && resp.IsComplete
+		stitch(collection.items, i, resp.Data, cfg.Target)
+	}
+	if len(failures) == total {
+		return nil, newMergeError(failures)
+	}
+	return &Response{Data: map[string]interface{}{}, IsComplete: isComplete}, newMergeError(failures)
+}
+
+// stitch 元素为对象时, 结果写入target或者合并进元素; 元素为标量时直接替换
+func stitch(items []interface{}, i int, data map[string]interface{}, target string) {
+	m, ok := items[i].(map[string]interface{})
+	if !ok {
+		items[i] = data
+		return
+	}
+	if target != "" {
+		m[target] = data
+		return
+	}
+	for k, v := range data {
+		m[k] = v
+	}
+}
+
+func sequentialParamValue(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case int:
+		return strconv.Itoa(t)
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(t)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"melody/config"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newFanOutEndpoint(fanOut map[string]interface{}) *config.EndpointConfig {
+	return &config.EndpointConfig{
+		Backends: []*config.Backend{
+			{URLPattern: "/items"},
+			{
+				URLPattern: "/details/{{.Resp0_items.id}}",
+				ExtraConfig: config.ExtraConfig{
+					Namespace: map[string]interface{}{fanOutKey: fanOut},
+				},
+			},
+		},
+		Timeout: time.Second,
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{isSequentialKey: true},
+		},
+	}
+}
+
+func itemsProxy(ids ...string) Proxy {
+	return func(_ context.Context, _ *Request) (*Response, error) {
+		items := make([]interface{}, len(ids))
+		for i, id := range ids {
+			items[i] = map[string]interface{}{"id": id}
+		}
+		return &Response{Data: map[string]interface{}{"items": items}, IsComplete: true}, nil
+	}
+}
+
+func TestNewMergeDataMiddleware_fanOut(t *testing.T) {
+	var current, max int32
+	details := func(_ context.Context, r *Request) (*Response, error) {
+		n := atomic.AddInt32(&current, 1)
+		defer atomic.AddInt32(&current, -1)
+		for {
+			m := atomic.LoadInt32(&max)
+			if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		return &Response{Data: map[string]interface{}{"name": "item-" + r.Params["Resp0_items.id"]}, IsComplete: true}, nil
+	}
+
+	p := NewMergeDataMiddleware(newFanOutEndpoint(map[string]interface{}{
+		"max_concurrency": 2.0,
+		"target":          "detail",
+	}))(itemsProxy("a", "b", "c", "d", "e"), details)
+
+	out, err := p(context.Background(), &Request{Params: map[string]string{}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if !out.IsComplete {
+		t.Error("the response should be complete")
+	}
+	if max > 2 {
+		t.Errorf("the concurrency limit was not respected: %d", max)
+	}
+	items := out.Data["items"].([]interface{})
+	if len(items) != 5 {
+		t.Fatalf("unexpected items: %v", items)
+	}
+	for _, item := range items {
+		m := item.(map[string]interface{})
+		detail, ok := m["detail"].(map[string]interface{})
+		if !ok {
+			t.Errorf("the item was not stitched: %v", m)
+			continue
+		}
+		if detail["name"] != "item-"+m["id"].(string) {
+			t.Errorf("the item was stitched with the wrong detail: %v", m)
+		}
+	}
+}
+
+func TestNewMergeDataMiddleware_fanOutWithoutTarget(t *testing.T) {
+	details := func(_ context.Context, r *Request) (*Response, error) {
+		return &Response{Data: map[string]interface{}{"name": "item-" + r.Params["Resp0_items.id"]}, IsComplete: true}, nil
+	}
+	p := NewMergeDataMiddleware(newFanOutEndpoint(map[string]interface{}{}))(itemsProxy("a", "b"), details)
+
+	out, err := p(context.Background(), &Request{Params: map[string]string{}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	items := out.Data["items"].([]interface{})
+	for _, item := range items {
+		m := item.(map[string]interface{})
+		if m["name"] != "item-"+m["id"].(string) {
+			t.Errorf("the detail was not merged into the item: %v", m)
+		}
+	}
+}
+
+func TestNewMergeDataMiddleware_fanOutPartialFailure(t *testing.T) {
+	details := func(_ context.Context, r *Request) (*Response, error) {
+		if r.Params["Resp0_items.id"] == "b" {
+			return nil, errors.New("boom")
+		}
+		return &Response{Data: map[string]interface{}{"name": "ok"}, IsComplete: true}, nil
+	}
+	p := NewMergeDataMiddleware(newFanOutEndpoint(map[string]interface{}{"target": "detail"}))(itemsProxy("a", "b"), details)
+
+	out, err := p(context.Background(), &Request{Params: map[string]string{}})
+	if err == nil {
+		t.Error("expecting an error")
+	}
+	if out == nil || out.IsComplete {
+		t.Fatalf("the response should be incomplete: %v", out)
+	}
+	items := out.Data["items"].([]interface{})
+	if _, ok := items[0].(map[string]interface{})["detail"]; !ok {
+		t.Errorf("the successful element was not stitched: %v", items[0])
+	}
+	if _, ok := items[1].(map[string]interface{})["detail"]; ok {
+		t.Errorf("the failed element should not be stitched: %v", items[1])
+	}
+}
+
+func TestNewMergeDataMiddleware_fanOutNumericIDs(t *testing.T) {
+	items := func(_ context.Context, _ *Request) (*Response, error) {
+		// json解码之后数字都是float64
+		return &Response{Data: map[string]interface{}{"items": []interface{}{
+			map[string]interface{}{"id": 42.0},
+			map[string]interface{}{"id": 1234567.0},
+			map[string]interface{}{"id": 1.5},
+		}}, IsComplete: true}, nil
+	}
+	details := func(_ context.Context, r *Request) (*Response, error) {
+		return &Response{Data: map[string]interface{}{"path": r.Params["Resp0_items.id"]}, IsComplete: true}, nil
+	}
+
+	out, err := NewMergeDataMiddleware(newFanOutEndpoint(map[string]interface{}{"target": "detail"}))(items, details)(
+		context.Background(), &Request{Params: map[string]string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []string{"42", "1234567", "1.5"} {
+		item := out.Data["items"].([]interface{})[i].(map[string]interface{})
+		if path := item["detail"].(map[string]interface{})["path"]; path != expected {
+			t.Errorf("unexpected param for the item %d: %v", i, path)
+		}
+	}
+}
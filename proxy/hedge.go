@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"context"
+	"melody/config"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+const (
+	hedgeKey = "hedge"
+
+	defaultHedgeDelay = 100 * time.Millisecond
+	// 使用percentile之前最少需要的样本数
+	defaultHedgeMinSamples = 20
+	// 对冲请求选择其他host的最多次数
+	maxHedgedHostSelections = 3
+)
+
+// hedgeConfig backend对冲请求的配置
+type hedgeConfig struct {
+	// 最多额外发送的请求数
+	MaxHedges int
+	// 等待多久没有响应时发送下一个请求
+	Delay time.Duration
+	// 使用历史延迟的百分位作为等待时间, 例如 0.95, 为0时只使用Delay
+	Percentile     float64
+	MinSamples     int
+	IdempotentOnly bool
+}
+
+var hedgingRegistry atomic.Value
+
+type hedgingRegistryHolder struct {
+	metrics.Registry
+}
+
+// SetHedgingRegistry 设置输出对冲请求指标的metrics registry, nil表示不输出
+func SetHedgingRegistry(r metrics.Registry) {
+	hedgingRegistry.Store(hedgingRegistryHolder{r})
+}
+
+// hedgeMetrics 对冲请求的指标
+type hedgeMetrics struct {
+	// 开启了对冲的请求数
+	requests metrics.Counter
+	// 额外发送的请求数
+	hedges metrics.Counter
+	// 额外的请求先于第一个请求返回的次数
+	wins metrics.Counter
+	// 成功请求的延迟, 用于计算percentile
+	latency metrics.Histogram
+}
+
+func newHedgeMetrics(name string) hedgeMetrics {
+	r, ok := hedgingRegistry.Load().(hedgingRegistryHolder)
+	if !ok || r.Registry == nil {
+		r.Registry = metrics.NewRegistry()
+	}
+	prefix := "hedge." + name + "."
+	return hedgeMetrics{
+		requests: metrics.GetOrRegisterCounter(prefix+"requests", r.Registry),
+		hedges:   metrics.GetOrRegisterCounter(prefix+"hedges", r.Registry),
+		wins:     metrics.GetOrRegisterCounter(prefix+"wins", r.Registry),
+		latency:  metrics.GetOrRegisterHistogram(prefix+"latency", r.Registry, metrics.NewExpDecaySample(1028, 0.015)),
+	}
+}
+
+// NewHedgingMiddleware 先发送一个请求, 在配置的时间内没有得到响应时再向其他host发送额外的请求
+// 第一个完整的响应返回之后取消并关闭其他的请求, 与 ConcurrentCalls 同时配置时代替并发调用
+func NewHedgingMiddleware(endpoint *config.EndpointConfig, backend *config.Backend) Middleware {
+	cfg, ok := getHedgeConfig(backend.ExtraConfig)
+	if !ok || cfg.MaxHedges < 1 {
+		return EmptyMiddleware
+	}
+	// 不同endpoint使用相同的url_pattern时分别统计
+	m := newHedgeMetrics(endpoint.Endpoint + "." + backend.URLPattern)
+
+	return func(next ...Proxy) Proxy {
+		if len(next) > 1 {
+			panic(ErrTooManyProxies)
+		}
+
+		return func(ctx context.Context, request *Request) (*Response, error) {
+			if cfg.IdempotentOnly && !idempotentMethods[request.Method] {
+				return next[0](ctx, request)
+			}
+			m.requests.Inc(1)
+
+			// 返回的响应的Io读取结束之后才取消
+			localCtx, cancel := context.WithCancel(context.WithValue(ctx, hedgedHostsKey{}, &hedgedHosts{}))
+
+			type result struct {
+				attempt  int
+				response *Response
+				err      error
+			}
+			results := make(chan result, cfg.MaxHedges+1)
+			delay := cfg.delay(m.latency)
+
+			var timer *time.Timer
+			var hedge <-chan time.Time
+			cancels := make([]context.CancelFunc, 0, cfg.MaxHedges+1)
+			launch := func() {
+				attempt := len(cancels)
+				attemptCtx, attemptCancel := context.WithCancel(localCtx)
+				cancels = append(cancels, attemptCancel)
+				// 每一次尝试都使用一个独立的请求体副本
+				r := CloneRequest(request)
+				go func() {
+					begin := time.Now()
+					resp, err := next[0](attemptCtx, r)
+					closeRequest(r)
+					if err == nil && resp != nil && resp.IsComplete {
+						m.latency.Update(time.Since(begin).Nanoseconds())
+					}
+					results <- result{attempt, resp, err}
+				}()
+				if timer != nil {
+					timer.Stop()
+				}
+				hedge = nil
+				if len(cancels) <= cfg.MaxHedges {
+					timer = time.NewTimer(delay)
+					hedge = timer.C
+				}
+			}
+			// finish 取消除了winner之外的请求, 并在后台关闭它们稍后返回的响应
+			finish := func(winner, pending int) {
+				if timer != nil {
+					timer.Stop()
+				}
+				for i, c := range cancels {
+					if i != winner {
+						c()
+					}
+				}
+				if pending > 0 {
+					go func() {
+						for ; pending > 0; pending-- {
+							closeResponse((<-results).response)
+						}
+					}()
+				}
+			}
+
+			launch()
+			last := result{attempt: -1}
+			for pending := 1; pending > 0; {
+				select {
+				case r := <-results:
+					pending--
+					if r.err == nil && r.response != nil && r.response.IsComplete {
+						if r.attempt > 0 {
+							m.wins.Inc(1)
+						}
+						finish(r.attempt, pending)
+						closeResponse(last.response)
+						cancelOnClose(r.response, cancel)
+						return r.response, nil
+					}
+					closeResponse(last.response)
+					last = r
+					// 失败时不再等待, 直接发送下一个请求
+					if len(cancels) <= cfg.MaxHedges && ctx.Err() == nil {
+						m.hedges.Inc(1)
+						launch()
+						pending++
+					}
+				case <-hedge:
+					m.hedges.Inc(1)
+					launch()
+					pending++
+				case <-ctx.Done():
+					finish(-1, pending)
+					closeResponse(last.response)
+					cancel()
+					return nil, ctx.Err()
+				}
+			}
+			finish(last.attempt, 0)
+			cancelOnClose(last.response, cancel)
+			return last.response, last.err
+		}
+	}
+}
+
+// delay 历史样本足够时使用延迟的百分位, 否则使用配置的Delay
+func (h hedgeConfig) delay(latency metrics.Histogram) time.Duration {
+	if h.Percentile > 0 && latency.Count() >= int64(h.MinSamples) {
+		if d := time.Duration(latency.Percentile(h.Percentile)); d > 0 {
+			return d
+		}
+	}
+	return h.Delay
+}
+
+// hedgedHosts 同一个请求的各次尝试已经使用过的host
+type hedgedHosts struct {
+	mu    sync.Mutex
+	hosts map[string]bool
+}
+
+type hedgedHostsKey struct{}
+
+func (h *hedgedHosts) contains(host string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.hosts[host]
+}
+
+func (h *hedgedHosts) add(host string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.hosts == nil {
+		h.hosts = map[string]bool{}
+	}
+	h.hosts[host] = true
+}
+
+func getHedgeConfig(extra config.ExtraConfig) (hedgeConfig, bool) {
+	v, ok := extra[Namespace]
+	if !ok {
+		return hedgeConfig{}, ok
+	}
+	e, ok := v.(map[string]interface{})
+	if !ok {
+		return hedgeConfig{}, ok
+	}
+	tmp, ok := e[hedgeKey].(map[string]interface{})
+	if !ok {
+		return hedgeConfig{}, ok
+	}
+
+	cfg := hedgeConfig{
+		MaxHedges:      getInt(tmp, "max_hedges", 1),
+		Delay:          getDuration(tmp, "delay", defaultHedgeDelay),
+		MinSamples:     getInt(tmp, "min_samples", defaultHedgeMinSamples),
+		IdempotentOnly: true,
+	}
+	if p, ok := tmp["percentile"].(float64); ok && p > 0 && p < 1 {
+		cfg.Percentile = p
+	}
+	if b, ok := tmp["idempotent_only"].(bool); ok {
+		cfg.IdempotentOnly = b
+	}
+	return cfg, true
+}
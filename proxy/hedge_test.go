@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"melody/config"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// sequenceBalancer 依次返回hosts中的host
+type sequenceBalancer struct {
+	mu    sync.Mutex
+	hosts []string
+	calls int
+}
+
+func (s *sequenceBalancer) Host() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	host := s.hosts[s.calls%len(s.hosts)]
+	s.calls++
+	return host, nil
+}
+
+var hedgeEndpoint = &config.EndpointConfig{Endpoint: "/endpoint"}
+
+func newHedgeBackend(name string, hedge map[string]interface{}) *config.Backend {
+	return &config.Backend{
+		URLPattern:  name,
+		ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{hedgeKey: hedge}},
+	}
+}
+
+func TestNewHedgingMiddleware(t *testing.T) {
+	registry := metrics.NewRegistry()
+	SetHedgingRegistry(registry)
+	defer SetHedgingRegistry(nil)
+
+	backend := newHedgeBackend("/hedge", map[string]interface{}{"delay": "10ms"})
+	lb := &sequenceBalancer{hosts: []string{"http://a", "http://a", "http://b"}}
+	cancelled := make(chan struct{})
+	p := NewHedgingMiddleware(hedgeEndpoint, backend)(NewLoadBalancedMiddlewareWithBalancer(lb)(func(ctx context.Context, r *Request) (*Response, error) {
+		if r.URL.Host == "a" {
+			// 第一个请求很慢, 直到被取消
+			<-ctx.Done()
+			close(cancelled)
+			return nil, ctx.Err()
+		}
+		return &Response{Data: map[string]interface{}{"host": r.URL.Host}, IsComplete: true}, nil
+	}))
+
+	resp, err := p(context.Background(), &Request{Method: "GET"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data["host"] != "b" {
+		t.Errorf("the hedged request should be sent to another host: %v", resp.Data)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("the slow request was not cancelled")
+	}
+
+	for name, expected := range map[string]int64{"requests": 1, "hedges": 1, "wins": 1} {
+		if c := metrics.GetOrRegisterCounter("hedge./endpoint./hedge."+name, registry).Count(); c != expected {
+			t.Errorf("unexpected %s counter: %d", name, c)
+		}
+	}
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed chan struct{}
+}
+
+func (c closeRecorder) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestNewHedgingMiddleware_responseBody(t *testing.T) {
+	backend := newHedgeBackend("/body", map[string]interface{}{"delay": "1ms"})
+	loser := closeRecorder{Reader: strings.NewReader("loser"), closed: make(chan struct{})}
+	var mu sync.Mutex
+	calls := 0
+	p := NewHedgingMiddleware(hedgeEndpoint, backend)(func(ctx context.Context, _ *Request) (*Response, error) {
+		mu.Lock()
+		calls++
+		first := calls == 1
+		mu.Unlock()
+		if first {
+			// 第一个请求在winner返回之后才得到响应
+			<-ctx.Done()
+			return &Response{Io: loser}, nil
+		}
+		pr, pw := io.Pipe()
+		go func() {
+			pw.Write([]byte("winner"))
+			pw.Close()
+		}()
+		return &Response{Io: NewReadCloserWrapper(ctx, pr), IsComplete: true}, nil
+	})
+
+	resp, err := p(context.Background(), &Request{Method: "GET"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-loser.closed:
+	case <-time.After(time.Second):
+		t.Error("the response of the cancelled request was not closed")
+	}
+	// winner的context在读取完Io之前不能被取消
+	b, err := ioutil.ReadAll(resp.Io)
+	if err != nil || string(b) != "winner" {
+		t.Errorf("unexpected body %q: %v", b, err)
+	}
+}
+
+func TestNewHedgingMiddleware_fast(t *testing.T) {
+	backend := newHedgeBackend("/fast", map[string]interface{}{"delay": "100ms"})
+	var calls int
+	p := NewHedgingMiddleware(hedgeEndpoint, backend)(func(_ context.Context, _ *Request) (*Response, error) {
+		calls++
+		return &Response{IsComplete: true}, nil
+	})
+	if _, err := p(context.Background(), &Request{Method: "GET"}); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("unexpected number of calls: %d", calls)
+	}
+}
+
+func TestNewHedgingMiddleware_errors(t *testing.T) {
+	backend := newHedgeBackend("/errors", map[string]interface{}{"delay": "1s", "max_hedges": 2})
+	errBoom := errors.New("boom")
+	var mu sync.Mutex
+	calls := 0
+	p := NewHedgingMiddleware(hedgeEndpoint, backend)(func(_ context.Context, _ *Request) (*Response, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		return nil, errBoom
+	})
+	begin := time.Now()
+	if _, err := p(context.Background(), &Request{Method: "GET"}); err != errBoom {
+		t.Errorf("unexpected error %v", err)
+	}
+	// 失败时不等待delay
+	if time.Since(begin) > 500*time.Millisecond || calls != 3 {
+		t.Errorf("unexpected number of calls %d after %v", calls, time.Since(begin))
+	}
+}
+
+func TestNewHedgingMiddleware_idempotentOnly(t *testing.T) {
+	backend := newHedgeBackend("/post", map[string]interface{}{"delay": "1ms"})
+	var calls int
+	p := NewHedgingMiddleware(hedgeEndpoint, backend)(func(_ context.Context, _ *Request) (*Response, error) {
+		calls++
+		time.Sleep(10 * time.Millisecond)
+		return &Response{IsComplete: true}, nil
+	})
+	if _, err := p(context.Background(), &Request{Method: "POST"}); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("unexpected number of calls: %d", calls)
+	}
+}
+
+func TestHedgeConfig_delay(t *testing.T) {
+	cfg, ok := getHedgeConfig(config.ExtraConfig{Namespace: map[string]interface{}{
+		hedgeKey: map[string]interface{}{"delay": "50ms", "percentile": 0.5, "min_samples": 10},
+	}})
+	if !ok || cfg.MaxHedges != 1 || !cfg.IdempotentOnly {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+	h := metrics.NewHistogram(metrics.NewUniformSample(100))
+	if d := cfg.delay(h); d != 50*time.Millisecond {
+		t.Errorf("unexpected delay without samples: %v", d)
+	}
+	for i := 0; i < 10; i++ {
+		h.Update(int64(20 * time.Millisecond))
+	}
+	if d := cfg.delay(h); d != 20*time.Millisecond {
+		t.Errorf("unexpected delay from the percentile: %v", d)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"melody/transport/http/client"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 // HTTPResponseParser 将http.Response -> proxy.Response
@@ -32,6 +33,9 @@ func NewHTTPProxyWithHTTPRequestExecutor(remote *config.Backend, executor client
 	if remote.Encoding == encoding.NOOP {
 		return NewHTTPProxyDetailed(remote, executor, client.NoOpHTTPStatusHandler, NoOpHTTPResponseParser)
 	}
+	if remote.Encoding == encoding.STREAM {
+		return NewHTTPProxyDetailed(remote, executor, client.NoOpHTTPStatusHandler, NewStreamHTTPResponseParser(remote))
+	}
 
 	formatter := NewEntityFormatter(remote)
 	responseParser := DefaultHTTPResponseParserFactory(HTTPResponseParserConfig{
@@ -55,6 +59,8 @@ func NewHTTPProxyDetailed(remote *config.Backend, re client.HTTPRequestExecutor,
 			copy(temp, vs)
 			requestToBackend.Header[k] = temp
 		}
+		// 转发剩余的超时时间
+		setRequestTimeout(ctx, requestToBackend.Header)
 
 		if request.Body != nil {
 			if v, ok := request.Headers["Content-Length"]; ok && len(v) == 1 && v[0] != "chunked" {
@@ -65,7 +71,9 @@ func NewHTTPProxyDetailed(remote *config.Backend, re client.HTTPRequestExecutor,
 		}
 
 		// **真正发送请求的地方**
+		begin := time.Now()
 		resp, err := re(ctx, requestToBackend)
+		latency := time.Since(begin)
 		if requestToBackend.Body != nil {
 			requestToBackend.Body.Close()
 		}
@@ -77,8 +85,11 @@ func NewHTTPProxyDetailed(remote *config.Backend, re client.HTTPRequestExecutor,
 		}
 
 		if err != nil {
+			ReportHealth(ctx, requestToBackend.URL.String(), false, latency)
 			return nil, err
 		}
+		ReportHealth(ctx, requestToBackend.URL.String(), resp.StatusCode < http.StatusInternalServerError, latency)
+		recordCacheHints(ctx, resp)
 		// response的成功或者错误处理
 		resp, err = ch(ctx, resp)
 		if err != nil {
@@ -106,7 +117,10 @@ func NewRequestBuilderMiddleware(backend *config.Backend) Middleware {
 		return func(ctx context.Context, request *Request) (response *Response, e error) {
 			r := request.Clone()
 			r.GeneratePath(backend.URLPattern)
-			r.Method = backend.Method
+			// 没有配置method时使用请求的method
+			if backend.Method != "" {
+				r.Method = backend.Method
+			}
 			return proxy[0](ctx, &r)
 		}
 	}
@@ -29,14 +29,18 @@ func DefaultHTTPResponseParserFactory(cfg HTTPResponseParserConfig) HTTPResponse
 	return func(ctx context.Context, resp *http.Response) (*Response, error) {
 		defer resp.Body.Close()
 
-		var data map[string]interface{}
-		err := cfg.Decoder(resp.Body, &data)
-		if err != nil {
-			return nil, err
+		data := map[string]interface{}{}
+		// HEAD请求的响应没有响应体
+		if resp.Request == nil || resp.Request.Method != http.MethodHead {
+			if err := cfg.Decoder(resp.Body, &data); err != nil {
+				return nil, err
+			}
 		}
 		response := Response{
 			Data:       data,
 			IsComplete: true,
+			// 只记录状态码, backend的响应头不会被传递
+			Metadata: Metadata{StatusCode: resp.StatusCode},
 		}
 		response = cfg.EntityFormatter.Format(response)
 		return &response, nil
@@ -0,0 +1,279 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"melody/config"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+const (
+	concurrencyKey = "concurrency"
+
+	defaultRetryAfter        = time.Second
+	defaultQueueTimeout      = 100 * time.Millisecond
+	defaultAdaptiveTolerance = 2.0
+	// 延迟基线的平滑系数
+	adaptiveBaselineAlpha = 0.05
+	// 延迟过高或失败时limit的缩小比例
+	adaptiveBackoffRatio = 0.9
+)
+
+// concurrencyConfig 并发限制(隔离舱)的配置
+type concurrencyConfig struct {
+	// 同时处理的最大请求数, 开启自适应时作为初始值
+	MaxInFlight int
+	// 超过限制时最多排队的请求数, 0表示直接拒绝
+	MaxQueue     int
+	QueueTimeout time.Duration
+	// 拒绝时返回的 Retry-After
+	RetryAfter time.Duration
+	Adaptive   bool
+	MinLimit   int
+	MaxLimit   int
+	// 延迟超过基线的该倍数时缩小limit
+	Tolerance float64
+}
+
+var concurrencyRegistry atomic.Value
+
+type concurrencyRegistryHolder struct {
+	metrics.Registry
+}
+
+// SetConcurrencyRegistry 设置输出并发限制状态的metrics registry, nil表示不输出
+func SetConcurrencyRegistry(r metrics.Registry) {
+	concurrencyRegistry.Store(concurrencyRegistryHolder{r})
+}
+
+// ConcurrencyLimitError 正在处理的请求数超过了限制, 并且没有排队或者排队超时
+type ConcurrencyLimitError struct {
+	Name string
+	Wait time.Duration
+}
+
+// Error implements the error interface
+func (e ConcurrencyLimitError) Error() string {
+	return fmt.Sprintf("too many requests in flight for %s", e.Name)
+}
+
+// StatusCode returns the status code of the error
+func (e ConcurrencyLimitError) StatusCode() int { return http.StatusServiceUnavailable }
+
+// RetryAfter returns the duration the client should wait before retrying
+func (e ConcurrencyLimitError) RetryAfter() time.Duration { return e.Wait }
+
+// NewEndpointConcurrencyMiddleware 限制endpoint同时处理的请求数
+// 名称使用 method + endpoint, 相同路径不同method的endpoint各自计数
+func NewEndpointConcurrencyMiddleware(endpoint *config.EndpointConfig) Middleware {
+	return newConcurrencyMiddleware("endpoint", endpoint.Method+"."+endpoint.Endpoint, endpoint.ExtraConfig)
+}
+
+// NewBackendConcurrencyMiddleware 限制同时发送给backend的请求数, 一个backend变慢时不会占满整个网关
+// 名称使用 method + endpoint + url_pattern, 不同endpoint中相同url_pattern的backend各自计数
+func NewBackendConcurrencyMiddleware(endpoint *config.EndpointConfig, backend *config.Backend) Middleware {
+	return newConcurrencyMiddleware("backend", endpoint.Method+"."+endpoint.Endpoint+"."+backend.URLPattern, backend.ExtraConfig)
+}
+
+func newConcurrencyMiddleware(layer, name string, extra config.ExtraConfig) Middleware {
+	cfg, ok := getConcurrencyConfig(extra)
+	if !ok || cfg.MaxInFlight < 1 {
+		return EmptyMiddleware
+	}
+	l := newLimiter(layer+"."+name, cfg)
+
+	return func(next ...Proxy) Proxy {
+		if len(next) > 1 {
+			panic(ErrTooManyProxies)
+		}
+		return func(ctx context.Context, request *Request) (*Response, error) {
+			if err := l.acquire(ctx); err != nil {
+				return nil, err
+			}
+			begin := time.Now()
+			resp, err := next[0](ctx, request)
+			latency := time.Since(begin)
+			// noop与stream编码的响应体读取结束或者关闭之后才释放名额
+			cancelOnClose(resp, func() { l.release(latency, err) })
+			return resp, err
+		}
+	}
+}
+
+// limiter 带有等待队列的并发限制, 可以根据延迟自动调整limit
+type limiter struct {
+	name  string
+	cfg   concurrencyConfig
+	mu    sync.Mutex
+	limit float64
+	// 平滑之后的延迟基线
+	baseline float64
+	inFlight int
+	queue    *list.List
+
+	limitGauge    metrics.Gauge
+	inFlightGauge metrics.Gauge
+	queuedGauge   metrics.Gauge
+	rejected      metrics.Counter
+}
+
+func newLimiter(name string, cfg concurrencyConfig) *limiter {
+	r, ok := concurrencyRegistry.Load().(concurrencyRegistryHolder)
+	if !ok || r.Registry == nil {
+		r.Registry = metrics.NewRegistry()
+	}
+	prefix := "concurrency." + name + "."
+	l := &limiter{
+		name:          name,
+		cfg:           cfg,
+		limit:         float64(cfg.MaxInFlight),
+		queue:         list.New(),
+		limitGauge:    metrics.GetOrRegisterGauge(prefix+"limit", r.Registry),
+		inFlightGauge: metrics.GetOrRegisterGauge(prefix+"in_flight", r.Registry),
+		queuedGauge:   metrics.GetOrRegisterGauge(prefix+"queued", r.Registry),
+		rejected:      metrics.GetOrRegisterCounter(prefix+"rejected", r.Registry),
+	}
+	l.limitGauge.Update(int64(cfg.MaxInFlight))
+	return l
+}
+
+// acquire 获取一个处理请求的名额, 超过限制时排队等待或者直接拒绝
+func (l *limiter) acquire(ctx context.Context) error {
+	l.mu.Lock()
+	if l.inFlight < l.currentLimit() {
+		l.inFlight++
+		l.updateGauges()
+		l.mu.Unlock()
+		return nil
+	}
+	if l.queue.Len() >= l.cfg.MaxQueue {
+		l.mu.Unlock()
+		return l.reject()
+	}
+	// 名额由release直接转交给队列中的请求
+	ready := make(chan struct{})
+	e := l.queue.PushBack(ready)
+	l.updateGauges()
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.cfg.QueueTimeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-ready:
+		return nil
+	case <-timer.C:
+		err = l.reject()
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-ready:
+		// 放弃之前已经得到了名额
+		return nil
+	default:
+	}
+	l.queue.Remove(e)
+	l.updateGauges()
+	return err
+}
+
+// release 释放名额, 并根据这次请求的延迟调整limit
+func (l *limiter) release(latency time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	if l.cfg.Adaptive {
+		l.adapt(latency, err)
+	}
+	for l.queue.Len() > 0 && l.inFlight < l.currentLimit() {
+		e := l.queue.Front()
+		l.queue.Remove(e)
+		l.inFlight++
+		close(e.Value.(chan struct{}))
+	}
+	l.updateGauges()
+}
+
+// adapt 加性增、乘性减: 延迟超过基线的 Tolerance 倍或者超时时缩小limit, 名额使用过半时增大limit
+func (l *limiter) adapt(latency time.Duration, err error) {
+	sample := float64(latency)
+	if l.baseline == 0 {
+		l.baseline = sample
+	}
+	timeout := errors.Is(err, context.DeadlineExceeded)
+	if timeout || sample > l.baseline*l.cfg.Tolerance {
+		l.limit = math.Max(float64(l.cfg.MinLimit), l.limit*adaptiveBackoffRatio)
+	} else if float64(l.inFlight+1)*2 >= l.limit {
+		l.limit = math.Min(float64(l.cfg.MaxLimit), l.limit+1/l.limit)
+	}
+	if !timeout {
+		l.baseline += adaptiveBaselineAlpha * (sample - l.baseline)
+	}
+	l.limitGauge.Update(int64(l.currentLimit()))
+}
+
+func (l *limiter) currentLimit() int {
+	return int(l.limit)
+}
+
+func (l *limiter) updateGauges() {
+	l.inFlightGauge.Update(int64(l.inFlight))
+	l.queuedGauge.Update(int64(l.queue.Len()))
+}
+
+func (l *limiter) reject() error {
+	l.rejected.Inc(1)
+	return ConcurrencyLimitError{Name: l.name, Wait: l.cfg.RetryAfter}
+}
+
+func getConcurrencyConfig(extra config.ExtraConfig) (concurrencyConfig, bool) {
+	v, ok := extra[Namespace]
+	if !ok {
+		return concurrencyConfig{}, ok
+	}
+	e, ok := v.(map[string]interface{})
+	if !ok {
+		return concurrencyConfig{}, ok
+	}
+	tmp, ok := e[concurrencyKey].(map[string]interface{})
+	if !ok {
+		return concurrencyConfig{}, ok
+	}
+
+	cfg := concurrencyConfig{
+		MaxInFlight:  getInt(tmp, "max_in_flight", 0),
+		MaxQueue:     getInt(tmp, "max_queue", 0),
+		QueueTimeout: getDuration(tmp, "queue_timeout", defaultQueueTimeout),
+		RetryAfter:   getDuration(tmp, "retry_after", defaultRetryAfter),
+	}
+	adaptive, ok := tmp["adaptive"].(map[string]interface{})
+	if !ok {
+		return cfg, true
+	}
+	cfg.Adaptive = true
+	cfg.MinLimit = getInt(adaptive, "min_limit", 1)
+	cfg.MaxLimit = getInt(adaptive, "max_limit", cfg.MaxInFlight)
+	cfg.Tolerance = defaultAdaptiveTolerance
+	if t, ok := adaptive["tolerance"].(float64); ok && t > 1 {
+		cfg.Tolerance = t
+	}
+	if cfg.MinLimit < 1 {
+		cfg.MinLimit = 1
+	}
+	if cfg.MaxLimit < cfg.MaxInFlight {
+		cfg.MaxLimit = cfg.MaxInFlight
+	}
+	return cfg, true
+}
@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"melody/config"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+func newConcurrencyEndpoint(concurrency map[string]interface{}) *config.EndpointConfig {
+	return &config.EndpointConfig{
+		Endpoint:    "/limited",
+		Method:      http.MethodGet,
+		ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{concurrencyKey: concurrency}},
+	}
+}
+
+// blockingProxy 在release关闭之前一直阻塞
+func blockingProxy(started chan<- struct{}, release <-chan struct{}) Proxy {
+	return func(_ context.Context, _ *Request) (*Response, error) {
+		started <- struct{}{}
+		<-release
+		return &Response{IsComplete: true}, nil
+	}
+}
+
+func TestNewEndpointConcurrencyMiddleware_reject(t *testing.T) {
+	registry := metrics.NewRegistry()
+	SetConcurrencyRegistry(registry)
+	defer SetConcurrencyRegistry(nil)
+
+	started, release := make(chan struct{}, 2), make(chan struct{})
+	p := NewEndpointConcurrencyMiddleware(newConcurrencyEndpoint(map[string]interface{}{
+		"max_in_flight": 2,
+		"retry_after":   "3s",
+	}))(blockingProxy(started, release))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p(context.Background(), &Request{}); err != nil {
+				t.Error(err)
+			}
+		}()
+		<-started
+	}
+
+	begin := time.Now()
+	_, err := p(context.Background(), &Request{})
+	var e ConcurrencyLimitError
+	if !errors.As(err, &e) || e.StatusCode() != http.StatusServiceUnavailable || e.RetryAfter() != 3*time.Second {
+		t.Errorf("unexpected error %v", err)
+	}
+	if time.Since(begin) > 50*time.Millisecond {
+		t.Error("the request should be rejected without waiting")
+	}
+	if g := metrics.GetOrRegisterGauge("concurrency.endpoint.GET./limited.in_flight", registry).Value(); g != 2 {
+		t.Errorf("unexpected in flight gauge %d", g)
+	}
+	if c := metrics.GetOrRegisterCounter("concurrency.endpoint.GET./limited.rejected", registry).Count(); c != 1 {
+		t.Errorf("unexpected rejected counter %d", c)
+	}
+
+	close(release)
+	wg.Wait()
+	if g := metrics.GetOrRegisterGauge("concurrency.endpoint.GET./limited.in_flight", registry).Value(); g != 0 {
+		t.Errorf("unexpected in flight gauge %d", g)
+	}
+}
+
+func TestNewBackendConcurrencyMiddleware_queue(t *testing.T) {
+	started, release := make(chan struct{}, 3), make(chan struct{})
+	p := NewBackendConcurrencyMiddleware(&config.EndpointConfig{Endpoint: "/queue", Method: http.MethodGet}, &config.Backend{
+		URLPattern: "/queued",
+		ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{concurrencyKey: map[string]interface{}{
+			"max_in_flight": 1,
+			"max_queue":     1,
+			"queue_timeout": "1s",
+		}}},
+	})(blockingProxy(started, release))
+
+	results := make(chan error, 2)
+	go func() {
+		_, err := p(context.Background(), &Request{})
+		results <- err
+	}()
+	<-started
+	// 第二个请求排队等待
+	go func() {
+		_, err := p(context.Background(), &Request{})
+		results <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	// 队列已满
+	if _, err := p(context.Background(), &Request{}); err == nil {
+		t.Error("the request should be rejected when the queue is full")
+	}
+	// 排队的请求被取消
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := p(ctx, &Request{}); err == nil {
+		t.Error("the request should be rejected")
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+}
+
+func TestNewEndpointConcurrencyMiddleware_queueTimeout(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	defer close(release)
+	p := NewEndpointConcurrencyMiddleware(newConcurrencyEndpoint(map[string]interface{}{
+		"max_in_flight": 1,
+		"max_queue":     1,
+		"queue_timeout": "10ms",
+	}))(blockingProxy(started, release))
+
+	go p(context.Background(), &Request{})
+	<-started
+	if _, err := p(context.Background(), &Request{}); !errors.As(err, &ConcurrencyLimitError{}) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestLimiter_adaptive(t *testing.T) {
+	cfg, _ := getConcurrencyConfig(config.ExtraConfig{Namespace: map[string]interface{}{concurrencyKey: map[string]interface{}{
+		"max_in_flight": 10,
+		"adaptive":      map[string]interface{}{"min_limit": 5, "max_limit": 20},
+	}}})
+	l := newLimiter("adaptive", cfg)
+
+	// 延迟稳定并且名额使用过半时增大limit
+	for i := 0; i < 100; i++ {
+		for j := 0; j < 10; j++ {
+			l.acquire(context.Background())
+		}
+		for j := 0; j < 10; j++ {
+			l.release(10*time.Millisecond, nil)
+		}
+	}
+	if l.currentLimit() <= 10 || l.currentLimit() > 20 {
+		t.Errorf("the limit should grow: %d", l.currentLimit())
+	}
+
+	// 延迟升高或者超时时缩小limit
+	for i := 0; i < 50; i++ {
+		l.acquire(context.Background())
+		l.release(time.Second, context.DeadlineExceeded)
+	}
+	if l.currentLimit() != 5 {
+		t.Errorf("the limit should shrink to the minimum: %d", l.currentLimit())
+	}
+	if v := l.limitGauge.Value(); v != 5 {
+		t.Errorf("unexpected limit gauge %d", v)
+	}
+}
+
+func TestNewBackendConcurrencyMiddleware_stream(t *testing.T) {
+	registry := metrics.NewRegistry()
+	SetConcurrencyRegistry(registry)
+	defer SetConcurrencyRegistry(nil)
+
+	extra := config.ExtraConfig{Namespace: map[string]interface{}{concurrencyKey: map[string]interface{}{"max_in_flight": 1}}}
+	backend := &config.Backend{URLPattern: "/events", ExtraConfig: extra}
+	reader, writer := io.Pipe()
+	p := NewBackendConcurrencyMiddleware(&config.EndpointConfig{Endpoint: "/events", Method: http.MethodGet}, backend)(func(_ context.Context, _ *Request) (*Response, error) {
+		return &Response{IsComplete: true, Io: reader}, nil
+	})
+	// 相同url_pattern但是属于另一个endpoint的backend使用独立的名额
+	other := NewBackendConcurrencyMiddleware(&config.EndpointConfig{Endpoint: "/events", Method: http.MethodPost}, backend)(func(_ context.Context, _ *Request) (*Response, error) {
+		return &Response{IsComplete: true}, nil
+	})
+
+	resp, err := p(context.Background(), &Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other(context.Background(), &Request{}); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	// 响应体还在传输, 名额没有释放
+	if _, err := p(context.Background(), &Request{}); !errors.As(err, &ConcurrencyLimitError{}) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if g := metrics.GetOrRegisterGauge("concurrency.backend.GET./events./events.in_flight", registry).Value(); g != 1 {
+		t.Errorf("unexpected in flight gauge %d", g)
+	}
+
+	go func() {
+		writer.Write([]byte("data: 1\n\n"))
+		writer.Close()
+	}()
+	if body, err := ioutil.ReadAll(resp.Io); err != nil || string(body) != "data: 1\n\n" {
+		t.Errorf("unexpected body %q: %v", body, err)
+	}
+	if g := metrics.GetOrRegisterGauge("concurrency.backend.GET./events./events.in_flight", registry).Value(); g != 0 {
+		t.Errorf("unexpected in flight gauge %d", g)
+	}
+	if _, err := p(context.Background(), &Request{}); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -2,7 +2,6 @@ package proxy
 
 import (
 	"context"
-	"fmt"
 	"melody/config"
 	"regexp"
 	"strconv"
@@ -31,7 +30,9 @@ type incrementalMergeAccumulator struct {
 }
 
 func initResponseCombiners() *combinerRegister {
-	return newCombinerRegister(map[string]ResponseCombiner{defaultCombinerName: combineData}, combineData)
+	r := newCombinerRegister(map[string]ResponseCombiner{defaultCombinerName: combineData}, combineData)
+	registerBuiltinCombiners(r)
+	return r
 }
 
 // NewMergeDataMiddleware 为多个backends的endpoint包裹一层middleware去合并response
@@ -44,29 +45,57 @@ func NewMergeDataMiddleware(config *config.EndpointConfig) Middleware {
 		return EmptyMiddleware
 	}
 
-	serviceTimeOut := time.Duration(85*config.Timeout.Nanoseconds()/100) * time.Nanosecond
+	// 合并使用endpoint的timeout, 请求的context已经有更早的deadline时以context为准
+	serviceTimeOut := config.Timeout
 	combiner := getResponseCombiner(config.ExtraConfig)
+	// 按照请求属性选择需要调用的backend, 没有配置条件时为nil
+	conditions, hasConditions := getConditions(config.Backends)
+	if !hasConditions {
+		conditions = nil
+	}
 	return func(proxy ...Proxy) Proxy {
 		if len(proxy) != totalBackends {
 			panic(ErrNotEnoughProxies)
 		}
 
 		if !shouldRunSequentialMerger(config.ExtraConfig) {
+			if getCombinerName(config.ExtraConfig) == firstSuccessfulCombinerName {
+				// 第一个成功的response直接返回
+				return firstSuccessfulMerge(serviceTimeOut, conditions, proxy...)
+			}
 			// 并行合并请求
-			return parallelMerge(serviceTimeOut, combiner, proxy...)
+			return parallelMerge(serviceTimeOut, combiner, conditions, proxy...)
 		}
 		// 链式合并请求
 		patterns := make([]string, len(config.Backends))
+		timeouts := make([]time.Duration, len(config.Backends))
 		for i, v := range config.Backends {
 			patterns[i] = v.URLPattern
+			timeouts[i] = v.Timeout
 		}
 
-		return sequentialMerge(patterns, serviceTimeOut, combiner, proxy...)
+		return sequentialMerge(patterns, timeouts, getFanOutConfigs(config.Backends), serviceTimeOut, combiner, conditions, proxy...)
 	}
 }
 
-func sequentialMerge(patterns []string, timeout time.Duration, combiner ResponseCombiner, proxy ...Proxy) Proxy {
+// sequentialMerge 依次调用backend, 每一步按照backend的timeout分配剩余的时间
+func sequentialMerge(patterns []string, timeouts []time.Duration, fanOuts []*fanOutConfig, timeout time.Duration, combiner ResponseCombiner, conditions []condition, proxy ...Proxy) Proxy {
 	return func(ctx context.Context, request *Request) (response *Response, err error) {
+		matched := make([]bool, len(proxy))
+		if conditions == nil {
+			for i := range matched {
+				matched[i] = true
+			}
+		} else {
+			indexes := matchingBackends(conditions, newRoutingInput(ctx, request))
+			if len(indexes) == 0 {
+				return nil, ErrNoMatchingBackends
+			}
+			for _, i := range indexes {
+				matched[i] = true
+			}
+		}
+
 		localCtx, cancel := context.WithTimeout(ctx, timeout)
 
 		responses := make([]*Response, len(proxy))
@@ -77,6 +106,12 @@ func sequentialMerge(patterns []string, timeout time.Duration, combiner Response
 
 	Loop:
 		for i, nextProxy := range proxy {
+			// 不满足路由条件的backend直接跳过, 后续backend引用它的数据时参数不会被替换
+			if !matched[i] {
+				acc.Skip()
+				continue
+			}
+			var collection *fanOutCollection
 			if i > 0 {
 				for _, match := range sequentialLastParamKeyRegexp.FindAllStringSubmatch(patterns[i], -1) {
 					if len(match) > 1 {
@@ -90,47 +125,51 @@ func sequentialMerge(patterns []string, timeout time.Duration, combiner Response
 
 						key := "Resp" + match[1] + "_" + match[2]
 
-						var v interface{}
-						var ok bool
-
-						data := responses[index].Data
-						keys := strings.Split(match[2], ".")
-						if len(keys) > 1 {
-							for _, k := range keys[:len(keys)-1] {
-								v, ok = data[k]
-								if !ok {
-									break
-								}
-								switch clean := v.(type) {
-								case map[string]interface{}:
-									data = clean
-								default:
-									break
-								}
-							}
-						}
 						// 从index对应的backend的response中拿出参数
-						v, ok = data[keys[len(keys)-1]]
+						v, c, ok := lookupSequentialParam(responses[index].Data, strings.Split(match[2], "."))
 						if !ok {
 							continue
 						}
-
-						switch t := v.(type) {
-						case string:
-							request.Params[key] = t
-						case int:
-							request.Params[key] = strconv.Itoa(t)
-						case float64:
-							request.Params[key] = strconv.FormatFloat(t, 'E', -1, 32)
-						case bool:
-							request.Params[key] = strconv.FormatBool(t)
-						default:
-							request.Params[key] = fmt.Sprintf("%v", v)
+						if c != nil {
+							// 配置了fan_out时, 对数组的每个元素调用一次backend, 只展开第一个数组
+							if fanOuts[i] != nil {
+								if collection == nil {
+									c.key = key
+									collection = c
+								}
+								continue
+							}
+							if len(c.rest) > 0 {
+								continue
+							}
 						}
+						request.Params[key] = sequentialParamValue(v)
 					}
 				}
 			}
-			requestPart(localCtx, nextProxy, request, out, errChan)
+			stepCtx, stepCancel := localCtx, context.CancelFunc(func() {})
+			if budget := stepBudget(localCtx, timeouts, matched, i); budget > 0 {
+				stepCtx, stepCancel = context.WithTimeout(localCtx, budget)
+			}
+			if collection != nil {
+				response, err := fanOut(stepCtx, nextProxy, request, collection, fanOuts[i])
+				stepCancel()
+				if response == nil {
+					acc.Merge(nil, err)
+					break Loop
+				}
+				acc.Merge(response, nil)
+				if err != nil {
+					acc.errs = append(acc.errs, err)
+				}
+				if !response.IsComplete {
+					break Loop
+				}
+				responses[i] = response
+				continue
+			}
+			requestPart(stepCtx, nextProxy, request, out, errChan)
+			stepCancel()
 			select {
 			case err := <-errChan:
 				if i == 0 {
@@ -154,8 +193,13 @@ func sequentialMerge(patterns []string, timeout time.Duration, combiner Response
 	}
 }
 
-func parallelMerge(timeout time.Duration, rc ResponseCombiner, next ...Proxy) Proxy {
+func parallelMerge(timeout time.Duration, rc ResponseCombiner, conditions []condition, proxies ...Proxy) Proxy {
 	return func(ctx context.Context, request *Request) (response *Response, e error) {
+		next, err := selectProxies(ctx, request, conditions, proxies)
+		if err != nil {
+			return nil, err
+		}
+
 		localCtx, cancel := context.WithTimeout(ctx, timeout)
 		responses := make(chan *Response, len(next))
 		failed := make(chan error, len(next))
@@ -201,6 +245,11 @@ func (i *incrementalMergeAccumulator) Merge(res *Response, err error) {
 	i.data = i.combiner(2, []*Response{i.data, res})
 }
 
+// Skip 不满足路由条件而没有被调用的backend, 不影响结果的完整性
+func (i *incrementalMergeAccumulator) Skip() {
+	i.pending--
+}
+
 func (i *incrementalMergeAccumulator) Result() (*Response, error) {
 	if i.data == nil {
 		return &Response{
@@ -239,51 +288,64 @@ func shouldRunSequentialMerger(config config.ExtraConfig) bool {
 
 func getResponseCombiner(extra config.ExtraConfig) ResponseCombiner {
 	combiner, _ := responseCombiners.GetResponseCombiner(defaultCombinerName)
+	name := getCombinerName(extra)
+	if name == "" {
+		return combiner
+	}
+	// 需要参数的combiner, 参数来自 combiner_config
+	if f, ok := responseCombiners.GetResponseCombinerFactory(name); ok {
+		cfg := map[string]interface{}{}
+		if temp, ok := extra[Namespace].(map[string]interface{}); ok {
+			if c, ok := temp[combinerConfigKey].(map[string]interface{}); ok {
+				cfg = c
+			}
+		}
+		return f(cfg)
+	}
+	if c, ok := responseCombiners.GetResponseCombiner(name); ok {
+		combiner = c
+	}
+	return combiner
+}
+
+func getCombinerName(extra config.ExtraConfig) string {
 	if v, ok := extra[Namespace]; ok {
 		if temp, ok := v.(map[string]interface{}); ok {
-			if s, ok := temp[mergeKey]; ok {
-				if c, ok := responseCombiners.GetResponseCombiner(s.(string)); ok {
-					combiner = c
-				}
+			if s, ok := temp[mergeKey].(string); ok {
+				return s
 			}
 		}
 	}
-	return combiner
+	return ""
 }
 
 func combineData(count int, responses []*Response) *Response {
-	isComplete := len(responses) == count
-	var resp *Response
-	for _, v := range responses {
-		if v == nil || v.Data == nil {
-			isComplete = false
-			continue
-		}
-		isComplete = isComplete && v.IsComplete
-		if resp == nil {
-			resp = v
-			continue
-		}
-		for k, v := range v.Data {
-			resp.Data[k] = v
-		}
+	return mergeResponses(count, responses, shallowMerge)
+}
+
+// selectProxies 返回满足路由条件的backend
+func selectProxies(ctx context.Context, request *Request, conditions []condition, proxies []Proxy) ([]Proxy, error) {
+	if conditions == nil {
+		return proxies, nil
 	}
-	if nil == resp {
-		return &Response{
-			Data:       map[string]interface{}{},
-			IsComplete: isComplete,
-		}
+	indexes := matchingBackends(conditions, newRoutingInput(ctx, request))
+	if len(indexes) == 0 {
+		return nil, ErrNoMatchingBackends
+	}
+	next := make([]Proxy, len(indexes))
+	for i, index := range indexes {
+		next[i] = proxies[index]
 	}
-	resp.IsComplete = isComplete
-	return resp
+	return next, nil
 }
 
-//TODO 实现自定义combineData，可以根据mergeKey读取
-
 func requestPart(ctx context.Context, next Proxy, request *Request, out chan<- *Response, failed chan<- error) {
 	localCtx, cancel := context.WithCancel(ctx)
 
-	resp, err := next(localCtx, request)
+	// 每个backend使用一个独立的请求体reader
+	part, release := replayRequest(request)
+	resp, err := next(localCtx, part)
+	release()
 
 	if err != nil {
 		failed <- err
@@ -324,3 +386,8 @@ func (m mergeError) Error() string {
 	}
 	return strings.Join(msg, "\n")
 }
+
+// Errors 返回合并之前各个backend的错误
+func (m mergeError) Errors() []error {
+	return m.errs
+}
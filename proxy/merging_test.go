@@ -329,7 +329,7 @@ func TestNewMergeDataMiddleware_sequential(t *testing.T) {
 		func(ctx context.Context, r *Request) (*Response, error) {
 			checkRequestParam(t, r, "Resp0_int", "42")
 			checkRequestParam(t, r, "Resp0_string", "some")
-			checkRequestParam(t, r, "Resp0_float", "3.14E+00")
+			checkRequestParam(t, r, "Resp0_float", "3.14")
 			checkRequestParam(t, r, "Resp0_bool", "true")
 			checkRequestParam(t, r, "Resp0_struct.foo", "bar")
 			return &Response{Data: map[string]interface{}{"tupu": "foo"}, IsComplete: true}, nil
@@ -337,7 +337,7 @@ func TestNewMergeDataMiddleware_sequential(t *testing.T) {
 		func(ctx context.Context, r *Request) (*Response, error) {
 			checkRequestParam(t, r, "Resp0_int", "42")
 			checkRequestParam(t, r, "Resp0_string", "some")
-			checkRequestParam(t, r, "Resp0_float", "3.14E+00")
+			checkRequestParam(t, r, "Resp0_float", "3.14")
 			checkRequestParam(t, r, "Resp0_bool", "true")
 			checkRequestParam(t, r, "Resp0_struct.foo", "bar")
 			checkRequestParam(t, r, "Resp1_tupu", "foo")
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"io"
 	"melody/config"
+	"sync"
 )
 
 // Namespace to be used in extra config
@@ -40,6 +41,8 @@ type Response struct {
 	IsComplete bool
 	Io         io.Reader
 	Metadata   Metadata
+	// 请求失败时返回给客户端的错误, 由endpoint层设置
+	Error *Error
 }
 
 type Middleware func(...Proxy) Proxy
@@ -60,6 +63,11 @@ func (r readCloserWrapper) Read(p []byte) (n int, err error) {
 	return r.rc.Read(p)
 }
 
+// Close implements the io.Closer interface
+func (r readCloserWrapper) Close() error {
+	return r.rc.Close()
+}
+
 func (r readCloserWrapper) closeWhenCancel() {
 	<-r.ctx.Done()
 	r.rc.Close()
@@ -74,4 +82,49 @@ func NewReadCloserWrapper(ctx context.Context, reader io.ReadCloser) io.Reader {
 	return wrapper
 }
 
+// cancelOnClose 响应带有Io时, 在Io读取结束或者关闭之后才调用cancel, 否则立即调用
+// 避免在backend的响应体还在读取时取消请求的context
+func cancelOnClose(resp *Response, cancel context.CancelFunc) {
+	if resp == nil || resp.Io == nil {
+		cancel()
+		return
+	}
+	resp.Io = &cancelReader{r: resp.Io, cancel: cancel}
+}
+
+type cancelReader struct {
+	r      io.Reader
+	cancel context.CancelFunc
+	once   sync.Once
+}
+
+// Read implements the io.Reader interface
+func (c *cancelReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if err != nil {
+		c.once.Do(c.cancel)
+	}
+	return n, err
+}
+
+// Close implements the io.Closer interface
+func (c *cancelReader) Close() error {
+	var err error
+	if rc, ok := c.r.(io.Closer); ok {
+		err = rc.Close()
+	}
+	c.once.Do(c.cancel)
+	return err
+}
+
+// closeResponse 关闭被丢弃的响应的Io, 释放backend的连接
+func closeResponse(resp *Response) {
+	if resp == nil {
+		return
+	}
+	if rc, ok := resp.Io.(io.Closer); ok {
+		rc.Close()
+	}
+}
+
 func NoopProxy(_ context.Context, _ *Request) (*Response, error) { return nil, nil }
@@ -4,6 +4,7 @@ import "melody/register"
 
 type Register struct {
 	*combinerRegister
+	*cacheRegister
 }
 
 type combinerRegister struct {
@@ -14,6 +15,7 @@ type combinerRegister struct {
 func NewRegister() *Register {
 	return &Register{
 		responseCombiners,
+		responseCaches,
 	}
 }
 
@@ -39,3 +41,43 @@ func (r *combinerRegister) GetResponseCombiner(name string) (ResponseCombiner, b
 func (r *combinerRegister) SetResponseCombiner(name string, rc ResponseCombiner) {
 	r.data.Register(name, rc)
 }
+
+// GetResponseCombinerFactory 返回需要参数的ResponseCombiner的构造函数
+func (r *combinerRegister) GetResponseCombinerFactory(name string) (ResponseCombinerFactory, bool) {
+	v, ok := r.data.Get(name)
+	if !ok {
+		return nil, ok
+	}
+	f, ok := v.(ResponseCombinerFactory)
+	return f, ok
+}
+
+func (r *combinerRegister) SetResponseCombinerFactory(name string, f ResponseCombinerFactory) {
+	r.data.Register(name, f)
+}
+
+type cacheRegister struct {
+	factories register.Untyped
+	fallback  ResponseCacheFactory
+}
+
+func initResponseCaches() *cacheRegister {
+	r := register.New()
+	r.Register(defaultCacheStore, ResponseCacheFactory(NewMemoryResponseCache))
+	return &cacheRegister{r, NewMemoryResponseCache}
+}
+
+func (r *cacheRegister) GetResponseCacheFactory(name string) ResponseCacheFactory {
+	v, ok := r.factories.Get(name)
+	if !ok {
+		return r.fallback
+	}
+	if f, ok := v.(ResponseCacheFactory); ok {
+		return f
+	}
+	return r.fallback
+}
+
+func (r *cacheRegister) SetResponseCacheFactory(name string, f ResponseCacheFactory) {
+	r.factories.Register(name, f)
+}
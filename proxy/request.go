@@ -2,9 +2,11 @@ package proxy
 
 import (
 	"bytes"
+	"encoding/json"
 	"io"
 	"io/ioutil"
 	"net/url"
+	"strings"
 )
 
 // Request 包含了从Endpoint发送
@@ -19,6 +21,7 @@ type Request struct {
 	Headers map[string][]string
 }
 
+// Clone 返回一个浅拷贝, 与r共用同一个请求体
 func (r *Request) Clone() Request {
 	return Request{
 		Method:  r.Method,
@@ -31,7 +34,8 @@ func (r *Request) Clone() Request {
 	}
 }
 
-// CloneRequest 返回一个请求副本
+// CloneRequest 返回一个请求副本, 缓存过的请求体会得到一个新的reader
+// 使用完副本之后需要关闭它的请求体
 func CloneRequest(r *Request) *Request {
 	clone := r.Clone()
 	clone.Headers = CloneRequestHeaders(r.Headers)
@@ -39,6 +43,10 @@ func CloneRequest(r *Request) *Request {
 	if r.Body == nil {
 		return &clone
 	}
+	if body := replay(r.Body); body != nil {
+		clone.Body = body
+		return &clone
+	}
 	buf := new(bytes.Buffer)
 	buf.ReadFrom(r.Body)
 	r.Body.Close()
@@ -84,3 +92,40 @@ func (r *Request) GeneratePath(URLPattern string) {
 	}
 	r.Path = string(buff)
 }
+
+// RequestData 合并请求的json body、query string和url参数, 后者优先, 同名(不区分大小写)的值会被覆盖
+// 供需要把请求转换为其他协议的backend(例如gRPC、GraphQL)使用
+func RequestData(request *Request) (map[string]interface{}, error) {
+	data := map[string]interface{}{}
+	if request.Body != nil {
+		err := json.NewDecoder(request.Body).Decode(&data)
+		request.Body.Close()
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+	for k, vs := range request.Query {
+		if len(vs) == 1 {
+			setValue(data, k, vs[0])
+			continue
+		}
+		values := make([]interface{}, len(vs))
+		for i, v := range vs {
+			values[i] = v
+		}
+		setValue(data, k, values)
+	}
+	for k, v := range request.Params {
+		setValue(data, k, v)
+	}
+	return data, nil
+}
+
+func setValue(data map[string]interface{}, key string, v interface{}) {
+	for k := range data {
+		if strings.EqualFold(k, key) {
+			delete(data, k)
+		}
+	}
+	data[key] = v
+}
@@ -0,0 +1,264 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"melody/config"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	requestBodyKey          = "request_body"
+	requestBodyEncodingJSON = "json"
+	requestBodyEncodingForm = "form"
+	requestBodyEncodingXML  = "xml"
+	defaultXMLRoot          = "request"
+)
+
+// requestBodyConfig 发送给backend之前对JSON请求体的处理, 按照字段顺序执行
+type requestBodyConfig struct {
+	PropertyFilter propertyFilter
+	Mapping        map[string]string
+	// 写入固定的字段
+	Static map[string]interface{}
+	// 字段名 -> header名, 从请求头中取值写入字段
+	Headers map[string]string
+	// 将整个请求体包裹在该key下
+	Wrap     string
+	Encoding string
+	XMLRoot  string
+}
+
+// bodylessMethods 不携带请求体的方法, 不改写请求体
+var bodylessMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+// NewRequestBodyMiddleware 根据 melody_proxy.request_body 改写发送给backend的请求体
+// 没有请求体、请求体为空或者不是JSON的请求原样传递
+func NewRequestBodyMiddleware(backend *config.Backend) Middleware {
+	cfg, ok := getRequestBodyConfig(backend.ExtraConfig)
+	if !ok {
+		return EmptyMiddleware
+	}
+	return func(next ...Proxy) Proxy {
+		if len(next) > 1 {
+			panic(ErrTooManyProxies)
+		}
+		return func(ctx context.Context, request *Request) (*Response, error) {
+			if request.Body == nil || request.Body == http.NoBody || bodylessMethods[request.Method] {
+				return next[0](ctx, request)
+			}
+			if ct, ok := requestHeader(request, "Content-Type", "Content-Type"); ok && !strings.Contains(strings.ToLower(ct), "json") {
+				return next[0](ctx, request)
+			}
+			r, err := cfg.transform(request)
+			if err != nil {
+				return nil, err
+			}
+			return next[0](ctx, r)
+		}
+	}
+}
+
+func (c requestBodyConfig) transform(request *Request) (*Request, error) {
+	raw, err := ioutil.ReadAll(request.Body)
+	request.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	data := map[string]interface{}{}
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	if len(bytes.TrimSpace(raw)) == 0 || d.Decode(&data) != nil {
+		// 空的或者不是JSON对象的请求体原样传递
+		r := request.Clone()
+		r.Body = ioutil.NopCloser(bytes.NewReader(raw))
+		return &r, nil
+	}
+
+	entity := &Response{Data: data}
+	if len(entity.Data) > 0 {
+		c.PropertyFilter(entity)
+	}
+	for formerKey, newKey := range c.Mapping {
+		if v, ok := entity.Data[formerKey]; ok {
+			entity.Data[newKey] = v
+			delete(entity.Data, formerKey)
+		}
+	}
+	for k, v := range c.Static {
+		entity.Data[k] = v
+	}
+	for k, name := range c.Headers {
+		if v, ok := requestHeader(request, name, textproto.CanonicalMIMEHeaderKey(name)); ok {
+			entity.Data[k] = v
+		}
+	}
+	data = entity.Data
+	if c.Wrap != "" {
+		data = map[string]interface{}{c.Wrap: data}
+	}
+
+	var body []byte
+	var contentType string
+	switch c.Encoding {
+	case requestBodyEncodingForm:
+		body = []byte(encodeForm(data).Encode())
+		contentType = "application/x-www-form-urlencoded"
+	case requestBodyEncodingXML:
+		body, err = encodeXML(c.XMLRoot, data)
+		contentType = "application/xml"
+	default:
+		body, err = json.Marshal(data)
+		contentType = "application/json"
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r := request.Clone()
+	r.Headers = CloneRequestHeaders(request.Headers)
+	r.Headers["Content-Type"] = []string{contentType}
+	r.Headers["Content-Length"] = []string{strconv.Itoa(len(body))}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return &r, nil
+}
+
+// encodeForm 嵌套的对象使用 a.b 作为key, 数组展开为多个值
+func encodeForm(data map[string]interface{}) url.Values {
+	values := url.Values{}
+	var walk func(prefix string, v interface{})
+	walk = func(prefix string, v interface{}) {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			for k, sub := range t {
+				if prefix != "" {
+					k = prefix + "." + k
+				}
+				walk(k, sub)
+			}
+		case []interface{}:
+			for _, sub := range t {
+				walk(prefix, sub)
+			}
+		case nil:
+			values.Add(prefix, "")
+		default:
+			values.Add(prefix, fmt.Sprintf("%v", t))
+		}
+	}
+	walk("", data)
+	return values
+}
+
+// encodeXML 对象的key作为元素名, 数组展开为多个同名元素
+func encodeXML(root string, data map[string]interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	enc := xml.NewEncoder(buf)
+	var walk func(name string, v interface{}) error
+	walk = func(name string, v interface{}) error {
+		if items, ok := v.([]interface{}); ok {
+			for _, item := range items {
+				if err := walk(name, item); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		start := xml.StartElement{Name: xml.Name{Local: name}}
+		if err := enc.EncodeToken(start); err != nil {
+			return err
+		}
+		switch t := v.(type) {
+		case map[string]interface{}:
+			keys := make([]string, 0, len(t))
+			for k := range t {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				if err := walk(k, t[k]); err != nil {
+					return err
+				}
+			}
+		case nil:
+		default:
+			if err := enc.EncodeToken(xml.CharData(fmt.Sprintf("%v", t))); err != nil {
+				return err
+			}
+		}
+		return enc.EncodeToken(start.End())
+	}
+	if err := walk(root, data); err != nil {
+		return nil, err
+	}
+	if err := enc.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func getRequestBodyConfig(extra config.ExtraConfig) (requestBodyConfig, bool) {
+	v, ok := extra[Namespace]
+	if !ok {
+		return requestBodyConfig{}, false
+	}
+	e, ok := v.(map[string]interface{})
+	if !ok {
+		return requestBodyConfig{}, false
+	}
+	tmp, ok := e[requestBodyKey].(map[string]interface{})
+	if !ok {
+		return requestBodyConfig{}, false
+	}
+
+	cfg := requestBodyConfig{
+		Mapping:  map[string]string{},
+		Static:   map[string]interface{}{},
+		Headers:  map[string]string{},
+		Encoding: getStringOr(tmp, "encoding", requestBodyEncodingJSON),
+		XMLRoot:  getStringOr(tmp, "xml_root", defaultXMLRoot),
+	}
+	switch cfg.Encoding {
+	case requestBodyEncodingJSON, requestBodyEncodingForm, requestBodyEncodingXML:
+	default:
+		cfg.Encoding = requestBodyEncodingJSON
+	}
+	if whitelist := getStrings(tmp, "whitelist"); len(whitelist) > 0 {
+		cfg.PropertyFilter = newWhitelistingFilter(whitelist)
+	} else {
+		cfg.PropertyFilter = newBlacklistingFilter(getStrings(tmp, "blacklist"))
+	}
+	if m, ok := tmp["mapping"].(map[string]interface{}); ok {
+		for k, v := range m {
+			if s, ok := v.(string); ok {
+				cfg.Mapping[k] = s
+			}
+		}
+	}
+	if m, ok := tmp["static"].(map[string]interface{}); ok {
+		cfg.Static = m
+	}
+	if m, ok := tmp["headers"].(map[string]interface{}); ok {
+		for k, v := range m {
+			if s, ok := v.(string); ok {
+				cfg.Headers[k] = s
+			}
+		}
+	}
+	cfg.Wrap, _ = tmp["wrap"].(string)
+	return cfg, true
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"melody/config"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+func newRequestBodyBackend(cfg map[string]interface{}) *config.Backend {
+	return &config.Backend{
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{requestBodyKey: cfg},
+		},
+	}
+}
+
+func captureBody(t *testing.T, mw Middleware, request *Request) (*Request, []byte) {
+	var captured *Request
+	var body []byte
+	p := mw(func(_ context.Context, r *Request) (*Response, error) {
+		captured = r
+		if r.Body != nil {
+			body, _ = ioutil.ReadAll(r.Body)
+		}
+		return &Response{IsComplete: true}, nil
+	})
+	if _, err := p(context.Background(), request); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	return captured, body
+}
+
+func TestNewRequestBodyMiddleware_json(t *testing.T) {
+	mw := NewRequestBodyMiddleware(newRequestBodyBackend(map[string]interface{}{
+		"blacklist": []interface{}{"password", "user.internal"},
+		"mapping":   map[string]interface{}{"name": "full_name"},
+		"static":    map[string]interface{}{"source": "gateway"},
+		"headers":   map[string]interface{}{"tenant": "X-Tenant"},
+		"wrap":      "data",
+	}))
+	request := &Request{
+		Headers: map[string][]string{"X-Tenant": {"acme"}, "Content-Length": {"1024"}},
+		Body:    ioutil.NopCloser(bytes.NewBufferString(`{"name":"foo","password":"secret","age":42,"user":{"id":1,"internal":true}}`)),
+	}
+	r, body := captureBody(t, mw, request)
+
+	var res map[string]map[string]interface{}
+	if err := json.Unmarshal(body, &res); err != nil {
+		t.Fatalf("unexpected body %s: %s", string(body), err.Error())
+	}
+	data := res["data"]
+	if data["full_name"] != "foo" || data["source"] != "gateway" || data["tenant"] != "acme" || data["age"] != 42.0 {
+		t.Errorf("unexpected body: %s", string(body))
+	}
+	if _, ok := data["password"]; ok {
+		t.Errorf("the blacklisted field was sent: %s", string(body))
+	}
+	if user := data["user"].(map[string]interface{}); len(user) != 1 {
+		t.Errorf("the nested blacklisted field was sent: %s", string(body))
+	}
+	if r.Headers["Content-Type"][0] != "application/json" {
+		t.Errorf("unexpected content type: %v", r.Headers["Content-Type"])
+	}
+	if r.Headers["Content-Length"][0] != strconv.Itoa(len(body)) {
+		t.Errorf("the content length was not updated: %v", r.Headers["Content-Length"])
+	}
+	if request.Headers["Content-Type"] != nil {
+		t.Error("the headers of the original request were modified")
+	}
+}
+
+func TestNewRequestBodyMiddleware_form(t *testing.T) {
+	mw := NewRequestBodyMiddleware(newRequestBodyBackend(map[string]interface{}{
+		"whitelist": []interface{}{"a", "b"},
+		"encoding":  "form",
+	}))
+	r, body := captureBody(t, mw, &Request{
+		Headers: map[string][]string{},
+		Body:    ioutil.NopCloser(bytes.NewBufferString(`{"a":"1","b":{"c":2},"d":3,"e":[1,2]}`)),
+	})
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values.Get("a") != "1" || values.Get("b.c") != "2" || len(values) != 2 {
+		t.Errorf("unexpected form: %s", string(body))
+	}
+	if r.Headers["Content-Type"][0] != "application/x-www-form-urlencoded" {
+		t.Errorf("unexpected content type: %v", r.Headers["Content-Type"])
+	}
+}
+
+func TestNewRequestBodyMiddleware_xml(t *testing.T) {
+	mw := NewRequestBodyMiddleware(newRequestBodyBackend(map[string]interface{}{
+		"encoding": "xml",
+		"xml_root": "order",
+	}))
+	_, body := captureBody(t, mw, &Request{
+		Headers: map[string][]string{},
+		Body:    ioutil.NopCloser(bytes.NewBufferString(`{"id":1,"items":["a","b<c"],"buyer":{"name":"foo"}}`)),
+	})
+	expected := `<order><buyer><name>foo</name></buyer><id>1</id><items>a</items><items>b&lt;c</items></order>`
+	if string(body) != expected {
+		t.Errorf("unexpected xml: %s", string(body))
+	}
+}
+
+func TestNewRequestBodyMiddleware_passThrough(t *testing.T) {
+	mw := NewRequestBodyMiddleware(newRequestBodyBackend(map[string]interface{}{
+		"static": map[string]interface{}{"source": "gateway"},
+	}))
+	for _, request := range []*Request{
+		{Method: http.MethodGet, Body: http.NoBody},
+		{Method: http.MethodGet, Body: ioutil.NopCloser(bytes.NewBufferString(`{"a":1}`))},
+		{Method: http.MethodPost, Body: http.NoBody},
+		{Method: http.MethodPost, Body: ioutil.NopCloser(bytes.NewBufferString(``))},
+		{Method: http.MethodPost, Body: ioutil.NopCloser(bytes.NewBufferString(`not json`))},
+		{
+			Method:  http.MethodPost,
+			Headers: map[string][]string{"Content-Type": {"text/plain"}},
+			Body:    ioutil.NopCloser(bytes.NewBufferString(`{"a":1}`)),
+		},
+	} {
+		expected := ""
+		if request.Body != http.NoBody {
+			b, _ := ioutil.ReadAll(request.Body)
+			expected = string(b)
+			request.Body = ioutil.NopCloser(bytes.NewReader(b))
+		}
+		r, body := captureBody(t, mw, request)
+		if string(body) != expected {
+			t.Errorf("%s: unexpected body %q", request.Method, body)
+		}
+		if _, ok := r.Headers["Content-Length"]; ok {
+			t.Errorf("%s: unexpected headers %v", request.Method, r.Headers)
+		}
+	}
+}
+
+func TestNewRequestBodyMiddleware_noConfig(t *testing.T) {
+	mw := NewRequestBodyMiddleware(&config.Backend{})
+	_, body := captureBody(t, mw, &Request{Body: ioutil.NopCloser(bytes.NewBufferString(`raw`))})
+	if string(body) != "raw" {
+		t.Errorf("unexpected body: %s", string(body))
+	}
+}
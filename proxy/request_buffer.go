@@ -0,0 +1,268 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"melody/config"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+)
+
+const (
+	requestBufferKey = "request_buffer"
+	// 默认超过 1MB 的请求体写入临时文件
+	defaultMemoryBodySize = 1 << 20
+)
+
+// requestBufferConfig endpoint缓存请求体的配置
+type requestBufferConfig struct {
+	// 请求体的最大字节数, 超过时返回413, 0表示不限制
+	MaxSize int64
+	// 超过该字节数的请求体写入临时文件
+	MemoryLimit int64
+	// 临时文件的目录, 为空时使用系统的临时目录
+	Dir string
+}
+
+// RequestBodyTooLargeError 请求体超过了 request_buffer.max_size
+type RequestBodyTooLargeError struct {
+	Limit int64
+}
+
+// Error implements the error interface
+func (e RequestBodyTooLargeError) Error() string {
+	return fmt.Sprintf("request body exceeds the limit of %d bytes", e.Limit)
+}
+
+// Name returns the name of the error
+func (e RequestBodyTooLargeError) Name() string { return "request_body" }
+
+// StatusCode returns the status code of the error
+func (e RequestBodyTooLargeError) StatusCode() int { return http.StatusRequestEntityTooLarge }
+
+// NewRequestBufferMiddleware 在endpoint层把请求体缓存一次, 之后每个backend、重试与shadow请求
+// 通过 CloneRequest 得到各自独立的reader
+// 配置了 melody_proxy.request_buffer 或者endpoint有多个backend时生效, 只有配置了max_size才限制请求体的大小
+func NewRequestBufferMiddleware(endpoint *config.EndpointConfig) Middleware {
+	cfg, ok := getRequestBufferConfig(endpoint.ExtraConfig)
+	if !ok && len(endpoint.Backends) < 2 {
+		return EmptyMiddleware
+	}
+	return newRequestBufferMiddleware(cfg)
+}
+
+func newRequestBufferMiddleware(cfg requestBufferConfig) Middleware {
+	return func(next ...Proxy) Proxy {
+		if len(next) > 1 {
+			panic(ErrTooManyProxies)
+		}
+		return func(ctx context.Context, request *Request) (*Response, error) {
+			if request.Body == nil {
+				return next[0](ctx, request)
+			}
+			if _, ok := request.Body.(*bufferedBody); ok {
+				return next[0](ctx, request)
+			}
+			buf, err := newBodyBuffer(request, cfg)
+			if err != nil {
+				return nil, err
+			}
+			r := request.Clone()
+			body := buf.reader()
+			r.Body = body
+			// 释放endpoint持有的reader, 其他reader都结束之后删除临时文件
+			defer body.Close()
+			return next[0](ctx, &r)
+		}
+	}
+}
+
+// bodyBuffer 缓存的请求体, 较大的请求体保存在临时文件中
+type bodyBuffer struct {
+	mu     sync.Mutex
+	refs   int
+	data   []byte
+	file   *os.File
+	size   int64
+	closed bool
+}
+
+// errBodyBufferClosed 临时文件已经删除之后才开始读取请求体
+var errBodyBufferClosed = errors.New("the buffered request body has been released")
+
+func newBodyBuffer(request *Request, cfg requestBufferConfig) (*bodyBuffer, error) {
+	defer request.Body.Close()
+
+	limited := cfg.MaxSize > 0
+	if v, ok := request.Headers["Content-Length"]; ok && len(v) == 1 && limited {
+		if size, err := strconv.ParseInt(v[0], 10, 64); err == nil && size > cfg.MaxSize {
+			return nil, RequestBodyTooLargeError{Limit: cfg.MaxSize}
+		}
+	}
+
+	memory := cfg.MemoryLimit
+	if limited && memory > cfg.MaxSize {
+		memory = cfg.MaxSize
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(request.Body, memory+1))
+	if err != nil {
+		return nil, err
+	}
+	b := &bodyBuffer{}
+	if int64(len(data)) <= memory {
+		b.data = data
+		b.size = int64(len(data))
+		return b, nil
+	}
+
+	// 超过内存的上限, 写入临时文件
+	f, err := ioutil.TempFile(cfg.Dir, "melody-body-")
+	if err != nil {
+		return nil, err
+	}
+	rest := io.Reader(request.Body)
+	if limited {
+		rest = io.LimitReader(request.Body, cfg.MaxSize+1-int64(len(data)))
+	}
+	n, err := io.Copy(f, io.MultiReader(bytes.NewReader(data), rest))
+	if err == nil && limited && n > cfg.MaxSize {
+		err = RequestBodyTooLargeError{Limit: cfg.MaxSize}
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	b.file = f
+	b.size = n
+	// 没有关闭的reader被回收之后, 兜底删除临时文件
+	runtime.SetFinalizer(b, (*bodyBuffer).close)
+	return b, nil
+}
+
+// reader 返回一个从头读取请求体的reader, reader读取结束或者关闭时释放引用
+func (b *bodyBuffer) reader() *bufferedBody {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refs++
+	if b.closed {
+		return &bufferedBody{buf: b, r: errorReader{errBodyBufferClosed}}
+	}
+	if b.file == nil {
+		return &bufferedBody{buf: b, r: bytes.NewReader(b.data)}
+	}
+	return &bufferedBody{buf: b, r: io.NewSectionReader(b.file, 0, b.size)}
+}
+
+func (b *bodyBuffer) release() {
+	b.mu.Lock()
+	b.refs--
+	done := b.refs == 0
+	b.mu.Unlock()
+	if done {
+		b.close()
+	}
+}
+
+func (b *bodyBuffer) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.file == nil || b.closed {
+		return
+	}
+	b.closed = true
+	b.file.Close()
+	os.Remove(b.file.Name())
+}
+
+type errorReader struct {
+	err error
+}
+
+func (e errorReader) Read(_ []byte) (int, error) { return 0, e.err }
+
+// bufferedBody 缓存的请求体的一个独立的reader
+type bufferedBody struct {
+	buf  *bodyBuffer
+	r    io.Reader
+	once sync.Once
+}
+
+// Read implements the io.Reader interface
+func (b *bufferedBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err == io.EOF {
+		b.Close()
+	}
+	return n, err
+}
+
+// Close implements the io.Closer interface
+func (b *bufferedBody) Close() error {
+	b.once.Do(b.buf.release)
+	return nil
+}
+
+// retain 异步处理请求(例如shadow请求)时持有缓存的请求体, 返回的函数在处理结束之后调用
+// 避免异步的重试在其他reader都结束、临时文件被删除之后才开始读取
+func retain(request *Request) func() {
+	b, ok := request.Body.(*bufferedBody)
+	if !ok {
+		return func() {}
+	}
+	held := b.buf.reader()
+	return func() { held.Close() }
+}
+
+// replay 返回与body内容相同的新reader, body不是缓存的请求体时返回nil
+func replay(body io.ReadCloser) io.ReadCloser {
+	if b, ok := body.(*bufferedBody); ok {
+		return b.buf.reader()
+	}
+	return nil
+}
+
+// replayRequest 缓存过的请求体返回使用新reader的浅拷贝, 处理结束之后调用返回的函数释放该reader
+func replayRequest(request *Request) (*Request, func()) {
+	body := replay(request.Body)
+	if body == nil {
+		return request, func() {}
+	}
+	r := request.Clone()
+	r.Body = body
+	return &r, func() { body.Close() }
+}
+
+// closeRequest 关闭请求副本的请求体
+func closeRequest(r *Request) {
+	if r.Body != nil {
+		r.Body.Close()
+	}
+}
+
+func getRequestBufferConfig(extra config.ExtraConfig) (requestBufferConfig, bool) {
+	cfg := requestBufferConfig{MemoryLimit: defaultMemoryBodySize}
+	v, ok := extra[Namespace]
+	if !ok {
+		return cfg, false
+	}
+	e, ok := v.(map[string]interface{})
+	if !ok {
+		return cfg, false
+	}
+	tmp, ok := e[requestBufferKey].(map[string]interface{})
+	if !ok {
+		return cfg, false
+	}
+	cfg.MaxSize = int64(getInt(tmp, "max_size", 0))
+	cfg.MemoryLimit = int64(getInt(tmp, "memory_limit", defaultMemoryBodySize))
+	cfg.Dir, _ = tmp["dir"].(string)
+	return cfg, true
+}
@@ -0,0 +1,271 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"melody/config"
+	"melody/encoding"
+	"melody/logging"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// bodyRecorder 记录每个backend读取到的请求体
+type bodyRecorder struct {
+	mu     sync.Mutex
+	bodies map[string]string
+}
+
+func (b *bodyRecorder) proxy(name string) Proxy {
+	return func(_ context.Context, r *Request) (*Response, error) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		r.Body.Close()
+		b.mu.Lock()
+		b.bodies[name] = string(body)
+		b.mu.Unlock()
+		return &Response{Data: map[string]interface{}{name: true}, IsComplete: true}, nil
+	}
+}
+
+func newBufferedEndpoint(extra map[string]interface{}) *config.EndpointConfig {
+	cfg := &config.EndpointConfig{
+		Timeout:  time.Second,
+		Backends: []*config.Backend{{URLPattern: "/a"}, {URLPattern: "/b"}},
+	}
+	if extra != nil {
+		cfg.ExtraConfig = config.ExtraConfig{Namespace: map[string]interface{}{requestBufferKey: extra}}
+	}
+	return cfg
+}
+
+func TestNewRequestBufferMiddleware_fanOut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "melody-body")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, extra := range map[string]map[string]interface{}{
+		"default": nil,
+		"disk":    {"memory_limit": 4, "dir": dir},
+	} {
+		endpoint := newBufferedEndpoint(extra)
+		recorder := &bodyRecorder{bodies: map[string]string{}}
+		p := NewRequestBufferMiddleware(endpoint)(NewMergeDataMiddleware(endpoint)(
+			NewRequestBuilderMiddleware(endpoint.Backends[0])(recorder.proxy("a")),
+			NewRequestBuilderMiddleware(endpoint.Backends[1])(NewShadowProxy(recorder.proxy("b"), recorder.proxy("shadow"))),
+		))
+
+		payload := `{"name":"melody"}`
+		resp, err := p(context.Background(), &Request{
+			Method: http.MethodPost,
+			Body:   ioutil.NopCloser(bytes.NewBufferString(payload)),
+		})
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", name, err)
+		}
+		if !resp.IsComplete || len(resp.Data) != 2 {
+			t.Errorf("%s: unexpected response %+v", name, resp)
+		}
+
+		// 等待shadow请求结束
+		time.Sleep(10 * time.Millisecond)
+		recorder.mu.Lock()
+		for _, backend := range []string{"a", "b", "shadow"} {
+			if recorder.bodies[backend] != payload {
+				t.Errorf("%s: unexpected body for %s: %q", name, backend, recorder.bodies[backend])
+			}
+		}
+		recorder.mu.Unlock()
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 0 {
+		t.Errorf("the temporary files should be removed: %v", files)
+	}
+}
+
+func TestNewRequestBufferMiddleware_stack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "melody-body")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	payload := `{"name":"melody"}`
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != payload {
+			t.Errorf("unexpected body %q", body)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{%q:true}`, r.URL.Path[1:])
+	}))
+	defer backend.Close()
+
+	logger, err := logging.NewLogger("ERROR", ioutil.Discard, "pref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := newBufferedEndpoint(map[string]interface{}{"memory_limit": 2, "dir": dir})
+	for _, b := range endpoint.Backends {
+		b.Host = []string{backend.URL}
+		b.Method = http.MethodPost
+		b.Decoder = encoding.JSONDecoder()
+	}
+	p, err := NewDefaultFactory(HTTPProxyFactory(http.DefaultClient), logger).New(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		resp, err := p(context.Background(), &Request{
+			Method:  http.MethodPost,
+			Path:    "/",
+			Headers: map[string][]string{},
+			Body:    ioutil.NopCloser(strings.NewReader(payload)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !resp.IsComplete || len(resp.Data) != 2 {
+			t.Errorf("unexpected response %+v", resp)
+		}
+		// proxy返回时所有的reader都已经释放
+		if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+			t.Fatalf("the temporary files should be removed when the proxy returns: %d", len(files))
+		}
+	}
+}
+
+func TestNewRequestBufferMiddleware_retry(t *testing.T) {
+	endpoint := &config.EndpointConfig{
+		Backends:    []*config.Backend{{}},
+		ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{requestBufferKey: map[string]interface{}{"memory_limit": 1}}},
+	}
+	bodies := []string{}
+	p := NewRequestBufferMiddleware(endpoint)(func(_ context.Context, r *Request) (*Response, error) {
+		for i := 0; i < 3; i++ {
+			body, _ := ioutil.ReadAll(CloneRequest(r).Body)
+			bodies = append(bodies, string(body))
+		}
+		return &Response{IsComplete: true}, nil
+	})
+	if _, err := p(context.Background(), &Request{Body: ioutil.NopCloser(strings.NewReader("payload"))}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(bodies, ",") != "payload,payload,payload" {
+		t.Errorf("unexpected bodies %v", bodies)
+	}
+}
+
+func TestNewRequestBufferMiddleware_tooLarge(t *testing.T) {
+	endpoint := newBufferedEndpoint(map[string]interface{}{"max_size": 8, "memory_limit": 4})
+	p := NewRequestBufferMiddleware(endpoint)(explosiveProxy(t))
+
+	for _, request := range []*Request{
+		{Body: ioutil.NopCloser(strings.NewReader("0123456789"))},
+		{Body: ioutil.NopCloser(strings.NewReader("")), Headers: map[string][]string{"Content-Length": {"1024"}}},
+	} {
+		_, err := p(context.Background(), request)
+		var e RequestBodyTooLargeError
+		if !errors.As(err, &e) || e.StatusCode() != http.StatusRequestEntityTooLarge || e.Limit != 8 {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+}
+
+func TestNewRequestBufferMiddleware_noLimit(t *testing.T) {
+	// 没有配置max_size时不限制请求体的大小
+	endpoint := newBufferedEndpoint(map[string]interface{}{"memory_limit": 4})
+	payload := strings.Repeat("x", 1024)
+	var body string
+	p := NewRequestBufferMiddleware(endpoint)(func(_ context.Context, r *Request) (*Response, error) {
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		return &Response{IsComplete: true}, nil
+	})
+	request := &Request{Body: ioutil.NopCloser(strings.NewReader(payload)), Headers: map[string][]string{"Content-Length": {"1024"}}}
+	if _, err := p(context.Background(), request); err != nil {
+		t.Fatal(err)
+	}
+	if body != payload {
+		t.Errorf("unexpected body of %d bytes", len(body))
+	}
+}
+
+func TestNewRequestBufferMiddleware_asyncShadowRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "melody-body")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	endpoint := newBufferedEndpoint(map[string]interface{}{"memory_limit": 1, "dir": dir})
+	bodies := make(chan string, 2)
+	// shadow请求在endpoint返回之后才读取请求体, 读取结束之后再重试
+	shadow := func(_ context.Context, r *Request) (*Response, error) {
+		time.Sleep(10 * time.Millisecond)
+		for _, body := range []func() io.Reader{
+			func() io.Reader { return r.Body },
+			func() io.Reader { return CloneRequest(r).Body },
+		} {
+			b, err := ioutil.ReadAll(body())
+			if err != nil {
+				bodies <- err.Error()
+				continue
+			}
+			bodies <- string(b)
+		}
+		return &Response{IsComplete: true}, nil
+	}
+	p := NewRequestBufferMiddleware(endpoint)(NewShadowProxy(func(_ context.Context, r *Request) (*Response, error) {
+		ioutil.ReadAll(r.Body)
+		return &Response{IsComplete: true}, nil
+	}, shadow))
+	if _, err := p(context.Background(), &Request{Body: ioutil.NopCloser(strings.NewReader("payload"))}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if b := <-bodies; b != "payload" {
+			t.Errorf("unexpected body of the attempt #%d: %s", i, b)
+		}
+	}
+
+	for i := 0; ; i++ {
+		files, _ := ioutil.ReadDir(dir)
+		if len(files) == 0 {
+			break
+		}
+		if i == 100 {
+			t.Errorf("the temporary files should be removed: %v", files)
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNewRequestBufferMiddleware_singleBackend(t *testing.T) {
+	body := ioutil.NopCloser(strings.NewReader("payload"))
+	p := NewRequestBufferMiddleware(&config.EndpointConfig{Backends: []*config.Backend{{}}})(func(_ context.Context, r *Request) (*Response, error) {
+		if r.Body != body {
+			t.Error("the body of a single backend endpoint should not be buffered")
+		}
+		return &Response{IsComplete: true}, nil
+	})
+	if _, err := p(context.Background(), &Request{Body: body}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRequestData(t *testing.T) {
+	data, err := RequestData(&Request{
+		Body:   ioutil.NopCloser(strings.NewReader(`{"id":1,"name":"body","tags":["a"]}`)),
+		Query:  url.Values{"NAME": {"query"}, "fields": {"id", "name"}},
+		Params: map[string]string{"Id": "42"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"Id":     "42",
+		"NAME":   "query",
+		"tags":   []interface{}{"a"},
+		"fields": []interface{}{"id", "name"},
+	}
+	if !reflect.DeepEqual(data, expected) {
+		t.Errorf("unexpected data %v", data)
+	}
+
+	if data, err := RequestData(&Request{Body: ioutil.NopCloser(strings.NewReader(""))}); err != nil || len(data) != 0 {
+		t.Errorf("unexpected result %v: %v", data, err)
+	}
+	if _, err := RequestData(&Request{Body: ioutil.NopCloser(strings.NewReader("not json"))}); err == nil {
+		t.Error("expecting an error")
+	}
+}
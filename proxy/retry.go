@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"context"
+	"math"
+	"melody/config"
+	"melody/transport/http/client"
+	"net/http"
+	"time"
+
+	"github.com/valyala/fastrand"
+)
+
+const (
+	retryKey = "retry"
+
+	defaultRetryInitialBackoff = 100 * time.Millisecond
+	defaultRetryMaxBackoff     = time.Second
+	defaultRetryMultiplier     = 2.0
+)
+
+var (
+	defaultRetryStatusCodes = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	idempotentMethods       = map[string]bool{
+		http.MethodGet:     true,
+		http.MethodHead:    true,
+		http.MethodOptions: true,
+		http.MethodPut:     true,
+		http.MethodDelete:  true,
+		http.MethodTrace:   true,
+	}
+)
+
+type retryConfig struct {
+	MaxAttempts    int
+	StatusCodes    map[int]bool
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	Jitter         bool
+	IdempotentOnly bool
+}
+
+// NewRetryMiddleware 根据backend的retry配置, 在请求失败时按照指数退避策略重试
+// 该中间件位于负载均衡中间件之前, 所以每一次重试都会重新选择host
+func NewRetryMiddleware(backend *config.Backend) Middleware {
+	cfg, ok := getRetryConfig(backend.ExtraConfig)
+	if !ok || cfg.MaxAttempts <= 1 {
+		return EmptyMiddleware
+	}
+
+	return func(next ...Proxy) Proxy {
+		if len(next) > 1 {
+			panic(ErrTooManyProxies)
+		}
+
+		return func(ctx context.Context, request *Request) (*Response, error) {
+			if cfg.IdempotentOnly && !idempotentMethods[request.Method] {
+				return next[0](ctx, request)
+			}
+
+			var resp *Response
+			var err error
+			for attempt := 1; ; attempt++ {
+				// 每一次尝试都使用一个独立的请求体副本
+				r := CloneRequest(request)
+				resp, err = next[0](ctx, r)
+				closeRequest(r)
+				if attempt >= cfg.MaxAttempts || !cfg.shouldRetry(ctx, resp, err) {
+					return resp, err
+				}
+
+				backoff := cfg.backoff(attempt)
+				// 剩余的deadline不足以等待下一次重试
+				if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= backoff {
+					return resp, err
+				}
+
+				timer := time.NewTimer(backoff)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return resp, err
+				case <-timer.C:
+				}
+				// 丢弃这次尝试的响应, 释放backend的连接
+				closeResponse(resp)
+			}
+		}
+	}
+}
+
+func (r retryConfig) shouldRetry(ctx context.Context, resp *Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		if e, ok := err.(client.InvalidStatusCodeError); ok {
+			return r.StatusCodes[e.Code]
+		}
+		return true
+	}
+	if resp == nil {
+		return true
+	}
+	return r.StatusCodes[resp.Metadata.StatusCode]
+}
+
+// backoff 返回第n次尝试失败后需要等待的时间
+// 开启jitter时, 在 [0, backoff) 之间随机取值
+func (r retryConfig) backoff(attempt int) time.Duration {
+	backoff := float64(r.InitialBackoff) * math.Pow(r.Multiplier, float64(attempt-1))
+	if backoff > float64(r.MaxBackoff) {
+		backoff = float64(r.MaxBackoff)
+	}
+	if r.Jitter && backoff >= 1 {
+		backoff = float64(fastrand.Uint32n(uint32(math.Min(backoff, math.MaxUint32))))
+	}
+	return time.Duration(backoff)
+}
+
+func getRetryConfig(extra config.ExtraConfig) (retryConfig, bool) {
+	v, ok := extra[Namespace]
+	if !ok {
+		return retryConfig{}, ok
+	}
+	e, ok := v.(map[string]interface{})
+	if !ok {
+		return retryConfig{}, ok
+	}
+	tmp, ok := e[retryKey].(map[string]interface{})
+	if !ok {
+		return retryConfig{}, ok
+	}
+
+	cfg := retryConfig{
+		MaxAttempts:    getInt(tmp, "max_attempts", 1),
+		InitialBackoff: getDuration(tmp, "initial_backoff", defaultRetryInitialBackoff),
+		MaxBackoff:     getDuration(tmp, "max_backoff", defaultRetryMaxBackoff),
+		Multiplier:     defaultRetryMultiplier,
+		Jitter:         true,
+		IdempotentOnly: true,
+	}
+	if m, ok := tmp["multiplier"].(float64); ok && m >= 1 {
+		cfg.Multiplier = m
+	}
+	if b, ok := tmp["jitter"].(bool); ok {
+		cfg.Jitter = b
+	}
+	if b, ok := tmp["idempotent_only"].(bool); ok {
+		cfg.IdempotentOnly = b
+	}
+
+	codes := defaultRetryStatusCodes
+	if raw, ok := tmp["status_codes"].([]interface{}); ok {
+		codes = []int{}
+		for _, c := range raw {
+			switch code := c.(type) {
+			case float64:
+				codes = append(codes, int(code))
+			case int:
+				codes = append(codes, code)
+			}
+		}
+	}
+	cfg.StatusCodes = make(map[int]bool, len(codes))
+	for _, c := range codes {
+		cfg.StatusCodes[c] = true
+	}
+
+	return cfg, true
+}
+
+func getInt(m map[string]interface{}, key string, fallback int) int {
+	switch v := m[key].(type) {
+	case int:
+		return v
+	case int64:
+		return int(v)
+	case float64:
+		return int(v)
+	}
+	return fallback
+}
+
+func getDuration(m map[string]interface{}, key string, fallback time.Duration) time.Duration {
+	s, ok := m[key].(string)
+	if !ok {
+		return fallback
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return fallback
+	}
+	return d
+}
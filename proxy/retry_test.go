@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"melody/config"
+	"melody/transport/http/client"
+	"strings"
+	"testing"
+	"time"
+)
+
+type countingBalancer struct {
+	hosts []string
+	calls int
+}
+
+func (c *countingBalancer) Host() (string, error) {
+	host := c.hosts[c.calls%len(c.hosts)]
+	c.calls++
+	return host, nil
+}
+
+func newRetryBackend(retry map[string]interface{}) *config.Backend {
+	return &config.Backend{
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				retryKey: retry,
+			},
+		},
+	}
+}
+
+func TestNewRetryMiddleware_rebalancesOnEachAttempt(t *testing.T) {
+	backend := newRetryBackend(map[string]interface{}{
+		"max_attempts":    3.0,
+		"initial_backoff": "1ms",
+	})
+	lb := &countingBalancer{hosts: []string{"http://a", "http://b", "http://c"}}
+	hosts := []string{}
+	bodies := []string{}
+	p := NewRetryMiddleware(backend)(newLoadBalancedMiddleware(lb)(func(_ context.Context, r *Request) (*Response, error) {
+		hosts = append(hosts, r.URL.Host)
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		if r.URL.Host != "c" {
+			return nil, client.InvalidStatusCodeError{Code: 503}
+		}
+		return &Response{IsComplete: true, Data: map[string]interface{}{"ok": true}}, nil
+	}))
+
+	resp, err := p(context.Background(), &Request{Method: "GET", Path: "/", Body: newDummyReadCloser("body")})
+	if err != nil {
+		t.Error("unexpected error:", err.Error())
+		return
+	}
+	if resp == nil || !resp.IsComplete {
+		t.Errorf("unexpected response: %v", resp)
+	}
+	if len(hosts) != 3 || hosts[0] != "a" || hosts[1] != "b" || hosts[2] != "c" {
+		t.Errorf("unexpected hosts: %v", hosts)
+	}
+	for _, b := range bodies {
+		if b != "body" {
+			t.Errorf("unexpected bodies: %v", bodies)
+		}
+	}
+}
+
+func TestNewRetryMiddleware_statusCodes(t *testing.T) {
+	backend := newRetryBackend(map[string]interface{}{
+		"max_attempts":    5,
+		"initial_backoff": "1ms",
+		"status_codes":    []interface{}{502},
+	})
+	calls := 0
+	p := NewRetryMiddleware(backend)(func(_ context.Context, _ *Request) (*Response, error) {
+		calls++
+		return nil, client.InvalidStatusCodeError{Code: 404}
+	})
+
+	_, err := p(context.Background(), &Request{Method: "GET"})
+	if !errors.Is(err, client.ErrInvalidStatusCode) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("a 404 should not be retried. calls: %d", calls)
+	}
+}
+
+func TestNewRetryMiddleware_closesDiscardedResponses(t *testing.T) {
+	backend := newRetryBackend(map[string]interface{}{
+		"max_attempts":    2,
+		"initial_backoff": "1ms",
+	})
+	discarded := closeRecorder{Reader: strings.NewReader("unavailable"), closed: make(chan struct{})}
+	calls := 0
+	p := NewRetryMiddleware(backend)(func(_ context.Context, _ *Request) (*Response, error) {
+		calls++
+		if calls == 1 {
+			return &Response{Io: discarded, Metadata: Metadata{StatusCode: 503}}, nil
+		}
+		return &Response{IsComplete: true, Io: strings.NewReader("ok")}, nil
+	})
+
+	resp, err := p(context.Background(), &Request{Method: "GET"})
+	if err != nil || !resp.IsComplete {
+		t.Fatalf("unexpected response %v: %v", resp, err)
+	}
+	select {
+	case <-discarded.closed:
+	default:
+		t.Error("the response of the retried attempt was not closed")
+	}
+}
+
+func TestNewRetryMiddleware_idempotentOnly(t *testing.T) {
+	backend := newRetryBackend(map[string]interface{}{
+		"max_attempts":    3,
+		"initial_backoff": "1ms",
+	})
+	calls := 0
+	p := NewRetryMiddleware(backend)(func(_ context.Context, _ *Request) (*Response, error) {
+		calls++
+		return nil, errors.New("connection refused")
+	})
+
+	p(context.Background(), &Request{Method: "POST"})
+	if calls != 1 {
+		t.Errorf("a POST should not be retried. calls: %d", calls)
+	}
+
+	calls = 0
+	p(context.Background(), &Request{Method: "PUT"})
+	if calls != 3 {
+		t.Errorf("a PUT should be retried. calls: %d", calls)
+	}
+}
+
+func TestNewRetryMiddleware_respectsDeadline(t *testing.T) {
+	backend := newRetryBackend(map[string]interface{}{
+		"max_attempts":    10,
+		"initial_backoff": "50ms",
+		"jitter":          false,
+	})
+	calls := 0
+	p := NewRetryMiddleware(backend)(func(_ context.Context, _ *Request) (*Response, error) {
+		calls++
+		return &Response{Metadata: Metadata{StatusCode: 503}}, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 80*time.Millisecond)
+	defer cancel()
+
+	resp, err := p(ctx, &Request{Method: "GET"})
+	if err != nil {
+		t.Error("unexpected error:", err.Error())
+	}
+	if resp == nil || resp.Metadata.StatusCode != 503 {
+		t.Errorf("unexpected response: %v", resp)
+	}
+	// 50ms 后进行第二次尝试, 100ms 的退避超过了剩余的deadline
+	if calls != 2 {
+		t.Errorf("the backoff exceeds the remaining deadline. calls: %d", calls)
+	}
+}
+
+func TestNewRetryMiddleware_disabled(t *testing.T) {
+	p := NewRetryMiddleware(&config.Backend{})(dummyProxy(&Response{}))
+	if _, err := p(context.Background(), &Request{}); err != nil {
+		t.Error("unexpected error:", err.Error())
+	}
+}
+
+func TestRetryConfig_backoff(t *testing.T) {
+	cfg := retryConfig{
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     50 * time.Millisecond,
+		Multiplier:     2,
+	}
+	for i, want := range []time.Duration{10, 20, 40, 50, 50} {
+		if have := cfg.backoff(i + 1); have != want*time.Millisecond {
+			t.Errorf("attempt %d: want %s, have %s", i+1, want*time.Millisecond, have)
+		}
+	}
+
+	cfg.Jitter = true
+	for i := 1; i < 10; i++ {
+		if have := cfg.backoff(i); have < 0 || have > cfg.MaxBackoff {
+			t.Errorf("attempt %d: unexpected backoff %s", i, have)
+		}
+	}
+}
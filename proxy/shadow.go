@@ -65,9 +65,16 @@ func ShadowMiddleware(next ...Proxy) Proxy {
 }
 
 // NewShadowProxy 返回一个向p1和p2发送请求但忽略p2响应的代理
+// shadow请求结束之前一直持有缓存的请求体, 其中的重试可以在endpoint返回之后继续读取
 func NewShadowProxy(p1, p2 Proxy) Proxy {
 	return func(ctx context.Context, request *Request) (*Response, error) {
-		go p2(newcontextWrapper(ctx), CloneRequest(request))
+		shadow := CloneRequest(request)
+		release := retain(shadow)
+		go func() {
+			defer release()
+			p2(newcontextWrapper(ctx), shadow)
+			closeRequest(shadow)
+		}()
 		return p1(ctx, request)
 	}
 }
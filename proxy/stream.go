@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"melody/config"
+	"net/http"
+	"net/textproto"
+)
+
+const (
+	streamKey                = "stream"
+	defaultStreamMaxBodySize = 0
+	streamMaxBodySizeKey     = "max_body_size"
+	streamHeadersToReturnKey = "headers_to_return"
+)
+
+// ErrResponseTooLarge 流式响应的响应体超过了 max_body_size
+var ErrResponseTooLarge = errors.New("the response body exceeds the max body size")
+
+// hopByHopHeaders 只在单个连接上有意义的响应头, 不会转发给客户端
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+type streamConfig struct {
+	// 0 表示不限制
+	MaxBodySize int64
+	// 返回给客户端的响应头, 为空时返回除hop-by-hop之外的全部响应头
+	Headers []string
+}
+
+// NewStreamHTTPResponseParser 不解码响应体, 将body作为Response.Io直接向下传递
+// 配置在 melody_proxy.stream 中
+func NewStreamHTTPResponseParser(remote *config.Backend) HTTPResponseParser {
+	cfg := getStreamConfig(remote.ExtraConfig)
+	return func(ctx context.Context, resp *http.Response) (*Response, error) {
+		if cfg.MaxBodySize > 0 && resp.ContentLength > cfg.MaxBodySize {
+			resp.Body.Close()
+			return nil, ErrResponseTooLarge
+		}
+		var body io.ReadCloser = resp.Body
+		if cfg.MaxBodySize > 0 {
+			body = &maxBytesReader{rc: resp.Body, remaining: cfg.MaxBodySize}
+		}
+		return &Response{
+			Data:       map[string]interface{}{},
+			IsComplete: true,
+			Io:         NewReadCloserWrapper(ctx, body),
+			Metadata: Metadata{
+				Headers:    cfg.filterHeaders(resp.Header),
+				StatusCode: resp.StatusCode,
+			},
+		}, nil
+	}
+}
+
+func (s streamConfig) filterHeaders(headers http.Header) map[string][]string {
+	res := make(map[string][]string, len(headers))
+	if len(s.Headers) > 0 {
+		for _, k := range s.Headers {
+			if vs, ok := headers[textproto.CanonicalMIMEHeaderKey(k)]; ok {
+				res[textproto.CanonicalMIMEHeaderKey(k)] = vs
+			}
+		}
+	} else {
+		for k, vs := range headers {
+			res[k] = vs
+		}
+	}
+	for _, k := range hopByHopHeaders {
+		delete(res, k)
+	}
+	return res
+}
+
+// maxBytesReader 读取超过remaining字节之后返回 ErrResponseTooLarge
+type maxBytesReader struct {
+	rc        io.ReadCloser
+	remaining int64
+}
+
+func (m *maxBytesReader) Read(p []byte) (int, error) {
+	if m.remaining < 0 {
+		return 0, ErrResponseTooLarge
+	}
+	// 多读一个字节, 用于判断是否超过了限制
+	if int64(len(p)) > m.remaining+1 {
+		p = p[:m.remaining+1]
+	}
+	n, err := m.rc.Read(p)
+	m.remaining -= int64(n)
+	if m.remaining < 0 {
+		return n + int(m.remaining), ErrResponseTooLarge
+	}
+	return n, err
+}
+
+func (m *maxBytesReader) Close() error {
+	return m.rc.Close()
+}
+
+func getStreamConfig(extra config.ExtraConfig) streamConfig {
+	cfg := streamConfig{MaxBodySize: defaultStreamMaxBodySize}
+	v, ok := extra[Namespace]
+	if !ok {
+		return cfg
+	}
+	e, ok := v.(map[string]interface{})
+	if !ok {
+		return cfg
+	}
+	tmp, ok := e[streamKey].(map[string]interface{})
+	if !ok {
+		return cfg
+	}
+	if size, ok := tmp[streamMaxBodySizeKey].(float64); ok && size > 0 {
+		cfg.MaxBodySize = int64(size)
+	}
+	cfg.Headers = getStrings(tmp, streamHeadersToReturnKey)
+	return cfg
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"melody/config"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func newStreamBackend(cfg map[string]interface{}) *config.Backend {
+	return &config.Backend{
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{streamKey: cfg},
+		},
+	}
+}
+
+func TestNewStreamHTTPResponseParser(t *testing.T) {
+	parser := NewStreamHTTPResponseParser(newStreamBackend(map[string]interface{}{
+		"headers_to_return": []interface{}{"content-type", "Connection"},
+	}))
+	resp, err := parser(context.Background(), &http.Response{
+		StatusCode:    http.StatusPartialContent,
+		ContentLength: -1,
+		Header: http.Header{
+			"Content-Type": {"text/event-stream"},
+			"Connection":   {"keep-alive"},
+			"Set-Cookie":   {"a=b"},
+		},
+		Body: ioutil.NopCloser(strings.NewReader("data: 1\n\n")),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Metadata.StatusCode != http.StatusPartialContent {
+		t.Errorf("unexpected status code %d", resp.Metadata.StatusCode)
+	}
+	if len(resp.Metadata.Headers) != 1 || resp.Metadata.Headers["Content-Type"][0] != "text/event-stream" {
+		t.Errorf("unexpected headers %v", resp.Metadata.Headers)
+	}
+	body, _ := ioutil.ReadAll(resp.Io)
+	if string(body) != "data: 1\n\n" {
+		t.Errorf("unexpected body %q", string(body))
+	}
+}
+
+func TestNewStreamHTTPResponseParser_maxBodySize(t *testing.T) {
+	parser := NewStreamHTTPResponseParser(newStreamBackend(map[string]interface{}{
+		"max_body_size": 4.0,
+	}))
+
+	_, err := parser(context.Background(), &http.Response{
+		StatusCode:    http.StatusOK,
+		ContentLength: 5,
+		Body:          ioutil.NopCloser(bytes.NewBufferString("12345")),
+	})
+	if err != ErrResponseTooLarge {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	resp, err := parser(context.Background(), &http.Response{
+		StatusCode:    http.StatusOK,
+		ContentLength: -1,
+		Body:          ioutil.NopCloser(bytes.NewBufferString("123456789")),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Io)
+	if err != ErrResponseTooLarge {
+		t.Errorf("unexpected error %v", err)
+	}
+	if string(body) != "1234" {
+		t.Errorf("unexpected body %q", string(body))
+	}
+
+	resp, _ = parser(context.Background(), &http.Response{
+		StatusCode:    http.StatusOK,
+		ContentLength: -1,
+		Body:          ioutil.NopCloser(bytes.NewBufferString("1234")),
+	})
+	if body, err := ioutil.ReadAll(resp.Io); err != nil || string(body) != "1234" {
+		t.Errorf("unexpected body %q: %v", string(body), err)
+	}
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"context"
+	"melody/config"
+	"melody/encoding"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RequestTimeoutHeader 转发给backend的剩余超时时间(毫秒)的header, backend可以据此提前放弃请求
+var RequestTimeoutHeader = "X-Request-Timeout"
+
+// NewBackendTimeoutMiddleware 使用backend的timeout限制该backend的整个调用, 包括重试与并发调用
+// backend的timeout默认与endpoint相同
+func NewBackendTimeoutMiddleware(backend *config.Backend) Middleware {
+	if backend.Timeout <= 0 {
+		return EmptyMiddleware
+	}
+	return func(next ...Proxy) Proxy {
+		if len(next) > 1 {
+			panic(ErrTooManyProxies)
+		}
+		if backend.Encoding == encoding.STREAM {
+			// 流式响应的timeout只限制收到响应头之前的时间
+			return func(ctx context.Context, request *Request) (*Response, error) {
+				localCtx, stop, cancel := NewHeaderTimeoutContext(ctx, backend.Timeout)
+				resp, err := next[0](localCtx, request)
+				stop()
+				cancelOnClose(resp, cancel)
+				return resp, err
+			}
+		}
+		return func(ctx context.Context, request *Request) (*Response, error) {
+			localCtx, cancel := context.WithTimeout(ctx, backend.Timeout)
+			resp, err := next[0](localCtx, request)
+			// noop编码的响应体读取结束之后才取消
+			cancelOnClose(resp, cancel)
+			return resp, err
+		}
+	}
+}
+
+// NewHeaderTimeoutContext 返回超过timeout之后取消的context, 调用stop之后不再受timeout的限制
+// 用于流式响应: timeout只限制收到响应头之前的时间, 之后的响应体可以一直读取到backend结束或者cancel
+func NewHeaderTimeoutContext(parent context.Context, timeout time.Duration) (context.Context, func(), context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	h := &headerTimeoutContext{Context: ctx}
+	timer := time.AfterFunc(timeout, func() {
+		h.mu.Lock()
+		h.err = context.DeadlineExceeded
+		h.mu.Unlock()
+		cancel()
+	})
+	return h, func() { timer.Stop() }, func() {
+		timer.Stop()
+		cancel()
+	}
+}
+
+// headerTimeoutContext 因为超时被取消时 Err 返回 context.DeadlineExceeded
+type headerTimeoutContext struct {
+	context.Context
+	mu  sync.Mutex
+	err error
+}
+
+// Err implements the context.Context interface
+func (h *headerTimeoutContext) Err() error {
+	h.mu.Lock()
+	err := h.err
+	h.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return h.Context.Err()
+}
+
+// stepBudget 链式请求中第i步可以使用的时间
+// 按照剩余步骤的backend timeout的比例分配剩余的时间, 并且不超过该backend的timeout
+// 返回0时不限制该步骤
+func stepBudget(ctx context.Context, timeouts []time.Duration, matched []bool, i int) time.Duration {
+	if timeouts[i] <= 0 {
+		return 0
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return timeouts[i]
+	}
+	var total time.Duration
+	for j := i; j < len(timeouts); j++ {
+		if matched[j] {
+			total += timeouts[j]
+		}
+	}
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return 0
+	}
+	budget := time.Duration(float64(remaining) * float64(timeouts[i]) / float64(total))
+	if budget > timeouts[i] {
+		return timeouts[i]
+	}
+	return budget
+}
+
+// setRequestTimeout 把ctx的剩余时间写入发送给backend的header
+func setRequestTimeout(ctx context.Context, header map[string][]string) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return
+	}
+	remaining := time.Until(deadline) / time.Millisecond
+	if remaining <= 0 {
+		return
+	}
+	header[RequestTimeoutHeader] = []string{strconv.FormatInt(int64(remaining), 10)}
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"melody/config"
+	"melody/encoding"
+	"melody/logging"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNewBackendTimeoutMiddleware(t *testing.T) {
+	p := NewBackendTimeoutMiddleware(&config.Backend{Timeout: 10 * time.Millisecond})(func(ctx context.Context, _ *Request) (*Response, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	begin := time.Now()
+	if _, err := p(context.Background(), &Request{}); err != context.DeadlineExceeded {
+		t.Errorf("unexpected error %v", err)
+	}
+	if time.Since(begin) > 100*time.Millisecond {
+		t.Error("the backend timeout was not applied")
+	}
+}
+
+func TestNewMergeDataMiddleware_sequentialBudget(t *testing.T) {
+	endpoint := config.EndpointConfig{
+		Backends: []*config.Backend{
+			{URLPattern: "/", Timeout: 100 * time.Millisecond},
+			{URLPattern: "/{{.Resp0_id}}", Timeout: 300 * time.Millisecond},
+		},
+		Timeout:     400 * time.Millisecond,
+		ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{isSequentialKey: true}},
+	}
+	budgets := make([]time.Duration, 2)
+	step := func(i int) Proxy {
+		return func(ctx context.Context, _ *Request) (*Response, error) {
+			deadline, _ := ctx.Deadline()
+			budgets[i] = time.Until(deadline)
+			return &Response{Data: map[string]interface{}{"id": i}, IsComplete: true}, nil
+		}
+	}
+	p := NewMergeDataMiddleware(&endpoint)(step(0), step(1))
+	if _, err := p(context.Background(), &Request{Params: map[string]string{}}); err != nil {
+		t.Fatal(err)
+	}
+	// 总时间为endpoint的400ms, 按照 1:3 的比例分配
+	if budgets[0] > 100*time.Millisecond || budgets[0] < 90*time.Millisecond {
+		t.Errorf("unexpected budget of the first step %v", budgets[0])
+	}
+	if budgets[1] > 300*time.Millisecond || budgets[1] < 280*time.Millisecond {
+		t.Errorf("unexpected budget of the second step %v", budgets[1])
+	}
+}
+
+func TestNewHTTPProxy_requestTimeout(t *testing.T) {
+	var header string
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get(RequestTimeoutHeader)
+		w.Write([]byte("{}"))
+	}))
+	defer backendServer.Close()
+
+	rpURL, _ := url.Parse(backendServer.URL)
+	p := HTTPProxyFactory(http.DefaultClient)(&config.Backend{Decoder: encoding.JSONDecoder()})
+
+	if _, err := p(context.Background(), &Request{Method: "GET", URL: rpURL}); err != nil {
+		t.Fatal(err)
+	}
+	if header != "" {
+		t.Errorf("unexpected header without deadline %q", header)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := p(ctx, &Request{Method: "GET", URL: rpURL}); err != nil {
+		t.Fatal(err)
+	}
+	if ms, err := strconv.Atoi(header); err != nil || ms <= 0 || ms > 1000 {
+		t.Errorf("unexpected header %q", header)
+	}
+}
+
+func TestNewDefaultFactory_noopStreamWithTimeout(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("xxxxxxxxxx"))
+		w.(http.Flusher).Flush()
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("yyyyyyyyyy"))
+	}))
+	defer backendServer.Close()
+
+	backend := &config.Backend{
+		URLPattern: "/stream",
+		Host:       []string{backendServer.URL},
+		Encoding:   encoding.NOOP,
+		Timeout:    time.Second,
+	}
+	p, err := NewDefaultFactory(HTTPProxyFactory(http.DefaultClient), logging.NoOp).New(&config.EndpointConfig{
+		Endpoint: "/stream",
+		Timeout:  time.Second,
+		Backends: []*config.Backend{backend},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := p(context.Background(), &Request{Method: "GET", Params: map[string]string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Io)
+	if err != nil || string(body) != "xxxxxxxxxxyyyyyyyyyy" {
+		t.Errorf("unexpected body %q: %v", body, err)
+	}
+}
+
+func TestNewBackendTimeoutMiddleware_stream(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		w.Write([]byte("data: 1\n\n"))
+		w.(http.Flusher).Flush()
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("data: 2\n\n"))
+	}))
+	defer backendServer.Close()
+
+	for path, expected := range map[string]string{"/stream": "data: 1\n\ndata: 2\n\n", "/slow": ""} {
+		backend := &config.Backend{
+			URLPattern: path,
+			Host:       []string{backendServer.URL},
+			Encoding:   encoding.STREAM,
+			Timeout:    50 * time.Millisecond,
+		}
+		p := NewBackendTimeoutMiddleware(backend)(HTTPProxyFactory(http.DefaultClient)(backend))
+		u, _ := url.Parse(backendServer.URL + path)
+		resp, err := p(context.Background(), &Request{Method: "GET", URL: u})
+		if expected == "" {
+			// 响应头没有在timeout之内到达
+			if err != context.DeadlineExceeded {
+				t.Errorf("%s: unexpected error %v", path, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		body, err := ioutil.ReadAll(resp.Io)
+		if err != nil || string(body) != expected {
+			t.Errorf("%s: unexpected body %q: %v", path, body, err)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package router
+
+import (
+	"melody/config"
+	"melody/proxy"
+	"net/http"
+)
+
+const (
+	errorEnvelopeKey       = "error_envelope"
+	defaultRequestIDHeader = "X-Request-Id"
+	omittedField           = "-"
+	// 不输出详细信息时backend失败的默认原因
+	genericBackendMessage = "backend failure"
+)
+
+// ErrorEnvelope 失败时返回给客户端的错误结构的模板, 每个字段为输出时使用的key, "-" 表示不输出
+type ErrorEnvelope struct {
+	Code      string
+	Message   string
+	Backends  string
+	RequestID string
+	// 将整个错误包裹在该key下
+	Wrap string
+	// 从该请求头中读取request id, 请求中没有时自动生成
+	RequestIDHeader string
+	// 输出backend的名称和原始的错误信息, 默认只输出通用的原因, 避免暴露内部的地址和路径
+	ExposeBackendDetails bool
+}
+
+// GetErrorEnvelope 解析 melody_router.error_envelope
+func GetErrorEnvelope(extra config.ExtraConfig) (ErrorEnvelope, bool) {
+	v, ok := extra[Namespace]
+	if !ok {
+		return ErrorEnvelope{}, false
+	}
+	e, ok := v.(map[string]interface{})
+	if !ok {
+		return ErrorEnvelope{}, false
+	}
+	tmp, ok := e[errorEnvelopeKey].(map[string]interface{})
+	if !ok {
+		return ErrorEnvelope{}, false
+	}
+	return ErrorEnvelope{
+		Code:                 getStringOr(tmp, "code", "code"),
+		Message:              getStringOr(tmp, "message", "message"),
+		Backends:             getStringOr(tmp, "backends", "errors"),
+		RequestID:            getStringOr(tmp, "request_id", "request_id"),
+		Wrap:                 getStringOr(tmp, "wrap", ""),
+		RequestIDHeader:      getStringOr(tmp, "request_id_header", defaultRequestIDHeader),
+		ExposeBackendDetails: getBool(tmp, "expose_backend_details"),
+	}, true
+}
+
+// Render 按照模板把Error转换成输出的数据
+func (t ErrorEnvelope) Render(e *proxy.Error) map[string]interface{} {
+	data := map[string]interface{}{}
+	set := func(key string, v interface{}) {
+		if key != omittedField {
+			data[key] = v
+		}
+	}
+	set(t.Code, e.Code)
+	set(t.Message, e.Message)
+	backends := make([]interface{}, len(e.Backends))
+	for i, b := range e.Backends {
+		failure := map[string]interface{}{"message": genericMessage(b)}
+		if t.ExposeBackendDetails {
+			failure["message"] = b.Message
+			if b.Backend != "" {
+				failure["backend"] = b.Backend
+			}
+		}
+		if b.Code != 0 {
+			failure["status"] = b.Code
+		}
+		backends[i] = failure
+	}
+	set(t.Backends, backends)
+	if e.RequestID != "" {
+		set(t.RequestID, e.RequestID)
+	}
+	if t.Wrap != "" {
+		return map[string]interface{}{t.Wrap: data}
+	}
+	return data
+}
+
+func getStringOr(m map[string]interface{}, key, fallback string) string {
+	if s, ok := m[key].(string); ok && s != "" {
+		return s
+	}
+	return fallback
+}
+
+func getBool(m map[string]interface{}, key string) bool {
+	b, ok := m[key].(bool)
+	return ok && b
+}
+
+// genericMessage 不包含内部信息的失败原因
+func genericMessage(b proxy.BackendFailure) string {
+	if text := http.StatusText(b.Code); text != "" {
+		return text
+	}
+	return genericBackendMessage
+}
@@ -1,14 +1,25 @@
 package gin
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"melody/config"
 	"melody/core"
+	"melody/encoding"
 	"melody/proxy"
 	"melody/router"
+	"melody/transport/http/client"
+	"net/http"
 	"net/textproto"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -31,12 +42,28 @@ func CustomErrorEndpointHandler(config *config.EndpointConfig, proxy proxy.Proxy
 	isCacheEnable := config.CacheTTL.Seconds() != 0
 	request := NewRequest(config.HeadersToPass)
 	responseRender := getRender(config)
+	// endpoint层的状态码策略
+	policy, hasPolicy := router.GetStatusCodePolicy(config.ExtraConfig)
+	if hasPolicy {
+		errF = policy.ToHTTPError(errF)
+	}
+	isSingle := len(config.Backends) == 1
+	// 失败时返回的错误结构, no-op 与 stream 编码的endpoint不处理
+	envelope, hasEnvelope := router.GetErrorEnvelope(config.ExtraConfig)
+	hasEnvelope = hasEnvelope && !isNoopEndpoint(config)
+	isStream := isStreamEndpoint(config)
 
 	return func(c *gin.Context) {
-		reqCtx, cancel := context.WithTimeout(c, config.Timeout)
+		if c.Request.Method == http.MethodHead {
+			w := &headResponseWriter{ResponseWriter: c.Writer}
+			c.Writer = w
+			defer w.flush(c)
+		}
+		reqCtx, headersReceived, cancel := newRequestContext(c, config.Timeout, isStream)
 		c.Header(core.MelodyHeaderKey, core.MelodyHeaderValue)
 		// 执行代理 *
 		response, err := proxy(reqCtx, request(c, config.QueryString))
+		headersReceived()
 
 		select {
 		case <-reqCtx.Done():
@@ -73,17 +100,40 @@ func CustomErrorEndpointHandler(config *config.EndpointConfig, proxy proxy.Proxy
 			c.Error(err)
 			// 校验响应是否为nil
 			if response == nil {
-				if t, ok := err.(responseError); ok {
+				var t responseError
+				if errors.As(err, &t) {
 					c.Status(t.StatusCode())
 				} else {
 					c.Status(errF(err))
 				}
+				var r retryAfterError
+				if errors.As(err, &r) && r.RetryAfter() > 0 {
+					c.Header("Retry-After", strconv.Itoa(int(math.Ceil(r.RetryAfter().Seconds()))))
+				}
+				if hasPolicy && policy.ReturnErrorBody && isSingle {
+					if r, ok := decodeErrorBody(config.Backends[0], err); ok {
+						responseRender(c, r)
+						cancel()
+						return
+					}
+				}
+				if hasEnvelope {
+					responseRender(c, newErrorResponse(c, envelope, err))
+				}
 				cancel()
 				return
 			}
+			if hasPolicy {
+				if status := policy.PartialStatus(err); status != 0 {
+					c.Status(status)
+				}
+			}
+		} else if hasPolicy && policy.ReturnStatusCode && isSingle && response != nil && response.Metadata.StatusCode != 0 {
+			c.Status(response.Metadata.StatusCode)
 		}
 		// 去render成最终的编码格式
 		responseRender(c, response)
+		closeResponseBody(response)
 		// call cancel去关闭本次req context
 		cancel()
 	}
@@ -144,7 +194,112 @@ func NewRequest(passHeaders []string) func(*gin.Context, []string) *proxy.Reques
 	}
 }
 
+// headResponseWriter 丢弃HEAD请求的响应体, 只保留状态码与响应头
+type headResponseWriter struct {
+	gin.ResponseWriter
+	size int
+}
+
+func (w *headResponseWriter) Write(b []byte) (int, error) {
+	w.size += len(b)
+	return len(b), nil
+}
+
+func (w *headResponseWriter) WriteString(s string) (int, error) {
+	w.size += len(s)
+	return len(s), nil
+}
+
+func (w *headResponseWriter) WriteHeaderNow() {}
+
+func (w *headResponseWriter) Flush() {}
+
+// flush 写入状态码与响应头, 被丢弃的响应体长度作为Content-Length
+func (w *headResponseWriter) flush(c *gin.Context) {
+	c.Writer = w.ResponseWriter
+	if w.size > 0 && w.Header().Get("Content-Length") == "" {
+		w.Header().Set("Content-Length", strconv.Itoa(w.size))
+	}
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+// newErrorResponse 按照模板生成错误的response, 状态码为已经写入的状态码
+func newErrorResponse(c *gin.Context, envelope router.ErrorEnvelope, err error) *proxy.Response {
+	status := c.Writer.Status()
+	e := proxy.NewError(status, http.StatusText(status), err)
+	e.RequestID = c.GetHeader(envelope.RequestIDHeader)
+	if e.RequestID == "" {
+		e.RequestID = newRequestID()
+	}
+	c.Header(envelope.RequestIDHeader, e.RequestID)
+	return &proxy.Response{Data: envelope.Render(e), Error: e}
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+func isNoopEndpoint(cfg *config.EndpointConfig) bool {
+	name := cfg.OutputEncoding
+	if name == "" && len(cfg.Backends) == 1 {
+		name = cfg.Backends[0].Encoding
+	}
+	return name == encoding.NOOP || name == encoding.STREAM
+}
+
+// closeResponseBody 客户端断开时render不会读完noop与stream的响应体, 关闭它释放backend的连接与并发限制的名额
+func closeResponseBody(response *proxy.Response) {
+	if response == nil {
+		return
+	}
+	if rc, ok := response.Io.(io.Closer); ok {
+		rc.Close()
+	}
+}
+
+// isStreamEndpoint endpoint的响应以stream编码渲染
+func isStreamEndpoint(cfg *config.EndpointConfig) bool {
+	name := cfg.OutputEncoding
+	if name == "" && len(cfg.Backends) == 1 {
+		name = cfg.Backends[0].Encoding
+	}
+	return name == encoding.STREAM
+}
+
+// newRequestContext 使用endpoint的timeout限制本次请求
+// stream编码的endpoint只在proxy返回(收到响应头)之前受timeout限制, 之后响应体的持续时间不受限制
+func newRequestContext(c *gin.Context, timeout time.Duration, isStream bool) (context.Context, func(), context.CancelFunc) {
+	if isStream {
+		return proxy.NewHeaderTimeoutContext(c, timeout)
+	}
+	ctx, cancel := context.WithTimeout(c, timeout)
+	return ctx, func() {}, cancel
+}
+
+// decodeErrorBody 使用backend的解码器解码backend返回的错误响应体
+func decodeErrorBody(backend *config.Backend, err error) (*proxy.Response, bool) {
+	var e client.InvalidStatusCodeError
+	if !errors.As(err, &e) || len(e.Body) == 0 || backend.Decoder == nil {
+		return nil, false
+	}
+	var data map[string]interface{}
+	if err := backend.Decoder(bytes.NewReader(e.Body), &data); err != nil {
+		return nil, false
+	}
+	return &proxy.Response{Data: data}, true
+}
+
 type responseError interface {
 	error
 	StatusCode() int
 }
+
+// retryAfterError 带有客户端重试等待时间的错误, 例如并发限制拒绝的请求
+type retryAfterError interface {
+	error
+	RetryAfter() time.Duration
+}
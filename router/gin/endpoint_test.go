@@ -0,0 +1,338 @@
+package gin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"melody/config"
+	"melody/encoding"
+	"melody/logging"
+	"melody/proxy"
+	"melody/transport/http/client"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type testMergeError []error
+
+func (m testMergeError) Error() string   { return "merge error" }
+func (m testMergeError) Errors() []error { return m }
+
+func serveEndpoint(t *testing.T, endpoint *config.EndpointConfig, p proxy.Proxy) (int, string) {
+	gin.SetMode(gin.TestMode)
+	server := gin.New()
+	server.GET("/_gin_endpoint", EndpointHandler(endpoint, p))
+
+	req, _ := http.NewRequest("GET", "http://127.0.0.1:8080/_gin_endpoint", nil)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+
+	body, err := ioutil.ReadAll(w.Result().Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Result().Body.Close()
+	return w.Result().StatusCode, strings.TrimSpace(string(body))
+}
+
+func TestEndpointHandler_statusCodePolicy(t *testing.T) {
+	singleBackend := []*config.Backend{{Decoder: encoding.JSONDecoder()}}
+	multiBackends := []*config.Backend{{}, {}}
+	notFound := client.InvalidStatusCodeError{Code: http.StatusNotFound, Body: []byte(`{"message":"not found"}`)}
+
+	for _, tc := range []struct {
+		name     string
+		backends []*config.Backend
+		policy   map[string]interface{}
+		response *proxy.Response
+		err      error
+		status   int
+		body     string
+	}{
+		{
+			name:     "no policy",
+			backends: singleBackend,
+			err:      notFound,
+			status:   http.StatusInternalServerError,
+		},
+		{
+			name:     "single backend status",
+			backends: singleBackend,
+			policy:   map[string]interface{}{"return_status_code": true},
+			err:      notFound,
+			status:   http.StatusNotFound,
+		},
+		{
+			name:     "single backend status and body",
+			backends: singleBackend,
+			policy:   map[string]interface{}{"return_status_code": true, "return_error_body": true},
+			err:      notFound,
+			status:   http.StatusNotFound,
+			body:     `{"message":"not found"}`,
+		},
+		{
+			name:     "single backend success status",
+			backends: singleBackend,
+			policy:   map[string]interface{}{"return_status_code": true},
+			response: &proxy.Response{
+				Data:       map[string]interface{}{"id": 1},
+				IsComplete: true,
+				Metadata:   proxy.Metadata{StatusCode: http.StatusCreated},
+			},
+			status: http.StatusCreated,
+			body:   `{"id":1}`,
+		},
+		{
+			name:     "mapped status",
+			backends: multiBackends,
+			policy: map[string]interface{}{"status_mapping": map[string]interface{}{
+				"401": 401.0, "all_failed": 502.0, "partial": 206.0,
+			}},
+			err:    testMergeError{errors.New("timeout"), client.InvalidStatusCodeError{Code: http.StatusUnauthorized}},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:     "all failed",
+			backends: multiBackends,
+			policy: map[string]interface{}{"status_mapping": map[string]interface{}{
+				"401": 401.0, "all_failed": 502.0, "partial": 206.0,
+			}},
+			err:    testMergeError{errors.New("timeout"), client.InvalidStatusCodeError{Code: http.StatusNotFound}},
+			status: http.StatusBadGateway,
+		},
+		{
+			name:     "partial",
+			backends: multiBackends,
+			policy: map[string]interface{}{"status_mapping": map[string]interface{}{
+				"401": 401.0, "all_failed": 502.0, "partial": 206.0,
+			}},
+			response: &proxy.Response{Data: map[string]interface{}{"id": 1}},
+			err:      testMergeError{errors.New("timeout")},
+			status:   http.StatusPartialContent,
+			body:     `{"id":1}`,
+		},
+		{
+			name:     "partial without policy",
+			backends: multiBackends,
+			response: &proxy.Response{Data: map[string]interface{}{"id": 1}},
+			err:      testMergeError{errors.New("timeout")},
+			status:   http.StatusOK,
+			body:     `{"id":1}`,
+		},
+	} {
+		endpoint := &config.EndpointConfig{
+			Timeout:     time.Second,
+			Backends:    tc.backends,
+			ExtraConfig: config.ExtraConfig{},
+		}
+		if tc.policy != nil {
+			endpoint.ExtraConfig["melody_router"] = tc.policy
+		}
+		response, err := tc.response, tc.err
+		status, body := serveEndpoint(t, endpoint, func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			return response, err
+		})
+		if status != tc.status {
+			t.Errorf("%s: unexpected status code %d", tc.name, status)
+		}
+		if tc.body != "" && body != tc.body {
+			t.Errorf("%s: unexpected body %s", tc.name, body)
+		}
+	}
+}
+
+func TestEndpointHandler_errorEnvelope(t *testing.T) {
+	err := testMergeError{
+		proxy.BackendError{Backend: "users", Err: client.InvalidStatusCodeError{Code: http.StatusNotFound}},
+		proxy.BackendError{Backend: "orders", Err: errors.New("timeout")},
+	}
+	p := func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		return nil, err
+	}
+
+	for _, tc := range []struct {
+		encoding string
+		envelope map[string]interface{}
+		accept   string
+		body     string
+	}{
+		{
+			encoding: encoding.JSON,
+			envelope: map[string]interface{}{},
+			body:     `{"code":500,"errors":[{"message":"Not Found","status":404},{"message":"backend failure"}],"message":"Internal Server Error","request_id":"abc"}`,
+		},
+		{
+			encoding: encoding.JSON,
+			envelope: map[string]interface{}{"expose_backend_details": true},
+			body:     `{"code":500,"errors":[{"backend":"users","message":"Invalid status code","status":404},{"backend":"orders","message":"timeout"}],"message":"Internal Server Error","request_id":"abc"}`,
+		},
+		{
+			encoding: encoding.JSON,
+			envelope: map[string]interface{}{"wrap": "error", "backends": "-", "request_id": "trace"},
+			body:     `{"error":{"code":500,"message":"Internal Server Error","trace":"abc"}}`,
+		},
+		{
+			encoding: NEGOTIATE,
+			envelope: map[string]interface{}{"backends": "-"},
+			accept:   "application/xml",
+			body:     `<error><code>500</code><message>Internal Server Error</message><request_id>abc</request_id></error>`,
+		},
+	} {
+		endpoint := &config.EndpointConfig{
+			Timeout:        time.Second,
+			Backends:       []*config.Backend{{}, {}},
+			OutputEncoding: tc.encoding,
+			ExtraConfig: config.ExtraConfig{
+				"melody_router": map[string]interface{}{"error_envelope": tc.envelope},
+			},
+		}
+		gin.SetMode(gin.TestMode)
+		server := gin.New()
+		server.GET("/_gin_endpoint", EndpointHandler(endpoint, p))
+
+		req, _ := http.NewRequest("GET", "http://127.0.0.1:8080/_gin_endpoint", nil)
+		req.Header.Set("X-Request-Id", "abc")
+		if tc.accept != "" {
+			req.Header.Set("Accept", tc.accept)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("unexpected status code %d", w.Code)
+		}
+		if body := strings.TrimSpace(w.Body.String()); body != tc.body {
+			t.Errorf("unexpected body %s", body)
+		}
+		if w.Header().Get("X-Request-Id") != "abc" {
+			t.Errorf("unexpected request id %s", w.Header().Get("X-Request-Id"))
+		}
+	}
+}
+
+func TestEndpointHandler_errorEnvelopeRequestID(t *testing.T) {
+	endpoint := &config.EndpointConfig{
+		Timeout:  time.Second,
+		Backends: []*config.Backend{{}},
+		ExtraConfig: config.ExtraConfig{
+			"melody_router": map[string]interface{}{"error_envelope": map[string]interface{}{}},
+		},
+	}
+	status, body := serveEndpoint(t, endpoint, func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		return nil, errors.New("boom")
+	})
+	if status != http.StatusInternalServerError {
+		t.Errorf("unexpected status code %d", status)
+	}
+	if !strings.Contains(body, `"request_id":"`) || !strings.Contains(body, `"message":"backend failure"`) || strings.Contains(body, "boom") {
+		t.Errorf("unexpected body %s", body)
+	}
+}
+
+func TestEndpointHandler_retryAfter(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	server := gin.New()
+	endpoint := &config.EndpointConfig{Timeout: time.Second, Backends: []*config.Backend{{}}}
+	server.GET("/_gin_endpoint", EndpointHandler(endpoint, func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		return nil, proxy.BackendError{Backend: "/a", Err: proxy.ConcurrencyLimitError{Name: "backend./a", Wait: 1500 * time.Millisecond}}
+	}))
+
+	req, _ := http.NewRequest("GET", "http://127.0.0.1:8080/_gin_endpoint", nil)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status code %d", w.Code)
+	}
+	if h := w.Header().Get("Retry-After"); h != "2" {
+		t.Errorf("unexpected Retry-After header %q", h)
+	}
+}
+
+func TestEndpointHandler_streamOutlivesTimeout(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 1; i <= 3; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	defer backendServer.Close()
+
+	endpoint := &config.EndpointConfig{
+		Endpoint: "/_gin_endpoint",
+		Timeout:  50 * time.Millisecond,
+		Backends: []*config.Backend{{
+			URLPattern: "/events",
+			Host:       []string{backendServer.URL},
+			Encoding:   encoding.STREAM,
+			Timeout:    50 * time.Millisecond,
+		}},
+	}
+	p, err := proxy.NewDefaultFactory(proxy.HTTPProxyFactory(http.DefaultClient), logging.NoOp).New(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.GET("/_gin_endpoint", EndpointHandler(endpoint, p))
+	server := httptest.NewServer(engine)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/_gin_endpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	// 整个流的持续时间超过了endpoint与backend的timeout
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(body) != "data: 1\n\ndata: 2\n\ndata: 3\n\n" {
+		t.Errorf("unexpected body %q: %v", body, err)
+	}
+}
+
+// brokenWriter 模拟已经断开的客户端
+type brokenWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (brokenWriter) Write(_ []byte) (int, error) { return 0, errors.New("broken pipe") }
+
+func TestEndpointHandler_closesAbandonedBody(t *testing.T) {
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	go writer.Write([]byte("data: 1\n\n"))
+
+	p := func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		return &proxy.Response{Metadata: proxy.Metadata{StatusCode: http.StatusOK}, Io: reader}, nil
+	}
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.GET("/_gin_endpoint", EndpointHandler(&config.EndpointConfig{Timeout: time.Second, OutputEncoding: encoding.NOOP}, p))
+	req, _ := http.NewRequest("GET", "/_gin_endpoint", nil)
+	engine.ServeHTTP(brokenWriter{httptest.NewRecorder()}, req)
+
+	// render没有读完的响应体需要被关闭
+	done := make(chan error, 1)
+	go func() {
+		_, err := writer.Write([]byte("data: 2\n\n"))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != io.ErrClosedPipe {
+			t.Errorf("unexpected error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("the response body should be closed")
+	}
+}
@@ -0,0 +1,69 @@
+package gin
+
+import (
+	"melody/config"
+	"net/http"
+	"sync"
+)
+
+// generationHandler 同一份配置构建的handler, 记录正在处理的请求数
+// 被热加载替换之后, 等待正在处理的请求结束再释放这份配置持有的资源
+type generationHandler struct {
+	http.Handler
+	generation *config.Generation
+	// 当前的路由表, 该generation已经被替换时交给它处理
+	current  http.Handler
+	mu       sync.Mutex
+	inFlight int
+	retired  bool
+}
+
+// ServeHTTP implements the http.Handler interface
+func (g *generationHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !g.acquire() {
+		// 读取到该handler之后路由表被替换, 资源可能已经释放
+		g.current.ServeHTTP(w, req)
+		return
+	}
+	defer g.done()
+	g.Handler.ServeHTTP(w, req)
+}
+
+// acquire 在generation没有被替换时记录一个正在处理的请求
+func (g *generationHandler) acquire() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.retired {
+		return false
+	}
+	g.inFlight++
+	return true
+}
+
+func (g *generationHandler) done() {
+	g.mu.Lock()
+	g.inFlight--
+	release := g.retired && g.inFlight == 0
+	g.mu.Unlock()
+	if release {
+		g.generation.Close()
+	}
+}
+
+// retire 不再接收新的请求, 所有请求结束之后释放资源
+func (g *generationHandler) retire() {
+	g.mu.Lock()
+	g.retired = true
+	release := g.inFlight == 0
+	g.mu.Unlock()
+	if release {
+		g.generation.Close()
+	}
+}
+
+// retire 释放被替换的handler所属的generation
+func retire(old http.Handler) {
+	if g, ok := old.(*generationHandler); ok {
+		g.retire()
+	}
+}
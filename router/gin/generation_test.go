@@ -0,0 +1,68 @@
+package gin
+
+import (
+	"melody/config"
+	"melody/router"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestGenerationHandler_reload(t *testing.T) {
+	reloadable := router.NewReloadableHandler(nil)
+	var released int32
+	newGeneration := func() http.Handler {
+		backend := &config.Backend{}
+		generation := config.NewGeneration(config.ServiceConfig{Endpoints: []*config.EndpointConfig{{Backends: []*config.Backend{backend}}}})
+		var closed int32
+		config.RegisterCloser(backend, func() {
+			atomic.StoreInt32(&closed, 1)
+			atomic.AddInt32(&released, 1)
+		})
+		return &generationHandler{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				if atomic.LoadInt32(&closed) == 1 {
+					t.Error("the request was served by a released generation")
+				}
+				w.WriteHeader(http.StatusOK)
+			}),
+			generation: generation,
+			current:    reloadable,
+		}
+	}
+	retire(reloadable.Swap(newGeneration()))
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", "/", nil)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				w := httptest.NewRecorder()
+				reloadable.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					t.Errorf("unexpected status code %d", w.Code)
+				}
+			}
+		}()
+	}
+	for i := 0; i < 20000; i++ {
+		retire(reloadable.Swap(newGeneration()))
+	}
+	close(stop)
+	wg.Wait()
+
+	// 除了当前的路由表, 其他generation都已经释放
+	if n := atomic.LoadInt32(&released); n != 20000 {
+		t.Errorf("unexpected released generations %d", n)
+	}
+}
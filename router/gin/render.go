@@ -1,11 +1,14 @@
 package gin
 
 import (
+	"encoding/xml"
+	"fmt"
 	"io"
 	"melody/config"
 	"melody/encoding"
 	"melody/proxy"
 	"net/http"
+	"sort"
 	"sync"
 
 	"github.com/gin-gonic/gin"
@@ -22,6 +25,7 @@ var (
 		encoding.STRING: stringRender,
 		encoding.JSON:   jsonRender,
 		encoding.NOOP:   noopRender,
+		encoding.STREAM: streamRender,
 	}
 )
 
@@ -105,6 +109,11 @@ func xmlRender(c *gin.Context, response *proxy.Response) {
 		c.XML(status, nil)
 		return
 	}
+	// 错误结构没有固定的类型, 按照map输出
+	if response.Error != nil {
+		c.XML(status, newXMLMap(response.Data))
+		return
+	}
 	//TODO 选择string render的时候可以定制key
 	d, ok := response.Data["content"]
 	if !ok {
@@ -114,6 +123,66 @@ func xmlRender(c *gin.Context, response *proxy.Response) {
 	c.XML(status, d)
 }
 
+// xmlMap 以key作为元素名输出map, 数组展开为多个同名元素
+type xmlMap struct {
+	root string
+	data map[string]interface{}
+}
+
+// newXMLMap 只有一个key并且值为对象时, 使用该key作为根元素
+func newXMLMap(data map[string]interface{}) xmlMap {
+	if len(data) == 1 {
+		for k, v := range data {
+			if m, ok := v.(map[string]interface{}); ok {
+				return xmlMap{root: k, data: m}
+			}
+		}
+	}
+	return xmlMap{root: "error", data: data}
+}
+
+// MarshalXML implements the xml.Marshaler interface
+func (m xmlMap) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	if err := encodeXMLElement(e, m.root, m.data); err != nil {
+		return err
+	}
+	return e.Flush()
+}
+
+func encodeXMLElement(e *xml.Encoder, name string, v interface{}) error {
+	if items, ok := v.([]interface{}); ok {
+		for _, item := range items {
+			if err := encodeXMLElement(e, name, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if err := encodeXMLElement(e, k, t[k]); err != nil {
+				return err
+			}
+		}
+	case nil:
+	default:
+		if err := e.EncodeToken(xml.CharData(fmt.Sprintf("%v", t))); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
 func jsonRender(c *gin.Context, resp *proxy.Response) {
 	status := c.Writer.Status()
 	if resp == nil {
@@ -139,3 +208,41 @@ func noopRender(c *gin.Context, response *proxy.Response) {
 	}
 	io.Copy(c.Writer, response.Io)
 }
+
+// streamRender 每次从backend读到数据之后立即flush, 没有Content-Length时使用chunked传输
+// 对于 Server-Sent Events, 每个事件到达之后都会马上发送给客户端
+func streamRender(c *gin.Context, response *proxy.Response) {
+	if response == nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.Status(response.Metadata.StatusCode)
+	for k, vs := range response.Metadata.Headers {
+		for _, v := range vs {
+			c.Writer.Header().Add(k, v)
+		}
+	}
+	c.Writer.WriteHeaderNow()
+	if response.Io == nil {
+		return
+	}
+	c.Writer.Flush()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := response.Io.Read(buf)
+		if n > 0 {
+			if _, werr := c.Writer.Write(buf[:n]); werr != nil {
+				c.Error(werr)
+				return
+			}
+			c.Writer.Flush()
+		}
+		if err != nil {
+			if err != io.EOF {
+				c.Error(err)
+			}
+			return
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package gin
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"io"
 	"io/ioutil"
 	"melody/config"
 	"melody/core"
@@ -491,3 +493,61 @@ func TestRender_noop_nilBody(t *testing.T) {
 		t.Error("Unexpected body:", content, "expected:", expectedContent)
 	}
 }
+
+func TestRender_stream(t *testing.T) {
+	reader, writer := io.Pipe()
+	next := make(chan struct{})
+	go func() {
+		writer.Write([]byte("data: 1\n\n"))
+		<-next
+		writer.Write([]byte("data: 2\n\n"))
+		writer.Close()
+	}()
+
+	p := func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		return &proxy.Response{
+			Metadata: proxy.Metadata{
+				StatusCode: http.StatusOK,
+				Headers:    map[string][]string{"Content-Type": {"text/event-stream"}},
+			},
+			Io: reader,
+		}, nil
+	}
+	endpoint := &config.EndpointConfig{
+		Timeout:        time.Second,
+		OutputEncoding: encoding.STREAM,
+	}
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.GET("/_gin_endpoint", EndpointHandler(endpoint, p))
+	server := httptest.NewServer(engine)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/_gin_endpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Error("Content-Type error:", resp.Header.Get("Content-Type"))
+	}
+	if len(resp.TransferEncoding) == 0 || resp.TransferEncoding[0] != "chunked" {
+		t.Error("the response should be chunked:", resp.TransferEncoding)
+	}
+
+	// 第一个事件需要在第二个事件产生之前到达客户端
+	events := bufio.NewReader(resp.Body)
+	for _, expected := range []string{"data: 1\n", "\n"} {
+		line, err := events.ReadString('\n')
+		if err != nil || line != expected {
+			t.Fatalf("unexpected line %q: %v", line, err)
+		}
+	}
+	close(next)
+	rest, _ := ioutil.ReadAll(events)
+	if string(rest) != "data: 2\n\n" {
+		t.Errorf("unexpected body %q", string(rest))
+	}
+}
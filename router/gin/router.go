@@ -2,15 +2,22 @@ package gin
 
 import (
 	"context"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"melody/config"
 	"melody/logging"
 	"melody/proxy"
 	"melody/router"
 	"net/http"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 )
 
+// methodPattern gin只接受由大写字母组成的method
+var methodPattern = regexp.MustCompile(`^[A-Z]+$`)
+
 // RunServerFunc 定义了Melody Server的运行方法
 type RunServerFunc func(context.Context, config.ServiceConfig, http.Handler) error
 
@@ -22,12 +29,18 @@ type Config struct {
 	ProxyFactory   proxy.Factory
 	Logger         logging.Logger
 	RunServer      RunServerFunc
+	// EngineFactory 热加载时根据新的配置创建gin.Engine, 为nil时使用gin.Default
+	EngineFactory func(config.ServiceConfig) *gin.Engine
 }
 
 type ginRouter struct {
 	cfg       Config
 	ctx       context.Context
 	RunServer RunServerFunc
+	handler   *router.ReloadableHandler
+	// Run 安装了第一份路由表之后关闭, 在此之前的热加载需要等待
+	ready     chan struct{}
+	readyOnce *sync.Once
 }
 
 type factory struct {
@@ -48,6 +61,9 @@ func (f factory) NewWithContext(ctx context.Context) router.Router {
 		cfg:       f.cfg,
 		ctx:       ctx,
 		RunServer: f.cfg.RunServer,
+		handler:   router.NewReloadableHandler(f.cfg.Engine),
+		ready:     make(chan struct{}),
+		readyOnce: new(sync.Once),
 	}
 }
 
@@ -73,71 +89,350 @@ func (r ginRouter) Run(config config.ServiceConfig) {
 
 	router.InitHTTPDefaultTransport(config)
 
-	r.cfg.Engine.RedirectTrailingSlash = true
-	r.cfg.Engine.RedirectFixedPath = true
-	r.cfg.Engine.HandleMethodNotAllowed = true
+	handler, _ := r.newHandler(r.cfg.Engine, config, false)
+	retire(r.handler.Swap(handler))
+	r.readyOnce.Do(func() { close(r.ready) })
 
-	// 启用 Middleware
-	r.cfg.Engine.Use(r.cfg.MiddleWares...)
+	// Run Melody server
+	if err := r.RunServer(r.ctx, config, r.handler); err != nil {
+		r.cfg.Logger.Error(err.Error())
+	}
 
-	// 注册 Debug 路由
-	if config.Debug {
-		r.registerDebugEndpoints()
+	r.cfg.Logger.Info("Melody server execution ended")
+}
+
+// Reload 根据新的配置构建一个全新的gin.Engine, 并原子地替换正在运行的路由表
+// 任何一个endpoint构建失败都会返回错误, 此时旧的路由表保持不变
+// 在 Run 安装第一份路由表之前调用时会等待, 避免被 Run 覆盖
+// 旧的路由表处理完正在进行的请求之后, 释放它持有的资源
+func (r ginRouter) Reload(cfg config.ServiceConfig) (err error) {
+	select {
+	case <-r.ready:
+	case <-r.ctx.Done():
+		return r.ctx.Err()
 	}
+	defer func() {
+		// gin 在注册冲突的路由时会panic
+		if e := recover(); e != nil {
+			err = fmt.Errorf("registering the endpoints: %v", e)
+		}
+	}()
 
-	// 注册所有Endpoints
-	r.registerMelodyEndpoints(config.Endpoints)
+	handler, err := r.newHandler(r.newEngine(cfg), cfg, true)
+	if err != nil {
+		return err
+	}
+	retire(r.handler.Swap(handler))
+	return nil
+}
 
-	// 处理404请求
-	r.cfg.Engine.NoRoute(func(c *gin.Context) {
-		c.Header(router.HeaderCompleteKey, router.HeaderInCompleteResponseValue)
-	})
+func (r ginRouter) newEngine(cfg config.ServiceConfig) *gin.Engine {
+	if r.cfg.EngineFactory == nil {
+		return gin.Default()
+	}
+	return r.cfg.EngineFactory(cfg)
+}
 
-	// Run Melody server
-	if err := r.RunServer(r.ctx, config, r.cfg.Engine); err != nil {
-		r.cfg.Logger.Error(err.Error())
+// newHandler 构建一份新的路由表, 构建过程中登记的资源属于该路由表的generation
+// 构建失败时立即释放这些资源
+func (r ginRouter) newHandler(engine *gin.Engine, cfg config.ServiceConfig, strict bool) (handler http.Handler, err error) {
+	generation := config.NewGeneration(cfg)
+	defer func() {
+		if e := recover(); e != nil {
+			generation.Close()
+			panic(e)
+		}
+		if err != nil {
+			generation.Close()
+		}
+	}()
+	handler, err = r.buildHandler(engine, cfg, strict)
+	if err != nil {
+		return nil, err
 	}
+	return &generationHandler{Handler: handler, generation: generation, current: r.handler}, nil
+}
 
-	r.cfg.Logger.Info("Melody server execution ended")
+// buildHandler 构建所有endpoint的handler并注册到engine中
+// 有endpoint绑定了listener时, 每个listener使用独立的路由表
+// strict 为 true 时, 任何一个endpoint构建失败都会中断注册并返回错误
+func (r ginRouter) buildHandler(engine *gin.Engine, cfg config.ServiceConfig, strict bool) (http.Handler, error) {
+	handlers, err := r.newEndpointHandlers(cfg.Endpoints, strict)
+	if err != nil {
+		return nil, err
+	}
+
+	bound := false
+	for _, h := range handlers {
+		bound = bound || len(h.cfg.Listeners) > 0
+	}
+	if !bound {
+		return r.newHostHandler(engine, cfg, handlers), nil
+	}
+
+	listeners := listenerRouter{}
+	for i, l := range cfg.Listeners {
+		endpoints := []endpointHandler{}
+		for _, h := range handlers {
+			if len(h.cfg.Listeners) == 0 || contains(h.cfg.Listeners, l.Name) {
+				endpoints = append(endpoints, h)
+			}
+		}
+		e := engine
+		if i > 0 {
+			e = r.newEngine(cfg)
+		}
+		listeners.handlers = append(listeners.handlers, r.newHostHandler(e, cfg, endpoints))
+		listeners.names = append(listeners.names, l.Name)
+	}
+	return listeners, nil
+}
+
+// listenerRouter 根据接收请求的listener选择handler, 没有匹配时使用第一个listener的handler
+type listenerRouter struct {
+	names    []string
+	handlers []http.Handler
 }
 
-func (r ginRouter) registerMelodyEndpoints(endpoints []*config.EndpointConfig) {
+// ServeHTTP implements the http.Handler interface
+func (l listenerRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name := router.ListenerName(req.Context())
+	for i, n := range l.names {
+		if n == name {
+			l.handlers[i].ServeHTTP(w, req)
+			return
+		}
+	}
+	l.handlers[0].ServeHTTP(w, req)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// newHostHandler 绑定了虚拟主机的endpoint注册到该host单独的engine中, 没有绑定的endpoint对所有的host生效
+func (r ginRouter) newHostHandler(engine *gin.Engine, cfg config.ServiceConfig, handlers []endpointHandler) http.Handler {
+	shared := []endpointHandler{}
+	hosts := []string{}
+	scoped := map[string][]endpointHandler{}
+	for _, h := range handlers {
+		if len(h.cfg.Hosts) == 0 {
+			shared = append(shared, h)
+			continue
+		}
+		for _, host := range h.cfg.Hosts {
+			if _, ok := scoped[host]; !ok {
+				hosts = append(hosts, host)
+			}
+			scoped[host] = append(scoped[host], h)
+		}
+	}
+
+	r.registerEngine(engine, cfg, shared)
+	if len(hosts) == 0 {
+		return engine
+	}
+
+	vhosts := newHostRouter(engine)
+	for _, host := range hosts {
+		// 依次使用host自己的endpoint、匹配的通配虚拟主机(后缀从长到短)的endpoint以及共享的endpoint
+		// 已经被更具体的虚拟主机注册过的path会被跳过
+		scopes := [][]endpointHandler{scoped[host]}
+		for _, wildcard := range wildcardsOf(host, hosts) {
+			scopes = append(scopes, scoped[wildcard])
+		}
+		scopes = append(scopes, shared)
+
+		endpoints := []endpointHandler{}
+		// 已经注册的 method + path
+		routes := map[string]bool{}
+		paths := []string{}
+		for _, scope := range scopes {
+			added := map[string]bool{}
+			scopePaths := []string{}
+			for _, h := range scope {
+				if p := conflictingPath(h.cfg.Endpoint, paths); p != "" {
+					r.cfg.Logger.Error("host", host, "skipping", h.cfg.Method, h.cfg.Endpoint, "because its params conflict with", p)
+					continue
+				}
+				all := endpointMethods(h.cfg)
+				methods := make([]string, 0, len(all))
+				for _, m := range all {
+					if !routes[m+" "+h.cfg.Endpoint] {
+						methods = append(methods, m)
+					}
+				}
+				if len(methods) == 0 {
+					continue
+				}
+				if len(methods) < len(all) {
+					// 只注册没有被更具体的虚拟主机注册过的method
+					cfg := *h.cfg
+					cfg.Methods = methods
+					h = endpointHandler{cfg: &cfg, handler: h.handler}
+				}
+				endpoints = append(endpoints, h)
+				for _, m := range methods {
+					added[m+" "+h.cfg.Endpoint] = true
+				}
+				scopePaths = append(scopePaths, h.cfg.Endpoint)
+			}
+			for route := range added {
+				routes[route] = true
+			}
+			paths = append(paths, scopePaths...)
+		}
+
+		e := r.newEngine(cfg)
+		r.registerEngine(e, cfg, endpoints)
+		vhosts.add(host, e)
+	}
+	return vhosts
+}
+
+// endpointHandler endpoint与对应的gin handler
+type endpointHandler struct {
+	cfg     *config.EndpointConfig
+	handler gin.HandlerFunc
+}
+
+// newEndpointHandlers 为每个endpoint创建proxy与handler, 多个engine共享同一个handler
+func (r ginRouter) newEndpointHandlers(endpoints []*config.EndpointConfig, strict bool) ([]endpointHandler, error) {
+	handlers := make([]endpointHandler, 0, len(endpoints))
 	for _, e := range endpoints {
 		proxyStack, err := r.cfg.ProxyFactory.New(e)
 		if err != nil {
+			if strict {
+				return nil, fmt.Errorf("calling the ProxyFactory for %s %s: %s", e.Method, e.Endpoint, err.Error())
+			}
 			r.cfg.Logger.Error("calling the ProxyFactory", err.Error())
 			continue
 		}
+		handlers = append(handlers, endpointHandler{cfg: e, handler: r.cfg.HandlerFactory(e, proxyStack)})
+	}
+	return handlers, nil
+}
+
+// registerEngine 将middlewares, debug路由以及endpoints注册到engine中
+func (r ginRouter) registerEngine(engine *gin.Engine, config config.ServiceConfig, endpoints []endpointHandler) {
+	engine.RedirectTrailingSlash = true
+	engine.RedirectFixedPath = true
+	engine.HandleMethodNotAllowed = true
+
+	// 启用 Middleware
+	engine.Use(r.cfg.MiddleWares...)
+
+	// 注册 Debug 路由
+	if config.Debug {
+		r.registerDebugEndpoints(engine)
+	}
+
+	// 注册所有Endpoints
+	r.registerMelodyEndpoints(engine, endpoints)
+
+	// 处理404请求
+	engine.NoRoute(func(c *gin.Context) {
+		c.Header(router.HeaderCompleteKey, router.HeaderInCompleteResponseValue)
+	})
+}
+
+func (r ginRouter) registerMelodyEndpoints(engine *gin.Engine, endpoints []endpointHandler) {
+	// 每个path上已经注册的method, 用于补充HEAD与OPTIONS
+	paths := []string{}
+	registered := map[string]map[string]bool{}
+	getHandlers := map[string]gin.HandlerFunc{}
+
+	for _, h := range endpoints {
+		e, handler := h.cfg, h.handler
+		methods := r.registerMelodyEndpoint(engine, endpointMethods(e), e.Endpoint, handler, len(e.Backends))
+
+		if _, ok := registered[e.Endpoint]; !ok {
+			paths = append(paths, e.Endpoint)
+			registered[e.Endpoint] = map[string]bool{}
+		}
+		for _, m := range methods {
+			registered[e.Endpoint][m] = true
+		}
+		if registered[e.Endpoint][http.MethodGet] {
+			getHandlers[e.Endpoint] = handler
+		}
+	}
 
-		r.registerMelodyEndpoint(e.Method, e.Endpoint, r.cfg.HandlerFactory(e, proxyStack), len(e.Backends))
+	for _, path := range paths {
+		r.registerImplicitMethods(engine, path, registered[path], getHandlers[path])
 	}
 }
 
-func (r ginRouter) registerMelodyEndpoint(method, path string, handler gin.HandlerFunc, totBackends int) {
+// endpointMethods 返回endpoint接受的method
+func endpointMethods(e *config.EndpointConfig) []string {
+	if len(e.Methods) > 0 {
+		return e.Methods
+	}
+	return config.ParseMethods(e.Method)
+}
+
+// registerMelodyEndpoint 返回成功注册的method
+func (r ginRouter) registerMelodyEndpoint(engine *gin.Engine, methods []string, path string, handler gin.HandlerFunc, totBackends int) []string {
 	//if requestMethod != http.MethodGet && totBackends > 1 {
 	//
 	//}
-	method = strings.ToTitle(method)
-	switch method {
-	case http.MethodGet:
-		r.cfg.Engine.GET(path, handler)
-	case http.MethodPost:
-		r.cfg.Engine.POST(path, handler)
-	case http.MethodPut:
-		r.cfg.Engine.PUT(path, handler)
-	case http.MethodPatch:
-		r.cfg.Engine.PATCH(path, handler)
-	case http.MethodDelete:
-		r.cfg.Engine.DELETE(path, handler)
-	default:
-		r.cfg.Logger.Error("Unsupported method", method)
-	}
-}
-
-func (r ginRouter) registerDebugEndpoints() {
+	registered := make([]string, 0, len(methods))
+	for _, method := range methods {
+		if !methodPattern.MatchString(method) {
+			r.cfg.Logger.Error("Unsupported method", method)
+			continue
+		}
+		engine.Handle(method, path, handler)
+		registered = append(registered, method)
+	}
+	return registered
+}
+
+// registerImplicitMethods 没有声明HEAD的GET endpoint使用GET的handler处理HEAD请求,
+// 没有声明OPTIONS的path返回204与Allow响应头, CORS的预检请求在全局的cors middleware中已经处理
+func (r ginRouter) registerImplicitMethods(engine *gin.Engine, path string, methods map[string]bool, getHandler gin.HandlerFunc) {
+	if methods[http.MethodGet] && !methods[http.MethodHead] {
+		if r.registerImplicitMethod(engine, http.MethodHead, path, getHandler) {
+			methods[http.MethodHead] = true
+		}
+	}
+	if len(methods) == 0 || methods[http.MethodOptions] {
+		return
+	}
+	methods[http.MethodOptions] = true
+	allowed := make([]string, 0, len(methods))
+	for m := range methods {
+		allowed = append(allowed, m)
+	}
+	sort.Strings(allowed)
+	allow := strings.Join(allowed, ", ")
+	r.registerImplicitMethod(engine, http.MethodOptions, path, func(c *gin.Context) {
+		c.Header("Allow", allow)
+		c.Status(http.StatusNoContent)
+	})
+}
+
+// registerImplicitMethod 与其他path冲突时(例如不同的参数名)跳过, 不影响声明的endpoint
+func (r ginRouter) registerImplicitMethod(engine *gin.Engine, method, path string, handler gin.HandlerFunc) (ok bool) {
+	defer func() {
+		if e := recover(); e != nil {
+			r.cfg.Logger.Debug("unable to register", method, path, e)
+			ok = false
+		}
+	}()
+	engine.Handle(method, path, handler)
+	return true
+}
+
+func (r ginRouter) registerDebugEndpoints(engine *gin.Engine) {
 	debugHandler := DebugHandler(r.cfg.Logger)
-	r.cfg.Engine.GET("/__debug/*param", debugHandler)
-	r.cfg.Engine.POST("/__debug/*param", debugHandler)
-	r.cfg.Engine.PUT("/__debug/*param", debugHandler)
-	r.cfg.Engine.DELETE("/__debug/*param", debugHandler)
+	engine.GET("/__debug/*param", debugHandler)
+	engine.POST("/__debug/*param", debugHandler)
+	engine.PUT("/__debug/*param", debugHandler)
+	engine.DELETE("/__debug/*param", debugHandler)
 }
@@ -12,7 +12,9 @@ import (
 	"melody/logging"
 	"melody/proxy"
 	"melody/router"
+	"melody/transport/http/server"
 	"net/http"
+	"net/http/httptest"
 	"regexp"
 	"strings"
 	"testing"
@@ -137,19 +139,19 @@ func TestDefaultFactory_ko(t *testing.T) {
 		Endpoints: []*config.EndpointConfig{
 			{
 				Endpoint: "/ignored",
-				Method:   "GETTT",
+				Method:   "GET TT",
 				Backends: []*config.Backend{
 					{},
 				},
 			},
 			{
 				Endpoint: "/empty",
-				Method:   "GETTT",
+				Method:   "GET TT",
 				Backends: []*config.Backend{},
 			},
 			{
 				Endpoint: "/also-ignored",
-				Method:   "PUTt",
+				Method:   "PUT/T",
 				Backends: []*config.Backend{
 					{},
 					{},
@@ -248,6 +250,404 @@ func TestRunServer_ko(t *testing.T) {
 	}
 }
 
+func TestRunServer_reload(t *testing.T) {
+	buff := new(bytes.Buffer)
+	logger, err := logging.NewLogger("ERROR", buff, "")
+	if err != nil {
+		t.Error("building the logger:", err.Error())
+		return
+	}
+
+	handlers := make(chan http.Handler, 1)
+	runServerFunc := func(ctx context.Context, _ config.ServiceConfig, h http.Handler) error {
+		handlers <- h
+		<-ctx.Done()
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := NewFactory(
+		Config{
+			Engine:         gin.New(),
+			MiddleWares:    []gin.HandlerFunc{},
+			HandlerFactory: EndpointHandler,
+			ProxyFactory:   noopProxyFactory(map[string]interface{}{"supu": "tupu"}),
+			Logger:         logger,
+			RunServer:      runServerFunc,
+			EngineFactory:  func(_ config.ServiceConfig) *gin.Engine { return gin.New() },
+		},
+	).NewWithContext(ctx)
+
+	reloader, ok := r.(router.Reloader)
+	if !ok {
+		t.Error("the gin router should be reloadable")
+		return
+	}
+
+	newEndpoint := func(path string) *config.EndpointConfig {
+		return &config.EndpointConfig{
+			Endpoint: path,
+			Method:   "GET",
+			Timeout:  time.Second,
+			Backends: []*config.Backend{{}},
+		}
+	}
+
+	go r.Run(config.ServiceConfig{Endpoints: []*config.EndpointConfig{newEndpoint("/old")}})
+	handler := <-handlers
+
+	assertStatus := func(path string, status int) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		handler.ServeHTTP(w, req)
+		if w.Code != status {
+			t.Errorf("%s: unexpected status code. have: %d, want: %d", path, w.Code, status)
+		}
+	}
+
+	assertStatus("/old", http.StatusOK)
+	assertStatus("/new", http.StatusNotFound)
+
+	if err := reloader.Reload(config.ServiceConfig{Endpoints: []*config.EndpointConfig{newEndpoint("/new")}}); err != nil {
+		t.Error("unexpected error:", err.Error())
+		return
+	}
+
+	assertStatus("/old", http.StatusNotFound)
+	assertStatus("/new", http.StatusOK)
+
+	// 重复的路由注册失败, 旧的路由表应当保持不变
+	if err := reloader.Reload(config.ServiceConfig{Endpoints: []*config.EndpointConfig{
+		newEndpoint("/dup"),
+		newEndpoint("/dup"),
+	}}); err == nil {
+		t.Error("expecting an error")
+	}
+
+	assertStatus("/new", http.StatusOK)
+	assertStatus("/dup", http.StatusNotFound)
+}
+
+func TestRunServer_methods(t *testing.T) {
+	buff := new(bytes.Buffer)
+	logger, err := logging.NewLogger("ERROR", buff, "")
+	if err != nil {
+		t.Error("building the logger:", err.Error())
+		return
+	}
+
+	handlers := make(chan http.Handler, 1)
+	runServerFunc := func(ctx context.Context, _ config.ServiceConfig, h http.Handler) error {
+		handlers <- h
+		<-ctx.Done()
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := NewFactory(
+		Config{
+			Engine:         gin.New(),
+			MiddleWares:    []gin.HandlerFunc{},
+			HandlerFactory: EndpointHandler,
+			ProxyFactory:   noopProxyFactory(map[string]interface{}{"supu": "tupu"}),
+			Logger:         logger,
+			RunServer:      runServerFunc,
+		},
+	).NewWithContext(ctx)
+
+	go r.Run(config.ServiceConfig{Endpoints: []*config.EndpointConfig{
+		{Endpoint: "/list", Method: "get, post", Timeout: time.Second, Backends: []*config.Backend{{}}},
+		{Endpoint: "/any", Method: "ANY", Timeout: time.Second, Backends: []*config.Backend{{}}},
+		{Endpoint: "/cache", Method: "PURGE", Timeout: time.Second, Backends: []*config.Backend{{}}},
+	}})
+	handler := <-handlers
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		status int
+		allow  string
+	}{
+		{method: "GET", path: "/list", status: http.StatusOK},
+		{method: "POST", path: "/list", status: http.StatusOK},
+		{method: "PUT", path: "/list", status: http.StatusMethodNotAllowed},
+		{method: "HEAD", path: "/list", status: http.StatusOK},
+		{method: "OPTIONS", path: "/list", status: http.StatusNoContent, allow: "GET, HEAD, OPTIONS, POST"},
+		{method: "DELETE", path: "/any", status: http.StatusOK},
+		{method: "TRACE", path: "/any", status: http.StatusOK},
+		{method: "HEAD", path: "/any", status: http.StatusOK},
+		{method: "OPTIONS", path: "/any", status: http.StatusOK},
+		{method: "PURGE", path: "/cache", status: http.StatusOK},
+		{method: "GET", path: "/cache", status: http.StatusMethodNotAllowed},
+		{method: "OPTIONS", path: "/cache", status: http.StatusNoContent, allow: "OPTIONS, PURGE"},
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(tc.method, tc.path, nil)
+		handler.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("%s %s: unexpected status code. have: %d, want: %d", tc.method, tc.path, w.Code, tc.status)
+		}
+		if allow := w.Header().Get("Allow"); allow != tc.allow {
+			t.Errorf("%s %s: unexpected Allow header: %s", tc.method, tc.path, allow)
+		}
+		if tc.method == "HEAD" {
+			get := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", tc.path, nil)
+			handler.ServeHTTP(get, req)
+			if w.Body.Len() != 0 {
+				t.Errorf("%s %s: unexpected body: %s", tc.method, tc.path, w.Body.String())
+			}
+			if w.Header().Get("Content-Length") != fmt.Sprintf("%d", get.Body.Len()) {
+				t.Errorf("%s %s: unexpected Content-Length: %s", tc.method, tc.path, w.Header().Get("Content-Length"))
+			}
+		}
+	}
+}
+
+func TestRunServer_catchAll(t *testing.T) {
+	buff := new(bytes.Buffer)
+	logger, err := logging.NewLogger("ERROR", buff, "")
+	if err != nil {
+		t.Error("building the logger:", err.Error())
+		return
+	}
+
+	handlers := make(chan http.Handler, 1)
+	runServerFunc := func(ctx context.Context, _ config.ServiceConfig, h http.Handler) error {
+		handlers <- h
+		<-ctx.Done()
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// 返回backend的url_pattern生成的path
+	pf := proxy.FactoryFunc(func(e *config.EndpointConfig) (proxy.Proxy, error) {
+		return func(_ context.Context, r *proxy.Request) (*proxy.Response, error) {
+			r.GeneratePath(e.Backends[0].URLPattern)
+			return &proxy.Response{Data: map[string]interface{}{"path": r.Path}, IsComplete: true}, nil
+		}, nil
+	})
+
+	r := NewFactory(
+		Config{
+			Engine:         gin.New(),
+			MiddleWares:    []gin.HandlerFunc{},
+			HandlerFactory: EndpointHandler,
+			ProxyFactory:   pf,
+			Logger:         logger,
+			RunServer:      runServerFunc,
+		},
+	).NewWithContext(ctx)
+
+	serviceCfg := config.ServiceConfig{
+		Version: 1,
+		Host:    []string{"http://127.0.0.1:8080"},
+		Endpoints: []*config.EndpointConfig{
+			{Endpoint: "/api/v1/users/*rest", Backends: []*config.Backend{{URLPattern: "/users/{rest}"}}},
+			{Endpoint: "/files/{tenant}/{*path}", Backends: []*config.Backend{{URLPattern: "/{tenant}{path}"}}},
+		},
+	}
+	if err := serviceCfg.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	go r.Run(serviceCfg)
+	handler := <-handlers
+
+	for path, expected := range map[string]string{
+		"/api/v1/users/42":          `{"path":"/users/42"}`,
+		"/api/v1/users/42/orders/1": `{"path":"/users/42/orders/1"}`,
+		"/api/v1/users/":            `{"path":"/users/"}`,
+		"/files/acme/a/b/c.txt":     `{"path":"/acme/a/b/c.txt"}`,
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: unexpected status code %d", path, w.Code)
+		}
+		if body := strings.TrimSpace(w.Body.String()); body != expected {
+			t.Errorf("%s: unexpected body %s", path, body)
+		}
+	}
+}
+
+func TestRunServer_virtualHosts(t *testing.T) {
+	buff := new(bytes.Buffer)
+	logger, err := logging.NewLogger("ERROR", buff, "")
+	if err != nil {
+		t.Error("building the logger:", err.Error())
+		return
+	}
+
+	handlers := make(chan http.Handler, 1)
+	runServerFunc := func(ctx context.Context, _ config.ServiceConfig, h http.Handler) error {
+		handlers <- h
+		<-ctx.Done()
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// 返回endpoint的名称
+	pf := proxy.FactoryFunc(func(e *config.EndpointConfig) (proxy.Proxy, error) {
+		name := e.Endpoint + " " + strings.Join(e.Hosts, ",")
+		return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			return &proxy.Response{Data: map[string]interface{}{"name": name}, IsComplete: true}, nil
+		}, nil
+	})
+
+	r := NewFactory(
+		Config{
+			Engine:         gin.New(),
+			MiddleWares:    []gin.HandlerFunc{},
+			HandlerFactory: EndpointHandler,
+			ProxyFactory:   pf,
+			Logger:         logger,
+			RunServer:      runServerFunc,
+			EngineFactory:  func(_ config.ServiceConfig) *gin.Engine { return gin.New() },
+		},
+	).NewWithContext(ctx)
+
+	newEndpoint := func(path string, hosts ...string) *config.EndpointConfig {
+		return &config.EndpointConfig{
+			Endpoint: path,
+			Method:   "GET",
+			Timeout:  time.Second,
+			Hosts:    hosts,
+			Backends: []*config.Backend{{}},
+		}
+	}
+
+	go r.Run(config.ServiceConfig{Endpoints: []*config.EndpointConfig{
+		newEndpoint("/users", "api.a.com"),
+		newEndpoint("/users", "api.b.com"),
+		newEndpoint("/orders", "*.b.com"),
+		newEndpoint("/health"),
+		newEndpoint("/health", "*.b.com"),
+	}})
+	handler := <-handlers
+
+	for _, tc := range []struct {
+		host   string
+		path   string
+		status int
+		name   string
+	}{
+		{host: "api.a.com", path: "/users", status: http.StatusOK, name: "/users api.a.com"},
+		{host: "API.A.COM:8080", path: "/users", status: http.StatusOK, name: "/users api.a.com"},
+		{host: "api.b.com", path: "/users", status: http.StatusOK, name: "/users api.b.com"},
+		{host: "api.a.com", path: "/orders", status: http.StatusNotFound},
+		{host: "api.b.com", path: "/orders", status: http.StatusOK, name: "/orders *.b.com"},
+		{host: "www.b.com", path: "/orders", status: http.StatusOK, name: "/orders *.b.com"},
+		{host: "www.b.com", path: "/users", status: http.StatusNotFound},
+		{host: "localhost", path: "/users", status: http.StatusNotFound},
+		{host: "localhost", path: "/health", status: http.StatusOK, name: "/health "},
+		{host: "api.a.com", path: "/health", status: http.StatusOK, name: "/health "},
+		{host: "www.b.com", path: "/health", status: http.StatusOK, name: "/health *.b.com"},
+		{host: "api.b.com", path: "/health", status: http.StatusOK, name: "/health *.b.com"},
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://"+tc.host+tc.path, nil)
+		handler.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("%s%s: unexpected status code %d", tc.host, tc.path, w.Code)
+			continue
+		}
+		if tc.status != http.StatusOK {
+			continue
+		}
+		if body := strings.TrimSpace(w.Body.String()); body != `{"name":"`+tc.name+`"}` {
+			t.Errorf("%s%s: unexpected body %s", tc.host, tc.path, body)
+		}
+	}
+}
+
+func TestRunServer_listeners(t *testing.T) {
+	buff := new(bytes.Buffer)
+	logger, err := logging.NewLogger("ERROR", buff, "")
+	if err != nil {
+		t.Error("building the logger:", err.Error())
+		return
+	}
+
+	handlers := make(chan http.Handler, 1)
+	runServerFunc := func(ctx context.Context, _ config.ServiceConfig, h http.Handler) error {
+		handlers <- h
+		<-ctx.Done()
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := NewFactory(
+		Config{
+			Engine:         gin.New(),
+			MiddleWares:    []gin.HandlerFunc{},
+			HandlerFactory: EndpointHandler,
+			ProxyFactory:   noopProxyFactory(map[string]interface{}{"supu": "tupu"}),
+			Logger:         logger,
+			RunServer:      runServerFunc,
+			EngineFactory:  func(_ config.ServiceConfig) *gin.Engine { return gin.New() },
+		},
+	).NewWithContext(ctx)
+
+	newEndpoint := func(path string, listeners ...string) *config.EndpointConfig {
+		return &config.EndpointConfig{
+			Endpoint:  path,
+			Method:    "GET",
+			Timeout:   time.Second,
+			Listeners: listeners,
+			Backends:  []*config.Backend{{}},
+		}
+	}
+
+	serviceCfg := config.ServiceConfig{
+		Listeners: []*config.Listener{
+			{Name: "public", Address: ":8080"},
+			{Name: "admin", Address: ":9090"},
+		},
+		Endpoints: []*config.EndpointConfig{
+			newEndpoint("/users", "public"),
+			newEndpoint("/stats", "admin"),
+			newEndpoint("/health"),
+		},
+	}
+	go r.Run(serviceCfg)
+	handler := <-handlers
+
+	for _, tc := range []struct {
+		listener int
+		path     string
+		status   int
+	}{
+		{listener: 0, path: "/users", status: http.StatusOK},
+		{listener: 0, path: "/stats", status: http.StatusNotFound},
+		{listener: 0, path: "/health", status: http.StatusOK},
+		{listener: 1, path: "/users", status: http.StatusNotFound},
+		{listener: 1, path: "/stats", status: http.StatusOK},
+		{listener: 1, path: "/health", status: http.StatusOK},
+	} {
+		l := serviceCfg.Listeners[tc.listener]
+		// 使用listener的server的BaseContext模拟该listener接收的请求
+		ctx := server.NewListenerServer(serviceCfg, l, handler).BaseContext(nil)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", tc.path, nil)
+		handler.ServeHTTP(w, req.WithContext(ctx))
+		if w.Code != tc.status {
+			t.Errorf("%s %s: unexpected status code %d", l.Name, tc.path, w.Code)
+		}
+	}
+}
+
 func checkResponseIs404(t *testing.T, req *http.Request) {
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -291,3 +691,196 @@ type erroredProxyFactory struct {
 func (e erroredProxyFactory) New(_ *config.EndpointConfig) (proxy.Proxy, error) {
 	return proxy.NoopProxy, e.Error
 }
+
+func TestRunServer_virtualHostsSharedMethods(t *testing.T) {
+	buff := new(bytes.Buffer)
+	logger, err := logging.NewLogger("ERROR", buff, "")
+	if err != nil {
+		t.Error("building the logger:", err.Error())
+		return
+	}
+
+	handlers := make(chan http.Handler, 1)
+	runServerFunc := func(ctx context.Context, _ config.ServiceConfig, h http.Handler) error {
+		handlers <- h
+		<-ctx.Done()
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pf := proxy.FactoryFunc(func(e *config.EndpointConfig) (proxy.Proxy, error) {
+		name := e.Method + " " + e.Endpoint + " " + strings.Join(e.Hosts, ",")
+		return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			return &proxy.Response{Data: map[string]interface{}{"name": name}, IsComplete: true}, nil
+		}, nil
+	})
+
+	r := NewFactory(
+		Config{
+			Engine:         gin.New(),
+			MiddleWares:    []gin.HandlerFunc{},
+			HandlerFactory: EndpointHandler,
+			ProxyFactory:   pf,
+			Logger:         logger,
+			RunServer:      runServerFunc,
+			EngineFactory:  func(_ config.ServiceConfig) *gin.Engine { return gin.New() },
+		},
+	).NewWithContext(ctx)
+
+	newEndpoint := func(method, path string, hosts ...string) *config.EndpointConfig {
+		return &config.EndpointConfig{
+			Endpoint: path,
+			Method:   method,
+			Timeout:  time.Second,
+			Hosts:    hosts,
+			Backends: []*config.Backend{{}},
+		}
+	}
+
+	go r.Run(config.ServiceConfig{Endpoints: []*config.EndpointConfig{
+		newEndpoint("GET", "/items", "api.a.com"),
+		newEndpoint("GET,POST", "/items"),
+		newEndpoint("GET", "/users/:id", "api.a.com"),
+		newEndpoint("GET", "/users/:name/orders"),
+	}})
+	handler := <-handlers
+
+	for _, tc := range []struct {
+		method string
+		host   string
+		path   string
+		status int
+		name   string
+	}{
+		{method: "GET", host: "api.a.com", path: "/items", status: http.StatusOK, name: "GET /items api.a.com"},
+		{method: "POST", host: "api.a.com", path: "/items", status: http.StatusOK, name: "GET,POST /items "},
+		{method: "POST", host: "localhost", path: "/items", status: http.StatusOK, name: "GET,POST /items "},
+		{method: "GET", host: "api.a.com", path: "/users/42", status: http.StatusOK, name: "GET /users/:id api.a.com"},
+		{method: "GET", host: "api.a.com", path: "/users/42/orders", status: http.StatusNotFound},
+		{method: "GET", host: "localhost", path: "/users/42/orders", status: http.StatusOK, name: "GET /users/:name/orders "},
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(tc.method, "http://"+tc.host+tc.path, nil)
+		handler.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("%s %s%s: unexpected status code %d", tc.method, tc.host, tc.path, w.Code)
+			continue
+		}
+		if tc.status != http.StatusOK {
+			continue
+		}
+		if body := strings.TrimSpace(w.Body.String()); body != `{"name":"`+tc.name+`"}` {
+			t.Errorf("%s %s%s: unexpected body %s", tc.method, tc.host, tc.path, body)
+		}
+	}
+	if !strings.Contains(buff.String(), "/users/:name/orders") {
+		t.Errorf("the conflicting endpoint should be logged: %s", buff.String())
+	}
+}
+
+func TestRunServer_reloadGenerations(t *testing.T) {
+	buff := new(bytes.Buffer)
+	logger, _ := logging.NewLogger("ERROR", buff, "")
+
+	handlers := make(chan http.Handler, 1)
+	runServerFunc := func(ctx context.Context, _ config.ServiceConfig, h http.Handler) error {
+		handlers <- h
+		<-ctx.Done()
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	closed := make(chan string, 2)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	proxyFactory := proxy.FactoryFunc(func(cfg *config.EndpointConfig) (proxy.Proxy, error) {
+		config.RegisterCloser(cfg.Backends[0], func() { closed <- cfg.Endpoint })
+		return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			if cfg.Endpoint == "/slow" {
+				close(started)
+				<-release
+			}
+			return &proxy.Response{Data: map[string]interface{}{}, IsComplete: true}, nil
+		}, nil
+	})
+
+	r := NewFactory(
+		Config{
+			Engine:         gin.New(),
+			MiddleWares:    []gin.HandlerFunc{},
+			HandlerFactory: EndpointHandler,
+			ProxyFactory:   proxyFactory,
+			Logger:         logger,
+			RunServer:      runServerFunc,
+			EngineFactory:  func(_ config.ServiceConfig) *gin.Engine { return gin.New() },
+		},
+	).NewWithContext(ctx)
+	reloader := r.(router.Reloader)
+
+	newConfig := func(path string) config.ServiceConfig {
+		return config.ServiceConfig{Endpoints: []*config.EndpointConfig{{
+			Endpoint: path,
+			Method:   "GET",
+			Timeout:  time.Second,
+			Backends: []*config.Backend{{}},
+		}}}
+	}
+	serve := func(h http.Handler, path string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Run 之前到达的热加载不能被 Run 的路由表覆盖
+	reloaded := make(chan error, 1)
+	go func() { reloaded <- reloader.Reload(newConfig("/reloaded")) }()
+	time.Sleep(10 * time.Millisecond)
+	go r.Run(newConfig("/initial"))
+	handler := <-handlers
+	if err := <-reloaded; err != nil {
+		t.Fatal(err)
+	}
+	if code := serve(handler, "/reloaded"); code != http.StatusOK {
+		t.Fatalf("unexpected status code %d", code)
+	}
+	if e := <-closed; e != "/initial" {
+		t.Errorf("unexpected generation closed: %s", e)
+	}
+
+	if err := reloader.Reload(newConfig("/slow")); err != nil {
+		t.Fatal(err)
+	}
+	if e := <-closed; e != "/reloaded" {
+		t.Errorf("unexpected generation closed: %s", e)
+	}
+
+	// 旧的路由表在正在处理的请求结束之后才释放
+	done := make(chan int)
+	go func() { done <- serve(handler, "/slow") }()
+	<-started
+	if err := reloader.Reload(newConfig("/next")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-closed:
+		t.Errorf("generation %s closed with a request in flight", e)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("unexpected status code %d", code)
+	}
+	select {
+	case e := <-closed:
+		if e != "/slow" {
+			t.Errorf("unexpected generation closed: %s", e)
+		}
+	case <-time.After(time.Second):
+		t.Error("the replaced generation was not closed")
+	}
+}
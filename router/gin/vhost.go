@@ -0,0 +1,100 @@
+package gin
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"melody/config"
+)
+
+// hostRouter 根据请求的Host头选择engine, 没有匹配的虚拟主机时使用默认的engine
+type hostRouter struct {
+	fallback *gin.Engine
+	hosts    map[string]*gin.Engine
+	// 形如 *.example.com 的虚拟主机, 按照后缀从长到短排序
+	wildcards []wildcardHost
+}
+
+type wildcardHost struct {
+	suffix string
+	engine *gin.Engine
+}
+
+func newHostRouter(fallback *gin.Engine) *hostRouter {
+	return &hostRouter{
+		fallback: fallback,
+		hosts:    map[string]*gin.Engine{},
+	}
+}
+
+func (h *hostRouter) add(host string, engine *gin.Engine) {
+	if !strings.HasPrefix(host, "*.") {
+		h.hosts[host] = engine
+		return
+	}
+	h.wildcards = append(h.wildcards, wildcardHost{suffix: host[1:], engine: engine})
+	sort.SliceStable(h.wildcards, func(i, j int) bool {
+		return len(h.wildcards[i].suffix) > len(h.wildcards[j].suffix)
+	})
+}
+
+func (h *hostRouter) engine(host string) *gin.Engine {
+	host = config.NormalizeHost(host)
+	if e, ok := h.hosts[host]; ok {
+		return e
+	}
+	for _, w := range h.wildcards {
+		if strings.HasSuffix(host, w.suffix) {
+			return w.engine
+		}
+	}
+	return h.fallback
+}
+
+// ServeHTTP implements the http.Handler interface
+func (h *hostRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.engine(req.Host).ServeHTTP(w, req)
+}
+
+// wildcardsOf 返回hosts中匹配host的通配虚拟主机, 后缀从长到短排序
+func wildcardsOf(host string, hosts []string) []string {
+	res := []string{}
+	for _, h := range hosts {
+		if h != host && strings.HasPrefix(h, "*.") && strings.HasSuffix(host, h[1:]) {
+			res = append(res, h)
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return len(res[i]) > len(res[j])
+	})
+	return res
+}
+
+// conflictingPath 返回paths中与path在同一位置使用了不同参数名的path
+// gin不允许同一个engine中出现这样的路由
+func conflictingPath(path string, paths []string) string {
+	segments := strings.Split(path, "/")
+	for _, p := range paths {
+		other := strings.Split(p, "/")
+		for i := 0; i < len(segments) && i < len(other); i++ {
+			a, b := segments[i], other[i]
+			if isParamSegment(a) && isParamSegment(b) {
+				if a != b {
+					return p
+				}
+				continue
+			}
+			if a != b {
+				break
+			}
+		}
+	}
+	return ""
+}
+
+func isParamSegment(s string) bool {
+	return strings.HasPrefix(s, ":") || strings.HasPrefix(s, "*")
+}
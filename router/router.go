@@ -22,6 +22,10 @@ var (
 	ErrorInternalError       = http.ErrorInternalError
 	DefaultToHTTPError       = http.DefaultToHTTPError
 	InitHTTPDefaultTransport = http.InitHTTPDefaultTransport
+	// NewReloadableHandler 返回一个可以被原子替换的http.Handler
+	NewReloadableHandler = http.NewReloadableHandler
+	// ListenerName 返回接收当前请求的listener的名称
+	ListenerName = http.ListenerName
 )
 
 // Router 暴露出去的接口
@@ -29,6 +33,15 @@ type Router interface {
 	Run(config.ServiceConfig)
 }
 
+// Reloader 是可以在运行时根据新的配置重建路由表的Router
+type Reloader interface {
+	Router
+	Reload(config.ServiceConfig) error
+}
+
+// ReloadableHandler 可以被原子替换的http.Handler
+type ReloadableHandler = http.ReloadableHandler
+
 // ToHTTPError change  error -> http status code
 type ToHTTPError http.ToHTTPError
 
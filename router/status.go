@@ -0,0 +1,131 @@
+package router
+
+import (
+	"errors"
+	"melody/config"
+	"melody/transport/http/client"
+	"strconv"
+)
+
+// Namespace endpoint层的router配置在 ExtraConfig 中的key
+const Namespace = "melody_router"
+
+const (
+	allFailedKey = "all_failed"
+	partialKey   = "partial"
+)
+
+// StatusCodePolicy endpoint响应状态码的策略
+type StatusCodePolicy struct {
+	// 单个backend的endpoint直接使用backend的状态码
+	ReturnStatusCode bool
+	// 单个backend的endpoint在backend失败时返回解码之后的响应体
+	ReturnErrorBody bool
+	// 任意一个backend返回了key对应的状态码时, 使用value作为endpoint的状态码
+	Mapping map[int]int
+	// 所有backend都失败时的状态码, 0 表示不处理
+	AllFailed int
+	// 部分backend失败时的状态码, 0 表示不处理
+	Partial int
+}
+
+// GetStatusCodePolicy 解析 melody_router 中的状态码策略
+func GetStatusCodePolicy(extra config.ExtraConfig) (StatusCodePolicy, bool) {
+	v, ok := extra[Namespace]
+	if !ok {
+		return StatusCodePolicy{}, false
+	}
+	tmp, ok := v.(map[string]interface{})
+	if !ok {
+		return StatusCodePolicy{}, false
+	}
+
+	policy := StatusCodePolicy{Mapping: map[int]int{}}
+	policy.ReturnStatusCode, _ = tmp["return_status_code"].(bool)
+	policy.ReturnErrorBody, _ = tmp["return_error_body"].(bool)
+	if m, ok := tmp["status_mapping"].(map[string]interface{}); ok {
+		for k, v := range m {
+			code, ok := v.(float64)
+			if !ok {
+				continue
+			}
+			switch k {
+			case allFailedKey:
+				policy.AllFailed = int(code)
+			case partialKey:
+				policy.Partial = int(code)
+			default:
+				if from, err := strconv.Atoi(k); err == nil {
+					policy.Mapping[from] = int(code)
+				}
+			}
+		}
+	}
+	return policy, true
+}
+
+// ToHTTPError 返回按照策略转换错误的ToHTTPError, 用于没有任何response的情况
+// 依次尝试 status_mapping, return_status_code 和 all_failed, 都不满足时使用fallback
+func (p StatusCodePolicy) ToHTTPError(fallback ToHTTPError) ToHTTPError {
+	return func(err error) int {
+		codes := StatusCodes(err)
+		if code, ok := p.mapped(codes); ok {
+			return code
+		}
+		if p.ReturnStatusCode && len(codes) == 1 {
+			return codes[0]
+		}
+		if p.AllFailed != 0 {
+			return p.AllFailed
+		}
+		return fallback(err)
+	}
+}
+
+// PartialStatus 部分backend失败时的状态码, 返回0表示保持默认的状态码
+func (p StatusCodePolicy) PartialStatus(err error) int {
+	if code, ok := p.mapped(StatusCodes(err)); ok {
+		return code
+	}
+	return p.Partial
+}
+
+func (p StatusCodePolicy) mapped(codes []int) (int, bool) {
+	for _, c := range codes {
+		if code, ok := p.Mapping[c]; ok {
+			return code, true
+		}
+	}
+	return 0, false
+}
+
+type multiError interface {
+	Errors() []error
+}
+
+type statusCoder interface {
+	StatusCode() int
+}
+
+// StatusCodes 返回错误中携带的backend状态码, 多个backend合并的错误会被展开
+func StatusCodes(err error) []int {
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(multiError); ok {
+		codes := []int{}
+		for _, err := range e.Errors() {
+			codes = append(codes, StatusCodes(err)...)
+		}
+		return codes
+	}
+	var e client.InvalidStatusCodeError
+	if errors.As(err, &e) {
+		return []int{e.Code}
+	}
+	var s statusCoder
+	if errors.As(err, &s) {
+		return []int{s.StatusCode()}
+	}
+	return nil
+}
@@ -0,0 +1,438 @@
+package sd
+
+import (
+	"hash/crc32"
+	"melody/config"
+	"melody/register"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/valyala/fastrand"
+)
+
+// Namespace 负载均衡策略在 Backend.ExtraConfig 中的key
+const Namespace = "melody_loadbalancer"
+
+const (
+	StrategyRoundRobin         = "round_robin"
+	StrategyRandom             = "random"
+	StrategyWeightedRoundRobin = "weighted_round_robin"
+	StrategyLeastOutstanding   = "least_outstanding"
+	StrategyP2C                = "p2c"
+	StrategyConsistentHash     = "consistent_hash"
+
+	defaultHashReplicas = 100
+)
+
+// BalancerFactory 根据backend的配置与subscriber构造Balancer
+type BalancerFactory func(cfg *config.Backend, subscriber Subscriber) Balancer
+
+// WeightedSubscriber 可以为每一个host提供权重的Subscriber
+type WeightedSubscriber interface {
+	Subscriber
+	Weight(host string) int
+}
+
+// TrackingBalancer 统计每个host上正在处理的请求数
+// 每次成功调用 Host 之后, 请求结束时都必须调用 Release
+type TrackingBalancer interface {
+	Balancer
+	Release(host string)
+}
+
+// HashKey 描述计算一致性hash时使用的请求属性
+type HashKey struct {
+	Header string
+	Param  string
+	Query  string
+}
+
+// KeyedBalancer 根据请求属性计算出的key选择host, 相同的key总是得到相同的host
+type KeyedBalancer interface {
+	Balancer
+	HashKey() HashKey
+	HostByKey(key string) (string, error)
+}
+
+// RegisterBalancerFactory registers the received factory
+func RegisterBalancerFactory(name string, bf BalancerFactory) error {
+	return balancerFactories.Register(name, bf)
+}
+
+// GetBalancer 按照 Backend.ExtraConfig 中配置的策略构造Balancer
+// 没有配置或者策略未注册时, 使用 NewBalancer
+func GetBalancer(cfg *config.Backend, subscriber Subscriber) Balancer {
+	return balancerFactories.Get(getBalancerConfig(cfg.ExtraConfig).strategy())(cfg, subscriber)
+}
+
+// GetBalancerRegister returns the package balancer register
+func GetBalancerRegister() *BalancerRegister {
+	return balancerFactories
+}
+
+// BalancerRegister is a balancer register
+type BalancerRegister struct {
+	data register.Untyped
+}
+
+func initBalancerRegister() *BalancerRegister {
+	r := &BalancerRegister{register.New()}
+	r.Register(StrategyRoundRobin, func(_ *config.Backend, s Subscriber) Balancer { return NewRoundRobinLB(s) })
+	r.Register(StrategyRandom, func(_ *config.Backend, s Subscriber) Balancer { return NewRandomLB(s) })
+	r.Register(StrategyWeightedRoundRobin, func(cfg *config.Backend, s Subscriber) Balancer {
+		return NewWeightedRoundRobinLB(newConfigWeightedSubscriber(s, getBalancerConfig(cfg.ExtraConfig)))
+	})
+	r.Register(StrategyLeastOutstanding, func(_ *config.Backend, s Subscriber) Balancer { return NewLeastOutstandingLB(s) })
+	r.Register(StrategyP2C, func(_ *config.Backend, s Subscriber) Balancer { return NewP2CLB(s) })
+	r.Register(StrategyConsistentHash, func(cfg *config.Backend, s Subscriber) Balancer {
+		c := getBalancerConfig(cfg.ExtraConfig)
+		return NewConsistentHashLB(s, c.hashKey(), c.replicas())
+	})
+	return r
+}
+
+// Register implements the RegisterSetter interface
+func (r *BalancerRegister) Register(name string, bf BalancerFactory) error {
+	r.data.Register(name, bf)
+	return nil
+}
+
+// Get implements the RegisterGetter interface
+func (r *BalancerRegister) Get(name string) BalancerFactory {
+	tmp, ok := r.data.Get(name)
+	if !ok {
+		return defaultBalancerFactory
+	}
+	bf, ok := tmp.(BalancerFactory)
+	if !ok {
+		return defaultBalancerFactory
+	}
+	return bf
+}
+
+func defaultBalancerFactory(_ *config.Backend, subscriber Subscriber) Balancer {
+	return NewBalancer(subscriber)
+}
+
+var balancerFactories = initBalancerRegister()
+
+type balancerConfig map[string]interface{}
+
+func getBalancerConfig(extra config.ExtraConfig) balancerConfig {
+	v, ok := extra[Namespace]
+	if !ok {
+		return balancerConfig{}
+	}
+	tmp, ok := v.(map[string]interface{})
+	if !ok {
+		return balancerConfig{}
+	}
+	return balancerConfig(tmp)
+}
+
+func (c balancerConfig) strategy() string {
+	s, _ := c["strategy"].(string)
+	return s
+}
+
+func (c balancerConfig) weights() map[string]int {
+	weights := map[string]int{}
+	tmp, ok := c["weights"].(map[string]interface{})
+	if !ok {
+		return weights
+	}
+	for host, w := range tmp {
+		switch v := w.(type) {
+		case float64:
+			weights[host] = int(v)
+		case int:
+			weights[host] = v
+		}
+	}
+	return weights
+}
+
+func (c balancerConfig) hashKey() HashKey {
+	k := HashKey{}
+	k.Header, _ = c["header"].(string)
+	k.Param, _ = c["param"].(string)
+	k.Query, _ = c["query"].(string)
+	return k
+}
+
+func (c balancerConfig) replicas() int {
+	switch v := c["replicas"].(type) {
+	case float64:
+		return int(v)
+	case int:
+		return v
+	}
+	return defaultHashReplicas
+}
+
+// newConfigWeightedSubscriber 优先使用subscriber自身提供的权重, 否则使用配置中的权重
+func newConfigWeightedSubscriber(subscriber Subscriber, cfg balancerConfig) WeightedSubscriber {
+	if ws, ok := subscriber.(WeightedSubscriber); ok {
+		return ws
+	}
+	return configWeightedSubscriber{subscriber, cfg.weights()}
+}
+
+type configWeightedSubscriber struct {
+	Subscriber
+	weights map[string]int
+}
+
+// Weight implements the WeightedSubscriber interface. 没有配置权重的host, 权重为1
+func (s configWeightedSubscriber) Weight(host string) int {
+	if w, ok := s.weights[host]; ok {
+		return w
+	}
+	return 1
+}
+
+// NewWeightedRoundRobinLB 平滑加权轮询, 权重为0的host不会被选中
+func NewWeightedRoundRobinLB(subscriber WeightedSubscriber) Balancer {
+	return &weightedRoundRobinLB{
+		balancer: balancer{subscriber: subscriber},
+		weight:   subscriber.Weight,
+		current:  map[string]int{},
+	}
+}
+
+type weightedRoundRobinLB struct {
+	balancer
+	weight  func(string) int
+	mu      sync.Mutex
+	current map[string]int
+}
+
+// Host implements the balancer interface
+func (w *weightedRoundRobinLB) Host() (string, error) {
+	hosts, err := w.hosts()
+	if err != nil {
+		return "", err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// host列表发生变化时, 清理已经下线的host
+	if len(w.current) > len(hosts) {
+		w.current = make(map[string]int, len(hosts))
+	}
+
+	total := 0
+	best := ""
+	for _, host := range hosts {
+		weight := w.weight(host)
+		if weight <= 0 {
+			continue
+		}
+		w.current[host] += weight
+		total += weight
+		if best == "" || w.current[host] > w.current[best] {
+			best = host
+		}
+	}
+	if best == "" {
+		return "", ErrNoHosts
+	}
+	w.current[best] -= total
+	return best, nil
+}
+
+// NewLeastOutstandingLB 选择正在处理的请求数最少的host
+func NewLeastOutstandingLB(subscriber Subscriber) TrackingBalancer {
+	return &leastOutstandingLB{outstanding: outstanding{balancer: balancer{subscriber: subscriber}}}
+}
+
+type leastOutstandingLB struct {
+	outstanding
+}
+
+// Host implements the balancer interface
+func (l *leastOutstandingLB) Host() (string, error) {
+	hosts, err := l.hosts()
+	if err != nil {
+		return "", err
+	}
+	// 从随机的位置开始遍历, 避免请求数相同时总是选中第一个host
+	offset := int(fastrand.Uint32n(uint32(len(hosts))))
+	best := hosts[offset]
+	min := l.load(best)
+	for i := 1; i < len(hosts) && min > 0; i++ {
+		host := hosts[(offset+i)%len(hosts)]
+		if n := l.load(host); n < min {
+			best, min = host, n
+		}
+	}
+	l.acquire(best)
+	return best, nil
+}
+
+// NewP2CLB power of two choices: 随机选择两个host, 使用其中正在处理的请求数较少的那个
+func NewP2CLB(subscriber Subscriber) TrackingBalancer {
+	return &p2cLB{outstanding: outstanding{balancer: balancer{subscriber: subscriber}}}
+}
+
+type p2cLB struct {
+	outstanding
+}
+
+// Host implements the balancer interface
+func (p *p2cLB) Host() (string, error) {
+	hosts, err := p.hosts()
+	if err != nil {
+		return "", err
+	}
+	host := hosts[0]
+	if len(hosts) > 1 {
+		i := fastrand.Uint32n(uint32(len(hosts)))
+		j := fastrand.Uint32n(uint32(len(hosts) - 1))
+		if j >= i {
+			j++
+		}
+		host = hosts[i]
+		if p.load(hosts[j]) < p.load(host) {
+			host = hosts[j]
+		}
+	}
+	p.acquire(host)
+	return host, nil
+}
+
+type outstanding struct {
+	balancer
+	counters sync.Map
+}
+
+func (o *outstanding) counter(host string) *int64 {
+	if c, ok := o.counters.Load(host); ok {
+		return c.(*int64)
+	}
+	c, _ := o.counters.LoadOrStore(host, new(int64))
+	return c.(*int64)
+}
+
+func (o *outstanding) load(host string) int64 {
+	return atomic.LoadInt64(o.counter(host))
+}
+
+func (o *outstanding) acquire(host string) {
+	atomic.AddInt64(o.counter(host), 1)
+}
+
+// Release implements the TrackingBalancer interface
+func (o *outstanding) Release(host string) {
+	atomic.AddInt64(o.counter(host), -1)
+}
+
+// NewConsistentHashLB 基于虚拟节点的一致性hash, 相同的key总是落到同一个host
+// 没有key的请求随机选择host
+func NewConsistentHashLB(subscriber Subscriber, key HashKey, replicas int) KeyedBalancer {
+	if replicas <= 0 {
+		replicas = defaultHashReplicas
+	}
+	return &consistentHashLB{
+		balancer: balancer{subscriber: subscriber},
+		key:      key,
+		replicas: replicas,
+	}
+}
+
+type consistentHashLB struct {
+	balancer
+	key      HashKey
+	replicas int
+	mu       sync.RWMutex
+	members  []string
+	ring     hashRing
+}
+
+type hashRing struct {
+	points []uint32
+	hosts  map[uint32]string
+}
+
+// Host implements the balancer interface
+func (c *consistentHashLB) Host() (string, error) {
+	hosts, err := c.hosts()
+	if err != nil {
+		return "", err
+	}
+	return hosts[int(fastrand.Uint32n(uint32(len(hosts))))], nil
+}
+
+// HashKey implements the KeyedBalancer interface
+func (c *consistentHashLB) HashKey() HashKey {
+	return c.key
+}
+
+// HostByKey implements the KeyedBalancer interface
+func (c *consistentHashLB) HostByKey(key string) (string, error) {
+	if key == "" {
+		return c.Host()
+	}
+	hosts, err := c.hosts()
+	if err != nil {
+		return "", err
+	}
+	ring := c.getRing(hosts)
+
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= h })
+	if i == len(ring.points) {
+		i = 0
+	}
+	return ring.hosts[ring.points[i]], nil
+}
+
+// getRing 只在host列表发生变化时重建hash环
+func (c *consistentHashLB) getRing(hosts []string) hashRing {
+	c.mu.RLock()
+	if equalHosts(c.members, hosts) {
+		defer c.mu.RUnlock()
+		return c.ring
+	}
+	c.mu.RUnlock()
+
+	ring := hashRing{
+		points: make([]uint32, 0, len(hosts)*c.replicas),
+		hosts:  make(map[uint32]string, len(hosts)*c.replicas),
+	}
+	for _, host := range hosts {
+		for i := 0; i < c.replicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(host + "#" + strconv.Itoa(i)))
+			if _, ok := ring.hosts[h]; ok {
+				continue
+			}
+			ring.hosts[h] = host
+			ring.points = append(ring.points, h)
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+
+	members := make([]string, len(hosts))
+	copy(members, hosts)
+
+	c.mu.Lock()
+	c.members = members
+	c.ring = ring
+	c.mu.Unlock()
+	return ring
+}
+
+func equalHosts(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
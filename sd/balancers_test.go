@@ -0,0 +1,157 @@
+package sd
+
+import (
+	"melody/config"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestGetBalancer_fallback(t *testing.T) {
+	subscriber := FixedSubscriber{"a", "b"}
+	for _, extra := range []config.ExtraConfig{
+		{},
+		{Namespace: map[string]interface{}{"strategy": "unknown"}},
+	} {
+		lb := GetBalancer(&config.Backend{ExtraConfig: extra}, subscriber)
+		switch lb.(type) {
+		case *roundRobinLB, *randomLB:
+		default:
+			t.Errorf("unexpected balancer type: %T", lb)
+		}
+	}
+}
+
+func TestRegisterBalancerFactory(t *testing.T) {
+	RegisterBalancerFactory("custom", func(_ *config.Backend, _ Subscriber) Balancer { return nopBalancer("custom") })
+	lb := GetBalancer(&config.Backend{ExtraConfig: config.ExtraConfig{
+		Namespace: map[string]interface{}{"strategy": "custom"},
+	}}, FixedSubscriber{"a", "b"})
+	if h, _ := lb.Host(); h != "custom" {
+		t.Errorf("the registered factory was not used. have: %s", h)
+	}
+}
+
+func TestWeightedRoundRobinLB(t *testing.T) {
+	lb := GetBalancer(&config.Backend{ExtraConfig: config.ExtraConfig{
+		Namespace: map[string]interface{}{
+			"strategy": StrategyWeightedRoundRobin,
+			"weights":  map[string]interface{}{"a": 3.0, "b": 1.0, "c": 0.0},
+		},
+	}}, FixedSubscriber{"a", "b", "c"})
+
+	counts := map[string]int{}
+	var last string
+	for i := 0; i < 8; i++ {
+		h, err := lb.Host()
+		if err != nil {
+			t.Error("unexpected error:", err.Error())
+			return
+		}
+		if h == "b" && last == "b" {
+			t.Error("the smooth weighted round robin should interleave the hosts")
+		}
+		last = h
+		counts[h]++
+	}
+	if counts["a"] != 6 || counts["b"] != 2 || counts["c"] != 0 {
+		t.Errorf("unexpected distribution: %v", counts)
+	}
+}
+
+func TestWeightedRoundRobinLB_noWeights(t *testing.T) {
+	lb := NewWeightedRoundRobinLB(configWeightedSubscriber{FixedSubscriber{"a"}, map[string]int{"a": 0}})
+	if _, err := lb.Host(); err != ErrNoHosts {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestLeastOutstandingLB(t *testing.T) {
+	lb := NewLeastOutstandingLB(FixedSubscriber{"a", "b", "c"})
+
+	seen := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		h, _ := lb.Host()
+		seen[h] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("every host should get one request: %v", seen)
+	}
+
+	lb.Release("b")
+	if h, _ := lb.Host(); h != "b" {
+		t.Errorf("the released host should be selected. have: %s", h)
+	}
+}
+
+func TestP2CLB(t *testing.T) {
+	lb := NewP2CLB(FixedSubscriber{"a", "b"})
+	busy, _ := lb.Host()
+	for i := 0; i < 10; i++ {
+		h, _ := lb.Host()
+		if h == busy {
+			t.Errorf("the busy host should not be selected: %s", h)
+		}
+		lb.Release(h)
+	}
+}
+
+func TestOutstanding_concurrent(t *testing.T) {
+	lb := NewP2CLB(FixedSubscriber{"a", "b", "c"})
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h, _ := lb.Host()
+			lb.Release(h)
+		}()
+	}
+	wg.Wait()
+	for _, h := range []string{"a", "b", "c"} {
+		if n := lb.(*p2cLB).load(h); n != 0 {
+			t.Errorf("unexpected outstanding requests for %s: %d", h, n)
+		}
+	}
+}
+
+func TestConsistentHashLB(t *testing.T) {
+	hosts := FixedSubscriber{"a", "b", "c", "d"}
+	lb := GetBalancer(&config.Backend{ExtraConfig: config.ExtraConfig{
+		Namespace: map[string]interface{}{
+			"strategy": StrategyConsistentHash,
+			"header":   "X-User-Id",
+		},
+	}}, &hosts)
+
+	kb, ok := lb.(KeyedBalancer)
+	if !ok {
+		t.Errorf("unexpected balancer type: %T", lb)
+		return
+	}
+	if kb.HashKey().Header != "X-User-Id" {
+		t.Errorf("unexpected hash key: %v", kb.HashKey())
+	}
+
+	before := map[string]string{}
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		h1, _ := kb.HostByKey(key)
+		h2, _ := kb.HostByKey(key)
+		if h1 != h2 {
+			t.Errorf("the same key should be routed to the same host: %s != %s", h1, h2)
+		}
+		before[key] = h1
+	}
+
+	hosts = FixedSubscriber{"a", "b", "c"}
+	for key, host := range before {
+		h, _ := kb.HostByKey(key)
+		if host != "d" && h != host {
+			t.Errorf("key %s should stay on %s after removing another host, have: %s", key, host, h)
+		}
+		if h == "d" {
+			t.Error("the removed host should not be selected")
+		}
+	}
+}
@@ -37,7 +37,7 @@ func New(name string) sd.Subscriber {
 
 // NewDetailed creates a DNS subscriber with the received values
 func NewDetailed(name string, lookup lookup, ttl time.Duration) sd.Subscriber {
-	s := subscriber{name, &sd.FixedSubscriber{}, &sync.Mutex{}, ttl, lookup}
+	s := subscriber{name, &sd.FixedSubscriber{}, &map[string]int{}, &sync.Mutex{}, ttl, lookup}
 	s.update()
 	go s.loop()
 	return s
@@ -46,11 +46,12 @@ func NewDetailed(name string, lookup lookup, ttl time.Duration) sd.Subscriber {
 type lookup func(service, proto, name string) (cname string, addrs []*net.SRV, err error)
 
 type subscriber struct {
-	name   string
-	cache  *sd.FixedSubscriber
-	mutex  *sync.Mutex
-	ttl    time.Duration
-	lookup lookup
+	name    string
+	cache   *sd.FixedSubscriber
+	weights *map[string]int
+	mutex   *sync.Mutex
+	ttl     time.Duration
+	lookup  lookup
 }
 
 // Hosts implements the subscriber interface
@@ -60,6 +61,17 @@ func (s subscriber) Hosts() ([]string, error) {
 	return s.cache.Hosts()
 }
 
+// Weight implements the sd.WeightedSubscriber interface, 返回SRV记录中的weight
+// weight为0的记录按照1处理, 保证仍然可以被选中
+func (s subscriber) Weight(host string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if w := (*s.weights)[host]; w > 0 {
+		return w
+	}
+	return 1
+}
+
 func (s subscriber) loop() {
 	for {
 		<-time.After(s.ttl)
@@ -68,23 +80,26 @@ func (s subscriber) loop() {
 }
 
 func (s subscriber) update() {
-	instances, err := s.resolve()
+	instances, weights, err := s.resolve()
 	if err != nil {
 		return
 	}
 	s.mutex.Lock()
 	*(s.cache) = sd.FixedSubscriber(instances)
+	*(s.weights) = weights
 	s.mutex.Unlock()
 }
 
-func (s subscriber) resolve() ([]string, error) {
+func (s subscriber) resolve() ([]string, map[string]int, error) {
 	_, addrs, err := s.lookup("", "", s.name)
 	if err != nil {
-		return []string{}, err
+		return []string{}, map[string]int{}, err
 	}
 	instances := make([]string, len(addrs))
+	weights := make(map[string]int, len(addrs))
 	for i, addr := range addrs {
 		instances[i] = fmt.Sprintf("http://%s", net.JoinHostPort(addr.Target, fmt.Sprint(addr.Port)))
+		weights[instances[i]] = int(addr.Weight)
 	}
-	return instances, nil
+	return instances, weights, nil
 }
@@ -17,6 +17,7 @@ func TestSubscriber_New(t *testing.T) {
 		{
 			Port:   80,
 			Target: "127.0.0.1",
+			Weight: 3,
 		},
 		{
 			Port:   81,
@@ -42,6 +43,18 @@ func TestSubscriber_New(t *testing.T) {
 	if hosts[1] != "http://127.0.0.1:81" {
 		t.Error("Wrong host #1 (expected http://127.0.0.1:81):", hosts[1])
 	}
+
+	ws, ok := s.(sd.WeightedSubscriber)
+	if !ok {
+		t.Error("the dns subscriber should provide weights")
+		return
+	}
+	if w := ws.Weight(hosts[0]); w != 3 {
+		t.Error("Wrong weight for host #0:", w)
+	}
+	if w := ws.Weight(hosts[1]); w != 1 {
+		t.Error("Wrong weight for host #1:", w)
+	}
 }
 
 func TestSubscriber_LoockupError(t *testing.T) {
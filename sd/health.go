@@ -0,0 +1,332 @@
+package sd
+
+import (
+	"context"
+	"melody/config"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// HealthCheckNamespace 健康检查在 Backend.ExtraConfig 中的key
+const HealthCheckNamespace = "melody_healthcheck"
+
+const (
+	defaultHealthCheckInterval  = 10 * time.Second
+	defaultHealthCheckTimeout   = time.Second
+	defaultHealthCheckCooldown  = 30 * time.Second
+	defaultHealthCheckThreshold = 3
+)
+
+// HealthReporter 接收对host请求结果的被动观测
+// target 为请求的完整url, 由实现者通过 MatchHost 找到对应的host
+// 装饰其它subscriber的实现需要把结果继续传递给内层的HealthReporter
+type HealthReporter interface {
+	Report(target string, healthy bool, latency time.Duration)
+}
+
+// HostAdmitter 在向选中的host发送请求之前获取许可, 例如断路器的ticket
+// 获取成功时返回的done必须调用一次, 上报这次请求的结果
+// 装饰其它subscriber的实现需要把请求继续传递给内层的HostAdmitter
+type HostAdmitter interface {
+	Admit(target string) (done func(healthy bool, latency time.Duration), err error)
+}
+
+// Admit subscriber实现了 HostAdmitter 时获取许可, 否则直接允许
+func Admit(subscriber Subscriber, target string) (func(healthy bool, latency time.Duration), error) {
+	if a, ok := subscriber.(HostAdmitter); ok {
+		return a.Admit(target)
+	}
+	return func(bool, time.Duration) {}, nil
+}
+
+// HealthCheckConfig 健康检查的配置
+type HealthCheckConfig struct {
+	// 主动探测的路径, 为空时只进行被动检测
+	Path     string
+	Interval time.Duration
+	Timeout  time.Duration
+	// 连续失败多少次之后剔除host
+	Threshold int
+	// 剔除之后多久重新加入
+	Cooldown time.Duration
+}
+
+var healthRegistry atomic.Value
+
+type registryHolder struct {
+	metrics.Registry
+}
+
+// SetHealthCheckRegistry 设置输出host健康状态的metrics registry, nil表示不输出
+func SetHealthCheckRegistry(r metrics.Registry) {
+	healthRegistry.Store(registryHolder{r})
+}
+
+// NewHealthCheckSubscriber 根据backend的配置为subscriber加上健康检查
+// 没有配置时原样返回subscriber
+func NewHealthCheckSubscriber(cfg *config.Backend, subscriber Subscriber) Subscriber {
+	hc, ok := getHealthCheckConfig(cfg.ExtraConfig)
+	if !ok {
+		return subscriber
+	}
+	s := NewHealthCheckSubscriberWithConfig(cfg.URLPattern, subscriber, hc)
+	// 路由表被替换之后停止探测
+	config.RegisterCloser(cfg, s.(interface{ Close() }).Close)
+	return s
+}
+
+// NewHealthCheckSubscriberWithConfig 返回一个只提供健康host的subscriber
+// 主动探测在调用 Hosts 时按照 Interval 异步触发, 不会在没有流量的backend上常驻goroutine
+// 所有host都被剔除时, 返回全部host
+func NewHealthCheckSubscriberWithConfig(name string, subscriber Subscriber, cfg HealthCheckConfig) Subscriber {
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &healthCheckSubscriber{
+		ctx:    ctx,
+		cancel: cancel,
+		next:   subscriber,
+		cfg:    cfg,
+		name:   name,
+		client: &http.Client{Timeout: cfg.Timeout},
+		states: map[string]*hostState{},
+		now:    time.Now,
+	}
+	if r, ok := healthRegistry.Load().(registryHolder); ok {
+		h.registry = r.Registry
+	}
+	if ws, ok := subscriber.(WeightedSubscriber); ok {
+		return weightedHealthCheckSubscriber{h, ws}
+	}
+	return h
+}
+
+type healthCheckSubscriber struct {
+	// 关闭之后不再探测, 并取消正在进行的探测
+	ctx       context.Context
+	cancel    context.CancelFunc
+	next      Subscriber
+	cfg       HealthCheckConfig
+	name      string
+	client    *http.Client
+	registry  metrics.Registry
+	mu        sync.Mutex
+	states    map[string]*hostState
+	lastProbe time.Time
+	probing   int32
+	now       func() time.Time
+}
+
+type hostState struct {
+	failures     int
+	ejected      bool
+	ejectedUntil time.Time
+	healthy      metrics.Gauge
+	ejections    metrics.Counter
+}
+
+// Hosts implements the Subscriber interface
+func (h *healthCheckSubscriber) Hosts() ([]string, error) {
+	hosts, err := h.next.Hosts()
+	if err != nil || len(hosts) == 0 {
+		return hosts, err
+	}
+	h.maybeProbe(hosts)
+
+	now := h.now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	healthy := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		s := h.state(host)
+		if s.ejected {
+			if s.ejectedUntil.After(now) {
+				continue
+			}
+			s.ejected = false
+			s.healthy.Update(1)
+		}
+		healthy = append(healthy, host)
+	}
+	if len(healthy) == 0 {
+		return hosts, nil
+	}
+	return healthy, nil
+}
+
+// Report implements the HealthReporter interface
+func (h *healthCheckSubscriber) Report(target string, healthy bool, latency time.Duration) {
+	if r, ok := h.next.(HealthReporter); ok {
+		r.Report(target, healthy, latency)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for host, s := range h.states {
+		if MatchHost(target, host) {
+			h.record(s, healthy)
+			return
+		}
+	}
+}
+
+// Admit implements the HostAdmitter interface
+func (h *healthCheckSubscriber) Admit(target string) (func(healthy bool, latency time.Duration), error) {
+	return Admit(h.next, target)
+}
+
+// record 需要在持有锁的情况下调用
+func (h *healthCheckSubscriber) record(s *hostState, healthy bool) {
+	if healthy {
+		s.failures = 0
+		return
+	}
+	if s.ejected {
+		return
+	}
+	s.failures++
+	if s.failures < h.cfg.Threshold {
+		return
+	}
+	s.failures = 0
+	s.ejected = true
+	s.ejectedUntil = h.now().Add(h.cfg.Cooldown)
+	s.healthy.Update(0)
+	s.ejections.Inc(1)
+}
+
+// state 需要在持有锁的情况下调用
+func (h *healthCheckSubscriber) state(host string) *hostState {
+	if s, ok := h.states[host]; ok {
+		return s
+	}
+	s := &hostState{
+		healthy:   metrics.NilGauge{},
+		ejections: metrics.NilCounter{},
+	}
+	if h.registry != nil {
+		prefix := "healthcheck." + h.name + "." + host + "."
+		s.healthy = metrics.GetOrRegisterGauge(prefix+"healthy", h.registry)
+		s.ejections = metrics.GetOrRegisterCounter(prefix+"ejections", h.registry)
+	}
+	s.healthy.Update(1)
+	h.states[host] = s
+	return s
+}
+
+// Close 停止主动探测
+func (h *healthCheckSubscriber) Close() {
+	h.cancel()
+}
+
+func (h *healthCheckSubscriber) maybeProbe(hosts []string) {
+	if h.cfg.Path == "" || h.ctx.Err() != nil {
+		return
+	}
+	now := h.now()
+	h.mu.Lock()
+	due := now.Sub(h.lastProbe) >= h.cfg.Interval
+	h.mu.Unlock()
+	if !due || !atomic.CompareAndSwapInt32(&h.probing, 0, 1) {
+		return
+	}
+	h.mu.Lock()
+	h.lastProbe = now
+	h.mu.Unlock()
+
+	targets := make([]string, len(hosts))
+	copy(targets, hosts)
+	go func() {
+		defer atomic.StoreInt32(&h.probing, 0)
+		var wg sync.WaitGroup
+		for _, host := range targets {
+			wg.Add(1)
+			go func(host string) {
+				defer wg.Done()
+				ok := h.probe(host)
+				h.mu.Lock()
+				h.record(h.state(host), ok)
+				h.mu.Unlock()
+			}(host)
+		}
+		wg.Wait()
+	}()
+}
+
+func (h *healthCheckSubscriber) probe(host string) bool {
+	ctx, cancel := context.WithTimeout(h.ctx, h.cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(host, "/")+h.cfg.Path, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := h.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 400
+}
+
+type weightedHealthCheckSubscriber struct {
+	*healthCheckSubscriber
+	weighted WeightedSubscriber
+}
+
+// Weight implements the WeightedSubscriber interface
+func (w weightedHealthCheckSubscriber) Weight(host string) int {
+	return w.weighted.Weight(host)
+}
+
+// MatchHost 判断请求的url是否属于该host, 避免 :80 与 :8080 这样的前缀误判
+func MatchHost(target, host string) bool {
+	host = strings.TrimRight(host, "/")
+	if !strings.HasPrefix(target, host) {
+		return false
+	}
+	if len(target) == len(host) {
+		return true
+	}
+	switch target[len(host)] {
+	case '/', '?':
+		return true
+	}
+	return false
+}
+
+func getHealthCheckConfig(extra config.ExtraConfig) (HealthCheckConfig, bool) {
+	v, ok := extra[HealthCheckNamespace]
+	if !ok {
+		return HealthCheckConfig{}, false
+	}
+	tmp, ok := v.(map[string]interface{})
+	if !ok {
+		return HealthCheckConfig{}, false
+	}
+
+	cfg := HealthCheckConfig{
+		Interval:  defaultHealthCheckInterval,
+		Timeout:   defaultHealthCheckTimeout,
+		Threshold: defaultHealthCheckThreshold,
+		Cooldown:  defaultHealthCheckCooldown,
+	}
+	cfg.Path, _ = tmp["path"].(string)
+	for key, d := range map[string]*time.Duration{
+		"interval": &cfg.Interval,
+		"timeout":  &cfg.Timeout,
+		"cooldown": &cfg.Cooldown,
+	} {
+		if s, ok := tmp[key].(string); ok {
+			if parsed, err := time.ParseDuration(s); err == nil && parsed > 0 {
+				*d = parsed
+			}
+		}
+	}
+	if t, ok := tmp["unhealthy_threshold"].(float64); ok && t >= 1 {
+		cfg.Threshold = int(t)
+	}
+	return cfg, true
+}
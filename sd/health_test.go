@@ -0,0 +1,132 @@
+package sd
+
+import (
+	"melody/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+func TestNewHealthCheckSubscriber_noConfig(t *testing.T) {
+	subscriber := FixedSubscriber{"a"}
+	if s := NewHealthCheckSubscriber(&config.Backend{}, subscriber); len(s.(FixedSubscriber)) != 1 {
+		t.Error("the subscriber should not be decorated")
+	}
+}
+
+func TestHealthCheckSubscriber_passive(t *testing.T) {
+	registry := metrics.NewRegistry()
+	SetHealthCheckRegistry(registry)
+	defer SetHealthCheckRegistry(nil)
+
+	now := time.Now()
+	s := NewHealthCheckSubscriber(&config.Backend{
+		URLPattern: "/users",
+		ExtraConfig: config.ExtraConfig{
+			HealthCheckNamespace: map[string]interface{}{
+				"unhealthy_threshold": 2.0,
+				"cooldown":            "1m",
+			},
+		},
+	}, FixedSubscriber{"http://a:80", "http://a:8080"})
+	hc := s.(*healthCheckSubscriber)
+	hc.now = func() time.Time { return now }
+
+	assertHosts := func(expected ...string) {
+		hosts, err := s.Hosts()
+		if err != nil {
+			t.Error("unexpected error:", err.Error())
+			return
+		}
+		if len(hosts) != len(expected) {
+			t.Errorf("unexpected hosts. have: %v, want: %v", hosts, expected)
+			return
+		}
+		for i := range hosts {
+			if hosts[i] != expected[i] {
+				t.Errorf("unexpected hosts. have: %v, want: %v", hosts, expected)
+			}
+		}
+	}
+
+	assertHosts("http://a:80", "http://a:8080")
+
+	hc.Report("http://a:80/users?id=1", false, 0)
+	hc.Report("http://a:80/users?id=1", true, 0)
+	hc.Report("http://a:80/users?id=1", false, 0)
+	assertHosts("http://a:80", "http://a:8080")
+
+	hc.Report("http://a:80/users", false, 0)
+	assertHosts("http://a:8080")
+
+	gauge := registry.Get("healthcheck./users.http://a:80.healthy").(metrics.Gauge)
+	if gauge.Value() != 0 {
+		t.Errorf("unexpected gauge value: %d", gauge.Value())
+	}
+	if c := registry.Get("healthcheck./users.http://a:80.ejections").(metrics.Counter); c.Count() != 1 {
+		t.Errorf("unexpected ejections: %d", c.Count())
+	}
+
+	// 所有host都被剔除时, 返回全部host
+	hc.Report("http://a:8080", false, 0)
+	hc.Report("http://a:8080", false, 0)
+	assertHosts("http://a:80", "http://a:8080")
+
+	now = now.Add(time.Minute)
+	assertHosts("http://a:80", "http://a:8080")
+	if gauge.Value() != 1 {
+		t.Errorf("unexpected gauge value: %d", gauge.Value())
+	}
+}
+
+func TestHealthCheckSubscriber_active(t *testing.T) {
+	healthy := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	s := NewHealthCheckSubscriberWithConfig("test", FixedSubscriber{ts.URL, "http://127.0.0.1:1"}, HealthCheckConfig{
+		Path:      "/health",
+		Interval:  time.Millisecond,
+		Timeout:   100 * time.Millisecond,
+		Threshold: 1,
+		Cooldown:  time.Minute,
+	})
+
+	s.Hosts()
+	var hosts []string
+	for i := 0; i < 100; i++ {
+		time.Sleep(5 * time.Millisecond)
+		hosts, _ = s.Hosts()
+		if len(hosts) == 1 {
+			break
+		}
+	}
+	if len(hosts) != 1 || hosts[0] != ts.URL {
+		t.Errorf("the unreachable host should be ejected: %v", hosts)
+	}
+}
+
+func TestHealthCheckSubscriber_weighted(t *testing.T) {
+	s := NewHealthCheckSubscriberWithConfig("test", configWeightedSubscriber{FixedSubscriber{"a"}, map[string]int{"a": 5}}, HealthCheckConfig{Threshold: 1})
+	ws, ok := s.(WeightedSubscriber)
+	if !ok {
+		t.Error("the weights should be preserved")
+		return
+	}
+	if w := ws.Weight("a"); w != 5 {
+		t.Errorf("unexpected weight: %d", w)
+	}
+	if _, ok := NewHealthCheckSubscriberWithConfig("test", FixedSubscriber{"a"}, HealthCheckConfig{}).(WeightedSubscriber); ok {
+		t.Error("the subscriber should not provide weights")
+	}
+}
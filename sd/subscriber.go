@@ -1,7 +1,10 @@
 // Package sd defines some interfaces and implementations for service discovery
 package sd
 
-import "melody/config"
+import (
+	"melody/config"
+	"sync"
+)
 
 // Subscriber keeps the set of backend hosts up to date
 type Subscriber interface {
@@ -28,3 +31,29 @@ type SubscriberFactory func(*config.Backend) Subscriber
 func FixedSubscriberFactory(cfg *config.Backend) Subscriber {
 	return FixedSubscriber(cfg.Host)
 }
+
+var (
+	backendSubscribersMu sync.Mutex
+	backendSubscribers   = map[*config.Backend]Subscriber{}
+)
+
+// RegisterBackendSubscriber 记录proxy为backend构建的subscriber(包括健康检查与per-host熔断)
+// 不通过proxy发送请求的处理程序(例如websocket)使用 BackendSubscriber 复用它, backend所属的路由表被替换之后删除
+func RegisterBackendSubscriber(backend *config.Backend, subscriber Subscriber) {
+	backendSubscribersMu.Lock()
+	backendSubscribers[backend] = subscriber
+	backendSubscribersMu.Unlock()
+	config.RegisterCloser(backend, func() {
+		backendSubscribersMu.Lock()
+		delete(backendSubscribers, backend)
+		backendSubscribersMu.Unlock()
+	})
+}
+
+// BackendSubscriber 返回proxy为backend构建的subscriber
+func BackendSubscriber(backend *config.Backend) (Subscriber, bool) {
+	backendSubscribersMu.Lock()
+	defer backendSubscribersMu.Unlock()
+	s, ok := backendSubscribers[backend]
+	return s, ok
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"io"
 	"io/ioutil"
 	"melody/config"
 	"net/http"
@@ -11,8 +12,18 @@ import (
 
 const Namespace = "melody_http"
 
+// maxErrorBodySize 错误响应体最多保留的字节数
+const maxErrorBodySize = 1 << 20
+
 var ErrInvalidStatusCode = errors.New("Invalid status code")
 
+// InvalidStatusCodeError 在backend返回了非200/201的状态码时返回, 携带了原始的状态码与响应体
+// errors.Is(err, ErrInvalidStatusCode) 对它依然成立
+type InvalidStatusCodeError struct {
+	Code int
+	Body []byte
+}
+
 // HTTPStatusHandler 将接受到的response中status code格式化
 type HTTPStatusHandler func(context.Context, *http.Response) (*http.Response, error)
 
@@ -44,13 +55,16 @@ func GetHTTPStatusHandler(remote *config.Backend) HTTPStatusHandler {
 // DetailedHTTPStatusHandler
 func DetailedHTTPStatusHandler(next HTTPStatusHandler, name string) HTTPStatusHandler {
 	return func(ctx context.Context, resp *http.Response) (*http.Response, error) {
-		if r, err := next(ctx, resp); err == nil {
+		r, err := next(ctx, resp)
+		if err == nil {
 			return r, nil
 		}
 
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			body = []byte{}
+		body := []byte{}
+		if e, ok := err.(InvalidStatusCodeError); ok && e.Body != nil {
+			body = e.Body
+		} else if b, err := ioutil.ReadAll(resp.Body); err == nil {
+			body = b
 		}
 		resp.Body.Close()
 		resp.Body = ioutil.NopCloser(bytes.NewBuffer(body))
@@ -65,7 +79,9 @@ func DetailedHTTPStatusHandler(next HTTPStatusHandler, name string) HTTPStatusHa
 
 func DefaultHTTPStatusHandler(ctx context.Context, resp *http.Response) (*http.Response, error) {
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		return nil, ErrInvalidStatusCode
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+		resp.Body.Close()
+		return nil, InvalidStatusCodeError{Code: resp.StatusCode, Body: body}
 	}
 
 	return resp, nil
@@ -85,3 +101,13 @@ func (r HTTPResponseError) Name() string {
 func (r HTTPResponseError) StatusCode() int {
 	return r.Code
 }
+
+// Error returns the error message
+func (e InvalidStatusCodeError) Error() string {
+	return ErrInvalidStatusCode.Error()
+}
+
+// Is reports whether the target is ErrInvalidStatusCode
+func (e InvalidStatusCodeError) Is(target error) bool {
+	return target == ErrInvalidStatusCode
+}
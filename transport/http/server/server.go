@@ -9,7 +9,10 @@ import (
 	"melody/core"
 	"net"
 	"net/http"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -44,6 +47,9 @@ var (
 )
 
 const (
+	unixPrefix = "unix://"
+	// listener优雅关闭时等待正在处理的请求的最长时间
+	listenerShutdownTimeout = 10 * time.Second
 	// HeaderCompleteResponseValue 响应完整时CompleteResponseHeader的值
 	HeaderCompleteResponseValue = "true"
 	// HeaderIncompleteResponseValue 响应不完整时CompleteResponseHeader的值
@@ -84,8 +90,11 @@ func InitHTTPDefaultTransport(cfg config.ServiceConfig) {
 }
 
 // RunServer 作为默认运行http.Server的函数实现
-// 如果需要的话，将配置TLS层
+// 如果需要的话，将配置TLS层; 配置了listeners时在每个listener上运行一个http.Server
 func RunServer(ctx context.Context, cfg config.ServiceConfig, handler http.Handler) error {
+	if len(cfg.Listeners) > 0 {
+		return runListeners(ctx, cfg, handler)
+	}
 	done := make(chan error)
 	s := NewServer(cfg, handler)
 	if cfg.TLS == nil {
@@ -125,6 +134,170 @@ func NewServer(cfg config.ServiceConfig, handler http.Handler) *http.Server {
 	}
 }
 
+type listenerKey struct{}
+
+// ListenerName 返回接收当前请求的listener的名称, 没有配置listeners时返回空字符串
+func ListenerName(ctx context.Context) string {
+	name, _ := ctx.Value(listenerKey{}).(string)
+	return name
+}
+
+// runListeners 启动所有的listener, 任何一个listener退出或者ctx结束时, 优雅地关闭所有的listener
+func runListeners(ctx context.Context, cfg config.ServiceConfig, handler http.Handler) error {
+	servers := make([]*http.Server, 0, len(cfg.Listeners))
+	// 超过 listenerShutdownTimeout 仍未结束的连接被强制关闭
+	shutdown := func() error {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), listenerShutdownTimeout)
+		defer cancel()
+		var err error
+		for _, s := range servers {
+			if e := s.Shutdown(shutdownCtx); e != nil {
+				s.Close()
+				if err == nil {
+					err = e
+				}
+			}
+		}
+		return err
+	}
+
+	done := make(chan error, len(cfg.Listeners))
+	for _, l := range cfg.Listeners {
+		if err := checkListenerTLS(l); err != nil {
+			shutdown()
+			return err
+		}
+		ln, err := Listen(l)
+		if err != nil {
+			shutdown()
+			return err
+		}
+		s := NewListenerServer(cfg, l, listenerHandler(cfg, l, handler))
+		servers = append(servers, s)
+		go func(l *config.Listener) {
+			if l.IsTLS() {
+				done <- s.ServeTLS(ln, l.TLS.PublicKey, l.TLS.PrivateKey)
+				return
+			}
+			done <- s.Serve(ln)
+		}(l)
+	}
+
+	select {
+	case err := <-done:
+		shutdown()
+		return err
+	case <-ctx.Done():
+		return shutdown()
+	}
+}
+
+// Listen 监听listener的地址, unix:// 开头的地址使用unix socket
+func Listen(l *config.Listener) (net.Listener, error) {
+	if !strings.HasPrefix(l.Address, unixPrefix) {
+		return net.Listen("tcp", l.Address)
+	}
+	path := strings.TrimPrefix(l.Address, unixPrefix)
+	// 删除上次运行遗留的socket文件, 不是socket的文件保持不变
+	info, err := os.Lstat(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	case info.Mode()&os.ModeSocket == 0:
+		return nil, fmt.Errorf("listener %s: %s exists and is not a unix socket", l.Name, path)
+	default:
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// checkListenerTLS 使用TLS的listener必须同时配置公钥和私钥
+func checkListenerTLS(l *config.Listener) error {
+	if !l.IsTLS() {
+		return nil
+	}
+	if l.TLS.PublicKey == "" {
+		return fmt.Errorf("listener %s: %w", l.Name, errorPublicKey)
+	}
+	if l.TLS.PrivateKey == "" {
+		return fmt.Errorf("listener %s: %w", l.Name, errorPrivateKey)
+	}
+	return nil
+}
+
+// NewListenerServer 返回运行在listener上的http.Server, 请求的context中带有listener的名称
+func NewListenerServer(cfg config.ServiceConfig, l *config.Listener, handler http.Handler) *http.Server {
+	s := NewServer(cfg, handler)
+	s.Addr = l.Address
+	s.TLSConfig = ParseTLSConfig(l.TLS)
+	s.BaseContext = func(_ net.Listener) context.Context {
+		return context.WithValue(context.Background(), listenerKey{}, l.Name)
+	}
+	return s
+}
+
+// listenerHandler 配置了redirect_to_https的listener把所有请求重定向到第一个使用TLS的listener
+func listenerHandler(cfg config.ServiceConfig, l *config.Listener, handler http.Handler) http.Handler {
+	if !l.RedirectToHTTPS {
+		return handler
+	}
+	port := ""
+	for _, tl := range cfg.Listeners {
+		if tl.IsTLS() {
+			if _, p, err := net.SplitHostPort(tl.Address); err == nil && p != "443" {
+				port = ":" + p
+			}
+			break
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		target := "https://" + host + port + req.URL.RequestURI()
+		http.Redirect(w, req, target, http.StatusMovedPermanently)
+	})
+}
+
+// ReloadableHandler 是一个可以在运行时被原子替换的http.Handler
+// http.Server 始终持有同一个ReloadableHandler, 热加载时只替换其内部的handler
+type ReloadableHandler struct {
+	handler atomic.Value
+	mu      sync.Mutex
+}
+
+type handlerHolder struct {
+	http.Handler
+}
+
+// NewReloadableHandler 返回一个包装了handler的ReloadableHandler
+func NewReloadableHandler(handler http.Handler) *ReloadableHandler {
+	r := new(ReloadableHandler)
+	r.Swap(handler)
+	return r
+}
+
+// Swap 替换当前的handler并返回被替换的handler, 正在处理的请求不受影响
+func (r *ReloadableHandler) Swap(handler http.Handler) http.Handler {
+	if handler == nil {
+		handler = http.NotFoundHandler()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old, _ := r.handler.Load().(handlerHolder)
+	r.handler.Store(handlerHolder{handler})
+	return old.Handler
+}
+
+// ServeHTTP implements the http.Handler interface
+func (r *ReloadableHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.handler.Load().(handlerHolder).ServeHTTP(w, req)
+}
+
 // ParseTLSConfig 解析TLS配置
 func ParseTLSConfig(cfg *config.TLS) *tls.Config {
 	if cfg == nil {
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"melody/config"
+)
+
+func freeAddress(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestRunServer_listeners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "melody-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "melody.sock")
+
+	public, admin := freeAddress(t), freeAddress(t)
+	cfg := config.ServiceConfig{
+		Listeners: []*config.Listener{
+			{Name: "public", Address: public},
+			{Name: "admin", Address: admin},
+			{Name: "sidecar", Address: "unix://" + socket},
+			{Name: "redirect", Address: freeAddress(t), RedirectToHTTPS: true},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- RunServer(ctx, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, ListenerName(r.Context()))
+		}))
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	unixClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	for _, tc := range []struct {
+		client   *http.Client
+		url      string
+		expected string
+	}{
+		{http.DefaultClient, "http://" + public + "/", "public"},
+		{http.DefaultClient, "http://" + admin + "/", "admin"},
+		{unixClient, "http://sidecar/", "sidecar"},
+	} {
+		resp, err := tc.client.Get(tc.url)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != tc.expected {
+			t.Errorf("%s: unexpected body %s", tc.url, body)
+		}
+	}
+
+	noRedirect := &http.Client{CheckRedirect: func(_ *http.Request, _ []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := noRedirect.Get("http://" + cfg.Listeners[3].Address + "/users?id=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "https://127.0.0.1/users?id=1" {
+		t.Errorf("unexpected redirect %d %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Error("the listeners should be closed")
+	}
+	if _, err := net.Dial("tcp", public); err == nil {
+		t.Error("the public listener should be closed")
+	}
+}
+
+func TestRunServer_listenersKo(t *testing.T) {
+	address := freeAddress(t)
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	cfg := config.ServiceConfig{
+		Listeners: []*config.Listener{
+			{Name: "public", Address: freeAddress(t)},
+			{Name: "used", Address: address},
+		},
+	}
+	if err := RunServer(context.Background(), cfg, http.NotFoundHandler()); err == nil {
+		t.Error("expecting an error")
+	}
+	if _, err := net.Dial("tcp", cfg.Listeners[0].Address); err == nil {
+		t.Error("the public listener should be closed")
+	}
+
+	cfg.Listeners = []*config.Listener{{Address: freeAddress(t), TLS: &config.TLS{}}}
+	if err := RunServer(context.Background(), cfg, http.NotFoundHandler()); !errors.Is(err, errorPublicKey) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	cfg.Listeners = []*config.Listener{{Address: freeAddress(t), TLS: &config.TLS{PublicKey: "cert.pem"}}}
+	if err := RunServer(context.Background(), cfg, http.NotFoundHandler()); !errors.Is(err, errorPrivateKey) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestListen_unix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "melody-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 不是socket的文件不能被删除
+	file := filepath.Join(dir, "data")
+	if err := ioutil.WriteFile(file, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Listen(&config.Listener{Name: "file", Address: unixPrefix + file}); err == nil {
+		t.Error("expecting an error")
+	}
+	if b, err := ioutil.ReadFile(file); err != nil || string(b) != "data" {
+		t.Errorf("the file should be kept: %q %v", b, err)
+	}
+
+	// 上次运行遗留的socket被替换
+	socket := filepath.Join(dir, "melody.sock")
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	ln, err := Listen(&config.Listener{Name: "socket", Address: unixPrefix + socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+}